@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"sort"
+)
+
+// Lineup entries with the same multicast address are aliases of one
+// channel: they share the running Channel and must use the same key.
+
+// unifyAliases makes all aliases use the key of the first entry (by name)
+// and reports conflicting keys. Must be called with channelsMu held.
+func unifyAliases() {
+	keys := make([]string, 0, len(channels))
+	for k := range channels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	canonical := make(map[string]string) // addr => name
+	for _, k := range keys {
+		chInfo := channels[k]
+		first, ok := canonical[chInfo.addr]
+		if !ok {
+			canonical[chInfo.addr] = k
+			continue
+		}
+		firstInfo := channels[first]
+		if chInfo.masterKey != firstInfo.masterKey {
+			name, _ := url.PathUnescape(k)
+			firstName, _ := url.PathUnescape(first)
+			log.Printf("Channel %s has a different key than %s @ %s, using the key of %s", name, firstName, chInfo.addr, firstName)
+			chInfo.masterKey = firstInfo.masterKey
+			channels[k] = chInfo
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type channelEntry struct {
+	Name       string   `json:"name"`
+	Addr       string   `json:"addr"`
+	Group      string   `json:"group,omitempty"`
+	Program    uint16   `json:"program,omitempty"`
+	Aliases    []string `json:"aliases,omitempty"`
+	Restricted bool     `json:"restricted,omitempty"`
+	Running    bool     `json:"running"`
+	Disabled   bool     `json:"disabled,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+}
+
+type channelPage struct {
+	Total    int            `json:"total"`
+	Page     int            `json:"page"`
+	PerPage  int            `json:"per_page"`
+	Channels []channelEntry `json:"channels"`
+}
+
+const defaultPerPage = 50
+const maxPerPage = 1000
+
+func queryInt(q url.Values, name string, def int) int {
+	n, err := strconv.Atoi(q.Get(name))
+	if err != nil || n < 1 {
+		return def
+	}
+	return n
+}
+
+// channelsAPIHandler lists the channels, supported query parameters are
+// q (name search), group, tag, sort (name, addr, group, prefix with - for
+// descending order), page and per_page. POST adds or updates a channel and
+// DELETE removes one.
+func channelsAPIHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		putChannelHandler(w, req)
+		return
+	case http.MethodDelete:
+		deleteChannelHandler(w, req)
+		return
+	}
+	q := req.URL.Query()
+	search := strings.ToLower(q.Get("q"))
+	group := q.Get("group")
+	tag := q.Get("tag")
+	aliases := make(map[string][]string)
+	for _, k := range sortedChannels() {
+		chInfo, _ := lookupChannel(k)
+		aliases[chInfo.sessionKey()] = append(aliases[chInfo.sessionKey()], displayName(k))
+	}
+	runningChannelsMu.Lock()
+	entries := make([]channelEntry, 0)
+	for _, k := range visibleChannels(req) {
+		chInfo, _ := lookupChannel(k)
+		name := displayName(k)
+		if search != "" && !strings.Contains(strings.ToLower(name), search) {
+			continue
+		}
+		if group != "" && !strings.EqualFold(chInfo.group, group) {
+			continue
+		}
+		if tag != "" && !chInfo.hasTag(tag) {
+			continue
+		}
+		_, running := runningChannels[chInfo.sessionKey()]
+		var others []string
+		for _, alias := range aliases[chInfo.sessionKey()] {
+			if alias != name {
+				others = append(others, alias)
+			}
+		}
+		_, disabled := channelDisabled(chInfo.addr)
+		entries = append(entries, channelEntry{name, chInfo.addr, chInfo.group, chInfo.program, others, restrictedChannels[k], running, disabled, chInfo.tags})
+	}
+	runningChannelsMu.Unlock()
+
+	sortBy := q.Get("sort")
+	desc := strings.HasPrefix(sortBy, "-")
+	sortBy = strings.TrimPrefix(sortBy, "-")
+	less := func(a, b channelEntry) bool { return a.Name < b.Name }
+	switch sortBy {
+	case "addr":
+		less = func(a, b channelEntry) bool { return a.Addr < b.Addr }
+	case "group":
+		less = func(a, b channelEntry) bool { return a.Group < b.Group || a.Group == b.Group && a.Name < b.Name }
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if desc {
+			return less(entries[j], entries[i])
+		}
+		return less(entries[i], entries[j])
+	})
+
+	page := queryInt(q, "page", 1)
+	perPage := queryInt(q, "per_page", defaultPerPage)
+	if perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+	start := len(entries)
+	// compared without the product, which may overflow
+	if page-1 < len(entries)/perPage+1 {
+		start = min((page-1)*perPage, len(entries))
+	}
+	end := start + perPage
+	if end > len(entries) {
+		end = len(entries)
+	}
+	writeJSON(w, channelPage{len(entries), page, perPage, entries[start:end]})
+}
+
+var channelsTemplate = template.Must(template.ParseFS(webFS, "web/channels.html"))
+
+// channelsPageHandler shows the channel list of /api/channels with search,
+// group filter, sorting and pagination
+func channelsPageHandler(w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+	seen := make(map[string]bool)
+	groups := make([]string, 0)
+	for _, k := range visibleChannels(req) {
+		chInfo, _ := lookupChannel(k)
+		if g := chInfo.group; g != "" && !seen[g] {
+			seen[g] = true
+			groups = append(groups, g)
+		}
+	}
+	sort.Strings(groups)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	channelsTemplate.Execute(w, struct{ Groups []string }{groups})
+}
+
+// checkChannel validates a channel added or changed at runtime
+func checkChannel(chInfo ChannelInfo) error {
+	host, port, err := net.SplitHostPort(chInfo.addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsMulticast() {
+		return fmt.Errorf("%s is not a multicast address", host)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("Invalid port %s", port)
+	}
+	if !validKey(chInfo.masterKey) {
+		return fmt.Errorf("Channel key must be 16, 24 or 32 bytes in hex")
+	}
+	if err := checkSources(chInfo.sources); err != nil {
+		return err
+	}
+	if chInfo.format != "" && chInfo.format != "rtp" && chInfo.format != "udp" {
+		return fmt.Errorf("Invalid format %s", chInfo.format)
+	}
+	_, err = receiveInterface(chInfo.iface)
+	return err
+}
+
+// putChannelHandler adds a channel or changes the given parameters of an
+// existing one, the parameters are name, addr, key, group, format, iface,
+// program, pmt_pid and ecm_pid (empty to detect)
+func putChannelHandler(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	name := req.Form.Get("name")
+	if name == "" {
+		httpError(w, req, "Missing channel name", http.StatusBadRequest)
+		return
+	}
+	k := url.PathEscape(name)
+	chInfo, exists := lookupChannel(k)
+	if _, ok := req.Form["addr"]; ok {
+		chInfo.addr = req.Form.Get("addr")
+	}
+	if _, ok := req.Form["key"]; ok {
+		chInfo.masterKey = strings.ToLower(req.Form.Get("key"))
+	}
+	if _, ok := req.Form["group"]; ok {
+		chInfo.group = req.Form.Get("group")
+	}
+	if _, ok := req.Form["format"]; ok {
+		chInfo.format = req.Form.Get("format")
+	}
+	if _, ok := req.Form["iface"]; ok {
+		chInfo.iface = req.Form.Get("iface")
+	}
+	if _, ok := req.Form["program"]; ok {
+		program, err := strconv.ParseUint(req.Form.Get("program"), 10, 16)
+		if err != nil {
+			httpError(w, req, "Invalid program "+req.Form.Get("program"), http.StatusBadRequest)
+			return
+		}
+		chInfo.program = uint16(program)
+	}
+	for _, p := range []struct {
+		name string
+		pid  *uint16
+	}{{"pmt_pid", &chInfo.pmtPid}, {"ecm_pid", &chInfo.ecmPid}} {
+		if _, ok := req.Form[p.name]; !ok {
+			continue
+		}
+		*p.pid = 0
+		if v := req.Form.Get(p.name); v != "" {
+			pid, err := parsePid(v)
+			if err != nil {
+				httpError(w, req, err.Error(), http.StatusBadRequest)
+				return
+			}
+			*p.pid = pid
+		}
+	}
+	if err := checkChannel(chInfo); err != nil {
+		httpError(w, req, err.Error(), http.StatusBadRequest)
+		return
+	}
+	chInfo.unnamed = false
+	addChannel(k, chInfo)
+	// aliases share the running channel, so they get the key as well
+	for _, alias := range sortedChannels() {
+		if other, _ := lookupChannel(alias); alias != k && other.sessionKey() == chInfo.sessionKey() && other.masterKey != chInfo.masterKey {
+			other.masterKey = chInfo.masterKey
+			addChannel(alias, other)
+		}
+	}
+	if exists {
+		reqLogf(req, "Updated channel %s @ %s", name, chInfo.addr)
+	} else {
+		reqLogf(req, "Added channel %s @ %s", name, chInfo.addr)
+	}
+	writeJSON(w, map[string]string{"name": name, "addr": chInfo.addr})
+}
+
+// deleteChannelHandler removes the channel given with name from the lineup,
+// running sessions continue until their clients leave
+func deleteChannelHandler(w http.ResponseWriter, req *http.Request) {
+	name := req.FormValue("name")
+	if !removeChannel(url.PathEscape(name)) {
+		httpError(w, req, "No such channel", http.StatusNotFound)
+		return
+	}
+	reqLogf(req, "Removed channel %s", name)
+	writeJSON(w, map[string]string{"name": name})
+}
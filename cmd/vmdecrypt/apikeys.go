@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API keys for automation: when a keys file is given, the /api/ and
+// /record/ endpoints (except the token ones) require "Authorization: Bearer <key>". A key can
+// be restricted to some operations, e.g. "trace" or "trace:post", and to
+// some channels, then it may only be used for requests which name channels.
+// Every API request is written to the audit log, the ones which are denied
+// or change something also to the log.
+
+type apiKeyConfig struct {
+	Key        string   `json:"key"`
+	Name       string   `json:"name"`
+	Operations []string `json:"operations,omitempty"` // empty = all
+	Channels   []string `json:"channels,omitempty"`   // empty = all
+}
+
+var apiKeysFile string
+var apiKeys []apiKeyConfig
+
+var auditLogFile string
+var auditMu sync.Mutex
+
+// endpoints which are authenticated with viewer tokens instead
+var tokenEndpoints = map[string]bool{"quota": true, "prefs": true}
+
+func loadAPIKeys() error {
+	data, err := ioutil.ReadFile(apiKeysFile)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &apiKeys); err != nil {
+		return err
+	}
+	for _, k := range apiKeys {
+		if k.Key == "" {
+			return fmt.Errorf("API key %q has no key", k.Name)
+		}
+	}
+	log.Printf("%d API keys loaded", len(apiKeys))
+	return nil
+}
+
+// apiOperation returns the operation of an API request, e.g. "keys/probe",
+// and the channels it names
+func apiOperation(req *http.Request) (string, []string) {
+	path := strings.TrimPrefix(strings.TrimPrefix(req.URL.EscapedPath(), "/api"), "/")
+	var channels []string
+	add := func(names ...string) {
+		for _, name := range names {
+			if name != "" {
+				channels = append(channels, url.PathEscape(name))
+			}
+		}
+	}
+	switch op, rest, _ := strings.Cut(path, "/"); op {
+	case "fingerprint", "profile", "trace", "snapshot", "rotation", "record":
+		if k := strings.TrimSuffix(rest, ".jpg"); k != "" {
+			channels = append(channels, k)
+		}
+		return op, channels
+	case "channels":
+		if rest == "export" {
+			return path, nil
+		}
+		add(req.FormValue("name"))
+		return op, channels
+	case "cast", "sign":
+		add(req.FormValue("channel"))
+		return op, channels
+	case "zap":
+		add(req.URL.Query().Get("to"))
+		return op, channels
+	case "keys":
+		add(strings.Split(req.FormValue("channels"), ",")...)
+		return path, channels
+	case "debug":
+		return path, nil
+	default:
+		return op, nil
+	}
+}
+
+// allows reports if the key may perform the operation on the channels
+func (k *apiKeyConfig) allows(method, op string, channels []string) bool {
+	if len(k.Operations) > 0 {
+		ok := false
+		for _, o := range k.Operations {
+			if o == op || o == op+":"+strings.ToLower(method) {
+				ok = true
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(k.Channels) == 0 {
+		return true
+	}
+	if len(channels) == 0 {
+		return false
+	}
+	for _, c := range channels {
+		ok := false
+		for _, name := range k.Channels {
+			if url.PathEscape(name) == c {
+				ok = true
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func requestAPIKey(req *http.Request) *apiKeyConfig {
+	value := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	for i, k := range apiKeys {
+		if subtle.ConstantTimeCompare([]byte(k.Key), []byte(value)) == 1 {
+			return &apiKeys[i]
+		}
+	}
+	return nil
+}
+
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Remote    string    `json:"remote"`
+	Key       string    `json:"key"` // name of the API key
+	Method    string    `json:"method"`
+	Operation string    `json:"operation"`
+	Channels  []string  `json:"channels,omitempty"`
+	Allowed   bool      `json:"allowed"`
+}
+
+func audit(req *http.Request, e auditEntry) {
+	result := "denied"
+	if e.Allowed {
+		result = "allowed"
+	}
+	key := e.Key
+	if key == "" {
+		key = "-"
+	}
+	if !e.Allowed || (e.Method != http.MethodGet && e.Method != http.MethodHead) {
+		reqLogf(req, "audit: %s %s %v by key %s from %s %s", e.Method, e.Operation, e.Channels, key, e.Remote, result)
+	}
+	if auditLogFile == "" {
+		return
+	}
+	data, _ := json.Marshal(e)
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	f, err := os.OpenFile(auditLogFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer f.Close()
+	f.Write(append(data, '\n'))
+}
+
+// withAPIKeys checks the API key of /api/ requests and audits them
+func withAPIKeys(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		isAPI := strings.HasPrefix(req.URL.Path, "/api/") || strings.HasPrefix(req.URL.Path, "/record/")
+		if (apiKeys == nil && auditLogFile == "") || !isAPI {
+			h.ServeHTTP(w, req)
+			return
+		}
+		op, channels := apiOperation(req)
+		if tokenEndpoints[op] {
+			h.ServeHTTP(w, req)
+			return
+		}
+		e := auditEntry{Time: time.Now(), RequestID: requestID(req), Remote: req.RemoteAddr, Method: req.Method,
+			Operation: op, Channels: channels, Allowed: true}
+		if apiKeys != nil {
+			k := requestAPIKey(req)
+			if k != nil {
+				e.Key = k.Name
+			}
+			e.Allowed = k != nil && k.allows(req.Method, op, channels)
+			if k == nil {
+				audit(req, e)
+				httpError(w, req, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			if !e.Allowed {
+				audit(req, e)
+				httpError(w, req, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+		}
+		audit(req, e)
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"strings"
+
+	"github.com/rgerganov/vmdecrypt"
+)
+
+// Audio-only output: either a TS with the PAT, a PMT rewritten with only
+// the audio stream and the audio stream, or the raw audio elementary stream
+// (ADTS, MP3, AC-3). The first audio stream of the PMT is taken unless one
+// in the requested language is found.
+
+var audioContentTypes = map[byte]string{
+	0x03: "audio/mpeg",
+	0x04: "audio/mpeg",
+	0x0f: "audio/aac",
+	0x81: "audio/ac3",
+}
+
+// audioPid returns the first audio stream of the PMT in the language, or
+// the first one if none is in it
+func (ch *Channel) audioPid(lang string) (uint16, byte, bool) {
+	var first vmdecrypt.Stream
+	found := false
+	for _, s := range ch.dec.StreamList() {
+		if _, ok := audioContentTypes[s.Type]; !ok {
+			continue
+		}
+		if lang != "" && s.Language == lang {
+			return s.PID, s.Type, true
+		}
+		if !found {
+			first, found = s, true
+		}
+	}
+	return first.PID, first.Type, found
+}
+
+func audioHandler(w http.ResponseWriter, req *http.Request) {
+	// requestURI should be /audio/CNN, /audio/CNN?format=raw or /audio/CNN?lang=deu
+	chName := strings.SplitN(req.RequestURI[7:], "?", 2)[0]
+	chInfo, ok := getChannel(w, req, chName)
+	if !ok {
+		return
+	}
+	raw := req.URL.Query().Get("format") == "raw"
+	lang := strings.ToLower(req.URL.Query().Get("lang"))
+	chInfo.setHeaders(w)
+	ch := attachChannel(chInfo)
+	defer detachChannel(chInfo)
+
+	reqLogf(req, "Start serving audio client %v, session %v", req.RemoteAddr, ch.id)
+	if !raw {
+		w.Header().Set("Content-Type", "video/mp2t")
+	}
+	token := requestToken(req)
+	cw := newClientWriter(w)
+	ptr := ch.currentPtr()
+	var val interface{}
+	var audioPid, pmtPid uint16
+	audioFound := false
+	// the PMT is rewritten with only the audio stream
+	var pmt []byte
+	var pmtPkts [][]byte
+	var pmtCC byte
+	for {
+		ptr, val = ch.nextPtr(req.Context(), ptr)
+		if val == nil {
+			break
+		}
+		pkt := val.([]byte)
+		if !audioFound {
+			var streamType byte
+			if audioPid, streamType, audioFound = ch.audioPid(lang); !audioFound {
+				continue
+			}
+			if raw {
+				w.Header().Set("Content-Type", audioContentTypes[streamType])
+			}
+			pmtPid = ch.dec.PMTPid()
+		}
+		pid := binary.BigEndian.Uint16(pkt[1:3]) & 0x1fff
+		var n int
+		var err error
+		if raw && pid == audioPid {
+			n, err = cw.Write(pesPayload(pkt))
+		} else if !raw && (pid == 0 || pid == audioPid) {
+			n, err = cw.Write(pkt)
+		} else if !raw && pid == pmtPid && pkt[1]&0x40 != 0 {
+			if sec := ch.dec.PMT(); !bytes.Equal(sec, pmt) {
+				pmt = sec
+				pmtPkts = vmdecrypt.Packetize(vmdecrypt.FilterPMT(sec, func(pid uint16) bool { return pid == audioPid }), pmtPid)
+			}
+			for _, p := range pmtPkts {
+				p[3] = 0x10 | pmtCC
+				pmtCC = (pmtCC + 1) & 0xf
+				var m int
+				m, err = cw.Write(p)
+				if n += m; err != nil {
+					break
+				}
+			}
+		}
+		usageServed(chInfo.addr, n)
+		if err != nil {
+			break
+		}
+		if !token.consume(n) {
+			break
+		}
+	}
+	reqLogf(req, "Stop serving audio client %v", req.RemoteAddr)
+}
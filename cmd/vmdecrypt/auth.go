@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Authentication of the streaming endpoints and playlists for servers
+// reachable from outside the LAN: HTTP basic auth with the users of
+// -basic-auth, or signed URLs (?expires=<unix time>&sig=<HMAC>) for one
+// channel or all of them. The URLs in the playlists of authenticated
+// requests are signed, so players need the credentials only for the
+// playlist. Requests from -auth-exempt networks and with a valid access
+// token need neither.
+
+var basicAuthFile, signKeyFile string
+var authExempt []*net.IPNet
+
+// user => password
+var basicAuthUsers map[string]string
+var signKey []byte
+
+// how long the URLs in the playlists of authenticated requests are valid
+const signedURLTTL = 24 * time.Hour
+
+// endpoints which require authentication
+var authPrefixes = []string{"/ch/", "/ws/", "/whep/", "/rtp/", "/audio/", "/subs/", "/timeshift/", "/hls/", "/u/", "/live/",
+	"/channels", "/xmltv.xml", "/lineup.json", "/player_api.php", "/mosaic", "/dlna/control/"}
+
+func streamAuthEnabled() bool {
+	return signKey != nil
+}
+
+func loadStreamAuth() error {
+	if basicAuthFile == "" && signKeyFile == "" {
+		return nil
+	}
+	if basicAuthFile != "" {
+		if err := loadBasicAuth(); err != nil {
+			return err
+		}
+		log.Printf("%d users loaded", len(basicAuthUsers))
+	}
+	return loadSignKey()
+}
+
+func loadBasicAuth() error {
+	f, err := os.Open(basicAuthFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	basicAuthUsers = make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, password, ok := strings.Cut(line, ":")
+		if !ok || user == "" || password == "" {
+			return errors.New("Expected user:password lines in " + basicAuthFile)
+		}
+		basicAuthUsers[user] = password
+	}
+	return scanner.Err()
+}
+
+func loadSignKey() error {
+	if signKeyFile == "" {
+		// signed URLs are valid until the next start
+		signKey = make([]byte, 32)
+		rand.Read(signKey)
+		return nil
+	}
+	data, err := ioutil.ReadFile(signKeyFile)
+	if err != nil {
+		return err
+	}
+	if signKey = []byte(strings.TrimSpace(string(data))); len(signKey) < 16 {
+		return errors.New("The signing key must be at least 16 bytes")
+	}
+	return nil
+}
+
+// urlSignature returns the signature of URLs for the channel, or for all
+// channels if k is empty, which expire at the given time
+func urlSignature(k string, expires int64) string {
+	mac := hmac.New(sha256.New, signKey)
+	mac.Write([]byte(k + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// signedQuery adds the signature of the channel to q
+func signedQuery(q url.Values, k string, expires int64) {
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("sig", urlSignature(k, expires))
+}
+
+// authChannel returns the channel requested from a streaming endpoint,
+// empty for the playlists
+func authChannel(req *http.Request) string {
+	path := req.URL.EscapedPath()
+	for _, prefix := range []string{"/ch/", "/ws/", "/whep/", "/rtp/", "/audio/", "/subs/", "/timeshift/", "/hls/"} {
+		if strings.HasPrefix(path, prefix) {
+			k, _, _ := strings.Cut(path[len(prefix):], "/")
+			return strings.TrimSuffix(k, ".vtt")
+		}
+	}
+	return ""
+}
+
+// requestSignature returns the expiry and the channel (empty for all) of a
+// valid signature of the request
+func requestSignature(req *http.Request) (int64, string, bool) {
+	q := req.URL.Query()
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return 0, "", false
+	}
+	sig := []byte(q.Get("sig"))
+	if subtle.ConstantTimeCompare(sig, []byte(urlSignature("", expires))) == 1 {
+		return expires, "", true
+	}
+	if k := authChannel(req); k != "" && subtle.ConstantTimeCompare(sig, []byte(urlSignature(k, expires))) == 1 {
+		return expires, k, true
+	}
+	return 0, "", false
+}
+
+// requestCredentials returns the basic auth credentials, or the ones of
+// the Xtream API which are passed in the URL
+func requestCredentials(req *http.Request) (string, string, bool) {
+	if user, password, ok := req.BasicAuth(); ok {
+		return user, password, true
+	}
+	if req.URL.Path == "/player_api.php" {
+		q := req.URL.Query()
+		return q.Get("username"), q.Get("password"), q.Has("username")
+	}
+	if strings.HasPrefix(req.URL.Path, "/live/") {
+		if parts := strings.Split(req.URL.Path[len("/live/"):], "/"); len(parts) == 3 {
+			return parts[0], parts[1], true
+		}
+	}
+	return "", "", false
+}
+
+func basicAuthOK(req *http.Request) bool {
+	user, password, ok := requestCredentials(req)
+	if !ok {
+		return false
+	}
+	expected, known := basicAuthUsers[user]
+	// compare anyway so unknown users take as long
+	return subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1 && known
+}
+
+// tokenOK reports if the request carries an access token, the quota is
+// checked by the endpoints
+func tokenOK(req *http.Request) bool {
+	if !tokensEnabled() {
+		return false
+	}
+	if requestToken(req) != nil {
+		return true
+	}
+	// the Xtream password is the token
+	_, password, ok := requestCredentials(req)
+	if !ok {
+		return false
+	}
+	r := req.Clone(req.Context())
+	r.URL.RawQuery = url.Values{"token": {password}}.Encode()
+	return requestToken(r) != nil
+}
+
+// accessSignature signs the URLs of channel k (all channels if empty) in
+// the playlists served to req, if the request was authenticated with
+// credentials or a signature which covers k. Internal requests (req == nil)
+// are always signed.
+func accessSignature(req *http.Request, q url.Values, k string) {
+	if !streamAuthEnabled() {
+		return
+	}
+	if req == nil || basicAuthOK(req) {
+		signedQuery(q, k, time.Now().Add(signedURLTTL).Unix())
+	} else if expires, scope, ok := requestSignature(req); ok && (scope == "" || scope == k) {
+		signedQuery(q, k, expires)
+	}
+}
+
+func withStreamAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		protected := false
+		for _, prefix := range authPrefixes {
+			if strings.HasPrefix(req.URL.Path, prefix) {
+				protected = true
+			}
+		}
+		// relay keepalives carry the random session ID
+		keepalive := strings.HasPrefix(req.URL.Path, "/rtp/session/")
+		if !streamAuthEnabled() || !protected || keepalive || inNetworks(req.RemoteAddr, authExempt) {
+			h.ServeHTTP(w, req)
+			return
+		}
+		if _, _, ok := requestSignature(req); ok || basicAuthOK(req) || tokenOK(req) {
+			h.ServeHTTP(w, req)
+			return
+		}
+		if basicAuthUsers != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="vmdecrypt", charset="UTF-8"`)
+		}
+		httpError(w, req, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+type signResponse struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// signHandler returns a signed URL of the channel playlist, or of a
+// channel with ?channel=, valid for ?ttl= (default 24h)
+func signHandler(w http.ResponseWriter, req *http.Request) {
+	if !streamAuthEnabled() {
+		httpError(w, req, "Signed URLs require -basic-auth or -sign-key", http.StatusNotFound)
+		return
+	}
+	ttl := signedURLTTL
+	if s := req.FormValue("ttl"); s != "" {
+		var err error
+		if ttl, err = time.ParseDuration(s); err != nil || ttl <= 0 {
+			httpError(w, req, "Invalid ttl "+s, http.StatusBadRequest)
+			return
+		}
+	}
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	path, k := "/channels.m3u", ""
+	if name := req.FormValue("channel"); name != "" {
+		k = url.PathEscape(name)
+		if _, ok := lookupChannel(k); !ok {
+			httpError(w, req, "No such channel "+name, http.StatusNotFound)
+			return
+		}
+		path = "/ch/" + k
+	}
+	q := url.Values{}
+	signedQuery(q, k, expires.Unix())
+	writeJSON(w, signResponse{URL: serverURL() + path + "?" + q.Encode(), Expires: expires})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Micro-batching of the decrypted packets: they are added to the ring
+// buffer and written to the relays once per datagram, which wakes the
+// clients once instead of for every TS packet. With -latency-budget the
+// datagrams received within the budget are batched, trading that much
+// latency for fewer wakeups on hosts with many channels.
+
+var latencyBudget time.Duration
+
+const maxLatencyBudget = time.Second
+
+type packetBatch struct {
+	pkts      [][]byte // for the ring buffer
+	datagrams [][]byte // for the output
+	start     time.Time
+	// the reads of the batch time out when it is due
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func validateLatencyBudget() error {
+	if latencyBudget < 0 || latencyBudget > maxLatencyBudget {
+		return fmt.Errorf("Invalid latency budget %v, expected at most %v", latencyBudget, maxLatencyBudget)
+	}
+	return nil
+}
+
+// readContext returns the context of the next read, it has the deadline of
+// the started batch
+func (ch *Channel) readContext(ctx context.Context) context.Context {
+	b := &ch.batch
+	if latencyBudget == 0 || (len(b.pkts) == 0 && len(b.datagrams) == 0) {
+		return ctx
+	}
+	if b.ctx == nil {
+		b.ctx, b.cancel = context.WithDeadline(ctx, b.start.Add(latencyBudget))
+	}
+	return b.ctx
+}
+
+// batchTimeout reports if the read failed because the batch is due
+func (ch *Channel) batchTimeout(err error) bool {
+	b := &ch.batch
+	return b.ctx != nil && (b.ctx.Err() != nil || errors.Is(err, os.ErrDeadlineExceeded))
+}
+
+// endDatagram is called after every decrypted datagram, the batch is
+// flushed when it is due or would not fit in the ring buffer
+func (ch *Channel) endDatagram(out func([]byte) error) error {
+	b := &ch.batch
+	if len(b.pkts) == 0 && len(b.datagrams) == 0 {
+		return nil
+	}
+	if b.start.IsZero() {
+		b.start = time.Now()
+	}
+	if latencyBudget == 0 || len(b.pkts) >= ch.ringSize/2 || time.Since(b.start) >= latencyBudget {
+		return ch.flushBatch(out)
+	}
+	return nil
+}
+
+func (ch *Channel) flushBatch(out func([]byte) error) error {
+	b := &ch.batch
+	if b.cancel != nil {
+		b.cancel()
+		b.ctx, b.cancel = nil, nil
+	}
+	b.start = time.Time{}
+	if len(b.pkts) > 0 {
+		ch.mu.Lock()
+		for _, pkt := range b.pkts {
+			ch.buf.Value = pkt
+			ch.buf = ch.buf.Next()
+		}
+		ch.written += uint64(len(b.pkts))
+		ch.c.Broadcast()
+		ch.mu.Unlock()
+		b.pkts = b.pkts[:0]
+	}
+	datagrams := b.datagrams
+	b.datagrams = b.datagrams[:0]
+	for _, d := range datagrams {
+		if err := out(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
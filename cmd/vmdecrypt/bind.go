@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net"
+)
+
+// Binding multicast reception and the HTTP server to different interfaces,
+// e.g. receiving on a VLAN and serving on a WireGuard tunnel.
+
+// receiveInterface returns the interface for joining the multicast group of
+// a channel, the one given with -i unless the channel has its own
+func receiveInterface(name string) (*net.Interface, error) {
+	if name == "" {
+		return ifi, nil
+	}
+	return net.InterfaceByName(name)
+}
+
+// listenAddr resolves the listen address given with -a where the host may
+// be an interface name (e.g. wg0:8080) to the IPv4 address of the interface
+func listenAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" || net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	listenIfi, err := net.InterfaceByName(host)
+	if err != nil {
+		// not an interface, a host name
+		return addr, nil
+	}
+	ip, err := interfaceAddr(listenIfi)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// vmdecrypt canary: plays the same channel on two instances, e.g. the old
+// and the new version, and compares the content fingerprints of their
+// decrypted output (see /api/fingerprint) while it runs, reporting every
+// PTS second whose content differs.
+
+type canaryInstance struct {
+	server string
+	apiKey string
+	client *http.Client
+}
+
+// play keeps the channel running on the instance until ctx is done
+func (ci *canaryInstance) play(ctx context.Context, chURL string) {
+	for {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, chURL, nil)
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (ci *canaryInstance) fingerprints(chName string) (map[uint64]string, error) {
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/fingerprint/%s", ci.server, url.PathEscape(chName)), nil)
+	if ci.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+ci.apiKey)
+	}
+	resp, err := ci.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected status %s", ci.server, resp.Status)
+	}
+	var fps []Fingerprint
+	if err := json.NewDecoder(resp.Body).Decode(&fps); err != nil {
+		return nil, err
+	}
+	hashes := make(map[uint64]string)
+	for _, fp := range fps {
+		hashes[fp.Second] = fp.Hash
+	}
+	return hashes, nil
+}
+
+func canary(args []string) int {
+	fs := flag.NewFlagSet("canary", flag.ExitOnError)
+	serverA := fs.String("a", "", "URL of the first instance, e.g. the old version")
+	serverB := fs.String("b", "", "URL of the second instance, e.g. the new version")
+	chName := fs.String("channel", "", "Channel to compare")
+	duration := fs.Duration("duration", time.Minute, "How long the channel is compared")
+	interval := fs.Duration("interval", 5*time.Second, "How often the fingerprints are compared")
+	token := fs.String("token", "", "Access token for playing the channel")
+	apiKey := fs.String("api-key", "", "API key for the fingerprint API")
+	fs.Parse(args)
+	if *serverA == "" || *serverB == "" || *chName == "" || *interval <= 0 {
+		fmt.Println("Usage: vmdecrypt canary -a URL -b URL -channel <name> [-duration 1m] [-interval 5s]")
+		return 2
+	}
+	instances := []*canaryInstance{
+		{*serverA, *apiKey, &http.Client{Timeout: 10 * time.Second}},
+		{*serverB, *apiKey, &http.Client{Timeout: 10 * time.Second}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, ci := range instances {
+		chURL := fmt.Sprintf("%s/ch/%s", ci.server, url.PathEscape(*chName))
+		if *token != "" {
+			chURL += "?token=" + url.QueryEscape(*token)
+		}
+		go ci.play(ctx, chURL)
+	}
+
+	fmt.Printf("Comparing %s on %s and %s for %v\n", *chName, *serverA, *serverB, *duration)
+	compared := make(map[uint64]bool)
+	matched, diverged := 0, 0
+	end := time.Now().Add(*duration)
+	for time.Now().Before(end) {
+		time.Sleep(min(*interval, time.Until(end)))
+		a, err := instances[0].fingerprints(*chName)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		b, err := instances[1].fingerprints(*chName)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		seconds := make([]uint64, 0)
+		for s := range a {
+			if _, ok := b[s]; ok && !compared[s] {
+				seconds = append(seconds, s)
+			}
+		}
+		sort.Slice(seconds, func(i, j int) bool { return seconds[i] < seconds[j] })
+		for _, s := range seconds {
+			compared[s] = true
+			if a[s] == b[s] {
+				matched++
+				continue
+			}
+			diverged++
+			fmt.Printf("%s: PTS second %d differs: %s != %s\n", time.Now().Format(time.RFC3339), s, a[s], b[s])
+		}
+	}
+	fmt.Printf("PTS seconds: %d identical, %d different\n", matched, diverged)
+	if diverged > 0 || matched == 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Capture of multicast traffic with an AF_PACKET socket in promiscuous
+// mode, for networks where the switch floods the groups but IGMP joins of
+// the host are filtered. Needs CAP_NET_RAW.
+
+const (
+	ethPIP         = 0x0800 // ETH_P_IP
+	packetOutgoing = 4      // PACKET_OUTGOING
+)
+
+type captureSource struct {
+	fd    int
+	f     *os.File // for deadlines and closing while reading
+	rc    syscall.RawConn
+	group net.IP
+	port  uint16
+	buf   []byte
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+func openCapture(hostPort, iface string) (Source, error) {
+	host, portStr, _ := net.SplitHostPort(hostPort)
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port %s", portStr)
+	}
+	group := net.ParseIP(host).To4()
+	if group == nil {
+		return nil, fmt.Errorf("Capture supports only IPv4 groups, not %s", host)
+	}
+	ifi, err := receiveInterface(iface)
+	if err != nil {
+		return nil, err
+	}
+	// SOCK_DGRAM strips the link layer header, so packets start with IP
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, int(htons(ethPIP)))
+	if err != nil {
+		return nil, err
+	}
+	s := &captureSource{fd: fd, group: group, port: uint16(port), buf: make([]byte, maxDatagramSize)}
+	if err := s.setup(ifi); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	s.f = os.NewFile(uintptr(fd), "capture")
+	if s.rc, err = s.f.SyscallConn(); err != nil {
+		s.f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *captureSource) setup(ifi *net.Interface) error {
+	if err := syscall.Bind(s.fd, &syscall.SockaddrLinklayer{Protocol: htons(ethPIP), Ifindex: ifi.Index}); err != nil {
+		return err
+	}
+	// struct packet_mreq: mr_ifindex, mr_type, mr_alen, mr_address[8]
+	mreq := make([]byte, 16)
+	binary.NativeEndian.PutUint32(mreq[0:4], uint32(ifi.Index))
+	binary.NativeEndian.PutUint16(mreq[4:6], syscall.PACKET_MR_PROMISC)
+	if err := syscall.SetsockoptString(s.fd, syscall.SOL_PACKET, syscall.PACKET_ADD_MEMBERSHIP, string(mreq)); err != nil {
+		return err
+	}
+	if rcvBuf > 0 {
+		if err := syscall.SetsockoptInt(s.fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, rcvBuf); err != nil {
+			return err
+		}
+	}
+	return syscall.SetNonblock(s.fd, true)
+}
+
+// ReadPacket returns the UDP payload of the next captured datagram sent to
+// the group and port
+func (s *captureSource) ReadPacket(ctx context.Context) ([]byte, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(sourceTimeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		s.f.SetReadDeadline(deadline)
+		var n int
+		var from syscall.Sockaddr
+		var rerr error
+		err := s.rc.Read(func(fd uintptr) bool {
+			n, from, rerr = syscall.Recvfrom(int(fd), s.buf, 0)
+			return rerr != syscall.EAGAIN
+		})
+		if err == nil {
+			err = rerr
+		}
+		if err != nil {
+			return nil, err
+		}
+		// skip what this host sends
+		if ll, ok := from.(*syscall.SockaddrLinklayer); ok && ll.Pkttype == packetOutgoing {
+			continue
+		}
+		if payload := s.udpPayload(s.buf[:n]); payload != nil {
+			return append([]byte(nil), payload...), nil
+		}
+	}
+}
+
+func (s *captureSource) udpPayload(pkt []byte) []byte {
+	if len(pkt) < 20 || pkt[0]>>4 != 4 || pkt[9] != syscall.IPPROTO_UDP {
+		return nil
+	}
+	// fragments are not reassembled
+	if binary.BigEndian.Uint16(pkt[6:8])&0x3fff != 0 {
+		return nil
+	}
+	if !net.IP(pkt[16:20]).Equal(s.group) {
+		return nil
+	}
+	ihl := int(pkt[0]&0x0f) * 4
+	if len(pkt) < ihl+8 {
+		return nil
+	}
+	udp := pkt[ihl:]
+	if binary.BigEndian.Uint16(udp[2:4]) != s.port {
+		return nil
+	}
+	udpLen := int(binary.BigEndian.Uint16(udp[4:6]))
+	if udpLen < 8 || udpLen > len(udp) {
+		return nil
+	}
+	return udp[8:udpLen]
+}
+
+func (s *captureSource) Close() error {
+	return s.f.Close()
+}
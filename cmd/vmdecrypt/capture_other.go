@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func openCapture(hostPort, iface string) (Source, error) {
+	return nil, errors.New("Capture is supported only on Linux")
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Casting to Chromecast devices: mDNS discovery of _googlecast._tcp and
+// the CASTV2 protocol for launching the default media receiver.
+
+const castService = "_googlecast._tcp.local."
+const castDefaultReceiver = "CC1AD845"
+
+// CASTV2 messages are at most 64 KiB
+const castMaxMessage = 64 << 10
+
+type CastDevice struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+}
+
+func discoverCast(timeout time.Duration) ([]CastDevice, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	q := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	q.StartQuestions()
+	q.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(castService),
+		Type:  dnsmessage.TypePTR,
+		Class: dnsmessage.ClassINET,
+	})
+	msg, err := q.Finish()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteToUDP(msg, &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	devices := make([]CastDevice, 0)
+	seen := make(map[string]bool)
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		var p dnsmessage.Parser
+		if _, err := p.Start(buf[:n]); err != nil {
+			continue
+		}
+		p.SkipAllQuestions()
+		records, _ := p.AllAnswers()
+		p.SkipAllAuthorities()
+		// TXT and SRV records are usually sent as additionals
+		additionals, _ := p.AllAdditionals()
+		name, port := "", 8009
+		for _, rr := range append(records, additionals...) {
+			switch body := rr.Body.(type) {
+			case *dnsmessage.TXTResource:
+				for _, txt := range body.TXT {
+					if strings.HasPrefix(txt, "fn=") {
+						name = txt[3:]
+					}
+				}
+			case *dnsmessage.SRVResource:
+				port = int(body.Port)
+			}
+		}
+		addr := net.JoinHostPort(src.IP.String(), strconv.Itoa(port))
+		if name == "" || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		devices = append(devices, CastDevice{name, addr})
+	}
+	return devices, nil
+}
+
+// CastMessage protobuf encoding, see cast_channel.proto
+func castEncode(src, dst, ns, payload string) []byte {
+	msg := []byte{0x08, 0x00} // protocol_version = CASTV2_1_0
+	for i, s := range []string{src, dst, ns} {
+		msg = append(msg, byte((i+2)<<3|2))
+		msg = binary.AppendUvarint(msg, uint64(len(s)))
+		msg = append(msg, s...)
+	}
+	msg = append(msg, 0x28, 0x00) // payload_type = STRING
+	msg = append(msg, 6<<3|2)
+	msg = binary.AppendUvarint(msg, uint64(len(payload)))
+	msg = append(msg, payload...)
+	pkt := make([]byte, 4, 4+len(msg))
+	binary.BigEndian.PutUint32(pkt, uint32(len(msg)))
+	return append(pkt, msg...)
+}
+
+func castDecode(msg []byte) (ns string, payload string, err error) {
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return "", "", errors.New("Malformed cast message")
+		}
+		msg = msg[n:]
+		switch tag & 7 {
+		case 0:
+			_, n = binary.Uvarint(msg)
+			if n <= 0 {
+				return "", "", errors.New("Malformed cast message")
+			}
+			msg = msg[n:]
+		case 2:
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < l {
+				return "", "", errors.New("Malformed cast message")
+			}
+			val := string(msg[n : n+int(l)])
+			msg = msg[n+int(l):]
+			switch tag >> 3 {
+			case 4:
+				ns = val
+			case 6:
+				payload = val
+			}
+		default:
+			return "", "", fmt.Errorf("Unexpected wire type %v in cast message", tag&7)
+		}
+	}
+	return ns, payload, nil
+}
+
+type castConn struct {
+	conn  *tls.Conn
+	reqID int
+}
+
+func (c *castConn) send(dst, ns string, payload map[string]interface{}) error {
+	if _, ok := payload["requestId"]; !ok && ns != "urn:x-cast:com.google.cast.tp.connection" && ns != "urn:x-cast:com.google.cast.tp.heartbeat" {
+		c.reqID++
+		payload["requestId"] = c.reqID
+	}
+	data, _ := json.Marshal(payload)
+	_, err := c.conn.Write(castEncode("sender-0", dst, ns, string(data)))
+	return err
+}
+
+// recv returns the next non-heartbeat message
+func (c *castConn) recv() (map[string]interface{}, error) {
+	for {
+		hdr := make([]byte, 4)
+		if _, err := io.ReadFull(c.conn, hdr); err != nil {
+			return nil, err
+		}
+		n := binary.BigEndian.Uint32(hdr)
+		if n > castMaxMessage {
+			return nil, fmt.Errorf("Cast message too long: %d bytes", n)
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(c.conn, msg); err != nil {
+			return nil, err
+		}
+		ns, payload, err := castDecode(msg)
+		if err != nil {
+			return nil, err
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(payload), &m); err != nil {
+			continue
+		}
+		if ns == "urn:x-cast:com.google.cast.tp.heartbeat" {
+			if m["type"] == "PING" {
+				c.send("receiver-0", ns, map[string]interface{}{"type": "PONG"})
+			}
+			continue
+		}
+		return m, nil
+	}
+}
+
+func castTransportID(status map[string]interface{}) string {
+	st, _ := status["status"].(map[string]interface{})
+	apps, _ := st["applications"].([]interface{})
+	for _, a := range apps {
+		app, _ := a.(map[string]interface{})
+		if app["appId"] == castDefaultReceiver {
+			id, _ := app["transportId"].(string)
+			return id
+		}
+	}
+	return ""
+}
+
+func castMedia(addr, title, mediaURL, contentType string) error {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(20 * time.Second))
+	c := &castConn{conn: conn}
+	c.send("receiver-0", "urn:x-cast:com.google.cast.tp.connection", map[string]interface{}{"type": "CONNECT"})
+	c.send("receiver-0", "urn:x-cast:com.google.cast.receiver", map[string]interface{}{"type": "LAUNCH", "appId": castDefaultReceiver})
+	transportID := ""
+	for transportID == "" {
+		m, err := c.recv()
+		if err != nil {
+			return err
+		}
+		if m["type"] == "LAUNCH_ERROR" {
+			return fmt.Errorf("Cannot launch media receiver: %v", m["reason"])
+		}
+		if m["type"] == "RECEIVER_STATUS" {
+			transportID = castTransportID(m)
+		}
+	}
+	c.send(transportID, "urn:x-cast:com.google.cast.tp.connection", map[string]interface{}{"type": "CONNECT"})
+	c.send(transportID, "urn:x-cast:com.google.cast.media", map[string]interface{}{
+		"type":     "LOAD",
+		"autoplay": true,
+		"media": map[string]interface{}{
+			"contentId":   mediaURL,
+			"contentType": contentType,
+			"streamType":  "LIVE",
+			"metadata":    map[string]interface{}{"metadataType": 0, "title": title},
+		},
+	})
+	for {
+		m, err := c.recv()
+		if err != nil {
+			return err
+		}
+		switch m["type"] {
+		case "MEDIA_STATUS":
+			return nil
+		case "LOAD_FAILED", "LOAD_CANCELLED", "INVALID_REQUEST":
+			return fmt.Errorf("Cannot load media: %v", m["type"])
+		}
+	}
+}
+
+func castHandler(w http.ResponseWriter, req *http.Request) {
+	devices, err := discoverCast(2 * time.Second)
+	if err != nil {
+		httpError(w, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	chName := req.FormValue("channel")
+	if chName == "" {
+		writeJSON(w, devices)
+		return
+	}
+	k := url.PathEscape(chName)
+	if _, ok := getChannel(w, req, k); !ok {
+		return
+	}
+	devName := req.FormValue("device")
+	var dev *CastDevice
+	for i := range devices {
+		if strings.EqualFold(devices[i].Name, devName) {
+			dev = &devices[i]
+		}
+	}
+	if dev == nil {
+		httpError(w, req, "No such cast device: "+devName, http.StatusNotFound)
+		return
+	}
+	mediaURL, contentType := fmt.Sprintf("%s/ch/%s%s", serverURL(), k, accessQuery(req, k)), "video/mp2t"
+	if hlsEnabled() {
+		mediaURL, contentType = hlsURL(k)+accessQuery(req, k), "application/x-mpegURL"
+	}
+	reqLogf(req, "Casting %s to %s (%s)", chName, dev.Name, dev.Addr)
+	if err := castMedia(dev.Addr, chName, mediaURL, contentType); err != nil {
+		reqLogf(req, "%v @ %v", err, dev.Addr)
+		httpError(w, req, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, dev)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// "-config vmdecrypt.yaml" sets the flags from a YAML mapping of flag names
+// to values, e.g. "hls-ladder: 1280x720@2800k". Lists are joined with
+// commas for the flags which take comma separated values. Flags given on
+// the command line take precedence.
+
+// loadConfigFile sets the flags which are not given on the command line
+// from the YAML file and returns the unknown keys and bad values
+func loadConfigFile(path string) []configError {
+	errs := make([]configError, 0)
+	if path == "" {
+		return errs
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return append(errs, configError{Flag: "config", Error: err.Error()})
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return append(errs, configError{Flag: "config", Error: err.Error()})
+	}
+	if len(doc.Content) == 0 {
+		// empty file
+		return errs
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return append(errs, configError{Flag: "config", Line: root.Line, Error: "must be a mapping of flag names to values"})
+	}
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, node := root.Content[i], root.Content[i+1]
+		name := key.Value
+		if seen[name] {
+			errs = append(errs, configError{Flag: name, Line: key.Line, Error: "duplicate key"})
+			continue
+		}
+		seen[name] = true
+		if flag.Lookup(name) == nil || name == "config" {
+			errs = append(errs, configError{Flag: name, Line: key.Line, Error: "unknown key"})
+			continue
+		}
+		value, err := configValue(node)
+		if err != nil {
+			errs = append(errs, configError{Flag: name, Line: node.Line, Error: err.Error()})
+			continue
+		}
+		if given[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			errs = append(errs, configError{Flag: name, Line: node.Line, Error: fmt.Sprintf("invalid value %q: %v", value, err)})
+		}
+	}
+	return errs
+}
+
+// configValue returns the flag value of a YAML scalar or list of scalars
+func configValue(node *yaml.Node) (string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Tag == "!!null" {
+			return "", nil
+		}
+		return node.Value, nil
+	case yaml.SequenceNode:
+		values := make([]string, 0)
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return "", fmt.Errorf("list items must be scalars")
+			}
+			values = append(values, item.Value)
+		}
+		return strings.Join(values, ","), nil
+	}
+	return "", fmt.Errorf("value must be a scalar or a list")
+}
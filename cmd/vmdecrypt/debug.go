@@ -0,0 +1,168 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Debug bundle: /api/debug/bundle returns a tarball with everything useful
+// for a bug report, the configuration without secrets, the status, the
+// recent log lines and the goroutines.
+
+const recentLogLines = 2000
+
+type logRing struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+// recentLog keeps the last lines written to the log
+var recentLog = &logRing{lines: make([]string, recentLogLines)}
+
+func (lr *logRing) Write(p []byte) (int, error) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	for _, line := range strings.SplitAfter(string(p), "\n") {
+		if line == "" {
+			continue
+		}
+		lr.lines[lr.next] = line
+		lr.next = (lr.next + 1) % len(lr.lines)
+		lr.full = lr.full || lr.next == 0
+	}
+	return len(p), nil
+}
+
+func (lr *logRing) String() string {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	var b strings.Builder
+	if lr.full {
+		for _, line := range lr.lines[lr.next:] {
+			b.WriteString(line)
+		}
+	}
+	for _, line := range lr.lines[:lr.next] {
+		b.WriteString(line)
+	}
+	return b.String()
+}
+
+// redactFlag hides the PIN and credentials in URLs
+func redactFlag(name, value string) string {
+	if value == "" {
+		return value
+	}
+	if name == "pin" {
+		return "REDACTED"
+	}
+	if u, err := url.Parse(value); err == nil && u.Host != "" && (u.User != nil || u.RawQuery != "") {
+		u.User = nil
+		if u.RawQuery != "" {
+			u.RawQuery = "REDACTED"
+		}
+		return u.String()
+	}
+	return value
+}
+
+type debugChannel struct {
+	Name    string `json:"name"`
+	Addr    string `json:"addr"`
+	Format  string `json:"format,omitempty"`
+	Group   string `json:"group,omitempty"`
+	Iface   string `json:"iface,omitempty"`
+	Capture bool   `json:"capture,omitempty"`
+	Output  string `json:"output,omitempty"`
+	HasKey  bool   `json:"has_key"`
+}
+
+func debugChannels() []debugChannel {
+	chans := make([]debugChannel, 0)
+	for _, k := range sortedChannels() {
+		chInfo, _ := lookupChannel(k)
+		chans = append(chans, debugChannel{displayName(k), chInfo.addr, chInfo.format, chInfo.group,
+			chInfo.iface, chInfo.capture, chInfo.output, chInfo.masterKey != ""})
+	}
+	return chans
+}
+
+func debugFlags() map[string]string {
+	flags := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		flags[f.Name] = redactFlag(f.Name, f.Value.String())
+	})
+	return flags
+}
+
+func debugBundle() ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	add := func(name string, data []byte) error {
+		hdr := &tar.Header{Name: "vmdecrypt-debug/" + name, Mode: 0644, Size: int64(len(data)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	addJSON := func(name string, v interface{}) error {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		return add(name, append(data, '\n'))
+	}
+	var goroutines bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&goroutines, 2)
+	steps := []func() error{
+		func() error { return addJSON("version.json", currentVersion()) },
+		func() error { return addJSON("flags.json", debugFlags()) },
+		func() error { return addJSON("channels.json", debugChannels()) },
+		func() error { return addJSON("status.json", currentStatus()) },
+		func() error { return add("log.txt", []byte(recentLog.String())) },
+		func() error { return add("goroutines.txt", goroutines.Bytes()) },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func debugBundleHandler(w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+	data, err := debugBundle()
+	if err != nil {
+		httpError(w, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	reqLogf(req, "Debug bundle requested by %v", req.RemoteAddr)
+	name := fmt.Sprintf("vmdecrypt-debug-%s.tar.gz", time.Now().UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Write(data)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Disk rings: with -disk-ring-dir the decrypted packets of the running
+// channels are also kept in a memory-mapped file per channel, which gives
+// buffers of hours for timeshift without growing the Go heap. The file
+// starts with a header and an index of one record per second, mapping time
+// to packet sequence numbers, followed by the packets. It survives restarts.
+
+const (
+	diskRingMagic       = "VMDRING1"
+	diskRingHeader      = 64
+	diskRingIndexSlots  = 65536 // about 18 hours at one record per second
+	diskRingIndexRecord = 16
+	diskRingDataOffset  = diskRingHeader + diskRingIndexSlots*diskRingIndexRecord
+)
+
+var diskRingDir string
+var diskRingSize int64 // MiB per channel
+
+type diskRing struct {
+	mu        sync.Mutex
+	m         []byte
+	slots     uint64 // capacity in packets
+	seq       uint64 // packets written so far
+	indexes   uint64 // index records written so far
+	lastIndex time.Time
+}
+
+var diskRingsMu sync.Mutex
+
+// multicast address => disk ring
+var diskRings = make(map[string]*diskRing)
+
+// diskRingFor returns the disk ring of the channel, nil if disabled
+func diskRingFor(addr string) *diskRing {
+	if diskRingDir == "" {
+		return nil
+	}
+	diskRingsMu.Lock()
+	defer diskRingsMu.Unlock()
+	if r, ok := diskRings[addr]; ok {
+		return r
+	}
+	path := filepath.Join(diskRingDir, strings.NewReplacer(".", "_", ":", "_").Replace(addr)+".ring")
+	r, err := openDiskRing(path, diskRingSize<<20)
+	if err != nil {
+		log.Printf("%v @ %v", err, addr)
+		return nil
+	}
+	diskRings[addr] = r
+	return r
+}
+
+func openDiskRing(path string, size int64) (*diskRing, error) {
+	if size < diskRingDataOffset+188 {
+		return nil, fmt.Errorf("Disk ring size must be at least %d bytes", diskRingDataOffset+188)
+	}
+	m, err := mapFile(path, size)
+	if err != nil {
+		return nil, err
+	}
+	r := &diskRing{m: m, slots: uint64(size-diskRingDataOffset) / 188}
+	if string(m[0:8]) == diskRingMagic && binary.LittleEndian.Uint64(m[8:16]) == r.slots {
+		// continue after the last run
+		r.seq = binary.LittleEndian.Uint64(m[16:24])
+		r.indexes = binary.LittleEndian.Uint64(m[24:32])
+	} else {
+		copy(m[0:8], diskRingMagic)
+		binary.LittleEndian.PutUint64(m[8:16], r.slots)
+		binary.LittleEndian.PutUint64(m[16:24], 0)
+		binary.LittleEndian.PutUint64(m[24:32], 0)
+	}
+	return r, nil
+}
+
+func (r *diskRing) write(pkt []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if now.Sub(r.lastIndex) >= time.Second {
+		rec := r.m[diskRingHeader+(r.indexes%diskRingIndexSlots)*diskRingIndexRecord:]
+		binary.LittleEndian.PutUint64(rec[0:8], uint64(now.UnixNano()))
+		binary.LittleEndian.PutUint64(rec[8:16], r.seq)
+		r.indexes++
+		binary.LittleEndian.PutUint64(r.m[24:32], r.indexes)
+		r.lastIndex = now
+	}
+	copy(r.m[diskRingDataOffset+(r.seq%r.slots)*188:], pkt)
+	r.seq++
+	binary.LittleEndian.PutUint64(r.m[16:24], r.seq)
+}
+
+// oldest returns the sequence number of the oldest packet in the ring
+func (r *diskRing) oldest() uint64 {
+	if r.seq > r.slots {
+		return r.seq - r.slots
+	}
+	return 0
+}
+
+// seqAt returns the sequence number of the first packet written at or
+// after t, or of the oldest packet if t is older, false if there is none
+func (r *diskRing) seqAt(t time.Time) (uint64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	first := uint64(0)
+	if r.indexes > diskRingIndexSlots {
+		first = r.indexes - diskRingIndexSlots
+	}
+	for i := first; i < r.indexes; i++ {
+		rec := r.m[diskRingHeader+(i%diskRingIndexSlots)*diskRingIndexRecord:]
+		seq := binary.LittleEndian.Uint64(rec[8:16])
+		if seq < r.oldest() {
+			continue
+		}
+		if time.Unix(0, int64(binary.LittleEndian.Uint64(rec[0:8]))).Before(t) {
+			continue
+		}
+		return seq, true
+	}
+	return 0, false
+}
+
+// readFrom copies the packets from seq on into buf and returns their number
+// and the next sequence number, seq is moved forward if its packets were
+// overwritten meanwhile
+func (r *diskRing) readFrom(seq uint64, buf []byte) (int, uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if seq < r.oldest() {
+		seq = r.oldest()
+	}
+	n := 0
+	for ; seq < r.seq && (n+1)*188 <= len(buf); seq++ {
+		copy(buf[n*188:], r.m[diskRingDataOffset+(seq%r.slots)*188:][:188])
+		n++
+	}
+	return n, seq
+}
+
+func (ch *Channel) failed() bool {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.ioerr
+}
+
+// timeshiftHandler plays a channel from its disk ring starting at a point
+// in the past, e.g. /timeshift/CNN?offset=10m or ?from=2026-10-17T20:00:00Z
+func timeshiftHandler(w http.ResponseWriter, req *http.Request) {
+	chName := strings.SplitN(req.RequestURI[len("/timeshift/"):], "?", 2)[0]
+	chInfo, ok := getChannel(w, req, chName)
+	if !ok {
+		return
+	}
+	chInfo.setHeaders(w)
+	q := req.URL.Query()
+	start := time.Now()
+	if s := q.Get("from"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			httpError(w, req, err.Error(), http.StatusBadRequest)
+			return
+		}
+		start = t
+	} else if s := q.Get("offset"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			httpError(w, req, "Invalid offset "+s, http.StatusBadRequest)
+			return
+		}
+		start = start.Add(-d)
+	}
+	ring := diskRingFor(chInfo.addr)
+	if ring == nil {
+		httpError(w, req, "Timeshift is not enabled", http.StatusNotFound)
+		return
+	}
+	seq, ok := ring.seqAt(start)
+	if !ok {
+		httpError(w, req, "Not in the disk ring", http.StatusNotFound)
+		return
+	}
+	// keep the channel recorded while it is played
+	ch := attachChannel(chInfo)
+	defer detachChannel(chInfo)
+
+	reqLogf(req, "Start timeshift of client %v from %v", req.RemoteAddr, start.Format(time.RFC3339))
+	w.Header().Set("Content-Type", "video/mp2t")
+	token := requestToken(req)
+	buf := make([]byte, 7*188*16)
+	for {
+		var n int
+		n, seq = ring.readFrom(seq, buf)
+		if n == 0 {
+			if ch.failed() {
+				break
+			}
+			select {
+			case <-req.Context().Done():
+				reqLogf(req, "Stop timeshift of client %v", req.RemoteAddr)
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+			continue
+		}
+		written, err := w.Write(buf[:n*188])
+		usageServed(chInfo.addr, written)
+		if err != nil {
+			break
+		}
+		if !token.consume(n * 188) {
+			break
+		}
+	}
+	reqLogf(req, "Stop timeshift of client %v", req.RemoteAddr)
+}
+
+func validateDiskRing() error {
+	if diskRingDir == "" {
+		return nil
+	}
+	if st, err := os.Stat(diskRingDir); err != nil {
+		return err
+	} else if !st.IsDir() {
+		return fmt.Errorf("%s is not a directory", diskRingDir)
+	}
+	if diskRingSize<<20 < diskRingDataOffset+188 {
+		return fmt.Errorf("must be at least %d MiB", (diskRingDataOffset+188)>>20+1)
+	}
+	return nil
+}
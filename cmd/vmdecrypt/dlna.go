@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Minimal UPnP MediaServer so that smart TVs can browse the channels.
+// Only the ContentDirectory Browse action is implemented.
+
+const ssdpAddr = "239.255.255.250:1900"
+const ssdpMaxAge = 1800
+
+var ssdpTargets = []string{
+	"upnp:rootdevice",
+	"urn:schemas-upnp-org:device:MediaServer:1",
+	"urn:schemas-upnp-org:service:ContentDirectory:1",
+	"urn:schemas-upnp-org:service:ConnectionManager:1",
+}
+
+const tsProtocolInfo = "http-get:*:video/mpeg:DLNA.ORG_PN=MPEG_TS_SD_EU_ISO;DLNA.ORG_OP=00;DLNA.ORG_FLAGS=8d100000000000000000000000000000"
+const hlsProtocolInfo = "http-get:*:application/vnd.apple.mpegurl:*"
+
+func deviceUUID() string {
+	id := deviceID()
+	return fmt.Sprintf("uuid:%s-0000-4000-8000-%s%s", id, id[:4], id)
+}
+
+func ssdpLocation() string {
+	return serverURL() + "/dlna/description.xml"
+}
+
+func ssdpUSN(nt string) string {
+	if nt == deviceUUID() {
+		return nt
+	}
+	return deviceUUID() + "::" + nt
+}
+
+func ssdpNotify(conn *net.UDPConn, dst *net.UDPAddr) {
+	for _, nt := range append([]string{deviceUUID()}, ssdpTargets...) {
+		msg := "NOTIFY * HTTP/1.1\r\n" +
+			"HOST: " + ssdpAddr + "\r\n" +
+			"CACHE-CONTROL: max-age=" + strconv.Itoa(ssdpMaxAge) + "\r\n" +
+			"LOCATION: " + ssdpLocation() + "\r\n" +
+			"NT: " + nt + "\r\n" +
+			"NTS: ssdp:alive\r\n" +
+			"SERVER: Linux UPnP/1.0 vmdecrypt/1.0\r\n" +
+			"USN: " + ssdpUSN(nt) + "\r\n\r\n"
+		conn.WriteToUDP([]byte(msg), dst)
+	}
+}
+
+func ssdpReply(conn *net.UDPConn, dst *net.UDPAddr, st string) {
+	targets := []string{st}
+	if st == "ssdp:all" {
+		targets = append([]string{deviceUUID()}, ssdpTargets...)
+	} else if st != deviceUUID() {
+		found := false
+		for _, t := range ssdpTargets {
+			found = found || t == st
+		}
+		if !found {
+			return
+		}
+	}
+	for _, t := range targets {
+		msg := "HTTP/1.1 200 OK\r\n" +
+			"CACHE-CONTROL: max-age=" + strconv.Itoa(ssdpMaxAge) + "\r\n" +
+			"EXT:\r\n" +
+			"LOCATION: " + ssdpLocation() + "\r\n" +
+			"SERVER: Linux UPnP/1.0 vmdecrypt/1.0\r\n" +
+			"ST: " + t + "\r\n" +
+			"USN: " + ssdpUSN(t) + "\r\n\r\n"
+		conn.WriteToUDP([]byte(msg), dst)
+	}
+}
+
+func ssdpHeader(msg, name string) string {
+	for _, line := range strings.Split(msg, "\r\n") {
+		if i := strings.Index(line, ":"); i > 0 && strings.EqualFold(line[:i], name) {
+			return strings.TrimSpace(line[i+1:])
+		}
+	}
+	return ""
+}
+
+func ssdpAnnounce() {
+	group, _ := net.ResolveUDPAddr("udp4", ssdpAddr)
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		log.Println("SSDP:", err)
+		return
+	}
+	defer conn.Close()
+	go func() {
+		for {
+			ssdpNotify(conn, group)
+			time.Sleep(ssdpMaxAge / 2 * time.Second)
+		}
+	}()
+	log.Println("Announcing MediaServer via SSDP, location", ssdpLocation())
+	buf := make([]byte, 2048)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Println("SSDP:", err)
+			return
+		}
+		msg := string(buf[:n])
+		if !strings.HasPrefix(msg, "M-SEARCH") || ssdpHeader(msg, "MAN") != `"ssdp:discover"` {
+			continue
+		}
+		ssdpReply(conn, src, ssdpHeader(msg, "ST"))
+	}
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func descriptionHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:MediaServer:1</deviceType>
+    <friendlyName>vmdecrypt</friendlyName>
+    <manufacturer>vmdecrypt</manufacturer>
+    <modelName>vmdecrypt</modelName>
+    <UDN>%s</UDN>
+    <serviceList>
+      <service>
+        <serviceType>urn:schemas-upnp-org:service:ContentDirectory:1</serviceType>
+        <serviceId>urn:upnp-org:serviceId:ContentDirectory</serviceId>
+        <SCPDURL>/dlna/ContentDirectory.xml</SCPDURL>
+        <controlURL>/dlna/control/ContentDirectory</controlURL>
+        <eventSubURL>/dlna/event/ContentDirectory</eventSubURL>
+      </service>
+      <service>
+        <serviceType>urn:schemas-upnp-org:service:ConnectionManager:1</serviceType>
+        <serviceId>urn:upnp-org:serviceId:ConnectionManager</serviceId>
+        <SCPDURL>/dlna/ConnectionManager.xml</SCPDURL>
+        <controlURL>/dlna/control/ConnectionManager</controlURL>
+        <eventSubURL>/dlna/event/ConnectionManager</eventSubURL>
+      </service>
+    </serviceList>
+  </device>
+</root>
+`, deviceUUID())
+}
+
+const contentDirectorySCPD = `<?xml version="1.0"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <actionList>
+    <action>
+      <name>Browse</name>
+      <argumentList>
+        <argument><name>ObjectID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ObjectID</relatedStateVariable></argument>
+        <argument><name>BrowseFlag</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_BrowseFlag</relatedStateVariable></argument>
+        <argument><name>Filter</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Filter</relatedStateVariable></argument>
+        <argument><name>StartingIndex</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Index</relatedStateVariable></argument>
+        <argument><name>RequestedCount</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+        <argument><name>SortCriteria</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_SortCriteria</relatedStateVariable></argument>
+        <argument><name>Result</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Result</relatedStateVariable></argument>
+        <argument><name>NumberReturned</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+        <argument><name>TotalMatches</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+        <argument><name>UpdateID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_UpdateID</relatedStateVariable></argument>
+      </argumentList>
+    </action>
+  </actionList>
+  <serviceStateTable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ObjectID</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_BrowseFlag</name><dataType>string</dataType>
+      <allowedValueList><allowedValue>BrowseMetadata</allowedValue><allowedValue>BrowseDirectChildren</allowedValue></allowedValueList>
+    </stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Filter</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Index</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Count</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_SortCriteria</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Result</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_UpdateID</name><dataType>ui4</dataType></stateVariable>
+  </serviceStateTable>
+</scpd>
+`
+
+const connectionManagerSCPD = `<?xml version="1.0"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <actionList>
+    <action>
+      <name>GetProtocolInfo</name>
+      <argumentList>
+        <argument><name>Source</name><direction>out</direction><relatedStateVariable>SourceProtocolInfo</relatedStateVariable></argument>
+        <argument><name>Sink</name><direction>out</direction><relatedStateVariable>SinkProtocolInfo</relatedStateVariable></argument>
+      </argumentList>
+    </action>
+  </actionList>
+  <serviceStateTable>
+    <stateVariable sendEvents="yes"><name>SourceProtocolInfo</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>SinkProtocolInfo</name><dataType>string</dataType></stateVariable>
+  </serviceStateTable>
+</scpd>
+`
+
+func scpdHandler(scpd string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		io.WriteString(w, scpd)
+	}
+}
+
+func soapResponse(w http.ResponseWriter, service, action, args string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Header().Set("EXT", "")
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><u:%sResponse xmlns:u="urn:schemas-upnp-org:service:%s:1">%s</u:%sResponse></s:Body>
+</s:Envelope>
+`, action, service, args, action)
+}
+
+func soapFault(w http.ResponseWriter, code int, desc string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>
+<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError>
+</detail></s:Fault></s:Body>
+</s:Envelope>
+`, code, desc)
+}
+
+type browseRequest struct {
+	ObjectID       string `xml:"Body>Browse>ObjectID"`
+	BrowseFlag     string `xml:"Body>Browse>BrowseFlag"`
+	StartingIndex  int    `xml:"Body>Browse>StartingIndex"`
+	RequestedCount int    `xml:"Body>Browse>RequestedCount"`
+}
+
+const didlHeader = `<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/">`
+
+func didlItem(req *http.Request, id int, k string) string {
+	chName := displayName(k)
+	res := fmt.Sprintf(`<res protocolInfo="%s">%s</res>`, tsProtocolInfo, xmlEscape(fmt.Sprintf("%s/ch/%s%s", serverURL(), k, accessQuery(req, k))))
+	if hlsEnabled() {
+		res += fmt.Sprintf(`<res protocolInfo="%s">%s</res>`, hlsProtocolInfo, xmlEscape(hlsURL(k)+accessQuery(req, k)))
+	}
+	return fmt.Sprintf(`<item id="%d" parentID="0" restricted="1"><dc:title>%s</dc:title><upnp:class>object.item.videoItem.videoBroadcast</upnp:class>%s</item>`,
+		id, xmlEscape(chName), res)
+}
+
+func contentDirectoryHandler(w http.ResponseWriter, req *http.Request) {
+	action := req.Header.Get("SOAPACTION")
+	if !strings.Contains(action, "#Browse") {
+		soapFault(w, 401, "Invalid Action")
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	var br browseRequest
+	if err := xml.Unmarshal(body, &br); err != nil {
+		soapFault(w, 402, "Invalid Args")
+		return
+	}
+	keys := playlistChannels(req)
+	result := didlHeader
+	returned, total := 0, 0
+	switch {
+	case br.ObjectID == "0" && br.BrowseFlag == "BrowseMetadata":
+		result += fmt.Sprintf(`<container id="0" parentID="-1" restricted="1" childCount="%d"><dc:title>vmdecrypt</dc:title><upnp:class>object.container.storageFolder</upnp:class></container>`, len(keys))
+		returned, total = 1, 1
+	case br.ObjectID == "0":
+		total = len(keys)
+		start := min(max(br.StartingIndex, 0), total)
+		end := total
+		// compared without the sum, which may overflow
+		if br.RequestedCount > 0 && br.RequestedCount < end-start {
+			end = start + br.RequestedCount
+		}
+		for i := start; i < end; i++ {
+			result += didlItem(req, i+1, keys[i])
+			returned++
+		}
+	default:
+		id, err := strconv.Atoi(br.ObjectID)
+		if err != nil || id < 1 || id > len(keys) {
+			soapFault(w, 701, "No such object")
+			return
+		}
+		result += didlItem(req, id, keys[id-1])
+		returned, total = 1, 1
+	}
+	result += "</DIDL-Lite>"
+	soapResponse(w, "ContentDirectory", "Browse", fmt.Sprintf(
+		"<Result>%s</Result><NumberReturned>%d</NumberReturned><TotalMatches>%d</TotalMatches><UpdateID>0</UpdateID>",
+		xmlEscape(result), returned, total))
+}
+
+func connectionManagerHandler(w http.ResponseWriter, req *http.Request) {
+	if !strings.Contains(req.Header.Get("SOAPACTION"), "#GetProtocolInfo") {
+		soapFault(w, 401, "Invalid Action")
+		return
+	}
+	soapResponse(w, "ConnectionManager", "GetProtocolInfo",
+		fmt.Sprintf("<Source>%s,%s</Source><Sink></Sink>", xmlEscape(tsProtocolInfo), xmlEscape(hlsProtocolInfo)))
+}
+
+func startDLNA() {
+	http.HandleFunc("/dlna/description.xml", descriptionHandler)
+	http.HandleFunc("/dlna/ContentDirectory.xml", scpdHandler(contentDirectorySCPD))
+	http.HandleFunc("/dlna/ConnectionManager.xml", scpdHandler(connectionManagerSCPD))
+	http.HandleFunc("/dlna/control/ContentDirectory", contentDirectoryHandler)
+	http.HandleFunc("/dlna/control/ConnectionManager", connectionManagerHandler)
+	go ssdpAnnounce()
+}
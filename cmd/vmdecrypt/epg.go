@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rgerganov/vmdecrypt"
+)
+
+// Program guide from the DVB EIT of the decrypted channels, served as
+// XMLTV. The guide of a channel is known once it has been decrypted, the
+// schedule sections are repeated every few seconds.
+
+// events which ended this long ago are dropped
+const epgRetention = 6 * time.Hour
+
+var epgMu sync.Mutex
+
+// multicast address => event ID => event
+var epg = make(map[string]map[uint16]vmdecrypt.Event)
+
+func storeEvents(addr string, events []vmdecrypt.Event) {
+	epgMu.Lock()
+	defer epgMu.Unlock()
+	m, ok := epg[addr]
+	if !ok {
+		m = make(map[uint16]vmdecrypt.Event)
+		epg[addr] = m
+	}
+	for _, e := range events {
+		m[e.ID] = e
+	}
+	for id, e := range m {
+		if time.Since(e.Start.Add(e.Duration)) > epgRetention {
+			delete(m, id)
+		}
+	}
+}
+
+// channelEvents returns the events of the channel sorted by their start
+func channelEvents(addr string) []vmdecrypt.Event {
+	epgMu.Lock()
+	events := make([]vmdecrypt.Event, 0, len(epg[addr]))
+	for _, e := range epg[addr] {
+		events = append(events, e)
+	}
+	epgMu.Unlock()
+	sort.Slice(events, func(i, j int) bool { return events[i].Start.Before(events[j].Start) })
+	return events
+}
+
+type xmltvText struct {
+	Lang string `xml:"lang,attr,omitempty"`
+	Text string `xml:",chardata"`
+}
+
+type xmltvIcon struct {
+	Src string `xml:"src,attr"`
+}
+
+type xmltvChannel struct {
+	ID          string     `xml:"id,attr"`
+	DisplayName string     `xml:"display-name"`
+	Icon        *xmltvIcon `xml:"icon,omitempty"`
+}
+
+type xmltvProgramme struct {
+	Start   string     `xml:"start,attr"`
+	Stop    string     `xml:"stop,attr"`
+	Channel string     `xml:"channel,attr"`
+	Title   xmltvText  `xml:"title"`
+	Desc    *xmltvText `xml:"desc,omitempty"`
+}
+
+type xmltvTV struct {
+	XMLName    xml.Name         `xml:"tv"`
+	Generator  string           `xml:"generator-info-name,attr"`
+	Channels   []xmltvChannel   `xml:"channel"`
+	Programmes []xmltvProgramme `xml:"programme"`
+}
+
+const xmltvTimeFormat = "20060102150405 -0700"
+
+func xmltvHandler(w http.ResponseWriter, req *http.Request) {
+	tv := xmltvTV{Generator: "vmdecrypt", Channels: make([]xmltvChannel, 0), Programmes: make([]xmltvProgramme, 0)}
+	for _, k := range visibleChannels(req) {
+		chInfo, _ := lookupChannel(k)
+		id := chInfo.tvgID(k)
+		c := xmltvChannel{ID: id, DisplayName: displayName(k)}
+		if chInfo.logo != "" {
+			c.Icon = &xmltvIcon{chInfo.logo}
+		}
+		tv.Channels = append(tv.Channels, c)
+		for _, e := range channelEvents(chInfo.addr) {
+			p := xmltvProgramme{Start: e.Start.Format(xmltvTimeFormat), Stop: e.Start.Add(e.Duration).Format(xmltvTimeFormat),
+				Channel: id, Title: xmltvText{e.Language, e.Title}}
+			if e.Description != "" {
+				p.Desc = &xmltvText{e.Language, e.Description}
+			}
+			tv.Programmes = append(tv.Programmes, p)
+		}
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	enc.Encode(tv)
+	io.WriteString(w, "\n")
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Lineup export: the current channels, including the changes made with the
+// channels API, in the format of the channels file, as M3U with the source
+// addresses or as CSV, e.g. for feeding them back into the provider tools.
+
+// channelAddress returns the address of the channel in the channels file,
+// e.g. rtp://239.1.1.1:1234
+func channelAddress(chInfo ChannelInfo) string {
+	for scheme, format := range inputFormats {
+		if format == chInfo.format {
+			return scheme + "://" + chInfo.addr
+		}
+	}
+	return chInfo.addr
+}
+
+func formatCAIDList(caids []uint16) string {
+	list := make([]string, 0)
+	for _, c := range caids {
+		list = append(list, fmt.Sprintf("0x%04x", c))
+	}
+	return strings.Join(list, ",")
+}
+
+// channelAttrs returns the optional attributes of the channel
+func channelAttrs(chInfo ChannelInfo) map[string]interface{} {
+	attrs := make(map[string]interface{})
+	if chInfo.group != "" {
+		attrs["group"] = chInfo.group
+	}
+	if chInfo.logo != "" {
+		attrs["logo"] = chInfo.logo
+	}
+	if chInfo.epgID != "" {
+		attrs["epg_id"] = chInfo.epgID
+	}
+	if chInfo.number != 0 {
+		attrs["number"] = chInfo.number
+	}
+	if chInfo.iface != "" {
+		attrs["iface"] = chInfo.iface
+	}
+	if chInfo.capture {
+		attrs["capture"] = true
+	}
+	if chInfo.output != "" {
+		attrs["output"] = chInfo.output
+	}
+	if chInfo.fec {
+		attrs["fec"] = true
+	}
+	if len(chInfo.sources) > 0 {
+		sources := make([]string, 0)
+		for _, src := range chInfo.sources {
+			sources = append(sources, channelAddress(ChannelInfo{addr: src.addr, format: src.format}))
+		}
+		attrs["sources"] = sources
+	}
+	if len(chInfo.headers) > 0 {
+		attrs["headers"] = chInfo.headers
+	}
+	if len(chInfo.caids) > 0 {
+		attrs["caid"] = formatCAIDList(chInfo.caids)
+	}
+	if chInfo.program != 0 {
+		attrs["program"] = chInfo.program
+	}
+	if chInfo.pmtPid != 0 {
+		attrs["pmt_pid"] = chInfo.pmtPid
+	}
+	if chInfo.ecmPid != 0 {
+		attrs["ecm_pid"] = chInfo.ecmPid
+	}
+	if chInfo.caProfile != "" {
+		attrs["ca_profile"] = chInfo.caProfile
+	}
+	if len(chInfo.tags) > 0 {
+		attrs["tags"] = chInfo.tags
+	}
+	if len(chInfo.networks) > 0 {
+		attrs["networks"] = chInfo.networks
+	}
+	return attrs
+}
+
+// exportName is the name of the channel in the channels file, empty for
+// the channels named after their service name
+func exportName(k string) string {
+	if chInfo, _ := lookupChannel(k); chInfo.unnamed {
+		return ""
+	}
+	return displayName(k)
+}
+
+func exportProviderJSON(w http.ResponseWriter, keys []string) {
+	entries := make([][]interface{}, 0)
+	profiles := make(map[string]caProfile)
+	rules := make(map[string]tagRule)
+	for _, k := range keys {
+		chInfo, _ := lookupChannel(k)
+		entry := []interface{}{exportName(k), channelAddress(chInfo), chInfo.masterKey}
+		if attrs := channelAttrs(chInfo); len(attrs) > 0 {
+			entry = append(entry, attrs)
+		}
+		entries = append(entries, entry)
+		if chInfo.caProfile != "" {
+			l := chInfo.keyLayout
+			profiles[chInfo.caProfile] = caProfile{KeyLength: l.Length, KeyOffsets: []int{l.Offsets[0], l.Offsets[1]}}
+		}
+		for tag, r := range chInfo.tagRules {
+			rules[tag] = r
+		}
+	}
+	f := map[string]interface{}{"date": time.Now().UTC().Format(time.RFC3339), "channels": entries}
+	if len(profiles) > 0 {
+		f["ca_profiles"] = profiles
+	}
+	if len(rules) > 0 {
+		f["tag_rules"] = rules
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="channels.json"`)
+	writeJSON(w, f)
+}
+
+func exportM3U(w http.ResponseWriter, keys []string) {
+	w.Header().Set("Content-Type", "audio/x-mpegurl")
+	w.Header().Set("Content-Disposition", `attachment; filename="channels.m3u"`)
+	io.WriteString(w, "#EXTM3U\n")
+	for _, k := range keys {
+		chInfo, _ := lookupChannel(k)
+		fmt.Fprintf(w, "#EXTINF:-1%s, %s\n%s\n", extinfAttrs(k, chInfo), displayName(k), channelAddress(chInfo))
+	}
+}
+
+func exportCSV(w http.ResponseWriter, keys []string) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="channels.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"name", "address", "key", "group", "program", "caid", "ca_profile", "iface", "output", "tags", "logo", "epg_id"})
+	for _, k := range keys {
+		chInfo, _ := lookupChannel(k)
+		program := ""
+		if chInfo.program != 0 {
+			program = strconv.Itoa(int(chInfo.program))
+		}
+		cw.Write([]string{exportName(k), channelAddress(chInfo), chInfo.masterKey, chInfo.group, program,
+			formatCAIDList(chInfo.caids), chInfo.caProfile, chInfo.iface, chInfo.output, strings.Join(chInfo.tags, ","),
+			chInfo.logo, chInfo.epgID})
+	}
+	cw.Flush()
+}
+
+// exportHandler exports the lineup, format is provider-json (default), m3u
+// or csv
+func exportHandler(w http.ResponseWriter, req *http.Request) {
+	keys := visibleChannels(req)
+	switch format := req.URL.Query().Get("format"); format {
+	case "", "provider-json":
+		exportProviderJSON(w, keys)
+	case "m3u":
+		exportM3U(w, keys)
+	case "csv":
+		exportCSV(w, keys)
+	default:
+		httpError(w, req, "Unknown format "+format, http.StatusBadRequest)
+	}
+}
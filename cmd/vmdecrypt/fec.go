@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/rgerganov/vmdecrypt"
+)
+
+// SMPTE 2022-1 (Pro-MPEG COP3) FEC: the column and row FEC streams are
+// received on port+2 and port+4 of the group, a single missing RTP packet
+// in a column or row is recovered from the XOR of the others. Recovered
+// packets come late, so FEC is meant to be used with the jitter buffer.
+
+const (
+	fecHeaderSize = 16
+	fecHistory    = 1024 // media packets kept for recovery
+)
+
+type fecSource struct {
+	Source
+	addr      string
+	streams   []Source
+	fecPkts   chan []byte
+	media     map[uint16][]byte
+	order     []uint16 // sequence numbers of media, oldest first
+	latest    uint16
+	pending   [][]byte // FEC packets which may still recover something
+	recovered [][]byte
+	count     int
+	stop      chan bool
+}
+
+// openFEC adds FEC recovery to the media source of the channel
+func openFEC(media Source, chInfo ChannelInfo) (Source, error) {
+	host, portStr, _ := net.SplitHostPort(chInfo.addr)
+	port, _ := strconv.Atoi(portStr)
+	fs := &fecSource{Source: media, addr: chInfo.addr, fecPkts: make(chan []byte, 256),
+		media: make(map[uint16][]byte), stop: make(chan bool)}
+	for _, p := range []int{port + 2, port + 4} {
+		fecInfo := chInfo
+		fecInfo.addr = net.JoinHostPort(host, strconv.Itoa(p))
+		src, err := openInput(fecInfo)
+		if err != nil {
+			// the media source stays open for the caller
+			fs.closeStreams()
+			return nil, err
+		}
+		fs.streams = append(fs.streams, src)
+		go fs.receive(src)
+	}
+	return fs, nil
+}
+
+// receive reads a FEC stream, which may be missing or stop any time
+func (fs *fecSource) receive(src Source) {
+	for {
+		pkt, err := src.ReadPacket(context.Background())
+		select {
+		case <-fs.stop:
+			return
+		default:
+		}
+		if err != nil {
+			continue
+		}
+		select {
+		case fs.fecPkts <- pkt:
+		default:
+			// drop when the media stream is not read
+		}
+	}
+}
+
+func (fs *fecSource) ReadPacket(ctx context.Context) ([]byte, error) {
+	if len(fs.recovered) > 0 {
+		pkt := fs.recovered[0]
+		fs.recovered = fs.recovered[1:]
+		return pkt, nil
+	}
+	pkt, err := fs.Source.ReadPacket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if hdr, err := vmdecrypt.ParseRTP(pkt); err == nil && hdr.Offset < len(pkt) {
+		fs.addMedia(hdr.Seq, pkt)
+	}
+	newFEC := false
+	for {
+		select {
+		case f := <-fs.fecPkts:
+			fs.pending = append(fs.pending, f)
+			newFEC = true
+			continue
+		default:
+		}
+		break
+	}
+	if newFEC {
+		fs.recover()
+	}
+	return pkt, nil
+}
+
+func (fs *fecSource) addMedia(seq uint16, pkt []byte) {
+	if _, ok := fs.media[seq]; ok {
+		return
+	}
+	// the packets are decrypted in place after they are returned
+	fs.media[seq] = append([]byte(nil), pkt...)
+	fs.order = append(fs.order, seq)
+	if len(fs.order) > fecHistory {
+		delete(fs.media, fs.order[0])
+		fs.order = fs.order[1:]
+	}
+	if int16(seq-fs.latest) > 0 || len(fs.order) == 1 {
+		fs.latest = seq
+	}
+}
+
+// recover tries the pending FEC packets until nothing more is recovered
+func (fs *fecSource) recover() {
+	for progress := true; progress; {
+		progress = false
+		pending := fs.pending[:0]
+		for _, f := range fs.pending {
+			done, pkt := fs.tryFEC(f)
+			if pkt != nil {
+				fs.recovered = append(fs.recovered, pkt)
+				fs.count++
+				progress = true
+			}
+			if !done {
+				pending = append(pending, f)
+			}
+		}
+		fs.pending = pending
+	}
+}
+
+// tryFEC recovers the packet protected by f if it is the only one missing,
+// done is true when f is not needed any more
+func (fs *fecSource) tryFEC(f []byte) (bool, []byte) {
+	hdr, err := vmdecrypt.ParseRTP(f)
+	if err != nil || len(f) < hdr.Offset+fecHeaderSize {
+		return true, nil
+	}
+	fh := f[hdr.Offset : hdr.Offset+fecHeaderSize]
+	fecPayload := f[hdr.Offset+fecHeaderSize:]
+	base := binary.BigEndian.Uint16(fh[0:2])
+	offset, na := uint16(fh[13]), uint16(fh[14])
+	if offset == 0 || na == 0 {
+		return true, nil
+	}
+	if int16(fs.latest-(base+offset*(na-1))) > fecHistory/2 {
+		// too old
+		return true, nil
+	}
+	missing := -1
+	for i := uint16(0); i < na; i++ {
+		if _, ok := fs.media[base+i*offset]; !ok {
+			if missing >= 0 {
+				return false, nil
+			}
+			missing = int(i)
+		}
+	}
+	if missing < 0 {
+		return true, nil
+	}
+	length := binary.BigEndian.Uint16(fh[2:4])
+	pt := fh[4] & 0x7f
+	ts := binary.BigEndian.Uint32(fh[8:12])
+	payload := append([]byte(nil), fecPayload...)
+	var ssrc []byte
+	for i := uint16(0); i < na; i++ {
+		pkt, ok := fs.media[base+i*offset]
+		if !ok {
+			continue
+		}
+		mh, err := vmdecrypt.ParseRTP(pkt)
+		if err != nil {
+			return true, nil
+		}
+		p := pkt[mh.Offset:]
+		length ^= uint16(len(p))
+		pt ^= pkt[1] & 0x7f
+		ts ^= mh.Timestamp
+		for j := 0; j < len(p) && j < len(payload); j++ {
+			payload[j] ^= p[j]
+		}
+		ssrc = pkt[8:12]
+	}
+	if int(length) > len(payload) {
+		return true, nil
+	}
+	seq := base + uint16(missing)*offset
+	pkt := make([]byte, 12, 12+int(length))
+	pkt[0] = 0x80
+	pkt[1] = pt
+	binary.BigEndian.PutUint16(pkt[2:4], seq)
+	binary.BigEndian.PutUint32(pkt[4:8], ts)
+	copy(pkt[8:12], ssrc)
+	pkt = append(pkt, payload[:length]...)
+	fs.addMedia(seq, pkt)
+	return true, pkt
+}
+
+// closeStreams stops receiving the FEC streams
+func (fs *fecSource) closeStreams() {
+	close(fs.stop)
+	for _, src := range fs.streams {
+		src.Close()
+	}
+}
+
+func (fs *fecSource) Close() error {
+	fs.closeStreams()
+	if fs.count > 0 {
+		log.Printf("FEC recovered %d packets @ %v", fs.count, fs.addr)
+	}
+	return fs.Source.Close()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+// fecMedia returns the RTP media packet with the sequence number, 7 TS
+// packets of random payload
+func fecMedia(rnd *rand.Rand, seq uint16) []byte {
+	pkt := make([]byte, 12+7*188)
+	pkt[0], pkt[1] = 0x80, 33
+	binary.BigEndian.PutUint16(pkt[2:4], seq)
+	binary.BigEndian.PutUint32(pkt[4:8], uint32(seq)*3003)
+	binary.BigEndian.PutUint32(pkt[8:12], 0x12345678)
+	rnd.Read(pkt[12:])
+	return pkt
+}
+
+// fecPacket returns the SMPTE 2022-1 FEC packet protecting the media
+// packets base, base+offset, ... (na packets)
+func fecPacket(media map[uint16][]byte, base uint16, offset, na byte) []byte {
+	fh := make([]byte, fecHeaderSize)
+	binary.BigEndian.PutUint16(fh[0:2], base)
+	fh[13], fh[14] = offset, na
+	payload := make([]byte, 7*188)
+	var length uint16
+	var pt byte
+	var ts uint32
+	for i := 0; i < int(na); i++ {
+		pkt := media[base+uint16(i)*uint16(offset)]
+		length ^= uint16(len(pkt) - 12)
+		pt ^= pkt[1] & 0x7f
+		ts ^= binary.BigEndian.Uint32(pkt[4:8])
+		for j, b := range pkt[12:] {
+			payload[j] ^= b
+		}
+	}
+	binary.BigEndian.PutUint16(fh[2:4], length)
+	fh[4] = 0x80 | pt
+	binary.BigEndian.PutUint32(fh[8:12], ts)
+	hdr := []byte{0x80, 96, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}
+	return append(append(hdr, fh...), payload...)
+}
+
+func TestTryFEC(t *testing.T) {
+	tests := []struct {
+		name       string
+		base       uint16
+		offset, na byte
+		lost       []uint16
+		done       bool
+		recovered  bool
+	}{
+		{"row", 100, 1, 5, []uint16{102}, true, true},
+		{"first of a row", 100, 1, 5, []uint16{100}, true, true},
+		{"column", 100, 5, 4, []uint16{110}, true, true},
+		{"last of a column", 100, 5, 4, []uint16{115}, true, true},
+		{"row across the wrap", 65533, 1, 5, []uint16{0}, true, true},
+		{"column across the wrap", 65530, 4, 4, []uint16{65534}, true, true},
+		{"nothing lost", 100, 1, 5, nil, true, false},
+		{"two lost", 100, 1, 5, []uint16{101, 103}, false, false},
+		{"lost outside of the column", 100, 5, 4, []uint16{101}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rnd := rand.New(rand.NewSource(1))
+			media := make(map[uint16][]byte)
+			fs := &fecSource{media: make(map[uint16][]byte)}
+			for i := 0; i < int(tt.offset)*int(tt.na); i++ {
+				seq := tt.base + uint16(i)
+				media[seq] = fecMedia(rnd, seq)
+				lost := false
+				for _, l := range tt.lost {
+					lost = lost || l == seq
+				}
+				if !lost {
+					fs.addMedia(seq, media[seq])
+				}
+			}
+			done, pkt := fs.tryFEC(fecPacket(media, tt.base, tt.offset, tt.na))
+			if done != tt.done {
+				t.Errorf("done %v, want %v", done, tt.done)
+			}
+			if !tt.recovered {
+				if pkt != nil {
+					t.Errorf("recovered %x, want none", pkt[:12])
+				}
+				return
+			}
+			if want := media[tt.lost[0]]; !bytes.Equal(pkt, want) {
+				t.Errorf("recovered packet differs from the lost one:\n%x\n%x", pkt[:16], want[:16])
+			}
+			if _, ok := fs.media[tt.lost[0]]; !ok {
+				t.Errorf("recovered packet not added to the media")
+			}
+		})
+	}
+}
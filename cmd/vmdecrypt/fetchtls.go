@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+)
+
+// TLS settings for fetching the channels file: a client certificate for
+// endpoints which require mutual TLS and a custom CA bundle.
+
+var channelsClient = httpClient
+
+var fetchCert, fetchKey, fetchCA string
+
+func setupChannelsClient() error {
+	if fetchCert == "" && fetchKey == "" && fetchCA == "" {
+		return nil
+	}
+	config := &tls.Config{}
+	if fetchCert != "" || fetchKey != "" {
+		if fetchCert == "" || fetchKey == "" {
+			return errors.New("Both -c-cert and -c-key are required")
+		}
+		cert, err := tls.LoadX509KeyPair(fetchCert, fetchKey)
+		if err != nil {
+			return err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if fetchCA != "" {
+		pem, err := ioutil.ReadFile(fetchCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("No certificates found in " + fetchCA)
+		}
+		config.RootCAs = pool
+	}
+	transport := upstreamTransport.Clone()
+	transport.TLSClientConfig = config
+	channelsClient = &http.Client{Transport: transport, Timeout: httpClient.Timeout}
+	return nil
+}
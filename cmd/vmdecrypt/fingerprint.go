@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"net/http"
+	"strings"
+)
+
+// Content fingerprints: FNV-1a hashes of the decrypted PES payload of the
+// main stream, bucketed by PTS second. Two sources carrying the same
+// content produce the same hashes for the same PTS seconds.
+
+const fingerprintHistory = 60
+
+var videoStreamTypes = map[byte]bool{0x01: true, 0x02: true, 0x10: true, 0x1b: true, 0x24: true}
+
+type Fingerprint struct {
+	Second uint64 `json:"pts_second"`
+	Hash   string `json:"hash"`
+}
+
+type fingerprinter struct {
+	pid     uint16
+	second  uint64
+	started bool
+	h       hash.Hash64
+	history []Fingerprint
+}
+
+// mainPid returns the PID of the first video stream, or of the first
+// audio stream for radio channels
+func (ch *Channel) mainPid() (uint16, bool) {
+	var pid uint16
+	found := false
+	for p, streamType := range ch.dec.Streams() {
+		if videoStreamTypes[streamType] && (!found || p < pid) {
+			pid, found = p, true
+		}
+	}
+	if !found {
+		pid, _, found = ch.audioPid("")
+	}
+	return pid, found
+}
+
+// fingerprint must be called with decrypted packets from the decrypt goroutine
+func (ch *Channel) fingerprint(pkt []byte) {
+	fp := &ch.fp
+	if !fp.started {
+		if !ch.dec.HasKeys() {
+			return
+		}
+		pid, ok := ch.mainPid()
+		if !ok {
+			return
+		}
+		fp.pid, fp.h = pid, fnv.New64a()
+	}
+	if binary.BigEndian.Uint16(pkt[1:3])&0x1fff != fp.pid {
+		return
+	}
+	if pts, ok := pesPTS(pkt); ok {
+		second := pts / 90000
+		if fp.started && second != fp.second {
+			ch.mu.Lock()
+			fp.history = append(fp.history, Fingerprint{fp.second, fmt.Sprintf("%016x", fp.h.Sum64())})
+			if len(fp.history) > fingerprintHistory {
+				fp.history = fp.history[1:]
+			}
+			ch.mu.Unlock()
+			fp.h.Reset()
+		}
+		fp.second, fp.started = second, true
+	}
+	if fp.started {
+		fp.h.Write(pesPayload(pkt))
+	}
+}
+
+func (ch *Channel) fingerprints() []Fingerprint {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return append([]Fingerprint{}, ch.fp.history...)
+}
+
+func fingerprintHandler(w http.ResponseWriter, req *http.Request) {
+	// requestURI should be /api/fingerprint/CNN
+	chName := strings.SplitN(req.RequestURI[len("/api/fingerprint/"):], "?", 2)[0]
+	chInfo, ok := getChannel(w, req, chName)
+	if !ok {
+		return
+	}
+	runningChannelsMu.Lock()
+	ch, running := runningChannels[chInfo.sessionKey()]
+	runningChannelsMu.Unlock()
+	if !running {
+		httpError(w, req, "Channel is not running", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, ch.fingerprints())
+}
@@ -0,0 +1,32 @@
+package main
+
+// Format changes mid-stream (new PMT streams or video parameters) are
+// logged, posted to -webhook and, with -hls-restart-on-change, restart the
+// HLS transcoders of the channel, which usually break at such a change.
+
+var hlsRestartOnChange bool
+
+type formatEvent struct {
+	Event    string   `json:"event"`
+	Channels []string `json:"channels"`
+	Addr     string   `json:"addr"`
+	Session  string   `json:"session"`
+	Reason   string   `json:"reason"`
+}
+
+// formatChanged is called from the decrypting goroutine of ch
+func formatChanged(ch *Channel, chInfo ChannelInfo, reason string) {
+	ch.logf("Format change @ %v: %s", chInfo.addr, reason)
+	keys := make([]string, 0)
+	names := make([]string, 0)
+	for _, k := range sortedChannels() {
+		if other, _ := lookupChannel(k); other.sessionKey() == chInfo.sessionKey() {
+			keys = append(keys, k)
+			names = append(names, displayName(k))
+		}
+	}
+	go postEvent(formatEvent{"format_change", names, chInfo.addr, ch.id, reason})
+	if hlsRestartOnChange && hlsEnabled() {
+		go restartTranscoders(keys)
+	}
+}
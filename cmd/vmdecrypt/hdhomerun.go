@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"strconv"
+)
+
+// HDHomeRun emulation, see https://info.hdhomerun.com/info/http_api
+// Plex and Jellyfin use these endpoints to discover network tuners.
+
+var tunerCount int
+
+type hdhrDevice struct {
+	FriendlyName    string
+	Manufacturer    string
+	ModelNumber     string
+	FirmwareName    string
+	FirmwareVersion string
+	DeviceID        string
+	DeviceAuth      string
+	BaseURL         string
+	LineupURL       string
+	TunerCount      int
+}
+
+type hdhrLineupStatus struct {
+	ScanInProgress int
+	ScanPossible   int
+	Source         string
+	SourceList     []string
+}
+
+type hdhrLineupEntry struct {
+	GuideNumber string
+	GuideName   string
+	URL         string
+}
+
+func deviceID() string {
+	return fmt.Sprintf("%08X", crc32.ChecksumIEEE([]byte(httpAddr)))
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func discoverHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, hdhrDevice{
+		FriendlyName:    "vmdecrypt",
+		Manufacturer:    "Silicondust",
+		ModelNumber:     "HDTC-2US",
+		FirmwareName:    "hdhomeruntc_atsc",
+		FirmwareVersion: "20150826",
+		DeviceID:        deviceID(),
+		DeviceAuth:      "vmdecrypt",
+		BaseURL:         serverURL(),
+		LineupURL:       serverURL() + "/lineup.json",
+		TunerCount:      tunerCount,
+	})
+}
+
+// lineupStatusHandler reports that no channel scan is running, the lineup
+// is always the current channels file
+func lineupStatusHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, hdhrLineupStatus{ScanInProgress: 0, ScanPossible: 1, Source: "Cable", SourceList: []string{"Cable"}})
+}
+
+// lineupPostHandler accepts the scan requests (lineup.post?scan=start) of
+// Plex, there is nothing to scan
+func lineupPostHandler(w http.ResponseWriter, req *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// guideNumbers returns the channel numbers: the number attribute, or for
+// channels without one the numbers after the highest one in name order, so
+// that they do not depend on the playlist of the request
+func guideNumbers() map[string]int {
+	numbers := make(map[string]int)
+	last := 0
+	keys := sortedChannels()
+	for _, k := range keys {
+		chInfo, _ := lookupChannel(k)
+		if chInfo.number > last {
+			last = chInfo.number
+		}
+	}
+	for _, k := range keys {
+		chInfo, _ := lookupChannel(k)
+		if numbers[k] = chInfo.number; chInfo.number == 0 {
+			last++
+			numbers[k] = last
+		}
+	}
+	return numbers
+}
+
+func lineupHandler(w http.ResponseWriter, req *http.Request) {
+	lineup := make([]hdhrLineupEntry, 0)
+	numbers := guideNumbers()
+	for _, k := range playlistChannels(req) {
+		chName := displayName(k)
+		lineup = append(lineup, hdhrLineupEntry{
+			GuideNumber: strconv.Itoa(numbers[k]),
+			GuideName:   chName,
+			URL:         fmt.Sprintf("%s/ch/%s%s", serverURL(), k, accessQuery(req, k)),
+		})
+	}
+	writeJSON(w, lineup)
+}
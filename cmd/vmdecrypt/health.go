@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rgerganov/vmdecrypt"
+)
+
+// Per-channel error budget: channels with too many errors within
+// healthWindow are disabled for a cool-down period.
+
+const healthWindow = 10 * time.Minute
+
+var errorBudget int
+var errorCooldown time.Duration
+
+type channelHealth struct {
+	recent        []time.Time
+	counts        map[string]int // error kind => total count
+	disabledUntil time.Time
+	lastWorking   time.Time // last successfully decrypted ECM
+	lastECMError  time.Time
+}
+
+var healthMu sync.Mutex
+
+// multicast address => health
+var health = make(map[string]*channelHealth)
+
+func errorKind(err error) string {
+	if errors.Is(err, vmdecrypt.ErrECM) {
+		return "ecm"
+	}
+	return "ts"
+}
+
+func getHealth(addr string) *channelHealth {
+	h, ok := health[addr]
+	if !ok {
+		h = &channelHealth{counts: make(map[string]int)}
+		health[addr] = h
+	}
+	return h
+}
+
+func recordWorking(addr string) {
+	healthMu.Lock()
+	getHealth(addr).lastWorking = time.Now()
+	healthMu.Unlock()
+}
+
+func recordError(addr, kind string) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	h := getHealth(addr)
+	h.counts[kind]++
+	recordRotation(addr, rotationEvent{Event: "error", Kind: kind})
+	now := time.Now()
+	if kind == "ecm" {
+		h.lastECMError = now
+	}
+	recent := h.recent[:0]
+	for _, t := range h.recent {
+		if now.Sub(t) < healthWindow {
+			recent = append(recent, t)
+		}
+	}
+	h.recent = append(recent, now)
+	if errorBudget > 0 && len(h.recent) >= errorBudget && now.After(h.disabledUntil) {
+		h.disabledUntil = now.Add(errorCooldown)
+		h.recent = h.recent[:0]
+		log.Printf("Too many errors, disabling channel @ %v until %v", addr, h.disabledUntil.Format(time.RFC3339))
+	}
+}
+
+// keyFailing reports if the ECMs of the channel failed since they were last
+// decrypted
+func keyFailing(addr string) bool {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	h, ok := health[addr]
+	return ok && h.lastECMError.After(h.lastWorking)
+}
+
+// channelDisabled reports if the channel is disabled and until when
+func channelDisabled(addr string) (time.Time, bool) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	if h, ok := health[addr]; ok && time.Now().Before(h.disabledUntil) {
+		return h.disabledUntil, true
+	}
+	return time.Time{}, false
+}
+
+type healthStatus struct {
+	Addr          string         `json:"addr"`
+	Errors        map[string]int `json:"errors"`
+	DisabledUntil *time.Time     `json:"disabled_until,omitempty"`
+	LastWorking   *time.Time     `json:"last_working,omitempty"`
+}
+
+func healthStatuses() []healthStatus {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	statuses := make([]healthStatus, 0)
+	for addr, h := range health {
+		st := healthStatus{Addr: addr, Errors: make(map[string]int)}
+		for kind, n := range h.counts {
+			st.Errors[kind] = n
+		}
+		if time.Now().Before(h.disabledUntil) {
+			until := h.disabledUntil
+			st.DisabledUntil = &until
+		}
+		if !h.lastWorking.IsZero() {
+			last := h.lastWorking
+			st.LastWorking = &last
+		}
+		statuses = append(statuses, st)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Addr < statuses[j].Addr })
+	return statuses
+}
+
+// healthComment returns an M3U comment with the health of the channel
+func healthComment(addr string) string {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	h, ok := health[addr]
+	if !ok {
+		return "# never played\n"
+	}
+	last := "never"
+	if !h.lastWorking.IsZero() {
+		last = h.lastWorking.UTC().Format(time.RFC3339)
+	}
+	recent := 0
+	for _, t := range h.recent {
+		if time.Since(t) < healthWindow {
+			recent++
+		}
+	}
+	return fmt.Sprintf("# last working: %s, errors in the last %d minutes: %d\n", last, int(healthWindow.Minutes()), recent)
+}
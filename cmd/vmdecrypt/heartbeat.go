@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Heartbeats of relay clients: with -relay-heartbeat a relay is stopped
+// when its client does not call /rtp/session/<id>/keepalive within the
+// grace period, as there is no connection which tells that it is gone.
+
+var relayHeartbeat time.Duration
+
+var errNoHeartbeat = errors.New("No heartbeat from the relay client")
+
+type heartbeatWriter struct {
+	relayWriter
+	id       string
+	lastBeat atomic.Int64
+}
+
+var relaySessionsMu sync.Mutex
+
+// session id => relay output
+var relaySessions = make(map[string]*heartbeatWriter)
+
+func newHeartbeatWriter(w relayWriter, id string) *heartbeatWriter {
+	hw := &heartbeatWriter{relayWriter: w, id: id}
+	hw.beat()
+	relaySessionsMu.Lock()
+	relaySessions[id] = hw
+	relaySessionsMu.Unlock()
+	return hw
+}
+
+func (hw *heartbeatWriter) beat() {
+	hw.lastBeat.Store(time.Now().UnixNano())
+}
+
+func (hw *heartbeatWriter) deadline() time.Time {
+	return time.Unix(0, hw.lastBeat.Load()).Add(relayHeartbeat)
+}
+
+func (hw *heartbeatWriter) Write(p []byte) (int, error) {
+	if time.Now().After(hw.deadline()) {
+		return 0, errNoHeartbeat
+	}
+	return hw.relayWriter.Write(p)
+}
+
+func (hw *heartbeatWriter) Close() error {
+	relaySessionsMu.Lock()
+	delete(relaySessions, hw.id)
+	relaySessionsMu.Unlock()
+	return hw.relayWriter.Close()
+}
+
+func relayKeepaliveHandler(w http.ResponseWriter, req *http.Request, id string) {
+	relaySessionsMu.Lock()
+	hw, ok := relaySessions[id]
+	relaySessionsMu.Unlock()
+	if !ok {
+		httpError(w, req, "No such relay session", http.StatusNotFound)
+		return
+	}
+	hw.beat()
+	writeJSON(w, map[string]interface{}{"session": id, "deadline": hw.deadline()})
+}
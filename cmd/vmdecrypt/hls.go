@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HLS output with an ABR ladder. Segmenting and transcoding is done by
+// managed ffmpeg children which read the decrypted stream from /ch/.
+
+const hlsIdleTimeout = 30 * time.Second
+const hlsStartTimeout = 20 * time.Second
+
+var ffmpegPath string
+var hlsDir string
+var hlsLadder []Rendition
+var hlsLowLatency bool
+var hlsWatermark bool
+
+// extra ffmpeg options of the transcoders, "{name}" is replaced with the
+// query parameter name of the HLS request or its default in hlsParams
+var hlsProfile string
+var hlsParams map[string]string
+
+// the values end up in ffmpeg arguments and directory names
+var validParamValue = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+var profileParamRe = regexp.MustCompile(`\{(\w+)\}`)
+
+// characters which are not kept in the directory names of the transcoders
+var unsafeDirChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+type Rendition struct {
+	width   int
+	height  int
+	bitrate int // in kbps
+}
+
+type transcoder struct {
+	k          string
+	mark       string     // watermark burnt into the video, see watermarkID
+	params     url.Values // query parameters passed through to the profile
+	dir        string
+	cmd        *exec.Cmd
+	lastAccess time.Time
+	exited     chan bool
+	stopSubs   context.CancelFunc // stops segmentSubtitles
+
+	partsMu          sync.Mutex
+	independentParts map[string]bool // LL-HLS part => starts with a key frame
+}
+
+var transcodersMu sync.Mutex
+var transcoders = make(map[string]*transcoder)
+
+// parseLadder parses renditions in the form "1280x720@2800k,854x480@1200k"
+func parseLadder(s string) ([]Rendition, error) {
+	ladder := make([]Rendition, 0)
+	if s == "" {
+		return ladder, nil
+	}
+	for _, r := range strings.Split(s, ",") {
+		var rend Rendition
+		if _, err := fmt.Sscanf(r, "%dx%d@%dk", &rend.width, &rend.height, &rend.bitrate); err != nil {
+			return nil, fmt.Errorf("Invalid rendition %q, expected WIDTHxHEIGHT@BITRATEk", r)
+		}
+		ladder = append(ladder, rend)
+	}
+	return ladder, nil
+}
+
+// parseHLSParams parses the passed through query parameters with their
+// defaults in the form "preset=veryfast,crf=23" and checks that the profile
+// uses only those
+func parseHLSParams(s, profile string) (map[string]string, error) {
+	params := make(map[string]string)
+	if s != "" {
+		for _, p := range strings.Split(s, ",") {
+			name, value, ok := strings.Cut(p, "=")
+			if !ok || name == "" || !validParamValue.MatchString(value) {
+				return nil, fmt.Errorf("Invalid parameter %q, expected NAME=DEFAULT", p)
+			}
+			params[name] = value
+		}
+	}
+	for _, m := range profileParamRe.FindAllStringSubmatch(profile, -1) {
+		if _, ok := params[m[1]]; !ok {
+			return nil, fmt.Errorf("Profile parameter %s has no default in -hls-params", m[1])
+		}
+	}
+	return params, nil
+}
+
+// requestParams returns the passed through query parameters of the request
+func requestParams(req *http.Request) (url.Values, error) {
+	params := url.Values{}
+	for name := range hlsParams {
+		if v := req.URL.Query().Get(name); v != "" {
+			if !validParamValue.MatchString(v) {
+				return nil, fmt.Errorf("Invalid value of %s", name)
+			}
+			params.Set(name, v)
+		}
+	}
+	return params, nil
+}
+
+// profileArgs returns the ffmpeg options of the profile with the parameters
+// filled in
+func profileArgs(profile string, params url.Values) []string {
+	args := strings.Fields(profile)
+	for i, arg := range args {
+		args[i] = profileParamRe.ReplaceAllStringFunc(arg, func(m string) string {
+			name := m[1 : len(m)-1]
+			if v := params.Get(name); v != "" {
+				return v
+			}
+			return hlsParams[name]
+		})
+	}
+	return args
+}
+
+func hlsEnabled() bool {
+	return ffmpegPath != ""
+}
+
+func hlsSegmentTime() int {
+	if hlsLowLatency {
+		return 1
+	}
+	return 4
+}
+
+// watermarkID returns the identifier burnt into the HLS renditions for the
+// token of the request, it is derived from the token so that it does not
+// reveal it
+func watermarkID(req *http.Request) string {
+	if !hlsWatermark {
+		return ""
+	}
+	t := requestToken(req)
+	if t == nil || t == internalToken {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(t.Token))
+	return hex.EncodeToString(sum[:4])
+}
+
+func ffmpegArgs(input, dir, mark, profile string, params url.Values, restart bool) []string {
+	// the timestamps of the channel are kept for the subtitle rendition
+	args := []string{"-hide_banner", "-loglevel", "error", "-copyts", "-i", input}
+	streamMap := make([]string, 0)
+	for i := 0; i <= len(hlsLadder); i++ {
+		args = append(args, "-map", "0:v:0", "-map", "0:a:0")
+		streamMap = append(streamMap, fmt.Sprintf("v:%d,a:%d", i, i))
+		if mark != "" {
+			args = append(args, "-filter:v:"+strconv.Itoa(i),
+				"drawtext=text="+mark+":x=w-tw-10:y=h-th-10:fontsize=h/30:fontcolor=white@0.4")
+		}
+	}
+	if mark != "" {
+		// the overlay requires re-encoding the original rendition too
+		args = append(args, "-c:v:0", "libx264", "-preset", "veryfast", "-c:a:0", "copy")
+	} else {
+		args = append(args, "-c:v:0", "copy", "-c:a:0", "copy")
+	}
+	for i, r := range hlsLadder {
+		n := strconv.Itoa(i + 1)
+		args = append(args,
+			"-c:v:"+n, "libx264", "-preset", "veryfast",
+			"-b:v:"+n, fmt.Sprintf("%dk", r.bitrate),
+			"-s:v:"+n, fmt.Sprintf("%dx%d", r.width, r.height),
+			"-c:a:"+n, "aac", "-b:a:"+n, "128k")
+	}
+	args = append(args, profileArgs(profile, params)...)
+	flags := "delete_segments+independent_segments"
+	hlsTime, listSize := strconv.Itoa(hlsSegmentTime()), "6"
+	if hlsLowLatency {
+		// the "segments" of ffmpeg are the parts, cut without waiting for
+		// key frames and renamed when they are complete
+		flags = "delete_segments+split_by_time+temp_file"
+		hlsTime = strconv.FormatFloat(llPartTime, 'f', -1, 64)
+		listSize = strconv.Itoa(10 * llPartsPerSegment)
+	}
+	if restart {
+		// continue the playlists of the previous run after a discontinuity
+		flags += "+append_list+discont_start"
+	}
+	return append(args,
+		"-f", "hls",
+		"-hls_time", hlsTime,
+		"-hls_list_size", listSize,
+		"-hls_flags", flags,
+		"-var_stream_map", strings.Join(streamMap, " "),
+		"-hls_segment_filename", filepath.Join(dir, "stream_%v_%d.ts"),
+		filepath.Join(dir, "stream_%v.m3u8"))
+}
+
+// startTranscoder starts the transcoder of the channel, with a watermark
+// or profile parameters there is a separate transcoder for every mark and
+// parameter set
+func startTranscoder(k, mark string, params url.Values) (*transcoder, error) {
+	transcodersMu.Lock()
+	defer transcodersMu.Unlock()
+	key := k
+	if mark != "" {
+		key = k + "@" + mark
+	}
+	names := make([]string, 0)
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		key += "+" + name + "=" + params.Get(name)
+	}
+	if t, ok := transcoders[key]; ok {
+		t.lastAccess = time.Now()
+		return t, nil
+	}
+	dir, err := transcoderDir(key)
+	if err != nil {
+		return nil, err
+	}
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &transcoder{k: k, mark: mark, params: params, dir: dir, lastAccess: time.Now(), exited: make(chan bool), stopSubs: cancel}
+	if err := t.start(key, false); err != nil {
+		cancel()
+		return nil, err
+	}
+	go t.segmentSubtitles(ctx)
+	return t, nil
+}
+
+// transcoderDir returns the directory of the transcoder with the given key,
+// the key is made of the channel name and request parameters, so it is only
+// used sanitized and with its hash
+func transcoderDir(key string) (string, error) {
+	name := unsafeDirChars.ReplaceAllString(key, "_")
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	sum := sha256.Sum256([]byte(key))
+	dir := filepath.Join(hlsDir, name+"-"+hex.EncodeToString(sum[:8]))
+	if rel, err := filepath.Rel(hlsDir, dir); err != nil || strings.Contains(rel, string(filepath.Separator)) || rel == ".." {
+		return "", fmt.Errorf("Invalid transcoder directory %s", dir)
+	}
+	return dir, nil
+}
+
+// start runs ffmpeg for t, must be called with transcodersMu held
+func (t *transcoder) start(key string, restart bool) error {
+	input := fmt.Sprintf("%s/ch/%s%s", serverURL(), t.k, accessQuery(nil, t.k))
+	chInfo, _ := lookupChannel(t.k)
+	t.cmd = exec.Command(ffmpegPath, ffmpegArgs(input, t.dir, t.mark, chInfo.hlsProfile(), t.params, restart)...)
+	t.cmd.Stderr = os.Stderr
+	if err := t.cmd.Start(); err != nil {
+		return err
+	}
+	transcoders[key] = t
+	log.Println("Started transcoder for", key)
+	go func() {
+		err := t.cmd.Wait()
+		log.Printf("Transcoder for %s exited: %v", key, err)
+		transcodersMu.Lock()
+		// a restarted transcoder keeps the directory
+		replaced := transcoders[key] != nil && transcoders[key] != t
+		if transcoders[key] == t {
+			delete(transcoders, key)
+		}
+		transcodersMu.Unlock()
+		if !replaced {
+			t.stopSubs()
+			os.RemoveAll(t.dir)
+		}
+		close(t.exited)
+	}()
+	return nil
+}
+
+// restartTranscoders restarts the transcoders of the channels, e.g. after a
+// format change, their playlists continue after a discontinuity
+func restartTranscoders(keys []string) {
+	restart := make(map[string]bool)
+	for _, k := range keys {
+		restart[k] = true
+	}
+	transcodersMu.Lock()
+	defer transcodersMu.Unlock()
+	for key, t := range transcoders {
+		if !restart[t.k] {
+			continue
+		}
+		log.Println("Restarting transcoder for", key)
+		next := &transcoder{k: t.k, mark: t.mark, params: t.params, dir: t.dir, lastAccess: t.lastAccess, exited: make(chan bool), stopSubs: t.stopSubs}
+		t.cmd.Process.Kill()
+		if err := next.start(key, true); err != nil {
+			log.Println(err)
+			delete(transcoders, key)
+		}
+	}
+}
+
+// stopTranscoders stops all the transcoders, e.g. on shutdown
+func stopTranscoders() {
+	transcodersMu.Lock()
+	defer transcodersMu.Unlock()
+	for k, t := range transcoders {
+		t.cmd.Process.Kill()
+		delete(transcoders, k)
+	}
+}
+
+func reapTranscoders() {
+	for range time.Tick(hlsIdleTimeout / 2) {
+		transcodersMu.Lock()
+		for k, t := range transcoders {
+			if time.Since(t.lastAccess) > hlsIdleTimeout {
+				log.Println("No more HLS clients, stopping transcoder for", k)
+				t.cmd.Process.Kill()
+				delete(transcoders, k)
+			}
+		}
+		transcodersMu.Unlock()
+	}
+}
+
+// waitFile waits until ffmpeg produces the given file
+func (t *transcoder) waitFile(name string) error {
+	deadline := time.Now().Add(hlsStartTimeout)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(filepath.Join(t.dir, name)); err == nil {
+			return nil
+		}
+		select {
+		case <-t.exited:
+			return errors.New("Transcoder exited")
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+	return errors.New("Timeout waiting for transcoder")
+}
+
+// sourceBandwidth estimates the bandwidth of the passthrough variant from
+// its first segment
+func (t *transcoder) sourceBandwidth() int {
+	f, err := os.Open(filepath.Join(t.dir, "stream_0.m3u8"))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	duration := 0.0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#EXTINF:") {
+			duration, _ = strconv.ParseFloat(strings.TrimSuffix(line[8:], ","), 64)
+		} else if line != "" && !strings.HasPrefix(line, "#") && duration > 0 {
+			fi, err := os.Stat(filepath.Join(t.dir, line))
+			if err != nil {
+				return 0
+			}
+			return int(float64(fi.Size()*8) / duration)
+		}
+	}
+	return 0
+}
+
+// readPlaylist returns the media playlist and the sequence number of its
+// last segment
+func (t *transcoder) readPlaylist(name string) ([]byte, int, error) {
+	data, err := os.ReadFile(filepath.Join(t.dir, name))
+	if err != nil {
+		return nil, 0, err
+	}
+	seq, count := 0, 0
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:") {
+			seq, _ = strconv.Atoi(line[22:])
+		} else if strings.HasPrefix(line, "#EXTINF:") {
+			count++
+		}
+	}
+	return data, seq + count - 1, nil
+}
+
+// query returns the query of the URLs in the playlists of t
+func (t *transcoder) query(req *http.Request) string {
+	q := accessQuery(req, t.k)
+	if len(t.params) == 0 {
+		return q
+	}
+	if q == "" {
+		return "?" + t.params.Encode()
+	}
+	return q + "&" + t.params.Encode()
+}
+
+// servePlaylist implements blocking playlist reload: when _HLS_msn is
+// given, the response is delayed until that segment is available
+func (t *transcoder) servePlaylist(w http.ResponseWriter, req *http.Request, name string) {
+	if hlsLowLatency {
+		t.serveLLPlaylist(w, req, strings.TrimSuffix(strings.TrimPrefix(name, "stream_"), ".m3u8"))
+		return
+	}
+	msn, err := strconv.Atoi(req.URL.Query().Get("_HLS_msn"))
+	if err != nil {
+		msn = -1
+	}
+	deadline := time.Now().Add(3 * time.Duration(hlsSegmentTime()) * time.Second)
+	for {
+		data, last, err := t.readPlaylist(name)
+		if err != nil {
+			httpError(w, req, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if msn > last+2 {
+			httpError(w, req, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if msn <= last {
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			if w.Header().Get("Cache-Control") == "" {
+				w.Header().Set("Cache-Control", "no-cache")
+			}
+			io.WriteString(w, "#EXTM3U\n#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES\n")
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n")[1:] {
+				if line != "" && !strings.HasPrefix(line, "#") {
+					line += t.query(req)
+				}
+				io.WriteString(w, line+"\n")
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			httpError(w, req, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		select {
+		case <-t.exited:
+			httpError(w, req, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		case <-req.Context().Done():
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func (t *transcoder) writeMaster(w io.Writer, req *http.Request) {
+	if hlsLowLatency {
+		// the parts and thus the segments may start without a key frame
+		io.WriteString(w, "#EXTM3U\n#EXT-X-VERSION:6\n")
+	} else {
+		io.WriteString(w, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+	}
+	subs := ""
+	if t.hasSubtitles() {
+		fmt.Fprintf(w, "#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",NAME=\"Teletext\",DEFAULT=NO,AUTOSELECT=YES,URI=\"%s%s\"\n",
+			subsPlaylist, t.query(req))
+		subs = ",SUBTITLES=\"subs\""
+	}
+	fmt.Fprintf(w, "#EXT-X-STREAM-INF:BANDWIDTH=%d%s\nstream_0.m3u8%s\n", t.sourceBandwidth(), subs, t.query(req))
+	for i, r := range hlsLadder {
+		fmt.Fprintf(w, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d%s\nstream_%d.m3u8%s\n",
+			(r.bitrate+128)*1000, r.width, r.height, subs, i+1, t.query(req))
+	}
+}
+
+func hlsHandler(w http.ResponseWriter, req *http.Request) {
+	// requestURI should be /hls/CNN/master.m3u8
+	parts := strings.Split(req.URL.EscapedPath()[5:], "/")
+	if len(parts) != 2 {
+		httpError(w, req, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	k, name := parts[0], filepath.Base(parts[1])
+	chInfo, ok := getChannel(w, req, k)
+	if !ok {
+		return
+	}
+	chInfo.setHeaders(w)
+	params, err := requestParams(req)
+	if err != nil {
+		httpError(w, req, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mark := watermarkID(req)
+	if mark != "" && name == "master.m3u8" {
+		reqLogf(req, "HLS of %s for token %s is watermarked with %s", k, requestToken(req).Name, mark)
+	}
+	t, err := startTranscoder(k, mark, params)
+	if err != nil {
+		reqLogf(req, "%v", err)
+		httpError(w, req, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if name == "master.m3u8" {
+		if err := t.waitFile("stream_0.m3u8"); err != nil {
+			reqLogf(req, "%v @ %v", err, k)
+			httpError(w, req, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		t.writeMaster(w, req)
+		return
+	}
+	if name == subsPlaylist {
+		t.serveSubsPlaylist(w, req)
+		return
+	}
+	if strings.HasSuffix(name, ".m3u8") {
+		t.servePlaylist(w, req, name)
+		return
+	}
+	if hlsLowLatency {
+		if m := llSegmentName.FindStringSubmatch(name); m != nil {
+			msn, err := strconv.Atoi(m[2])
+			if err != nil {
+				httpError(w, req, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			t.serveLLSegment(w, req, chInfo, m[1], msn)
+			return
+		}
+		// the preload hint is requested before ffmpeg writes the part
+		if llPartName.MatchString(name) && !t.waitPart(req, name) {
+			httpError(w, req, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(t.dir, name)); err == nil {
+		if !requestToken(req).consume(int(fi.Size())) {
+			httpError(w, req, "Quota exceeded", http.StatusForbidden)
+			return
+		}
+		usageServed(chInfo.addr, int(fi.Size()))
+	}
+	http.ServeFile(w, req, filepath.Join(t.dir, name))
+}
+
+func hlsURL(k string) string {
+	return fmt.Sprintf("%s/hls/%s/master.m3u8", serverURL(), k)
+}
+
+func startHLS(ladder, params string) {
+	var err error
+	hlsLadder, err = parseLadder(ladder)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if hlsParams, err = parseHLSParams(params, hlsProfile); err != nil {
+		log.Fatal(err)
+	}
+	if hlsDir == "" {
+		hlsDir = filepath.Join(os.TempDir(), "vmdecrypt-hls")
+	}
+	http.HandleFunc("/hls/", hlsHandler)
+	go reapTranscoders()
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LL-HLS partial segments: with -hls-ll ffmpeg cuts the variants into short
+// parts, and the media playlists group llPartsPerSegment consecutive parts
+// into a segment, which is served as the concatenation of its parts. The
+// playlists advertise the parts (EXT-X-PART) and the next one
+// (EXT-X-PRELOAD-HINT), whose request blocks until ffmpeg has written it.
+
+// duration of the parts cut by ffmpeg, they can be a frame longer
+const llPartTime = 0.3
+const llPartTarget = 0.4
+const llPartsPerSegment = 3
+
+// how many segments at the end of the playlist list their parts
+const llPartSegments = 3
+
+// PID of the video of the variants, the first PID of the ffmpeg TS muxer
+const llVideoPid = 0x100
+
+var llPartName = regexp.MustCompile(`^stream_(\d+)_(\d+)\.ts$`)
+var llSegmentName = regexp.MustCompile(`^segment_(\d+)_(\d+)\.ts$`)
+
+type llPart struct {
+	seq           int
+	name          string
+	duration      float64
+	discontinuity bool
+}
+
+// readParts returns the parts in the ffmpeg playlist of the variant
+func (t *transcoder) readParts(variant string) ([]llPart, error) {
+	data, err := os.ReadFile(filepath.Join(t.dir, "stream_"+variant+".m3u8"))
+	if err != nil {
+		return nil, err
+	}
+	parts := make([]llPart, 0)
+	seq, duration, discontinuity := 0, 0.0, false
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			seq, _ = strconv.Atoi(line[22:])
+		case strings.HasPrefix(line, "#EXTINF:"):
+			duration, _ = strconv.ParseFloat(strings.TrimSuffix(line[8:], ","), 64)
+		case line == "#EXT-X-DISCONTINUITY":
+			discontinuity = true
+		case line != "" && !strings.HasPrefix(line, "#"):
+			parts = append(parts, llPart{seq, line, duration, discontinuity})
+			seq, discontinuity = seq+1, false
+		}
+	}
+	return parts, nil
+}
+
+// independent reports if the part starts with a key frame, i.e. the first
+// PES of the video has the random access indicator
+func (t *transcoder) independent(name string) bool {
+	t.partsMu.Lock()
+	defer t.partsMu.Unlock()
+	if ind, ok := t.independentParts[name]; ok {
+		return ind
+	}
+	data, err := os.ReadFile(filepath.Join(t.dir, name))
+	if err != nil {
+		return false
+	}
+	ind := false
+	for i := 0; i+188 <= len(data); i += 188 {
+		pkt := data[i : i+188]
+		if binary.BigEndian.Uint16(pkt[1:3])&0x1fff != llVideoPid || pkt[1]&0x40 == 0 {
+			continue
+		}
+		ind = pkt[3]&0x20 != 0 && pkt[4] > 0 && pkt[5]&0x40 != 0
+		break
+	}
+	if t.independentParts == nil || len(t.independentParts) > 100*llPartsPerSegment {
+		// forget the parts deleted by ffmpeg
+		t.independentParts = make(map[string]bool)
+	}
+	t.independentParts[name] = ind
+	return ind
+}
+
+// writePart writes the EXT-X-PART line of the part
+func (t *transcoder) writePart(w io.Writer, p llPart, query string) {
+	independent := ""
+	if t.independent(p.name) {
+		independent = ",INDEPENDENT=YES"
+	}
+	fmt.Fprintf(w, "#EXT-X-PART:DURATION=%.3f,URI=\"%s%s\"%s\n", p.duration, p.name, query, independent)
+}
+
+// serveLLPlaylist serves the media playlist of the variant with its parts.
+// With _HLS_msn (and _HLS_part) the response is delayed until that segment
+// (or part) is available.
+func (t *transcoder) serveLLPlaylist(w http.ResponseWriter, req *http.Request, variant string) {
+	q := req.URL.Query()
+	msn, err := strconv.Atoi(q.Get("_HLS_msn"))
+	if err != nil {
+		msn = -1
+	}
+	// the sequence number of the part to wait for
+	want := -1
+	if msn >= 0 {
+		want = (msn+1)*llPartsPerSegment - 1
+		if part, err := strconv.Atoi(q.Get("_HLS_part")); err == nil {
+			if part < 0 || part >= llPartsPerSegment {
+				httpError(w, req, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			want = msn*llPartsPerSegment + part
+		}
+	}
+	deadline := time.Now().Add(3 * time.Duration(hlsSegmentTime()) * time.Second)
+	for {
+		parts, err := t.readParts(variant)
+		if err != nil {
+			httpError(w, req, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		last := -1
+		if len(parts) > 0 {
+			last = parts[len(parts)-1].seq
+		}
+		if msn > last/llPartsPerSegment+2 {
+			httpError(w, req, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if want <= last {
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			if w.Header().Get("Cache-Control") == "" {
+				w.Header().Set("Cache-Control", "no-cache")
+			}
+			t.writeLLPlaylist(w, variant, parts, t.query(req))
+			return
+		}
+		if time.Now().After(deadline) {
+			httpError(w, req, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		select {
+		case <-t.exited:
+			httpError(w, req, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		case <-req.Context().Done():
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func (t *transcoder) writeLLPlaylist(w io.Writer, variant string, parts []llPart, query string) {
+	// the first segment starts with the first part of a segment
+	for len(parts) > 0 && parts[0].seq%llPartsPerSegment != 0 {
+		parts = parts[1:]
+	}
+	segments := make([][]llPart, 0)
+	for len(parts) > 0 {
+		n := 1
+		for n < len(parts) && parts[n].seq/llPartsPerSegment == parts[0].seq/llPartsPerSegment {
+			n++
+		}
+		segments = append(segments, parts[:n])
+		parts = parts[n:]
+	}
+	// the last segment is complete when it has all its parts
+	var pending []llPart
+	if n := len(segments); n > 0 && len(segments[n-1]) < llPartsPerSegment {
+		pending = segments[n-1]
+		segments = segments[:n-1]
+	}
+	target := 1.0
+	for _, seg := range segments {
+		target = math.Max(target, segmentDuration(seg))
+	}
+	io.WriteString(w, "#EXTM3U\n#EXT-X-VERSION:6\n")
+	fmt.Fprintf(w, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target)))
+	fmt.Fprintf(w, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*llPartTarget)
+	fmt.Fprintf(w, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", llPartTarget)
+	msn := 0
+	if len(segments) > 0 {
+		msn = segments[0][0].seq / llPartsPerSegment
+	} else if len(pending) > 0 {
+		msn = pending[0].seq / llPartsPerSegment
+	}
+	fmt.Fprintf(w, "#EXT-X-MEDIA-SEQUENCE:%d\n", msn)
+	for i, seg := range segments {
+		if discontinuous(seg) {
+			io.WriteString(w, "#EXT-X-DISCONTINUITY\n")
+		}
+		if i >= len(segments)-llPartSegments {
+			for _, p := range seg {
+				t.writePart(w, p, query)
+			}
+		}
+		fmt.Fprintf(w, "#EXTINF:%.3f,\nsegment_%s_%d.ts%s\n", segmentDuration(seg), variant, seg[0].seq/llPartsPerSegment, query)
+	}
+	next := msn * llPartsPerSegment
+	if len(pending) > 0 {
+		if discontinuous(pending) {
+			io.WriteString(w, "#EXT-X-DISCONTINUITY\n")
+		}
+		for _, p := range pending {
+			t.writePart(w, p, query)
+		}
+		next = pending[len(pending)-1].seq + 1
+	} else if len(segments) > 0 {
+		seg := segments[len(segments)-1]
+		next = seg[len(seg)-1].seq + 1
+	}
+	fmt.Fprintf(w, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"stream_%s_%d.ts%s\"\n", variant, next, query)
+}
+
+// discontinuous reports if the transcoder restarted within the parts, the
+// discontinuity is signaled at the start of their segment
+func discontinuous(parts []llPart) bool {
+	for _, p := range parts {
+		if p.discontinuity {
+			return true
+		}
+	}
+	return false
+}
+
+func segmentDuration(parts []llPart) float64 {
+	d := 0.0
+	for _, p := range parts {
+		d += p.duration
+	}
+	return d
+}
+
+// waitPart waits until ffmpeg has written the part, which is renamed to its
+// name when it is complete
+func (t *transcoder) waitPart(req *http.Request, name string) bool {
+	deadline := time.Now().Add(3 * time.Duration(hlsSegmentTime()) * time.Second)
+	for {
+		if _, err := os.Stat(filepath.Join(t.dir, name)); err == nil {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		select {
+		case <-t.exited:
+			return false
+		case <-req.Context().Done():
+			return false
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// serveLLSegment serves a segment as the concatenation of its parts
+func (t *transcoder) serveLLSegment(w http.ResponseWriter, req *http.Request, chInfo ChannelInfo, variant string, msn int) {
+	parts := make([][]byte, 0)
+	size := 0
+	for seq := msn * llPartsPerSegment; seq < (msn+1)*llPartsPerSegment; seq++ {
+		name := fmt.Sprintf("stream_%s_%d.ts", variant, seq)
+		if !t.waitPart(req, name) {
+			httpError(w, req, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		data, err := os.ReadFile(filepath.Join(t.dir, name))
+		if err != nil {
+			httpError(w, req, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		parts = append(parts, data)
+		size += len(data)
+	}
+	if !requestToken(req).consume(size) {
+		httpError(w, req, "Quota exceeded", http.StatusForbidden)
+		return
+	}
+	usageServed(chInfo.addr, size)
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+	for _, data := range parts {
+		if _, err := w.Write(data); err != nil {
+			return
+		}
+	}
+}
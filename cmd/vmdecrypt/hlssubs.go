@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WebVTT subtitle rendition of the HLS master playlist: the teletext cues
+// of the channel are cut into segments of the HLS segment time by their
+// PTS. ffmpeg keeps the timestamps of the channel (-copyts), so the
+// X-TIMESTAMP-MAP of the segments maps the cues onto the video.
+
+const subsPlaylist = "subs.m3u8"
+
+// segments in the subtitle playlist
+const subsListSize = 6
+
+// segmentSubtitles writes the subtitle segments and playlist of t until ctx
+// is done, channels without teletext get none
+func (t *transcoder) segmentSubtitles(ctx context.Context) {
+	chInfo, ok := lookupChannel(t.k)
+	if !ok {
+		return
+	}
+	ch := attachChannel(chInfo)
+	defer detachChannel(chInfo)
+	segTime := uint64(hlsSegmentTime()) * 90000
+	ptr := ch.currentPtr()
+	var val interface{}
+	var dec *teletextDecoder
+	var txtPid uint16
+	var pes []byte
+	var pts, segStart uint64
+	var cues strings.Builder
+	seq := 0
+	for {
+		ptr, val = ch.nextPtr(ctx, ptr)
+		if val == nil {
+			return
+		}
+		pkt := val.([]byte)
+		if dec == nil {
+			var page uint16
+			if txtPid, page = ch.dec.Teletext(); txtPid == 0 {
+				if ch.dec.PMT() != nil {
+					return
+				}
+				continue
+			}
+			dec = &teletextDecoder{page: page}
+			t.writeSubsPlaylist(seq)
+		}
+		if binary.BigEndian.Uint16(pkt[1:3])&0x1fff != txtPid {
+			continue
+		}
+		newPTS, ok := pesPTS(pkt)
+		if !ok {
+			if pes != nil {
+				pes = append(pes, pesPayload(pkt)...)
+			}
+			continue
+		}
+		if pes != nil {
+			cues.WriteString(dec.processPES(pes, pts))
+		} else {
+			segStart = newPTS
+		}
+		pes, pts = pesPayload(pkt), newPTS
+		for (newPTS-segStart)&(1<<33-1) >= segTime {
+			// the cue times are relative to the first PTS of the decoder
+			data := fmt.Sprintf("WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:%d,LOCAL:00:00:00.000\n\n%s", dec.basePTS, cues.String())
+			if err := os.WriteFile(filepath.Join(t.dir, fmt.Sprintf("subs_%d.vtt", seq)), []byte(data), 0600); err != nil {
+				return
+			}
+			os.Remove(filepath.Join(t.dir, fmt.Sprintf("subs_%d.vtt", seq-2*subsListSize)))
+			seq++
+			t.writeSubsPlaylist(seq)
+			cues.Reset()
+			segStart += segTime
+		}
+	}
+}
+
+// writeSubsPlaylist writes the subtitle playlist with the segments before
+// seq
+func (t *transcoder) writeSubsPlaylist(seq int) {
+	first := seq - subsListSize
+	if first < 0 {
+		first = 0
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n", hlsSegmentTime(), first)
+	for i := first; i < seq; i++ {
+		fmt.Fprintf(&b, "#EXTINF:%d.000,\nsubs_%d.vtt\n", hlsSegmentTime(), i)
+	}
+	tmp := filepath.Join(t.dir, subsPlaylist+".tmp")
+	if os.WriteFile(tmp, []byte(b.String()), 0600) == nil {
+		os.Rename(tmp, filepath.Join(t.dir, subsPlaylist))
+	}
+}
+
+// hasSubtitles reports if t has a subtitle rendition
+func (t *transcoder) hasSubtitles() bool {
+	_, err := os.Stat(filepath.Join(t.dir, subsPlaylist))
+	return err == nil
+}
+
+func (t *transcoder) serveSubsPlaylist(w http.ResponseWriter, req *http.Request) {
+	data, err := os.ReadFile(filepath.Join(t.dir, subsPlaylist))
+	if err != nil {
+		httpError(w, req, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			line += t.query(req)
+		}
+		io.WriteString(w, line+"\n")
+	}
+}
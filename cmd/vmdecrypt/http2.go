@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// HTTP/2 without TLS (prior knowledge, as spoken by reverse proxies and
+// h2c-capable clients) next to HTTP/1.1, so the API, playlists and HLS
+// segments share one connection. Players of the raw TS channels keep
+// using HTTP/1.1 with chunked encoding as they never speak h2c. With TLS
+// HTTP/2 is negotiated with ALPN instead.
+
+var http2Streams int // -http2-streams, 0 = HTTP/1.1 only
+
+// idle keep-alive connections are closed after this time
+const httpIdleTimeout = 2 * time.Minute
+
+func configureHTTP(srv *http.Server) {
+	srv.IdleTimeout = httpIdleTimeout
+	if http2Streams == 0 {
+		return
+	}
+	srv.Protocols = new(http.Protocols)
+	srv.Protocols.SetHTTP1(true)
+	if tlsEnabled() {
+		srv.Protocols.SetHTTP2(true)
+	} else {
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	srv.HTTP2 = &http.HTTP2Config{
+		MaxConcurrentStreams: http2Streams,
+		// segments are small, a connection does not need more than this
+		MaxReceiveBufferPerConnection: 1 << 20,
+		MaxReceiveBufferPerStream:     256 << 10,
+		SendPingTimeout:               30 * time.Second,
+		PingTimeout:                   15 * time.Second,
+	}
+}
@@ -0,0 +1,117 @@
+//go:build impair
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Packet impairment for testing the receive path, built only with
+// "-tags impair". Example: -impair loss=0.01,reorder=0.02,dup=0.01,delay=5ms,seed=1
+
+type impairment struct {
+	loss    float64
+	reorder float64
+	dup     float64
+	delay   time.Duration
+	seed    int64
+}
+
+var impairSpec string
+
+func init() {
+	flag.StringVar(&impairSpec, "impair", "", "Inject loss, reordering, duplication and delay into the receive path")
+}
+
+func parseImpairment(s string) (impairment, error) {
+	imp := impairment{seed: 1}
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return imp, fmt.Errorf("Invalid impairment %q", kv)
+		}
+		var err error
+		switch parts[0] {
+		case "loss":
+			imp.loss, err = strconv.ParseFloat(parts[1], 64)
+		case "reorder":
+			imp.reorder, err = strconv.ParseFloat(parts[1], 64)
+		case "dup":
+			imp.dup, err = strconv.ParseFloat(parts[1], 64)
+		case "delay":
+			imp.delay, err = time.ParseDuration(parts[1])
+		case "seed":
+			imp.seed, err = strconv.ParseInt(parts[1], 10, 64)
+		default:
+			err = fmt.Errorf("Unknown impairment %q", parts[0])
+		}
+		if err != nil {
+			return imp, err
+		}
+	}
+	return imp, nil
+}
+
+type impairedReader struct {
+	r       packetReader
+	imp     impairment
+	rnd     *rand.Rand
+	pending [][]byte
+}
+
+func (ir *impairedReader) read(b []byte) (int, error) {
+	for {
+		n, _, err := ir.r.ReadFrom(b)
+		if err != nil {
+			return n, err
+		}
+		if ir.rnd.Float64() >= ir.imp.loss {
+			return n, nil
+		}
+	}
+}
+
+func (ir *impairedReader) ReadFrom(b []byte) (int, net.IP, error) {
+	if len(ir.pending) > 0 {
+		n := copy(b, ir.pending[0])
+		ir.pending = ir.pending[1:]
+		return n, nil, nil
+	}
+	n, err := ir.read(b)
+	if err != nil {
+		return n, nil, err
+	}
+	if ir.imp.delay > 0 {
+		time.Sleep(time.Duration(ir.rnd.Int63n(int64(ir.imp.delay))))
+	}
+	if ir.rnd.Float64() < ir.imp.dup {
+		ir.pending = append(ir.pending, append([]byte(nil), b[:n]...))
+	}
+	if ir.rnd.Float64() < ir.imp.reorder {
+		// deliver the next packet first
+		held := append([]byte(nil), b[:n]...)
+		if n, err = ir.read(b); err != nil {
+			return n, nil, err
+		}
+		ir.pending = append(ir.pending, held)
+	}
+	return n, nil, nil
+}
+
+func impairReader(r packetReader) packetReader {
+	if impairSpec == "" {
+		return r
+	}
+	imp, err := parseImpairment(impairSpec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &impairedReader{r: r, imp: imp, rnd: rand.New(rand.NewSource(imp.seed))}
+}
@@ -0,0 +1,7 @@
+//go:build !impair
+
+package main
+
+func impairReader(r packetReader) packetReader {
+	return r
+}
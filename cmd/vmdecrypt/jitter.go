@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// RTP jitter buffer: with -jitter-depth the datagrams of a channel are
+// released in sequence order, missing ones are waited for until the buffer
+// is full or the oldest held datagram waited -jitter-latency.
+
+var jitterDepth int
+var jitterLatency time.Duration
+
+type jitterPacket struct {
+	payload []byte
+	offset  int
+	arrival time.Time
+}
+
+type jitterBuffer struct {
+	slots   []*jitterPacket // indexed by sequence number modulo size
+	next    uint16          // next sequence number to release
+	started bool
+	held    int
+	latency time.Duration
+	ready   []*jitterPacket
+}
+
+func newJitterBuffer(depth int, latency time.Duration) *jitterBuffer {
+	// a power of two, so the slots stay right across sequence wraps
+	size := 1
+	for size < depth && size < 1<<15 {
+		size <<= 1
+	}
+	return &jitterBuffer{slots: make([]*jitterPacket, size), latency: latency}
+}
+
+// advance moves past the next sequence number, releasing its packet if held
+func (jb *jitterBuffer) advance() {
+	i := int(jb.next) & (len(jb.slots) - 1)
+	if p := jb.slots[i]; p != nil {
+		jb.ready = append(jb.ready, p)
+		jb.slots[i] = nil
+		jb.held--
+	}
+	jb.next++
+}
+
+func (jb *jitterBuffer) flush() {
+	for jb.held > 0 {
+		jb.advance()
+	}
+}
+
+// push adds an RTP datagram and returns the ones which can be processed
+func (jb *jitterBuffer) push(p *jitterPacket) []*jitterPacket {
+	jb.ready = jb.ready[:0]
+	seq := binary.BigEndian.Uint16(p.payload[2:4])
+	if !jb.started {
+		jb.next = seq
+		jb.started = true
+	}
+	d := int(int16(seq - jb.next))
+	if d < -len(jb.slots) || d >= 2*len(jb.slots) {
+		// the sender restarted or a long outage, start over
+		jb.flush()
+		jb.next = seq
+		d = 0
+	}
+	if d < 0 {
+		// too late or a duplicate
+		return jb.ready
+	}
+	for ; d >= len(jb.slots); d-- {
+		jb.advance()
+	}
+	i := int(seq) & (len(jb.slots) - 1)
+	if jb.slots[i] != nil {
+		return jb.ready
+	}
+	jb.slots[i] = p
+	jb.held++
+	for jb.slots[int(jb.next)&(len(jb.slots)-1)] != nil {
+		jb.advance()
+	}
+	// stop waiting for the missing packets in front of old ones
+	for jb.held > 0 {
+		first := jb.next
+		for jb.slots[int(first)&(len(jb.slots)-1)] == nil {
+			first++
+		}
+		if p.arrival.Sub(jb.slots[int(first)&(len(jb.slots)-1)].arrival) < jb.latency {
+			break
+		}
+		for jb.next != first {
+			jb.advance()
+		}
+		for jb.slots[int(jb.next)&(len(jb.slots)-1)] != nil {
+			jb.advance()
+		}
+	}
+	return jb.ready
+}
+
+// growRingForJitter enlarges the ring buffers, so the datagrams released at
+// once by the jitter buffer (up to 7 TS packets each) do not overrun clients
+func growRingForJitter() {
+	if jitterDepth > 1 && RingSize < 64+7*jitterDepth {
+		RingSize = 64 + 7*jitterDepth
+	}
+}
@@ -0,0 +1,59 @@
+//go:build impair
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// seqReader returns n RTP headers with consecutive sequence numbers
+type seqReader struct {
+	seq uint16
+	n   int
+}
+
+func (r *seqReader) ReadFrom(b []byte) (int, net.IP, error) {
+	if r.n == 0 {
+		return 0, nil, io.EOF
+	}
+	r.n--
+	b[0], b[1] = 0x80, 33
+	binary.BigEndian.PutUint16(b[2:4], r.seq)
+	r.seq++
+	return 12, nil, nil
+}
+
+func TestJitterBufferImpaired(t *testing.T) {
+	const n = 5000
+	imp := impairment{reorder: 0.1, dup: 0.05}
+	r := &impairedReader{r: &seqReader{seq: 63000, n: n}, imp: imp, rnd: rand.New(rand.NewSource(1))}
+	jb := newJitterBuffer(16, time.Hour)
+	released := make([]uint16, 0, n)
+	for {
+		b := make([]byte, 12)
+		if _, _, err := r.ReadFrom(b); err != nil {
+			break
+		}
+		for _, p := range jb.push(&jitterPacket{payload: b, offset: 12, arrival: time.Now()}) {
+			released = append(released, binary.BigEndian.Uint16(p.payload[2:4]))
+		}
+	}
+	jb.ready = jb.ready[:0]
+	jb.flush()
+	for _, p := range jb.ready {
+		released = append(released, binary.BigEndian.Uint16(p.payload[2:4]))
+	}
+	if len(released) != n {
+		t.Fatalf("released %d datagrams, want %d", len(released), n)
+	}
+	for i, seq := range released {
+		if want := uint16(63000 + i); seq != want {
+			t.Fatalf("datagram %d has sequence %d, want %d", i, seq, want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type jitterArrival struct {
+	seq uint16
+	ms  int // arrival time
+}
+
+func jitterDatagram(seq uint16, arrival time.Time) *jitterPacket {
+	payload := make([]byte, 12)
+	payload[0], payload[1] = 0x80, 33
+	binary.BigEndian.PutUint16(payload[2:4], seq)
+	return &jitterPacket{payload: payload, offset: 12, arrival: arrival}
+}
+
+// pushAll pushes the datagrams and returns the sequence numbers released
+func pushAll(jb *jitterBuffer, arrivals []jitterArrival) []uint16 {
+	start := time.Now()
+	released := make([]uint16, 0)
+	for _, a := range arrivals {
+		for _, p := range jb.push(jitterDatagram(a.seq, start.Add(time.Duration(a.ms)*time.Millisecond))) {
+			released = append(released, binary.BigEndian.Uint16(p.payload[2:4]))
+		}
+	}
+	return released
+}
+
+func TestJitterBuffer(t *testing.T) {
+	tests := []struct {
+		name     string
+		depth    int
+		arrivals []jitterArrival
+		want     []uint16
+	}{
+		{"in order", 8, []jitterArrival{{1, 0}, {2, 1}, {3, 2}}, []uint16{1, 2, 3}},
+		{"reordered", 8, []jitterArrival{{1, 0}, {3, 1}, {2, 2}, {4, 3}}, []uint16{1, 2, 3, 4}},
+		{"reordered across the wrap", 8, []jitterArrival{{65534, 0}, {65535, 1}, {1, 2}, {0, 3}, {2, 4}},
+			[]uint16{65534, 65535, 0, 1, 2}},
+		{"duplicate", 8, []jitterArrival{{1, 0}, {2, 1}, {2, 2}, {1, 3}, {3, 4}}, []uint16{1, 2, 3}},
+		{"duplicate of a held datagram", 8, []jitterArrival{{1, 0}, {3, 1}, {3, 2}, {2, 3}}, []uint16{1, 2, 3}},
+		{"held within the latency", 8, []jitterArrival{{1, 0}, {3, 1}, {4, 40}}, []uint16{1}},
+		// 2 is given up when 5 arrives 59ms after 3, and dropped when it
+		// comes later
+		{"released after the latency", 8, []jitterArrival{{1, 0}, {3, 1}, {4, 2}, {5, 60}, {2, 61}, {6, 62}},
+			[]uint16{1, 3, 4, 5, 6}},
+		{"released when full", 4, []jitterArrival{{1, 0}, {3, 1}, {4, 2}, {5, 3}, {6, 4}}, []uint16{1, 3, 4, 5, 6}},
+		{"sender restart", 8, []jitterArrival{{1, 0}, {2, 1}, {30000, 2}, {30001, 3}}, []uint16{1, 2, 30000, 30001}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jb := newJitterBuffer(tt.depth, 50*time.Millisecond)
+			if got := pushAll(jb, tt.arrivals); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("released %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
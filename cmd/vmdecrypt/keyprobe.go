@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rgerganov/vmdecrypt"
+)
+
+// Finding the keys of channels whose key fails: the configured key and then
+// the keys of a pool are tried one after the other on the live stream, each
+// until it decrypts or fails an ECM or for at most the timeout.
+
+const keyProbeWorkers = 8
+
+type keyProbeResult struct {
+	Names   []string `json:"names"`
+	Addr    string   `json:"addr"`
+	OldKey  string   `json:"old_key"`
+	Key     string   `json:"key,omitempty"` // working key, empty if none was found
+	Changed bool     `json:"changed"`
+	Error   string   `json:"error,omitempty"`
+	session string
+}
+
+type keyProbeReport struct {
+	Channels []*keyProbeResult `json:"channels"`
+	// channel name as in the channels file => key, for the whole lineup
+	// with the found keys
+	Keys map[string]string `json:"keys"`
+}
+
+// tryKey reports if the key decrypts the next ECM of src
+func tryKey(src Source, chInfo ChannelInfo, k string, timeout time.Duration) (bool, error) {
+	dec := newDecryptor(chInfo, k)
+	gotKeys := false
+	dec.OnKeys = func() { gotKeys = true }
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for {
+		payload, err := src.ReadPacket(ctx)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, os.ErrDeadlineExceeded) {
+				return false, nil
+			}
+			return false, err
+		}
+		offset := 0
+		if format := chInfo.inputFormat(); format == "rtp" || (format == "" && len(payload) > 0 && payload[0] != 0x47) {
+			hdr, err := vmdecrypt.ParseRTP(payload)
+			if err != nil {
+				continue
+			}
+			offset = hdr.Offset
+		}
+		err = dec.Process(vmdecrypt.StripRS(payload, offset)[offset:])
+		if gotKeys {
+			return true, nil
+		}
+		if errors.Is(err, vmdecrypt.ErrECM) {
+			return false, nil
+		}
+	}
+}
+
+// probeKeys returns the first of the configured key and the pool which
+// works for the channel, empty if none
+func probeKeys(chInfo ChannelInfo, pool []string, timeout time.Duration) (string, error) {
+	src, err := openSource(chInfo)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	tried := make(map[string]bool)
+	for _, k := range append([]string{chInfo.masterKey}, pool...) {
+		k = strings.ToLower(k)
+		if tried[k] {
+			continue
+		}
+		tried[k] = true
+		if !validKey(k) {
+			continue
+		}
+		ok, err := tryKey(src, chInfo, k, timeout)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return k, nil
+		}
+	}
+	return "", nil
+}
+
+// keyProbeHandler tries the keys given with keys (comma or whitespace
+// separated) on the channels whose key fails, or the channels given with
+// channels, or all of them with all=1. timeout is the time per key, with
+// apply=1 the found keys replace the configured ones.
+func keyProbeHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		httpError(w, req, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	pool := strings.FieldsFunc(req.FormValue("keys"), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t'
+	})
+	for _, k := range pool {
+		if !validKey(k) {
+			httpError(w, req, fmt.Sprintf("Invalid key %q, expected 16, 24 or 32 bytes in hex", k), http.StatusBadRequest)
+			return
+		}
+	}
+	timeout, err := time.ParseDuration(req.FormValue("timeout"))
+	if err != nil || timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	selected := make(map[string]bool)
+	for _, name := range strings.Split(req.FormValue("channels"), ",") {
+		if name != "" {
+			selected[url.PathEscape(name)] = true
+		}
+	}
+	all := req.FormValue("all") == "1"
+
+	// channels sharing a session are probed once
+	bySession := make(map[string]*keyProbeResult)
+	infos := make(map[string]ChannelInfo)
+	results := make([]*keyProbeResult, 0)
+	for _, k := range sortedChannels() {
+		chInfo, _ := lookupChannel(k)
+		if !all && !selected[k] && (len(selected) > 0 || !keyFailing(chInfo.addr)) {
+			continue
+		}
+		r, ok := bySession[chInfo.sessionKey()]
+		if !ok {
+			r = &keyProbeResult{Addr: chInfo.addr, OldKey: chInfo.masterKey, session: chInfo.sessionKey()}
+			bySession[r.session] = r
+			infos[r.session] = chInfo
+			results = append(results, r)
+		}
+		r.Names = append(r.Names, displayName(k))
+	}
+	reqLogf(req, "Probing %d keys on %d channels", len(pool), len(results))
+
+	jobs := make(chan *keyProbeResult)
+	var wg sync.WaitGroup
+	for i := 0; i < keyProbeWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range jobs {
+				key, err := probeKeys(infos[r.session], pool, timeout)
+				if err != nil {
+					r.Error = err.Error()
+				}
+				r.Key = key
+				r.Changed = key != "" && !strings.EqualFold(key, r.OldKey)
+			}
+		}()
+	}
+	for _, r := range results {
+		jobs <- r
+	}
+	close(jobs)
+	wg.Wait()
+
+	report := keyProbeReport{Channels: results, Keys: make(map[string]string)}
+	for _, k := range sortedChannels() {
+		chInfo, _ := lookupChannel(k)
+		if r, ok := bySession[chInfo.sessionKey()]; ok && r.Changed {
+			chInfo.masterKey = r.Key
+			if req.FormValue("apply") == "1" {
+				addChannel(k, chInfo)
+			}
+		}
+		name, _ := url.PathUnescape(k)
+		report.Keys[name] = chInfo.masterKey
+	}
+	for _, r := range results {
+		if r.Changed {
+			reqLogf(req, "Found a new key for %s @ %s", strings.Join(r.Names, ", "), r.Addr)
+		}
+	}
+	writeJSON(w, report)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// Container limits. GOMAXPROCS follows the cgroup CPU limit (done by the
+// Go runtime), the memory limit is set from the cgroup memory limit unless
+// GOMEMLIMIT is given.
+
+var version = "dev"
+
+// cgroupMemoryLimit returns the memory limit of the cgroup or 0
+func cgroupMemoryLimit() int64 {
+	for _, path := range []string{
+		"/sys/fs/cgroup/memory.max",                   // cgroup v2
+		"/sys/fs/cgroup/memory/memory.limit_in_bytes", // cgroup v1
+	} {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		limit, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		// v1 reports a huge number when there is no limit
+		if err != nil || limit <= 0 || limit >= math.MaxInt64/2 {
+			return 0
+		}
+		return limit
+	}
+	return 0
+}
+
+func applyLimits() {
+	if os.Getenv("GOMEMLIMIT") == "" {
+		if limit := cgroupMemoryLimit(); limit > 0 {
+			debug.SetMemoryLimit(limit / 10 * 9)
+			log.Printf("Memory limit set to %d bytes", limit/10*9)
+		}
+	}
+	// smaller ring buffers on tiny containers
+	if limit := debug.SetMemoryLimit(-1); limit < 64<<20 {
+		RingSize = 32
+	}
+}
+
+type versionInfo struct {
+	Version     string `json:"version"`
+	GoVersion   string `json:"go_version"`
+	GOMAXPROCS  int    `json:"gomaxprocs"`
+	NumCPU      int    `json:"num_cpu"`
+	MemoryLimit int64  `json:"memory_limit,omitempty"`
+	CgroupLimit int64  `json:"cgroup_memory_limit,omitempty"`
+	RingSize    int    `json:"ring_size"`
+}
+
+func currentVersion() versionInfo {
+	info := versionInfo{
+		Version:     version,
+		GoVersion:   runtime.Version(),
+		GOMAXPROCS:  runtime.GOMAXPROCS(0),
+		NumCPU:      runtime.NumCPU(),
+		CgroupLimit: cgroupMemoryLimit(),
+		RingSize:    RingSize,
+	}
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		info.MemoryLimit = limit
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok && version == "dev" {
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" {
+				info.Version = s.Value
+			}
+		}
+	}
+	return info
+}
+
+func versionHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, currentVersion())
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// vmdecrypt loadtest: many HTTP clients playing one channel of a running
+// instance, reporting the throughput, the packets lost by the clients
+// (continuity counter errors) and the time to the first byte.
+
+type loadClient struct {
+	bytes   int64
+	lost    int64
+	ttfb    time.Duration
+	err     error
+	counter map[uint16]byte // pid => last continuity counter
+}
+
+// checkContinuity counts the packets missing before pkt
+func (lc *loadClient) checkContinuity(pkt []byte) {
+	if pkt[0] != 0x47 || pkt[3]&0x10 == 0 {
+		return
+	}
+	pid := binary.BigEndian.Uint16(pkt[1:3]) & 0x1fff
+	if pid == 0x1fff {
+		return
+	}
+	cc := pkt[3] & 0x0f
+	if last, ok := lc.counter[pid]; ok && cc != (last+1)&0x0f && cc != last {
+		lc.lost += int64((cc - last - 1) & 0x0f)
+	}
+	lc.counter[pid] = cc
+}
+
+func (lc *loadClient) run(chURL string, d time.Duration) {
+	client := &http.Client{Timeout: d}
+	start := time.Now()
+	resp, err := client.Get(chURL)
+	if err != nil {
+		lc.err = err
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		lc.err = fmt.Errorf("Unexpected status %s", resp.Status)
+		return
+	}
+	buf := make([]byte, 188)
+	for {
+		if _, err := io.ReadFull(resp.Body, buf); err != nil {
+			break
+		}
+		if lc.bytes == 0 {
+			lc.ttfb = time.Since(start)
+		}
+		lc.bytes += int64(len(buf))
+		lc.checkContinuity(buf)
+	}
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+func loadtest(args []string) int {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	server := fs.String("server", "http://localhost:8080", "URL of the running instance")
+	chName := fs.String("channel", "", "Channel to play")
+	clients := fs.Int("clients", 10, "Number of concurrent clients")
+	duration := fs.Duration("duration", 30*time.Second, "How long the clients play")
+	ramp := fs.Duration("ramp", 0, "Time over which the clients are started")
+	token := fs.String("token", "", "Access token of the clients")
+	fs.Parse(args)
+	if *chName == "" || *clients < 1 {
+		fmt.Println("Usage: vmdecrypt loadtest -channel <name> [-clients N] [-duration 30s] [-server URL]")
+		return 2
+	}
+	chURL := fmt.Sprintf("%s/ch/%s", *server, url.PathEscape(*chName))
+	if *token != "" {
+		chURL += "?token=" + url.QueryEscape(*token)
+	}
+
+	fmt.Printf("Starting %d clients of %s for %v\n", *clients, chURL, *duration)
+	results := make([]*loadClient, *clients)
+	var wg sync.WaitGroup
+	for i := range results {
+		lc := &loadClient{counter: make(map[uint16]byte)}
+		results[i] = lc
+		wg.Add(1)
+		go func(delay time.Duration) {
+			defer wg.Done()
+			time.Sleep(delay)
+			lc.run(chURL, *duration-delay)
+		}(*ramp * time.Duration(i) / time.Duration(*clients))
+	}
+	wg.Wait()
+
+	var total, lost int64
+	failed := 0
+	ttfbs := make([]time.Duration, 0)
+	for _, lc := range results {
+		if lc.err != nil {
+			failed++
+			if failed == 1 {
+				fmt.Println(lc.err)
+			}
+			continue
+		}
+		total += lc.bytes
+		lost += lc.lost
+		if lc.bytes > 0 {
+			ttfbs = append(ttfbs, lc.ttfb)
+		}
+	}
+	sort.Slice(ttfbs, func(i, j int) bool { return ttfbs[i] < ttfbs[j] })
+	secs := duration.Seconds()
+	fmt.Printf("Clients: %d ok, %d failed\n", *clients-failed, failed)
+	fmt.Printf("Throughput: %.1f Mbit/s total, %.2f Mbit/s per client\n",
+		float64(total)*8/secs/1e6, float64(total)*8/secs/1e6/float64(max(*clients-failed, 1)))
+	fmt.Printf("Lost packets: %d (%.3f%%)\n", lost, 100*float64(lost)/float64(max(lost+total/188, 1)))
+	fmt.Printf("Time to first byte: p50 %v, p90 %v, p99 %v, max %v\n",
+		percentile(ttfbs, 0.5), percentile(ttfbs, 0.9), percentile(ttfbs, 0.99), percentile(ttfbs, 1))
+	if failed > 0 || lost > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Repeated stream errors of a channel (RTP discontinuities, lost TS sync)
+// are logged once per -log-sample window, followed by a summary like
+// "RTP discontinuity detected x431 in last 10s". The error counts of the
+// status API and the usage report stay complete.
+
+var logSampleWindow time.Duration
+
+type sampledLog struct {
+	start      time.Time
+	suppressed int
+	last       string
+}
+
+type logSampler struct {
+	mu   sync.Mutex
+	logs map[string]*sampledLog // format => its current window
+	logf func(format string, v ...interface{})
+}
+
+func newLogSampler(logf func(format string, v ...interface{})) *logSampler {
+	return &logSampler{logs: make(map[string]*sampledLog), logf: logf}
+}
+
+// printf logs the message unless one with the same format was logged in
+// the current window
+func (s *logSampler) printf(format string, v ...interface{}) {
+	if logSampleWindow == 0 || strings.HasPrefix(format, "trace: ") {
+		s.logf(format, v...)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.logs[format]
+	if !ok || (l.suppressed == 0 && time.Since(l.start) >= logSampleWindow) {
+		s.logs[format] = &sampledLog{start: time.Now()}
+		s.logf(format, v...)
+		return
+	}
+	if l.suppressed == 0 {
+		time.AfterFunc(time.Until(l.start.Add(logSampleWindow)), func() { s.flush(format) })
+	}
+	l.suppressed++
+	l.last = fmt.Sprintf(format, v...)
+}
+
+// flush ends the window of the format and logs its summary
+func (s *logSampler) flush(format string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.logs[format]
+	if !ok {
+		return
+	}
+	delete(s.logs, format)
+	if l.suppressed > 0 {
+		s.logf("%s x%d in last %v", l.last, l.suppressed, logSampleWindow)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Maintenance windows: new sessions are refused with a message during a
+// window and the running sessions are notified in the log and with a
+// webhook when a window starts and ends.
+
+type maintenanceWindow struct {
+	start    time.Time // time of day for daily windows
+	daily    bool
+	duration time.Duration
+}
+
+var maintenanceWindows []maintenanceWindow
+var maintenanceMessage string
+var webhookURL string
+
+// parseMaintenance parses windows like "2026-10-20T02:00:00Z/2h" (one-off)
+// or "03:00/30m" (daily, local time)
+func parseMaintenance(s string) ([]maintenanceWindow, error) {
+	windows := make([]maintenanceWindow, 0)
+	if s == "" {
+		return windows, nil
+	}
+	for _, w := range strings.Split(s, ",") {
+		mw, err := parseWindow(w, "maintenance window")
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, mw)
+	}
+	return windows, nil
+}
+
+// parseWindow parses one START/DURATION window, what names it in errors
+func parseWindow(w, what string) (maintenanceWindow, error) {
+	parts := strings.SplitN(strings.TrimSpace(w), "/", 2)
+	if len(parts) != 2 {
+		return maintenanceWindow{}, fmt.Errorf("Invalid %s %q, expected START/DURATION", what, w)
+	}
+	var mw maintenanceWindow
+	var err error
+	if mw.duration, err = time.ParseDuration(parts[1]); err != nil || mw.duration <= 0 {
+		return mw, fmt.Errorf("Invalid duration in %s %q", what, w)
+	}
+	if mw.start, err = time.Parse(time.RFC3339, parts[0]); err != nil {
+		if mw.start, err = time.Parse("15:04", parts[0]); err != nil {
+			return mw, fmt.Errorf("Invalid start in %s %q", what, w)
+		}
+		mw.daily = true
+	}
+	return mw, nil
+}
+
+// end returns the end of the window if now is within it
+func (mw maintenanceWindow) end(now time.Time) (time.Time, bool) {
+	if !mw.daily {
+		end := mw.start.Add(mw.duration)
+		return end, !now.Before(mw.start) && now.Before(end)
+	}
+	y, m, d := now.Date()
+	start := time.Date(y, m, d, mw.start.Hour(), mw.start.Minute(), 0, 0, now.Location())
+	// check the windows which started on the previous days too
+	for ; start.Add(mw.duration).After(now); start = start.AddDate(0, 0, -1) {
+		if !now.Before(start) {
+			return start.Add(mw.duration), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// inMaintenance reports if there is an active window and when it ends
+func inMaintenance() (time.Time, bool) {
+	now := time.Now()
+	var until time.Time
+	for _, mw := range maintenanceWindows {
+		if end, ok := mw.end(now); ok && end.After(until) {
+			until = end
+		}
+	}
+	return until, !until.IsZero()
+}
+
+// refuseMaintenance refuses the request if there is an active window
+func refuseMaintenance(w http.ResponseWriter, req *http.Request) bool {
+	until, ok := inMaintenance()
+	if !ok {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+	msg := maintenanceMessage
+	if msg == "" {
+		msg = "Down for maintenance"
+	}
+	httpError(w, req, msg+" until "+until.Format(time.RFC3339), http.StatusServiceUnavailable)
+	return true
+}
+
+type maintenanceEvent struct {
+	Event    string     `json:"event"`
+	Until    *time.Time `json:"until,omitempty"`
+	Message  string     `json:"message,omitempty"`
+	Sessions []string   `json:"sessions"`
+}
+
+func notifyMaintenance(ev maintenanceEvent) {
+	ev.Sessions = make([]string, 0)
+	runningChannelsMu.Lock()
+	for addr, ch := range runningChannels {
+		ev.Sessions = append(ev.Sessions, addr)
+		if ev.Event == "maintenance_start" {
+			ch.logf("Maintenance until %v, %d clients @ %v", ev.Until.Format(time.RFC3339), ch.numClients, addr)
+		}
+	}
+	runningChannelsMu.Unlock()
+	postEvent(ev)
+}
+
+// postEvent posts the event to -webhook as JSON
+func postEvent(ev interface{}) {
+	if webhookURL == "" {
+		return
+	}
+	data, _ := json.Marshal(ev)
+	resp, err := httpClient.Post(webhookURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	resp.Body.Close()
+}
+
+func watchMaintenance() {
+	active := false
+	for {
+		until, ok := inMaintenance()
+		if ok && !active {
+			log.Println("Maintenance window started, new sessions are refused until", until.Format(time.RFC3339))
+			notifyMaintenance(maintenanceEvent{Event: "maintenance_start", Until: &until, Message: maintenanceMessage})
+		} else if !ok && active {
+			log.Println("Maintenance window ended")
+			notifyMaintenance(maintenanceEvent{Event: "maintenance_end"})
+		}
+		active = ok
+		time.Sleep(10 * time.Second)
+	}
+}
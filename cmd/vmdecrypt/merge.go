@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/rgerganov/vmdecrypt"
+)
+
+// Channels split across several groups, e.g. {"sources":
+// ["igmp://239.1.1.2:1234"]} for a headend which sends the radio or data
+// services of a mux to another group. The TS packets of all the groups are
+// merged into one stream. The PSI/SI (PAT, SDT, EIT, ..., and the PMTs
+// listed in the PATs) comes only from the group of the channel, the
+// decryptor follows its program. An elementary stream PID belongs to the
+// group which carried it first and its packets from the other groups are
+// dropped.
+
+// highest PID of the PSI/SI tables with fixed PIDs
+const maxSIPid = 0x1f
+
+type sourceAddr struct {
+	addr   string
+	format string
+}
+
+// parseSourceAddress parses a source address like rtp://239.1.1.1:1234
+func parseSourceAddress(s string) (sourceAddr, error) {
+	scheme, hostPort, _ := strings.Cut(s, "://")
+	format, ok := inputFormats[scheme]
+	if !ok {
+		return sourceAddr{}, fmt.Errorf("unsupported address %q", s)
+	}
+	return sourceAddr{hostPort, format}, nil
+}
+
+func parseSources(v interface{}) ([]sourceAddr, error) {
+	if v == nil {
+		return nil, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("sources must be a list of addresses")
+	}
+	sources := make([]sourceAddr, 0)
+	for _, s := range list {
+		addr, _ := s.(string)
+		src, err := parseSourceAddress(addr)
+		if err != nil {
+			return nil, fmt.Errorf("sources: %v", err)
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+// checkSources validates the extra groups of a channel
+func checkSources(sources []sourceAddr) error {
+	for _, src := range sources {
+		host, _, err := net.SplitHostPort(src.addr)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || !ip.IsMulticast() {
+			return fmt.Errorf("source %s is not a multicast address", host)
+		}
+	}
+	return nil
+}
+
+// inputFormat is the format of the datagrams from openSource, the merged
+// sources deliver plain MPEG-TS
+func (chInfo ChannelInfo) inputFormat() string {
+	if len(chInfo.sources) > 0 {
+		return "udp"
+	}
+	return chInfo.format
+}
+
+type mergeDatagram struct {
+	src     int // index of the source
+	payload []byte
+}
+
+type mergedSource struct {
+	addr    string   // of the channel
+	addrs   []string // of the sources
+	srcs    []Source
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	packets chan mergeDatagram
+	errc    chan error
+	owners  map[uint16]int  // PID => index of the source carrying it
+	tables  map[uint16]bool // PMT and NIT PIDs from the PATs of the sources
+	// reported PID conflicts, PID << 8 | index of the source
+	conflicts map[uint32]bool
+}
+
+// openMerged joins the group of the channel and its extra sources
+func openMerged(chInfo ChannelInfo) (Source, error) {
+	m := &mergedSource{addr: chInfo.addr, packets: make(chan mergeDatagram, 256), errc: make(chan error, len(chInfo.sources)+1),
+		owners: make(map[uint16]int), tables: make(map[uint16]bool), conflicts: make(map[uint32]bool)}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	addrs := append([]sourceAddr{{chInfo.addr, chInfo.format}}, chInfo.sources...)
+	for _, a := range addrs {
+		info := chInfo
+		info.addr, info.format, info.sources = a.addr, a.format, nil
+		src, err := openSource(info)
+		if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("%v: %v", a.addr, err)
+		}
+		m.addrs = append(m.addrs, a.addr)
+		m.srcs = append(m.srcs, src)
+	}
+	for i, src := range m.srcs {
+		m.wg.Add(1)
+		go m.read(i, src)
+	}
+	return m, nil
+}
+
+func (m *mergedSource) read(i int, src Source) {
+	defer m.wg.Done()
+	for {
+		payload, err := src.ReadPacket(m.ctx)
+		if err != nil {
+			m.errc <- fmt.Errorf("%v: %v", m.addrs[i], err)
+			return
+		}
+		select {
+		case m.packets <- mergeDatagram{i, payload}:
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *mergedSource) ReadPacket(ctx context.Context) ([]byte, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case err := <-m.errc:
+			return nil, err
+		case d := <-m.packets:
+			if ts := m.merge(d); len(ts) > 0 {
+				return ts, nil
+			}
+		}
+	}
+}
+
+// merge returns the TS packets of the datagram whose PIDs belong to its
+// source, the tables of the extra sources are dropped
+func (m *mergedSource) merge(d mergeDatagram) []byte {
+	offset := 0
+	if len(d.payload) > 0 && d.payload[0] != 0x47 {
+		hdr, err := vmdecrypt.ParseRTP(d.payload)
+		if err != nil {
+			return nil
+		}
+		offset = hdr.Offset
+	}
+	ts := vmdecrypt.StripRS(d.payload, offset)[offset:]
+	out := ts[:0]
+	for i := 0; i+188 <= len(ts); i += 188 {
+		pkt := ts[i : i+188]
+		pid := binary.BigEndian.Uint16(pkt[1:3]) & 0x1fff
+		if pid == 0 {
+			m.addTables(pkt)
+		}
+		if pid <= maxSIPid || m.tables[pid] {
+			if d.src == 0 {
+				out = append(out, pkt...)
+			}
+			continue
+		}
+		owner, ok := m.owners[pid]
+		if !ok {
+			m.owners[pid] = d.src
+			owner = d.src
+		}
+		if owner != d.src && pid != 0x1fff {
+			if key := uint32(pid)<<8 | uint32(d.src); !m.conflicts[key] {
+				m.conflicts[key] = true
+				log.Printf("PID conflict: PID %d of %v is already carried by %v, dropping it @ %v", pid, m.addrs[d.src], m.addrs[owner], m.addr)
+			}
+			continue
+		}
+		out = append(out, pkt...)
+	}
+	return out
+}
+
+// addTables adds the PMT and NIT PIDs of a PAT
+func (m *mergedSource) addTables(pkt []byte) {
+	sec, ok := vmdecrypt.Section(pkt)
+	if !ok || len(sec) < 8 || sec[0] != 0 {
+		return
+	}
+	end := 3 + int(binary.BigEndian.Uint16(sec[1:3])&0x0fff) - 4
+	if end > len(sec) {
+		end = len(sec)
+	}
+	for i := 8; i+4 <= end; i += 4 {
+		m.tables[binary.BigEndian.Uint16(sec[i+2:i+4])&0x1fff] = true
+	}
+}
+
+func (m *mergedSource) Close() error {
+	m.cancel()
+	for _, src := range m.srcs {
+		src.Close()
+	}
+	m.wg.Wait()
+	return nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"math"
+	"os"
+)
+
+// MKV output of the remuxer: clusters start at the video key frames (or
+// every few seconds), the cues which point to them are written at the end.
+// The timestamps are in milliseconds.
+
+// longest cluster without a key frame
+const mkvClusterDuration = 5000
+
+type mkvMuxer struct {
+	f        *os.File
+	w        *bufio.Writer
+	video    bool
+	cueTrack int   // the video track, or the first one
+	offset   int64 // of the next element
+	segment  int64 // of the segment data
+
+	cluster     []byte
+	clusterTime int64
+	clusterKey  bool
+	duration    int64
+	cues        []byte
+
+	cuesSeekPos int64 // of the SeekPosition of the cues
+	durationPos int64 // of the Duration of the segment info
+	segmentSize int64 // of the size of the segment
+}
+
+// ebmlElement encodes an element, the ID includes its length marker
+func ebmlElement(id uint32, payloads ...[]byte) []byte {
+	size := 0
+	for _, p := range payloads {
+		size += len(p)
+	}
+	b := ebmlID(id)
+	b = append(b, ebmlSize(uint64(size))...)
+	for _, p := range payloads {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func ebmlID(id uint32) []byte {
+	b := be32(id)
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	return b
+}
+
+func ebmlSize(size uint64) []byte {
+	n := 1
+	for n < 8 && size >= 1<<(7*n)-1 {
+		n++
+	}
+	b := be64(size | 1<<(7*n))
+	return b[8-n:]
+}
+
+func ebmlUint(id uint32, v uint64) []byte {
+	b := be64(v)
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	return ebmlElement(id, b)
+}
+
+func ebmlFloat(id uint32, v float64) []byte {
+	return ebmlElement(id, be64(math.Float64bits(v)))
+}
+
+func ebmlString(id uint32, s string) []byte {
+	return ebmlElement(id, []byte(s))
+}
+
+var mkvCodecs = map[string]string{
+	"h264":       "V_MPEG4/ISO/AVC",
+	"mpeg1video": "V_MPEG1",
+	"mpeg2video": "V_MPEG2",
+	"aac":        "A_AAC",
+	"mp1":        "A_MPEG/L1",
+	"mp2":        "A_MPEG/L2",
+	"mp3":        "A_MPEG/L3",
+	"ac3":        "A_AC3",
+}
+
+func (t *remuxTrack) mkvEntry() []byte {
+	entry := [][]byte{
+		ebmlUint(0xd7, uint64(t.id)),   // TrackNumber
+		ebmlUint(0x73c5, uint64(t.id)), // TrackUID
+		ebmlUint(0x9c, 0),              // FlagLacing
+		ebmlString(0x22b59c, "und"),    // Language
+		ebmlString(0x86, mkvCodecs[t.codec]),
+	}
+	if len(t.config) > 0 && t.codec != "ac3" {
+		entry = append(entry, ebmlElement(0x63a2, t.config)) // CodecPrivate
+	}
+	if t.video {
+		entry = append(entry, ebmlUint(0x83, 1), ebmlElement(0xe0,
+			ebmlUint(0xb0, uint64(t.width)),
+			ebmlUint(0xba, uint64(t.height))))
+	} else {
+		entry = append(entry, ebmlUint(0x83, 2), ebmlElement(0xe1,
+			ebmlFloat(0xb5, float64(t.sampleRate)),
+			ebmlUint(0x9f, uint64(t.channels))))
+	}
+	return ebmlElement(0xae, entry...)
+}
+
+func newMKVMuxer(f *os.File, tracks []*remuxTrack) (*mkvMuxer, error) {
+	m := &mkvMuxer{f: f, w: bufio.NewWriterSize(f, 1<<16), cueTrack: tracks[0].id}
+	for _, t := range tracks {
+		if t.video && !m.video {
+			m.video, m.cueTrack = true, t.id
+		}
+	}
+	header := ebmlElement(0x1a45dfa3,
+		ebmlUint(0x4286, 1),            // EBMLVersion
+		ebmlUint(0x42f7, 1),            // EBMLReadVersion
+		ebmlUint(0x42f2, 4),            // EBMLMaxIDLength
+		ebmlUint(0x42f3, 8),            // EBMLMaxSizeLength
+		ebmlString(0x4282, "matroska"), // DocType
+		ebmlUint(0x4287, 4),            // DocTypeVersion
+		ebmlUint(0x4285, 2))            // DocTypeReadVersion
+	// the segment size is set by close
+	segment := append(ebmlID(0x18538067), 0x01, 0, 0, 0, 0, 0, 0, 0)
+	m.segmentSize = int64(len(header)) + 4
+	m.segment = int64(len(header) + len(segment))
+
+	entries := make([][]byte, 0)
+	for _, t := range tracks {
+		entries = append(entries, t.mkvEntry())
+	}
+	trackList := ebmlElement(0x1654ae6b, entries...)
+	seek := func(id uint32, pos uint64) []byte {
+		return ebmlElement(0x4dbb, ebmlElement(0x53ab, ebmlID(id)), ebmlElement(0x53ac, be64(pos)))
+	}
+	// the positions are fixed size, the cues one is set by close
+	seekHead := ebmlElement(0x114d9b74, seek(0x1549a966, 0), seek(0x1654ae6b, 0), seek(0x1c53bb6b, 0))
+	info := ebmlElement(0x1549a966,
+		ebmlUint(0x2ad7b1, 1000000),     // TimestampScale
+		ebmlString(0x4d80, "vmdecrypt"), // MuxingApp
+		ebmlString(0x5741, "vmdecrypt"), // WritingApp
+		ebmlFloat(0x4489, 0))            // Duration
+	seekHead = ebmlElement(0x114d9b74,
+		seek(0x1549a966, uint64(len(seekHead))),
+		seek(0x1654ae6b, uint64(len(seekHead)+len(info))),
+		seek(0x1c53bb6b, 0))
+	m.cuesSeekPos = m.segment + int64(len(seekHead)) - 8
+	m.durationPos = m.segment + int64(len(seekHead)+len(info)) - 8
+	for _, b := range [][]byte{header, segment, seekHead, info, trackList} {
+		if _, err := m.w.Write(b); err != nil {
+			return nil, err
+		}
+		m.offset += int64(len(b))
+	}
+	return m, nil
+}
+
+func (m *mkvMuxer) flushCluster() error {
+	if m.cluster == nil {
+		return nil
+	}
+	if m.clusterKey || !m.video {
+		cue := ebmlElement(0xbb, // CuePoint
+			ebmlUint(0xb3, uint64(m.clusterTime)), // CueTime
+			ebmlElement(0xb7, // CueTrackPositions
+				ebmlUint(0xf7, uint64(m.cueTrack)),          // CueTrack
+				ebmlUint(0xf1, uint64(m.offset-m.segment)))) // CueClusterPosition
+		m.cues = append(m.cues, cue...)
+	}
+	cluster := ebmlElement(0x1f43b675, ebmlUint(0xe7, uint64(m.clusterTime)), m.cluster)
+	m.cluster = nil
+	m.offset += int64(len(cluster))
+	_, err := m.w.Write(cluster)
+	return err
+}
+
+func (m *mkvMuxer) writeSample(s remuxSample) error {
+	ts := s.pts / 90
+	if m.cluster != nil && (s.key && s.track.video || ts-m.clusterTime > mkvClusterDuration || ts-m.clusterTime < -mkvClusterDuration) {
+		if err := m.flushCluster(); err != nil {
+			return err
+		}
+	}
+	if m.cluster == nil {
+		m.cluster, m.clusterTime, m.clusterKey = make([]byte, 0, 1<<16), ts, s.key && s.track.video
+	}
+	flags := byte(0)
+	if s.key {
+		flags = 0x80
+	}
+	block := append(ebmlSize(uint64(s.track.id)), 0, 0, flags)
+	binary.BigEndian.PutUint16(block[len(block)-3:], uint16(int16(ts-m.clusterTime)))
+	m.cluster = append(m.cluster, ebmlElement(0xa3, block, s.data)...) // SimpleBlock
+	if ts > m.duration {
+		m.duration = ts
+	}
+	return nil
+}
+
+func (m *mkvMuxer) close() error {
+	if err := m.flushCluster(); err != nil {
+		return err
+	}
+	cuesPos := m.offset - m.segment
+	cues := ebmlElement(0x1c53bb6b, m.cues)
+	m.offset += int64(len(cues))
+	if _, err := m.w.Write(cues); err != nil {
+		return err
+	}
+	if err := m.w.Flush(); err != nil {
+		return err
+	}
+	for _, patch := range []struct {
+		pos  int64
+		data []byte
+	}{
+		{m.segmentSize, be64(uint64(m.offset-m.segment) | 1<<56)},
+		{m.cuesSeekPos, be64(uint64(cuesPos))},
+		{m.durationPos, be64(math.Float64bits(float64(m.duration)))},
+	} {
+		if _, err := m.f.WriteAt(patch.data, patch.pos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,7 @@
+package main
+
+import "errors"
+
+func mapFile(path string, size int64) ([]byte, error) {
+	return nil, errors.New("Disk rings are not supported on Windows")
+}
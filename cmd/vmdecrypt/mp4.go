@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+)
+
+// MP4 output of the remuxer: the samples are written to the mdat as they
+// come, the moov with the sample tables follows at the end. All tracks use
+// the 90kHz timescale of the TS.
+
+const mp4Timescale = 90000
+
+type mp4Chunk struct {
+	offset  int64
+	samples int
+}
+
+type mp4Track struct {
+	*remuxTrack
+	sizes  []uint32
+	dts    []int64
+	ctsOff []int32
+	keys   []uint32 // sample numbers, 1-based
+	chunks []mp4Chunk
+	hasCTS bool
+}
+
+type mp4Muxer struct {
+	f       *os.File
+	w       *bufio.Writer
+	tracks  []*mp4Track
+	offset  int64 // of the next sample
+	last    *mp4Track
+	mdatPos int64
+}
+
+// mp4 boxes are built in memory from their payloads
+func mp4Box(typ string, payloads ...[]byte) []byte {
+	size := 8
+	for _, p := range payloads {
+		size += len(p)
+	}
+	b := make([]byte, 0, size)
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	b = append(b, typ...)
+	for _, p := range payloads {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func mp4FullBox(typ string, version byte, flags uint32, payloads ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return mp4Box(typ, append([][]byte{header}, payloads...)...)
+}
+
+func be16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func be32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func be64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+var mp4Matrix = []byte{
+	0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0, 0, 0,
+}
+
+func newMP4Muxer(f *os.File, tracks []*remuxTrack) (*mp4Muxer, error) {
+	m := &mp4Muxer{f: f, w: bufio.NewWriterSize(f, 1<<16)}
+	for _, t := range tracks {
+		m.tracks = append(m.tracks, &mp4Track{remuxTrack: t})
+	}
+	ftyp := mp4Box("ftyp", []byte("isom"), be32(0x200), []byte("isomiso2avc1mp41"))
+	// 64-bit mdat size, set by close
+	mdat := append(be32(1), "mdat"...)
+	mdat = append(mdat, be64(0)...)
+	if _, err := m.w.Write(append(ftyp, mdat...)); err != nil {
+		return nil, err
+	}
+	m.mdatPos = int64(len(ftyp))
+	m.offset = m.mdatPos + int64(len(mdat))
+	return m, nil
+}
+
+func (m *mp4Muxer) track(t *remuxTrack) *mp4Track {
+	for _, mt := range m.tracks {
+		if mt.remuxTrack == t {
+			return mt
+		}
+	}
+	return nil
+}
+
+func (m *mp4Muxer) writeSample(s remuxSample) error {
+	t := m.track(s.track)
+	if n := len(t.dts); n > 0 && s.dts <= t.dts[n-1] {
+		// decoding times must increase
+		s.dts = t.dts[n-1] + 1
+		if s.pts < s.dts {
+			s.pts = s.dts
+		}
+	}
+	if _, err := m.w.Write(s.data); err != nil {
+		return err
+	}
+	if m.last != t {
+		t.chunks = append(t.chunks, mp4Chunk{offset: m.offset})
+		m.last = t
+	}
+	t.chunks[len(t.chunks)-1].samples++
+	m.offset += int64(len(s.data))
+	t.sizes = append(t.sizes, uint32(len(s.data)))
+	t.dts = append(t.dts, s.dts)
+	t.ctsOff = append(t.ctsOff, int32(s.pts-s.dts))
+	t.hasCTS = t.hasCTS || s.pts != s.dts
+	if s.key && t.video {
+		t.keys = append(t.keys, uint32(len(t.dts)))
+	}
+	return nil
+}
+
+// durations returns the sample durations, the last one repeats the one
+// before
+func (t *mp4Track) durations() []uint32 {
+	durs := make([]uint32, len(t.dts))
+	for i := 0; i+1 < len(t.dts); i++ {
+		durs[i] = uint32(t.dts[i+1] - t.dts[i])
+	}
+	if n := len(durs); n > 1 {
+		durs[n-1] = durs[n-2]
+	} else if n == 1 {
+		durs[0] = mp4Timescale / 25
+	}
+	return durs
+}
+
+func (t *mp4Track) duration() int64 {
+	if len(t.dts) == 0 {
+		return 0
+	}
+	durs := t.durations()
+	return t.dts[len(t.dts)-1] - t.dts[0] + int64(durs[len(durs)-1])
+}
+
+// esds returns the ES descriptor with the decoder config of MPEG-4 sample
+// entries
+func esds(t *remuxTrack, objectType, streamType byte) []byte {
+	descriptor := func(tag byte, payload ...[]byte) []byte {
+		size := 0
+		for _, p := range payload {
+			size += len(p)
+		}
+		d := []byte{tag, 0x80 | byte(size>>21)&0x7f, 0x80 | byte(size>>14)&0x7f, 0x80 | byte(size>>7)&0x7f, byte(size) & 0x7f}
+		for _, p := range payload {
+			d = append(d, p...)
+		}
+		return d
+	}
+	config := []byte{objectType, streamType<<2 | 1, 0, 0, 0}
+	config = append(config, be32(0)...) // max bitrate
+	config = append(config, be32(0)...) // average bitrate
+	var dsi []byte
+	if len(t.config) > 0 {
+		dsi = descriptor(5, t.config)
+	}
+	es := descriptor(3, be16(uint16(t.id)), []byte{0}, descriptor(4, config, dsi), descriptor(6, []byte{2}))
+	return mp4FullBox("esds", 0, 0, es)
+}
+
+func (t *mp4Track) sampleEntry() []byte {
+	if t.video {
+		entry := make([]byte, 6, 78)
+		entry = append(entry, be16(1)...) // data_reference_index
+		entry = append(entry, make([]byte, 16)...)
+		entry = append(entry, be16(uint16(t.width))...)
+		entry = append(entry, be16(uint16(t.height))...)
+		entry = append(entry, be32(0x00480000)...)
+		entry = append(entry, be32(0x00480000)...)
+		entry = append(entry, be32(0)...)
+		entry = append(entry, be16(1)...) // frame_count
+		entry = append(entry, make([]byte, 32)...)
+		entry = append(entry, be16(0x18)...)
+		entry = append(entry, 0xff, 0xff)
+		switch t.codec {
+		case "h264":
+			return mp4Box("avc1", entry, mp4Box("avcC", t.config))
+		case "mpeg1video":
+			return mp4Box("mp4v", entry, esds(t.remuxTrack, 0x6a, 4))
+		default:
+			return mp4Box("mp4v", entry, esds(t.remuxTrack, 0x61, 4))
+		}
+	}
+	entry := make([]byte, 6, 28)
+	entry = append(entry, be16(1)...)
+	entry = append(entry, make([]byte, 8)...)
+	entry = append(entry, be16(uint16(t.channels))...)
+	entry = append(entry, be16(16)...)
+	entry = append(entry, make([]byte, 4)...)
+	entry = append(entry, be32(uint32(t.sampleRate)<<16)...)
+	switch t.codec {
+	case "aac":
+		return mp4Box("mp4a", entry, esds(t.remuxTrack, 0x40, 5))
+	case "ac3":
+		return mp4Box("ac-3", entry, mp4Box("dac3", t.config))
+	default:
+		objectType := byte(0x6b)
+		if t.lsf {
+			objectType = 0x69
+		}
+		return mp4Box("mp4a", entry, esds(t.remuxTrack, objectType, 5))
+	}
+}
+
+func (t *mp4Track) sampleTable() []byte {
+	durs := t.durations()
+	stts := make([]byte, 0)
+	entries := uint32(0)
+	for i := 0; i < len(durs); {
+		j := i
+		for j < len(durs) && durs[j] == durs[i] {
+			j++
+		}
+		stts = append(stts, be32(uint32(j-i))...)
+		stts = append(stts, be32(durs[i])...)
+		entries++
+		i = j
+	}
+	boxes := [][]byte{
+		mp4FullBox("stsd", 0, 0, be32(1), t.sampleEntry()),
+		mp4FullBox("stts", 0, 0, be32(entries), stts),
+	}
+	if t.hasCTS {
+		ctts := make([]byte, 0)
+		entries = 0
+		for i := 0; i < len(t.ctsOff); {
+			j := i
+			for j < len(t.ctsOff) && t.ctsOff[j] == t.ctsOff[i] {
+				j++
+			}
+			ctts = append(ctts, be32(uint32(j-i))...)
+			ctts = append(ctts, be32(uint32(t.ctsOff[i]))...)
+			entries++
+			i = j
+		}
+		boxes = append(boxes, mp4FullBox("ctts", 0, 0, be32(entries), ctts))
+	}
+	if t.video {
+		stss := be32(uint32(len(t.keys)))
+		for _, k := range t.keys {
+			stss = append(stss, be32(k)...)
+		}
+		boxes = append(boxes, mp4FullBox("stss", 0, 0, stss))
+	}
+	stsc := make([]byte, 0)
+	entries = 0
+	for i, c := range t.chunks {
+		if i == 0 || c.samples != t.chunks[i-1].samples {
+			stsc = append(stsc, be32(uint32(i+1))...)
+			stsc = append(stsc, be32(uint32(c.samples))...)
+			stsc = append(stsc, be32(1)...)
+			entries++
+		}
+	}
+	boxes = append(boxes, mp4FullBox("stsc", 0, 0, be32(entries), stsc))
+	stsz := append(be32(0), be32(uint32(len(t.sizes)))...)
+	for _, size := range t.sizes {
+		stsz = append(stsz, be32(size)...)
+	}
+	boxes = append(boxes, mp4FullBox("stsz", 0, 0, stsz))
+	co64 := be32(uint32(len(t.chunks)))
+	for _, c := range t.chunks {
+		co64 = append(co64, be64(uint64(c.offset))...)
+	}
+	boxes = append(boxes, mp4FullBox("co64", 0, 0, co64))
+	return mp4Box("stbl", boxes...)
+}
+
+// movie time in ms
+func mp4MovieTime(t int64) uint64 {
+	return uint64(t * 1000 / mp4Timescale)
+}
+
+func (t *mp4Track) trak() []byte {
+	duration := t.duration()
+	tkhd := make([]byte, 0, 92)
+	tkhd = append(tkhd, make([]byte, 16)...) // creation and modification time
+	tkhd = append(tkhd, be32(uint32(t.id))...)
+	tkhd = append(tkhd, be32(0)...)
+	tkhd = append(tkhd, be64(mp4MovieTime(t.dts[0]+duration))...)
+	tkhd = append(tkhd, make([]byte, 12)...) // reserved, layer, alternate_group
+	if t.video {
+		tkhd = append(tkhd, be32(0)...)
+	} else {
+		tkhd = append(tkhd, be32(0x01000000)...) // volume
+	}
+	tkhd = append(tkhd, mp4Matrix...)
+	tkhd = append(tkhd, be32(uint32(t.width)<<16)...)
+	tkhd = append(tkhd, be32(uint32(t.height)<<16)...)
+	boxes := [][]byte{mp4FullBox("tkhd", 1, 3, tkhd)}
+	if t.dts[0] > 0 {
+		// the track starts later, an empty edit delays it
+		elst := be32(2)
+		elst = append(elst, be64(mp4MovieTime(t.dts[0]))...)
+		elst = append(elst, be64(^uint64(0))...)
+		elst = append(elst, be32(0x00010000)...)
+		elst = append(elst, be64(mp4MovieTime(duration))...)
+		elst = append(elst, be64(0)...)
+		elst = append(elst, be32(0x00010000)...)
+		boxes = append(boxes, mp4Box("edts", mp4FullBox("elst", 1, 0, elst)))
+	}
+	mdhd := make([]byte, 16, 32)
+	mdhd = append(mdhd, be32(mp4Timescale)...)
+	mdhd = append(mdhd, be64(uint64(duration))...)
+	mdhd = append(mdhd, be16(0x55c4)...) // und
+	mdhd = append(mdhd, be16(0)...)
+	handler, name, header := "vide", "VideoHandler", mp4FullBox("vmhd", 0, 1, make([]byte, 8))
+	if !t.video {
+		handler, name, header = "soun", "SoundHandler", mp4FullBox("smhd", 0, 0, make([]byte, 4))
+	}
+	hdlr := mp4FullBox("hdlr", 0, 0, be32(0), []byte(handler), make([]byte, 12), []byte(name+"\x00"))
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, be32(1), mp4FullBox("url ", 0, 1)))
+	minf := mp4Box("minf", header, dinf, t.sampleTable())
+	boxes = append(boxes, mp4Box("mdia", mp4FullBox("mdhd", 1, 0, mdhd), hdlr, minf))
+	return mp4Box("trak", boxes...)
+}
+
+func (m *mp4Muxer) close() error {
+	if err := m.w.Flush(); err != nil {
+		return err
+	}
+	if _, err := m.f.WriteAt(be64(uint64(m.offset-m.mdatPos)), m.mdatPos+8); err != nil {
+		return err
+	}
+	duration := int64(0)
+	traks := make([][]byte, 0)
+	for _, t := range m.tracks {
+		if len(t.dts) == 0 {
+			continue
+		}
+		if end := t.dts[0] + t.duration(); end > duration {
+			duration = end
+		}
+		traks = append(traks, t.trak())
+	}
+	mvhd := make([]byte, 16, 108)
+	mvhd = append(mvhd, be32(1000)...)
+	mvhd = append(mvhd, be64(mp4MovieTime(duration))...)
+	mvhd = append(mvhd, be32(0x00010000)...) // rate
+	mvhd = append(mvhd, be16(0x0100)...)     // volume
+	mvhd = append(mvhd, make([]byte, 10)...)
+	mvhd = append(mvhd, mp4Matrix...)
+	mvhd = append(mvhd, make([]byte, 24)...)
+	mvhd = append(mvhd, be32(uint32(len(m.tracks)+1))...)
+	moov := mp4Box("moov", append([][]byte{mp4FullBox("mvhd", 1, 0, mvhd)}, traks...)...)
+	_, err := m.f.WriteAt(moov, m.offset)
+	return err
+}
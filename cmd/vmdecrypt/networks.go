@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Channels available only to clients from some networks, e.g. the LAN but
+// not the VPN range, with the networks attribute of the channel or a tag
+// rule: {"networks": ["192.168.1.0/24"]}. The other clients get 403 and do
+// not see the channels in the playlists. Behind a reverse proxy listed in
+// -trusted-proxies the client address is taken from X-Forwarded-For.
+// Requests from the host itself, e.g. of the HLS transcoders, are allowed.
+
+// parseNetworkList parses the networks attribute, a list or a comma
+// separated string
+func parseNetworkList(v interface{}) ([]string, error) {
+	var list []string
+	switch n := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		list = strings.Split(n, ",")
+	case []interface{}:
+		for _, s := range n {
+			cidr, _ := s.(string)
+			list = append(list, cidr)
+		}
+	}
+	for i, cidr := range list {
+		list[i] = strings.TrimSpace(cidr)
+	}
+	_, err := parseNetworks(strings.Join(list, ","))
+	return list, err
+}
+
+// clientIP returns the address of the client of the request
+func clientIP(req *http.Request) net.IP {
+	host, _, _ := net.SplitHostPort(req.RemoteAddr)
+	if fwd := req.Header.Get("X-Forwarded-For"); fwd != "" && trustedProxy(req.RemoteAddr) {
+		// the proxy appends the address of its client
+		hops := strings.Split(fwd, ",")
+		host = strings.TrimSpace(hops[len(hops)-1])
+	}
+	return net.ParseIP(host)
+}
+
+// networkAllowed reports if the client of the request may use the channel
+func networkAllowed(req *http.Request, chInfo ChannelInfo) bool {
+	if len(chInfo.allowedNets) == 0 {
+		return true
+	}
+	ip := clientIP(req)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, ipnet := range chInfo.allowedNets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Re-output of decrypted channels to a secondary multicast group, either
+// given per channel with the output attribute or mapped from the original
+// group into -output-range, e.g. 239.1.1.2 => 239.2.1.2 with 239.2.0.0/16.
+
+var outputRange *net.IPNet
+var outputTTL int
+var outputIface string
+
+type outputStatus struct {
+	Name     string `json:"name"`
+	Addr     string `json:"addr"`
+	Running  bool   `json:"running"`
+	Restarts int    `json:"restarts"`
+}
+
+var outputsMu sync.Mutex
+var outputs = make(map[string]*outputStatus)
+
+func parseOutputRange(s string) (*net.IPNet, error) {
+	if s == "" {
+		return nil, nil
+	}
+	ip, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() == nil || !ip.IsMulticast() {
+		return nil, fmt.Errorf("%s is not an IPv4 multicast range", s)
+	}
+	return ipnet, nil
+}
+
+// outputAddr returns the address where the channel is re-emitted, empty if
+// it is not
+func outputAddr(chInfo ChannelInfo) string {
+	if chInfo.output != "" {
+		return chInfo.output
+	}
+	if outputRange == nil {
+		return ""
+	}
+	host, port, _ := net.SplitHostPort(chInfo.addr)
+	group := net.ParseIP(host).To4()
+	if group == nil {
+		return ""
+	}
+	netIP := outputRange.IP.To4()
+	mask := outputRange.Mask
+	ip := make(net.IP, 4)
+	for i := range ip {
+		ip[i] = netIP[i] | group[i]&^mask[len(mask)-4+i]
+	}
+	return net.JoinHostPort(ip.String(), port)
+}
+
+func outputQuery() url.Values {
+	q := url.Values{}
+	if outputTTL > 0 {
+		q.Set("ttl", strconv.Itoa(outputTTL))
+	}
+	if outputIface != "" {
+		q.Set("iface", outputIface)
+	}
+	return q
+}
+
+func setOutputRunning(k string, running, restart bool) {
+	outputsMu.Lock()
+	defer outputsMu.Unlock()
+	st := outputs[k]
+	st.Running = running
+	if restart {
+		st.Restarts++
+	}
+}
+
+func reoutput(k, addr string) {
+	for first := true; backgroundCtx.Err() == nil; first = false {
+		chInfo, ok := lookupChannel(k)
+		if !ok {
+			log.Printf("Re-emitted channel %s not found", k)
+			return
+		}
+		if until, disabled := channelDisabled(chInfo.addr); disabled {
+			time.Sleep(time.Until(until))
+		}
+		conn, err := dialRelay(addr, outputQuery())
+		if err != nil {
+			log.Printf("%v @ %v", err, addr)
+			time.Sleep(prejoinRetry)
+			continue
+		}
+		ch := newChannel(chInfo, false)
+		log.Printf("Re-emitting channel @ %v to %v, session %v", chInfo.addr, addr, ch.id)
+		setOutputRunning(k, true, !first)
+		decryptWG.Add(1)
+		withChannelLabels(ch, func() { decryptRTP(backgroundCtx, ch, chInfo, newRelayWriter(conn)) })
+		setOutputRunning(k, false, false)
+		time.Sleep(prejoinRetry)
+	}
+}
+
+// startOutputs starts the re-output of the channels which have an output
+// address and are not re-emitted yet
+func startOutputs() {
+	outputsMu.Lock()
+	defer outputsMu.Unlock()
+	for _, k := range sortedChannels() {
+		if _, ok := outputs[k]; ok {
+			continue
+		}
+		chInfo, _ := lookupChannel(k)
+		addr := outputAddr(chInfo)
+		if addr == "" {
+			continue
+		}
+		if addr == chInfo.addr {
+			log.Printf("Not re-emitting channel @ %v to its own group", addr)
+			continue
+		}
+		name, _ := url.PathUnescape(k)
+		outputs[k] = &outputStatus{Name: name, Addr: addr}
+		go reoutput(k, addr)
+	}
+}
+
+func outputStatuses() []outputStatus {
+	outputsMu.Lock()
+	defer outputsMu.Unlock()
+	statuses := make([]outputStatus, 0)
+	for _, st := range outputs {
+		statuses = append(statuses, *st)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
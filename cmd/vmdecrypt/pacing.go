@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Relay output pacing. The bitrate of the stream is measured from the PCR
+// and the datagrams are sent evenly at that rate instead of in the bursts
+// in which they are received.
+
+var pacingEnabled = false
+var pacingSmoothing = 0.9
+
+// how far the sender may fall behind the schedule before it is reset
+const maxPacingLag = 500 * time.Millisecond
+
+const pcrWrap = (1 << 33) * 300
+
+type pacedDatagram struct {
+	data []byte
+	dur  time.Duration
+}
+
+type pacedWriter struct {
+	out     relayWriter
+	queue   chan pacedDatagram
+	done    chan bool
+	mu      sync.Mutex
+	err     error
+	pcrPid  uint16
+	pcrSeen bool
+	lastPCR uint64
+	bytes   int
+	rate    float64 // bytes per second
+}
+
+func newPacedWriter(out relayWriter) *pacedWriter {
+	pw := &pacedWriter{
+		out:   out,
+		queue: make(chan pacedDatagram, 1024),
+		done:  make(chan bool),
+	}
+	go pw.send()
+	return pw
+}
+
+// packetPCR returns the PCR of a TS packet in 27MHz units
+func packetPCR(pkt []byte) (uint64, bool) {
+	if pkt[3]&0x20 == 0 || pkt[4] < 7 || pkt[5]&0x10 == 0 {
+		return 0, false
+	}
+	base := uint64(pkt[6])<<25 | uint64(pkt[7])<<17 | uint64(pkt[8])<<9 | uint64(pkt[9])<<1 | uint64(pkt[10])>>7
+	ext := (uint64(pkt[10])&1)<<8 | uint64(pkt[11])
+	return base*300 + ext, true
+}
+
+func (pw *pacedWriter) measure(ts []byte) {
+	for ; len(ts) >= 188; ts = ts[188:] {
+		pw.bytes += 188
+		if ts[0] != 0x47 {
+			continue
+		}
+		pid := (uint16(ts[1])<<8 | uint16(ts[2])) & 0x1fff
+		if pw.pcrSeen && pid != pw.pcrPid {
+			continue
+		}
+		pcr, ok := packetPCR(ts)
+		if !ok {
+			continue
+		}
+		if pw.pcrSeen {
+			delta := (pcr + pcrWrap - pw.lastPCR) % pcrWrap
+			// ignore discontinuities
+			if delta > 0 && delta < 27000000 {
+				rate := float64(pw.bytes) * 27000000 / float64(delta)
+				if pw.rate == 0 {
+					pw.rate = rate
+				} else {
+					pw.rate = pacingSmoothing*pw.rate + (1-pacingSmoothing)*rate
+				}
+			}
+		}
+		pw.pcrPid, pw.pcrSeen = pid, true
+		pw.lastPCR = pcr
+		pw.bytes = 0
+	}
+}
+
+func (pw *pacedWriter) Write(p []byte) (int, error) {
+	pw.mu.Lock()
+	err := pw.err
+	pw.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	// RTP header (if any) precedes the TS packets
+	ts := p[len(p)%188:]
+	pw.measure(ts)
+	var dur time.Duration
+	if pw.rate > 0 {
+		dur = time.Duration(float64(len(ts)) / pw.rate * float64(time.Second))
+	}
+	data := make([]byte, len(p))
+	copy(data, p)
+	pw.queue <- pacedDatagram{data, dur}
+	return len(p), nil
+}
+
+func (pw *pacedWriter) send() {
+	var next time.Time
+	for d := range pw.queue {
+		now := time.Now()
+		if now.Sub(next) > maxPacingLag {
+			next = now
+		}
+		if wait := next.Sub(now); wait > 0 {
+			pw.out.Flush()
+			time.Sleep(wait)
+		}
+		if _, err := pw.out.Write(d.data); err != nil {
+			pw.mu.Lock()
+			pw.err = err
+			pw.mu.Unlock()
+		}
+		next = next.Add(d.dur)
+	}
+	pw.out.Flush()
+	pw.done <- true
+}
+
+func (pw *pacedWriter) Flush() error {
+	return nil
+}
+
+func (pw *pacedWriter) Close() error {
+	close(pw.queue)
+	<-pw.done
+	return pw.out.Close()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parental control: restricted channels require the PIN (or a token
+// entitled to them) and are hidden from playlists requested without it.
+
+var parentalPin string
+var restrictedChannels = make(map[string]bool)
+
+func parseRestricted(s string) {
+	if s == "" {
+		return
+	}
+	for _, name := range strings.Split(s, ",") {
+		restrictedChannels[url.PathEscape(strings.TrimSpace(name))] = true
+	}
+}
+
+func pinOK(req *http.Request) bool {
+	pin := req.URL.Query().Get("pin")
+	return parentalPin != "" && subtle.ConstantTimeCompare([]byte(pin), []byte(parentalPin)) == 1
+}
+
+func channelAllowed(req *http.Request, k string) bool {
+	chInfo, _ := lookupChannel(k)
+	return (!restrictedChannels[k] || pinOK(req) || tokenEntitled(req)) && networkAllowed(req, chInfo)
+}
+
+// visibleChannels returns the sorted channel names which can be listed
+// in playlists for the given request
+func visibleChannels(req *http.Request) []string {
+	keys := make([]string, 0)
+	for _, k := range sortedChannels() {
+		if channelAllowed(req, k) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// getChannel looks up the channel and checks if the request can access it
+func getChannel(w http.ResponseWriter, req *http.Request, k string) (ChannelInfo, bool) {
+	if refuseMaintenance(w, req) {
+		return ChannelInfo{}, false
+	}
+	if !checkToken(w, req) {
+		return ChannelInfo{}, false
+	}
+	chInfo, ok := lookupChannel(k)
+	if !ok {
+		httpError(w, req, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return chInfo, false
+	}
+	if !channelAllowed(req, k) {
+		httpError(w, req, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return chInfo, false
+	}
+	if until, disabled := channelDisabled(chInfo.addr); disabled {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+		httpError(w, req, "Channel disabled due to errors until "+until.Format(time.RFC3339), http.StatusServiceUnavailable)
+		return chInfo, false
+	}
+	return chInfo, true
+}
@@ -0,0 +1,39 @@
+package main
+
+import "github.com/rgerganov/vmdecrypt"
+
+// PES helpers of the outputs which take elementary streams from the TS.
+
+// pesPayload returns the elementary stream data carried in a TS packet
+func pesPayload(pkt []byte) []byte {
+	payload, ok := vmdecrypt.TSPayload(pkt)
+	if !ok {
+		return nil
+	}
+	if pkt[1]&0x40 != 0 {
+		// PES header
+		if len(payload) < 9 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+			return nil
+		}
+		hdrLen := 9 + int(payload[8])
+		if hdrLen > len(payload) {
+			return nil
+		}
+		payload = payload[hdrLen:]
+	}
+	return payload
+}
+
+// pesPTS returns the PTS of a PES starting in the given TS packet
+func pesPTS(pkt []byte) (uint64, bool) {
+	if pkt[1]&0x40 == 0 {
+		return 0, false
+	}
+	pes, _ := vmdecrypt.TSPayload(pkt)
+	if len(pes) < 14 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 || pes[7]&0x80 == 0 {
+		return 0, false
+	}
+	p := pes[9:14]
+	pts := uint64(p[0]>>1&7)<<30 | uint64(p[1])<<22 | uint64(p[2]>>1)<<15 | uint64(p[3])<<7 | uint64(p[4]>>1)
+	return pts, true
+}
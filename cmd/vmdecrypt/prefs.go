@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Per-token favorites and hidden channels. They are saved next to the
+// tokens file and used for the personal playlists at
+// /u/<token>/channels.m3u.
+
+type userPrefs struct {
+	Favorites []string `json:"favorites"`
+	Hidden    []string `json:"hidden"`
+}
+
+var prefsMu sync.Mutex
+
+// token => preferences
+var prefs map[string]*userPrefs
+
+func loadPrefs() {
+	prefs = make(map[string]*userPrefs)
+	if data, err := ioutil.ReadFile(tokensFile + ".prefs"); err == nil {
+		if err := json.Unmarshal(data, &prefs); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// savePrefs must be called with prefsMu held
+func savePrefs() {
+	data, _ := json.Marshal(prefs)
+	if err := ioutil.WriteFile(tokensFile+".prefs", data, 0600); err != nil {
+		log.Println(err)
+	}
+}
+
+func getPrefs(token string) userPrefs {
+	prefsMu.Lock()
+	defer prefsMu.Unlock()
+	if p, ok := prefs[token]; ok {
+		return userPrefs{append([]string{}, p.Favorites...), append([]string{}, p.Hidden...)}
+	}
+	return userPrefs{[]string{}, []string{}}
+}
+
+func addName(list []string, name string) []string {
+	for _, n := range list {
+		if n == name {
+			return list
+		}
+	}
+	return append(list, name)
+}
+
+func removeName(list []string, name string) []string {
+	res := make([]string, 0)
+	for _, n := range list {
+		if n != name {
+			res = append(res, n)
+		}
+	}
+	return res
+}
+
+// prefsHandler returns the preferences of the token, POST updates them
+// with the favorite, unfavorite, hide and unhide parameters
+func prefsHandler(w http.ResponseWriter, req *http.Request) {
+	t := requestToken(req)
+	if t == nil {
+		httpError(w, req, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if req.Method == http.MethodPost {
+		req.ParseForm()
+		prefsMu.Lock()
+		p, ok := prefs[t.Token]
+		if !ok {
+			p = &userPrefs{[]string{}, []string{}}
+			prefs[t.Token] = p
+		}
+		for _, name := range req.Form["favorite"] {
+			p.Favorites = addName(p.Favorites, name)
+		}
+		for _, name := range req.Form["unfavorite"] {
+			p.Favorites = removeName(p.Favorites, name)
+		}
+		for _, name := range req.Form["hide"] {
+			p.Hidden = addName(p.Hidden, name)
+		}
+		for _, name := range req.Form["unhide"] {
+			p.Hidden = removeName(p.Hidden, name)
+		}
+		savePrefs()
+		prefsMu.Unlock()
+	}
+	writeJSON(w, getPrefs(t.Token))
+}
+
+// personalM3UHandler serves /u/<token>/channels.m3u with the favorites
+// first and without the hidden channels
+func personalM3UHandler(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(req.URL.Path[len("/u/"):], "/")
+	if len(parts) != 2 || parts[1] != "channels.m3u" {
+		httpError(w, req, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	// the playlist URLs carry the token as a query parameter
+	q := req.URL.Query()
+	q.Set("token", parts[0])
+	req.URL.RawQuery = q.Encode()
+	if !checkToken(w, req) {
+		return
+	}
+	p := getPrefs(parts[0])
+	hidden := make(map[string]bool)
+	for _, name := range p.Hidden {
+		hidden[url.PathEscape(name)] = true
+	}
+	visible := make(map[string]bool)
+	for _, k := range playlistChannels(req) {
+		visible[k] = true
+	}
+	keys := make([]string, 0)
+	for _, name := range p.Favorites {
+		k := url.PathEscape(name)
+		if visible[k] && !hidden[k] {
+			keys = append(keys, k)
+			hidden[k] = true
+		}
+	}
+	for _, k := range playlistChannels(req) {
+		if !hidden[k] {
+			keys = append(keys, k)
+		}
+	}
+	writeM3U(w, req, keys)
+}
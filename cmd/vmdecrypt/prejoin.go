@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Channels given with -prejoin are decrypted from the start regardless of
+// clients and restarted when they stop because of errors. They are stopped
+// in standby.
+
+const prejoinRetry = 5 * time.Second
+
+type prejoinStatus struct {
+	Name     string `json:"name"`
+	Running  bool   `json:"running"`
+	Restarts int    `json:"restarts"`
+}
+
+var prejoinMu sync.Mutex
+var prejoined = make(map[string]*prejoinStatus)
+
+// channelKeys parses a comma separated list of channel names
+func channelKeys(s string) []string {
+	keys := make([]string, 0)
+	if s == "" {
+		return keys
+	}
+	for _, name := range strings.Split(s, ",") {
+		keys = append(keys, url.PathEscape(strings.TrimSpace(name)))
+	}
+	return keys
+}
+
+// waitIOErr waits until the channel stops or ctx is done
+func (ch *Channel) waitIOErr(ctx context.Context) {
+	stop := context.AfterFunc(ctx, func() {
+		ch.mu.Lock()
+		ch.c.Broadcast()
+		ch.mu.Unlock()
+	})
+	defer stop()
+	ch.mu.Lock()
+	for !ch.ioerr && ctx.Err() == nil {
+		ch.c.Wait()
+	}
+	ch.mu.Unlock()
+}
+
+func setPrejoinRunning(k string, running, restart bool) {
+	prejoinMu.Lock()
+	defer prejoinMu.Unlock()
+	st := prejoined[k]
+	st.Running = running
+	if restart {
+		st.Restarts++
+	}
+}
+
+func prejoin(k string) {
+	for restart := false; backgroundCtx.Err() == nil; {
+		awakeCtx := awake()
+		chInfo, ok := lookupChannel(k)
+		if !ok {
+			log.Printf("Prejoined channel %s not found", k)
+			return
+		}
+		if until, disabled := channelDisabled(chInfo.addr); disabled {
+			time.Sleep(time.Until(until))
+		}
+		log.Println("Prejoining channel @", chInfo.addr)
+		setPrejoinRunning(k, true, restart)
+		ch := attachChannel(chInfo)
+		ctx, cancel := context.WithCancel(awakeCtx)
+		stop := context.AfterFunc(backgroundCtx, cancel)
+		ch.waitIOErr(ctx)
+		restart = ctx.Err() == nil
+		stop()
+		cancel()
+		detachChannel(chInfo)
+		setPrejoinRunning(k, false, false)
+		if restart {
+			time.Sleep(prejoinRetry)
+		}
+	}
+}
+
+func startPrejoin(keys []string) {
+	prejoinMu.Lock()
+	for _, k := range keys {
+		if _, ok := prejoined[k]; !ok {
+			name, _ := url.PathUnescape(k)
+			prejoined[k] = &prejoinStatus{Name: name}
+			go prejoin(k)
+		}
+	}
+	prejoinMu.Unlock()
+}
+
+func prejoinStatuses() []prejoinStatus {
+	prejoinMu.Lock()
+	defer prejoinMu.Unlock()
+	statuses := make([]prejoinStatus, 0)
+	for _, st := range prejoined {
+		statuses = append(statuses, *st)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Per-channel CPU profiles. The goroutines of a channel are labeled with
+// its address and session, the profile can be narrowed down to them with
+// "go tool pprof -tagfocus channel=<addr>".
+
+const maxProfileSeconds = 60
+
+func withChannelLabels(ch *Channel, f func()) {
+	pprof.Do(context.Background(), pprof.Labels("channel", ch.addr, "session", ch.id), func(context.Context) {
+		f()
+	})
+}
+
+func profileHandler(w http.ResponseWriter, req *http.Request) {
+	// requestURI should be /api/profile/CNN?seconds=10
+	chName := strings.SplitN(req.RequestURI[len("/api/profile/"):], "?", 2)[0]
+	chInfo, ok := getChannel(w, req, chName)
+	if !ok {
+		return
+	}
+	seconds, err := strconv.Atoi(req.URL.Query().Get("seconds"))
+	if err != nil || seconds < 1 || seconds > maxProfileSeconds {
+		seconds = 10
+	}
+	runningChannelsMu.Lock()
+	_, running := runningChannels[chInfo.sessionKey()]
+	runningChannelsMu.Unlock()
+	if !running {
+		httpError(w, req, "Channel is not running", http.StatusNotFound)
+		return
+	}
+	var buf bytes.Buffer
+	if err := pprof.StartCPUProfile(&buf); err != nil {
+		httpError(w, req, err.Error(), http.StatusConflict)
+		return
+	}
+	reqLogf(req, "Profiling channel @ %v for %d seconds", chInfo.addr, seconds)
+	select {
+	case <-time.After(time.Duration(seconds) * time.Second):
+	case <-req.Context().Done():
+	}
+	pprof.StopCPUProfile()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-cpu.pprof"`, chName))
+	w.Header().Set("X-Pprof-Tagfocus", "channel="+chInfo.addr)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recordings: with -record-dir the decrypted TS of a channel is written to
+// disk for a given duration, started with POST /record/<channel> or by
+// -record-schedule. The files are named after -record-template and rotated
+// every -record-segment, the oldest files are removed when the recordings
+// exceed -record-quota. Finished files can be remuxed into MP4 or MKV, see
+// remux.go.
+
+var recordDir string
+var recordTemplate string
+var recordSegment time.Duration
+var recordQuota int64 // MiB, 0 = unlimited
+
+const recordQuotaInterval = 10 * time.Second
+
+type recording struct {
+	ID        string    `json:"id"`
+	Channel   string    `json:"channel"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	File      string    `json:"file"` // the current one, relative to -record-dir
+	Bytes     int64     `json:"bytes"`
+	Scheduled bool      `json:"scheduled"`
+
+	key  string
+	stop chan struct{}
+}
+
+var recordingsMu sync.Mutex
+
+// ID => running recording
+var recordings = make(map[string]*recording)
+
+var recordingsWG sync.WaitGroup
+
+type recordSchedule struct {
+	key     string
+	window  maintenanceWindow
+	lastEnd time.Time // of the last started recording
+}
+
+var recordSchedules []*recordSchedule
+
+// parseRecordSchedule parses recordings like "CNN@20:00/1h" (daily, local
+// time) or "BBC@2026-10-20T20:00:00Z/30m" (one-off)
+func parseRecordSchedule(s string) ([]*recordSchedule, error) {
+	schedules := make([]*recordSchedule, 0)
+	if s == "" {
+		return schedules, nil
+	}
+	for _, r := range strings.Split(s, ",") {
+		i := strings.LastIndex(r, "@")
+		if i < 1 {
+			return nil, fmt.Errorf("Invalid recording %q, expected CHANNEL@START/DURATION", r)
+		}
+		w, err := parseWindow(r[i+1:], "recording")
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, &recordSchedule{key: url.PathEscape(strings.TrimSpace(r[:i])), window: w})
+	}
+	return schedules, nil
+}
+
+func validateRecording() error {
+	if recordDir == "" {
+		return nil
+	}
+	if st, err := os.Stat(recordDir); err != nil {
+		return err
+	} else if !st.IsDir() {
+		return fmt.Errorf("%s is not a directory", recordDir)
+	}
+	if recordTemplate == "" || filepath.IsAbs(recordTemplate) || strings.Contains(recordTemplate, "..") {
+		return fmt.Errorf("Invalid recording template %q", recordTemplate)
+	}
+	if recordSegment < 0 || recordQuota < 0 {
+		return fmt.Errorf("Recording segment and quota must not be negative")
+	}
+	return nil
+}
+
+// recordFile returns the file name of a recording part started at t
+func recordFile(name string, t time.Time) string {
+	name = strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(name)
+	return strings.NewReplacer(
+		"{channel}", name,
+		"{start}", t.Format("20060102T150405"),
+		"{date}", t.Format("2006-01-02"),
+		"{time}", t.Format("150405"),
+	).Replace(recordTemplate)
+}
+
+// enforceRecordQuota removes the oldest recorded files which are not being
+// written until the recordings fit into the quota, it reports if they do
+func enforceRecordQuota() bool {
+	if recordQuota == 0 {
+		return true
+	}
+	recordingsMu.Lock()
+	open := make(map[string]bool)
+	for _, r := range recordings {
+		open[r.File] = true
+	}
+	recordingsMu.Unlock()
+	for _, f := range remuxing() {
+		open[f] = true
+	}
+	type recordedFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	files := make([]recordedFile, 0)
+	total := int64(0)
+	filepath.WalkDir(recordDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !isRecording(path) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		total += info.Size()
+		if rel, _ := filepath.Rel(recordDir, path); !open[rel] {
+			files = append(files, recordedFile{path, info.Size(), info.ModTime()})
+		}
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, f := range files {
+		if total <= recordQuota<<20 {
+			break
+		}
+		if err := os.Remove(f.path); err != nil {
+			log.Println(err)
+			continue
+		}
+		log.Printf("Removed recording %s, quota exceeded", f.path)
+		total -= f.size
+	}
+	return total <= recordQuota<<20
+}
+
+// isRecording reports if the file is a recording or a remuxed one
+func isRecording(path string) bool {
+	switch filepath.Ext(strings.TrimSuffix(path, ".part")) {
+	case ".ts", ".mp4", ".mkv":
+		return true
+	}
+	return false
+}
+
+func startRecording(k string, end time.Time, scheduled bool) *recording {
+	r := &recording{ID: newID(), Channel: displayName(k), Start: time.Now(), End: end, Scheduled: scheduled,
+		key: k, stop: make(chan struct{})}
+	recordingsMu.Lock()
+	recordings[r.ID] = r
+	recordingsMu.Unlock()
+	recordingsWG.Add(1)
+	go r.run()
+	return r
+}
+
+// stopRecordings stops all recordings, e.g. on shutdown
+func stopRecordings() {
+	recordingsMu.Lock()
+	defer recordingsMu.Unlock()
+	for id, r := range recordings {
+		close(r.stop)
+		delete(recordings, id)
+	}
+}
+
+// waitRecordings waits until the stopped recordings have closed their files
+func waitRecordings(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		recordingsWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+func (r *recording) stopped() bool {
+	select {
+	case <-r.stop:
+		return true
+	default:
+		return time.Now().After(r.End)
+	}
+}
+
+func (r *recording) run() {
+	defer recordingsWG.Done()
+	log.Printf("Recording %s until %v", r.Channel, r.End.Format(time.RFC3339))
+	w := &recordWriter{r: r}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for !r.stopped() && !w.full {
+		chInfo, ok := lookupChannel(r.key)
+		if !ok {
+			log.Printf("Recorded channel %s not found", r.key)
+			break
+		}
+		ch := attachChannel(chInfo)
+		ptr, pos := ch.currentPos()
+		for !r.stopped() && !w.full {
+			var val interface{}
+			ptr, val = ch.nextPtr(ctx, ptr)
+			if val == nil {
+				break
+			}
+			if ch.overrun(pos) {
+				ptr, pos = ch.currentPos()
+				continue
+			}
+			pos++
+			if err := w.write(val.([]byte)); err != nil {
+				log.Printf("%v @ %v", err, chInfo.addr)
+				w.full = true
+			}
+		}
+		detachChannel(chInfo)
+		if !r.stopped() && !w.full {
+			select {
+			case <-r.stop:
+			case <-time.After(prejoinRetry):
+			}
+		}
+	}
+	w.close()
+	recordingsMu.Lock()
+	delete(recordings, r.ID)
+	recordingsMu.Unlock()
+	log.Printf("Recording of %s stopped, %d bytes", r.Channel, r.Bytes)
+}
+
+// recordWriter writes the packets of a recording and rotates its files
+type recordWriter struct {
+	r          *recording
+	f          *os.File
+	bw         *bufio.Writer
+	opened     time.Time
+	quotaCheck time.Time
+	full       bool // quota exceeded or write error
+}
+
+func (w *recordWriter) close() {
+	if w.f == nil {
+		return
+	}
+	if err := w.bw.Flush(); err != nil {
+		log.Println(err)
+	}
+	w.f.Close()
+	w.f = nil
+	if recordRemux != "" {
+		recordingsMu.Lock()
+		name := w.r.File
+		recordingsMu.Unlock()
+		if _, err := queueRemux(name, recordRemux); err != nil {
+			log.Printf("%v, %s is not remuxed", err, name)
+		}
+	}
+}
+
+func (w *recordWriter) write(pkt []byte) error {
+	now := time.Now()
+	if w.f != nil && recordSegment > 0 && now.Sub(w.opened) >= recordSegment {
+		w.close()
+	}
+	if w.f == nil {
+		name := recordFile(w.r.Channel, now)
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(recordDir, name)), 0755); err != nil {
+			return err
+		}
+		// another recording of the channel may have started in the same
+		// second
+		ext := filepath.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		f, err := os.OpenFile(filepath.Join(recordDir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		for i := 2; os.IsExist(err); i++ {
+			name = fmt.Sprintf("%s-%d%s", base, i, ext)
+			f, err = os.OpenFile(filepath.Join(recordDir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		}
+		if err != nil {
+			return err
+		}
+		w.f, w.bw, w.opened = f, bufio.NewWriterSize(f, 1<<16), now
+		recordingsMu.Lock()
+		w.r.File = name
+		recordingsMu.Unlock()
+	}
+	if now.Sub(w.quotaCheck) >= recordQuotaInterval {
+		w.quotaCheck = now
+		if !enforceRecordQuota() {
+			w.full = true
+			log.Printf("Recording of %s stopped, quota of %d MiB exceeded", w.r.Channel, recordQuota)
+			return nil
+		}
+	}
+	n, err := w.bw.Write(pkt)
+	recordingsMu.Lock()
+	w.r.Bytes += int64(n)
+	recordingsMu.Unlock()
+	return err
+}
+
+func watchRecordSchedules() {
+	for {
+		now := time.Now()
+		for _, s := range recordSchedules {
+			if end, ok := s.window.end(now); ok && !end.Equal(s.lastEnd) && !shuttingDown.Load() {
+				s.lastEnd = end
+				startRecording(s.key, end, true)
+			}
+		}
+		time.Sleep(10 * time.Second)
+	}
+}
+
+func runningRecordings(k string) []recording {
+	recordingsMu.Lock()
+	defer recordingsMu.Unlock()
+	list := make([]recording, 0)
+	for _, r := range recordings {
+		if k == "" || r.key == k {
+			list = append(list, *r)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Start.Before(list[j].Start) })
+	return list
+}
+
+// recordHandler starts (POST /record/CNN?duration=1h) and stops (DELETE)
+// the recordings of a channel and lists them (GET, /record/ for all)
+func recordHandler(w http.ResponseWriter, req *http.Request) {
+	chName := strings.SplitN(req.RequestURI[len("/record/"):], "?", 2)[0]
+	if chName == "" && req.Method == http.MethodGet {
+		writeJSON(w, runningRecordings(""))
+		return
+	}
+	if _, ok := getChannel(w, req, chName); !ok {
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(w, runningRecordings(chName))
+	case http.MethodPost:
+		d, err := time.ParseDuration(req.FormValue("duration"))
+		if err != nil || d <= 0 {
+			httpError(w, req, "Invalid duration "+req.FormValue("duration"), http.StatusBadRequest)
+			return
+		}
+		r := startRecording(chName, time.Now().Add(d), false)
+		reqLogf(req, "Recording %s started by %v", r.Channel, req.RemoteAddr)
+		recordingsMu.Lock()
+		status := *r
+		recordingsMu.Unlock()
+		writeJSON(w, status)
+	case http.MethodDelete:
+		list := runningRecordings(chName)
+		recordingsMu.Lock()
+		for _, r := range list {
+			if running, ok := recordings[r.ID]; ok {
+				close(running.stop)
+				delete(recordings, r.ID)
+			}
+		}
+		recordingsMu.Unlock()
+		writeJSON(w, list)
+	default:
+		httpError(w, req, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Rejoining after I/O errors: when the group stops sending or can't be
+// joined, the channel keeps its clients and joins the group again with an
+// exponential backoff. It gives up when the outage lasts -outage.
+
+var outageLimit = 30 * time.Second
+
+const minRejoinDelay = 500 * time.Millisecond
+const maxRejoinDelay = 8 * time.Second
+
+// sourceError is an I/O error of the source
+type sourceError struct {
+	err error
+}
+
+func (e sourceError) Error() string {
+	return e.err.Error()
+}
+
+func (e sourceError) Unwrap() error {
+	return e.err
+}
+
+func isSourceError(err error) bool {
+	var se sourceError
+	return errors.As(err, &se)
+}
+
+func (ch *Channel) packetsWritten() uint64 {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.written
+}
+
+// decryptSource joins the group and decrypts until an error or until ctx
+// is canceled
+func (ch *Channel) decryptSource(ctx context.Context, chInfo ChannelInfo) error {
+	src, err := openSource(chInfo)
+	if err != nil {
+		recordError(chInfo.addr, "join")
+		return sourceError{err}
+	}
+	ch.logf("Start decrypting channel @ %v", chInfo.addr)
+	// a blocked read returns when the channel is canceled
+	stop := context.AfterFunc(ctx, func() { src.Close() })
+	err = ch.decrypt(ctx, src, chInfo.inputFormat(), ch.relay)
+	if stop() {
+		src.Close()
+	}
+	return err
+}
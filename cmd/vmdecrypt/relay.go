@@ -0,0 +1,350 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// Writers for relaying decrypted datagrams. On Linux consecutive datagrams
+// of the same size are batched and sent with one syscall using UDP
+// segmentation offload (GSO).
+
+const gsoMaxSegments = 8
+const gsoMaxDelay = 2 * time.Millisecond
+const gsoMaxSize = 65507 // max UDP payload over IPv4
+
+var gsoEnabled = true
+
+type relayWriter interface {
+	Write(p []byte) (int, error)
+	Flush() error
+	Close() error
+}
+
+type plainWriter struct {
+	conn *net.UDPConn
+}
+
+func (pw *plainWriter) Write(p []byte) (int, error) {
+	return pw.conn.Write(p)
+}
+
+func (pw *plainWriter) Flush() error {
+	return nil
+}
+
+func (pw *plainWriter) Close() error {
+	return pw.conn.Close()
+}
+
+func newRelayWriter(conn *net.UDPConn) relayWriter {
+	var w relayWriter = &plainWriter{conn}
+	if gsoEnabled && gsoSupported(conn) {
+		w = &gsoWriter{conn: conn}
+	}
+	if pacingEnabled {
+		w = newPacedWriter(w)
+	}
+	return w
+}
+
+type gsoWriter struct {
+	conn    *net.UDPConn
+	buf     []byte
+	segSize int
+	count   int
+	first   time.Time
+}
+
+func (gw *gsoWriter) Write(p []byte) (int, error) {
+	if gw.count > 0 && (len(p) != gw.segSize || gw.count == gsoMaxSegments || len(gw.buf)+len(p) > gsoMaxSize || time.Since(gw.first) > gsoMaxDelay) {
+		if err := gw.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	if gw.count == 0 {
+		gw.segSize = len(p)
+		gw.first = time.Now()
+	}
+	gw.buf = append(gw.buf, p...)
+	gw.count++
+	return len(p), nil
+}
+
+func (gw *gsoWriter) Flush() error {
+	if gw.count == 0 {
+		return nil
+	}
+	var err error
+	if gw.count == 1 {
+		_, err = gw.conn.Write(gw.buf)
+	} else {
+		err = writeSegments(gw.conn, gw.buf, gw.segSize)
+	}
+	gw.buf = gw.buf[:0]
+	gw.count = 0
+	return err
+}
+
+func (gw *gsoWriter) Close() error {
+	err := gw.Flush()
+	gw.conn.Close()
+	return err
+}
+
+func interfaceAddr(ifi *net.Interface) (net.IP, error) {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("No IPv4 address on %s", ifi.Name)
+}
+
+// dialRelay opens the relay output with the output interface, TTL and DSCP
+// given with the iface, ttl and dscp parameters
+func dialRelay(addr string, q url.Values) (*net.UDPConn, error) {
+	raddr, err := resolveUDPAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	multicast := raddr.IP.IsMulticast()
+	var outIfi *net.Interface
+	var laddr *net.UDPAddr
+	if s := q.Get("lport"); s != "" {
+		// a fixed local port lets a peer behind NAT punch a hole to it
+		port, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid local port %s", s)
+		}
+		laddr = &net.UDPAddr{Port: int(port)}
+	}
+	if s := q.Get("iface"); s != "" {
+		if outIfi, err = net.InterfaceByName(s); err != nil {
+			return nil, err
+		}
+		if !multicast {
+			ip, err := interfaceAddr(outIfi)
+			if err != nil {
+				return nil, err
+			}
+			if laddr == nil {
+				laddr = &net.UDPAddr{}
+			}
+			laddr.IP = ip
+		}
+	}
+	conn, err := net.DialUDP("udp", laddr, raddr)
+	if err != nil {
+		return nil, err
+	}
+	if err := configureRelay(conn, q, outIfi); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func configureRelay(conn *net.UDPConn, q url.Values, outIfi *net.Interface) error {
+	multicast := conn.RemoteAddr().(*net.UDPAddr).IP.IsMulticast()
+	if multicast && outIfi != nil {
+		if err := ipv4.NewPacketConn(conn).SetMulticastInterface(outIfi); err != nil {
+			return err
+		}
+	}
+	if s := q.Get("ttl"); s != "" {
+		ttl, err := strconv.Atoi(s)
+		if err != nil || ttl < 1 || ttl > 255 {
+			return fmt.Errorf("Invalid TTL %s", s)
+		}
+		if multicast {
+			err = ipv4.NewPacketConn(conn).SetMulticastTTL(ttl)
+		} else {
+			err = ipv4.NewConn(conn).SetTTL(ttl)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if s := q.Get("dscp"); s != "" {
+		dscp, err := strconv.Atoi(s)
+		if err != nil || dscp < 0 || dscp > 63 {
+			return fmt.Errorf("Invalid DSCP %s", s)
+		}
+		if err := ipv4.NewConn(conn).SetTOS(dscp << 2); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var errPeerGone = errors.New("Relay destination is gone")
+
+// peerWriter sends keepalives when nothing was sent for a while and stops
+// the relay when the destination does not send anything back (e.g. RTCP
+// or its own keepalives) within the timeout, or reports it unreachable
+type peerWriter struct {
+	relayWriter
+	conn      *net.UDPConn
+	lastWrite atomic.Int64
+	gone      atomic.Bool
+	stop      chan bool
+}
+
+func newPeerWriter(w relayWriter, conn *net.UDPConn, keepalive, timeout time.Duration) *peerWriter {
+	pw := &peerWriter{relayWriter: w, conn: conn, stop: make(chan bool)}
+	pw.lastWrite.Store(time.Now().UnixNano())
+	// the first packet opens the NAT mapping towards the peer
+	conn.Write([]byte{})
+	if keepalive > 0 {
+		go pw.keepalive(keepalive)
+	}
+	if timeout > 0 {
+		go pw.watch(timeout)
+	}
+	return pw
+}
+
+func (pw *peerWriter) keepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pw.stop:
+			return
+		case <-ticker.C:
+			if pw.gone.Load() {
+				return
+			}
+			if time.Since(time.Unix(0, pw.lastWrite.Load())) >= interval {
+				pw.conn.Write([]byte{})
+			}
+		}
+	}
+}
+
+func (pw *peerWriter) watch(timeout time.Duration) {
+	buf := make([]byte, 1500)
+	for {
+		pw.conn.SetReadDeadline(time.Now().Add(timeout))
+		if _, err := pw.conn.Read(buf); err != nil {
+			select {
+			case <-pw.stop:
+			default:
+				log.Printf("%v @ %v", err, pw.conn.RemoteAddr())
+				pw.gone.Store(true)
+			}
+			return
+		}
+	}
+}
+
+func (pw *peerWriter) Write(p []byte) (int, error) {
+	if pw.gone.Load() {
+		return 0, errPeerGone
+	}
+	pw.lastWrite.Store(time.Now().UnixNano())
+	return pw.relayWriter.Write(p)
+}
+
+func (pw *peerWriter) Close() error {
+	close(pw.stop)
+	return pw.relayWriter.Close()
+}
+
+// relayOutput returns the writer for the relay destination, keepalive and
+// timeout enable the keepalives and the liveness check of the peer
+func relayOutput(conn *net.UDPConn, q url.Values) (relayWriter, error) {
+	var keepalive, timeout time.Duration
+	var err error
+	if s := q.Get("keepalive"); s != "" {
+		if keepalive, err = time.ParseDuration(s); err != nil || keepalive <= 0 {
+			return nil, fmt.Errorf("Invalid keepalive %s", s)
+		}
+	}
+	if s := q.Get("timeout"); s != "" {
+		if timeout, err = time.ParseDuration(s); err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("Invalid timeout %s", s)
+		}
+	}
+	w := newRelayWriter(conn)
+	if keepalive > 0 || timeout > 0 {
+		w = newPeerWriter(w, conn, keepalive, timeout)
+	}
+	return w, nil
+}
+
+// channelRelay is an RTP relay of a running channel, it shares the join and
+// the decryption with the HTTP clients of the channel
+type channelRelay struct {
+	id     string
+	chInfo ChannelInfo
+	out    relayWriter
+}
+
+// addRelay adds a relay to the attached channel, it reports false and
+// closes the relay when the channel has already stopped
+func (ch *Channel) addRelay(r *channelRelay) bool {
+	runningRelays.Add(1)
+	ch.relaysMu.Lock()
+	stopped := ch.relaysClosed
+	if !stopped {
+		ch.relays = append(ch.relays, r)
+	}
+	ch.relaysMu.Unlock()
+	if stopped {
+		r.close()
+	}
+	return !stopped
+}
+
+// relay writes a decrypted datagram to the relays of the channel, the ones
+// which fail are stopped
+func (ch *Channel) relay(payload []byte) error {
+	ch.relaysMu.Lock()
+	var failed []*channelRelay
+	relays := ch.relays[:0]
+	for _, r := range ch.relays {
+		if _, err := r.out.Write(payload); err != nil {
+			ch.logf("%v, stop relaying session %v", err, r.id)
+			failed = append(failed, r)
+		} else {
+			relays = append(relays, r)
+		}
+	}
+	ch.relays = relays
+	ch.relaysMu.Unlock()
+	for _, r := range failed {
+		r.close()
+	}
+	return nil
+}
+
+// closeRelays stops the relays when the channel stops
+func (ch *Channel) closeRelays() {
+	ch.relaysMu.Lock()
+	relays := ch.relays
+	ch.relays, ch.relaysClosed = nil, true
+	ch.relaysMu.Unlock()
+	for _, r := range relays {
+		r.close()
+	}
+}
+
+func (r *channelRelay) close() {
+	r.out.Close()
+	runningRelays.Add(-1)
+	detachChannel(r.chInfo)
+}
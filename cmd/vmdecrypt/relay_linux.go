@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	solUDP     = 17  // SOL_UDP
+	udpSegment = 103 // UDP_SEGMENT from linux/udp.h
+)
+
+func gsoSupported(conn *net.UDPConn) bool {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	supported := false
+	rc.Control(func(fd uintptr) {
+		_, err := syscall.GetsockoptInt(int(fd), solUDP, udpSegment)
+		supported = err == nil
+	})
+	return supported
+}
+
+func writeSegments(conn *net.UDPConn, buf []byte, segSize int) error {
+	oob := make([]byte, syscall.CmsgSpace(2))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = solUDP
+	h.Type = udpSegment
+	h.SetLen(syscall.CmsgLen(2))
+	binary.NativeEndian.PutUint16(oob[syscall.CmsgLen(0):], uint16(segSize))
+	_, _, err := conn.WriteMsgUDP(buf, oob, nil)
+	if err == nil {
+		return nil
+	}
+	// GSO not supported by the route/device, fall back to separate writes
+	for len(buf) > 0 {
+		n := segSize
+		if n > len(buf) {
+			n = len(buf)
+		}
+		if _, err := conn.Write(buf[:n]); err != nil {
+			return err
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+func gsoSupported(conn *net.UDPConn) bool {
+	return false
+}
+
+func writeSegments(conn *net.UDPConn, buf []byte, segSize int) error {
+	for len(buf) > 0 {
+		n := segSize
+		if n > len(buf) {
+			n = len(buf)
+		}
+		if _, err := conn.Write(buf[:n]); err != nil {
+			return err
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// benchSource returns n RTP datagrams of 7 clear TS packets each
+type benchSource struct {
+	n   int
+	seq uint16
+	buf []byte
+}
+
+func newBenchSource(n int) *benchSource {
+	buf := make([]byte, 12+7*188)
+	buf[0], buf[1] = 0x80, 33
+	for i := 0; i < 7; i++ {
+		pkt := buf[12+i*188 : 12+(i+1)*188]
+		pkt[0], pkt[1], pkt[2], pkt[3] = 0x47, 0x01, 0x00, 0x10
+	}
+	return &benchSource{n: n, buf: buf}
+}
+
+func (s *benchSource) ReadPacket(ctx context.Context) ([]byte, error) {
+	if s.n == 0 {
+		return nil, io.EOF
+	}
+	s.n--
+	s.seq++
+	binary.BigEndian.PutUint16(s.buf[2:4], s.seq)
+	for i := 0; i < 7; i++ {
+		pkt := s.buf[12+i*188:]
+		pkt[3] = 0x10 | byte(int(s.seq)*7+i)&0xf
+	}
+	return s.buf, nil
+}
+
+func (s *benchSource) Close() error {
+	return nil
+}
+
+// benchmarkRelay decrypts b.N datagrams and relays them to a local UDP
+// socket like a re-output, the rate is reported in TS packets per second
+func benchmarkRelay(b *testing.B, gso bool) {
+	defer func(v bool) { gsoEnabled = v }(gsoEnabled)
+	gsoEnabled = gso
+	sink, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sink.Close()
+	sink.SetReadBuffer(8 << 20)
+	go func() {
+		buf := make([]byte, gsoMaxSize)
+		for {
+			if _, err := sink.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	conn, err := net.DialUDP("udp4", nil, sink.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		b.Fatal(err)
+	}
+	dest := newRelayWriter(conn)
+	defer dest.Close()
+	chInfo := ChannelInfo{addr: "239.1.1.1:1234", masterKey: "00000000000000000000000000000000"}
+	ch := newChannel(chInfo, false)
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	err = ch.decrypt(context.Background(), newBenchSource(b.N), "rtp", func(payload []byte) error {
+		_, err := dest.Write(payload)
+		return err
+	})
+	dest.Flush()
+	b.StopTimer()
+	if _, ok := err.(sourceError); !ok {
+		b.Fatal(err)
+	}
+	b.ReportMetric(float64(7*b.N)/time.Since(start).Seconds(), "pkts/s")
+}
+
+func BenchmarkRelay(b *testing.B) {
+	benchmarkRelay(b, false)
+}
+
+func BenchmarkRelayGSO(b *testing.B) {
+	benchmarkRelay(b, true)
+}
+
+// BenchmarkDecrypt measures the relay path without the socket writes
+func BenchmarkDecrypt(b *testing.B) {
+	chInfo := ChannelInfo{addr: "239.1.1.1:1234", masterKey: "00000000000000000000000000000000"}
+	ch := newChannel(chInfo, false)
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	err := ch.decrypt(context.Background(), newBenchSource(b.N), "rtp", func([]byte) error { return nil })
+	b.StopTimer()
+	if _, ok := err.(sourceError); !ok {
+		b.Fatal(err)
+	}
+	b.ReportMetric(float64(7*b.N)/time.Since(start).Seconds(), "pkts/s")
+}
@@ -0,0 +1,932 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rgerganov/vmdecrypt"
+)
+
+// Remuxing of recordings into MP4 or MKV without transcoding: the H.264,
+// MPEG-2 video, AAC, MPEG audio and AC-3 streams of the first program are
+// copied into the new container. The timestamps start at zero, wrap
+// arounds are removed and gaps, e.g. when the recording rejoined the
+// channel, are closed. With -record-remux every finished file of a
+// recording is remuxed in the background and the TS is removed unless
+// -record-keep-ts is given, POST /api/remux?file=<file>&format=mkv remuxes
+// a recorded file and GET /api/remux lists the jobs.
+
+var recordRemux string
+var recordKeepTS bool
+
+var remuxFormats = map[string]bool{"mp4": true, "mkv": true}
+
+// timestamps which jump further ahead are discontinuities
+const remuxMaxJump = 10 * 90000
+
+// the samples which are buffered until the codec parameters of all
+// streams are known
+const remuxMaxPending = 4000
+
+type remuxJob struct {
+	ID       string     `json:"id"`
+	File     string     `json:"file"` // relative to -record-dir
+	Format   string     `json:"format"`
+	Status   string     `json:"status"` // queued, running, done or failed
+	Error    string     `json:"error,omitempty"`
+	Output   string     `json:"output,omitempty"`
+	Queued   time.Time  `json:"queued"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+var remuxMu sync.Mutex
+
+// the jobs in the order they were queued, the finished ones are dropped
+// beyond maxRemuxJobs
+var remuxJobs []*remuxJob
+var remuxQueue = make(chan *remuxJob, maxRemuxJobs)
+
+const maxRemuxJobs = 100
+
+func validateRemux() error {
+	if recordRemux != "" && !remuxFormats[recordRemux] {
+		return fmt.Errorf("Unknown remux format %q, expected mp4 or mkv", recordRemux)
+	}
+	return nil
+}
+
+// queueRemux queues the remuxing of a recorded file
+func queueRemux(file, format string) (*remuxJob, error) {
+	j := &remuxJob{ID: newID(), File: file, Format: format, Status: "queued", Queued: time.Now()}
+	select {
+	case remuxQueue <- j:
+	default:
+		return nil, errors.New("Remux queue is full")
+	}
+	remuxMu.Lock()
+	remuxJobs = append(remuxJobs, j)
+	for i := 0; len(remuxJobs) > maxRemuxJobs && i < len(remuxJobs); i++ {
+		if s := remuxJobs[i].Status; s == "done" || s == "failed" {
+			remuxJobs = append(remuxJobs[:i], remuxJobs[i+1:]...)
+			i--
+		}
+	}
+	remuxMu.Unlock()
+	return j, nil
+}
+
+func remuxWorker() {
+	for j := range remuxQueue {
+		remuxMu.Lock()
+		j.Status = "running"
+		remuxMu.Unlock()
+		src := filepath.Join(recordDir, j.File)
+		output := strings.TrimSuffix(j.File, filepath.Ext(j.File)) + "." + j.Format
+		err := remuxFile(src, filepath.Join(recordDir, output), j.Format)
+		if err == nil && !recordKeepTS {
+			err = os.Remove(src)
+		}
+		now := time.Now()
+		remuxMu.Lock()
+		j.Status, j.Output, j.Finished = "done", output, &now
+		if err != nil {
+			j.Status, j.Error = "failed", err.Error()
+		}
+		remuxMu.Unlock()
+		if err != nil {
+			log.Printf("Remuxing %s failed: %v", j.File, err)
+		} else {
+			log.Printf("Remuxed %s to %s", j.File, output)
+		}
+	}
+}
+
+// remuxing returns the files being read or written by the running job
+func remuxing() []string {
+	remuxMu.Lock()
+	defer remuxMu.Unlock()
+	for _, j := range remuxJobs {
+		if j.Status == "running" {
+			output := strings.TrimSuffix(j.File, filepath.Ext(j.File)) + "." + j.Format
+			return []string{j.File, output + ".part"}
+		}
+	}
+	return nil
+}
+
+// remuxHandler lists the remux jobs (GET) or queues one (POST with ?file=
+// relative to -record-dir and ?format=mp4 or mkv)
+func remuxHandler(w http.ResponseWriter, req *http.Request) {
+	if recordDir == "" {
+		httpError(w, req, "Remuxing requires -record-dir", http.StatusNotFound)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		remuxMu.Lock()
+		list := make([]remuxJob, 0, len(remuxJobs))
+		for _, j := range remuxJobs {
+			list = append(list, *j)
+		}
+		remuxMu.Unlock()
+		writeJSON(w, list)
+	case http.MethodPost:
+		file, format := filepath.Clean(req.FormValue("file")), req.FormValue("format")
+		if format == "" {
+			format = "mp4"
+		}
+		if !remuxFormats[format] {
+			httpError(w, req, "Unknown format "+format, http.StatusBadRequest)
+			return
+		}
+		if filepath.IsAbs(file) || strings.HasPrefix(file, "..") || !strings.HasSuffix(file, ".ts") {
+			httpError(w, req, "Invalid file "+req.FormValue("file"), http.StatusBadRequest)
+			return
+		}
+		if st, err := os.Stat(filepath.Join(recordDir, file)); err != nil || !st.Mode().IsRegular() {
+			httpError(w, req, "No such recording "+file, http.StatusNotFound)
+			return
+		}
+		for _, r := range runningRecordings("") {
+			if r.File == file {
+				httpError(w, req, "The file is still being recorded", http.StatusConflict)
+				return
+			}
+		}
+		j, err := queueRemux(file, format)
+		if err != nil {
+			httpError(w, req, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		reqLogf(req, "Remuxing of %s to %s queued by %v", file, format, req.RemoteAddr)
+		remuxMu.Lock()
+		status := *j
+		remuxMu.Unlock()
+		writeJSON(w, status)
+	default:
+		httpError(w, req, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// remuxTrack is an elementary stream copied into the new container
+type remuxTrack struct {
+	id         int
+	video      bool
+	codec      string // h264, mpeg1video, mpeg2video, aac, mp1, mp2, mp3 or ac3
+	width      int
+	height     int
+	sampleRate int
+	channels   int
+	lsf        bool   // MPEG-2 audio (lower sampling frequencies)
+	config     []byte // avcC, sequence header, AudioSpecificConfig or dac3, nil until known
+}
+
+// remuxSample is an access unit or audio frame, the timestamps are in
+// 90kHz units
+type remuxSample struct {
+	track *remuxTrack
+	dts   int64
+	pts   int64
+	key   bool
+	data  []byte
+}
+
+type remuxMuxer interface {
+	writeSample(s remuxSample) error
+	close() error
+}
+
+// remuxClock removes wrap arounds and discontinuities from the timestamps
+// of a stream
+type remuxClock struct {
+	started bool
+	lastRaw uint64
+	last    int64
+	step    int64 // the last regular increment
+}
+
+// signed33 returns the difference of two 33-bit timestamps
+func signed33(a, b uint64) int64 {
+	d := int64((a - b) & (1<<33 - 1))
+	if d >= 1<<32 {
+		d -= 1 << 33
+	}
+	return d
+}
+
+func (c *remuxClock) next(raw uint64) int64 {
+	if !c.started {
+		c.started, c.lastRaw, c.last = true, raw, int64(raw)
+		return c.last
+	}
+	d := signed33(raw, c.lastRaw)
+	c.lastRaw = raw
+	if d > remuxMaxJump || d < 0 {
+		// decoding times only increase, continue after the last sample
+		d = c.step
+	} else if d > 0 {
+		c.step = d
+	}
+	c.last += d
+	return c.last
+}
+
+// remuxStream assembles the PES packets of a PID
+type remuxStream struct {
+	track *remuxTrack
+	clock remuxClock
+	pes   []byte
+	rai   bool // random_access_indicator of the first packet
+
+	// audio frames which continue in the next PES
+	audio       []byte
+	audioStart  int64
+	audioFrames int64
+}
+
+type remuxDemuxer struct {
+	pmtPid  uint16
+	streams map[uint16]*remuxStream
+	tracks  []*remuxTrack
+	emit    func(remuxSample) error
+}
+
+// stream type => codec, the DVB AC-3 descriptor marks AC-3 in private
+// streams
+var remuxCodecs = map[byte]string{
+	0x01: "mpeg1video",
+	0x02: "mpeg2video",
+	0x1b: "h264",
+	0x03: "mpeg-audio",
+	0x04: "mpeg-audio",
+	0x0f: "aac",
+	0x81: "ac3",
+}
+
+func (d *remuxDemuxer) parsePMT(sec []byte) {
+	if len(sec) < 16 || sec[0] != 2 {
+		return
+	}
+	end := 3 + int(binary.BigEndian.Uint16(sec[1:3])&0x0fff) - 4
+	esStart := 12 + int(binary.BigEndian.Uint16(sec[10:12])&0x0fff)
+	if end > len(sec) || esStart > end {
+		return
+	}
+	es := sec[esStart:end]
+	d.streams = make(map[uint16]*remuxStream)
+	for len(es) >= 5 {
+		streamType := es[0]
+		pid := binary.BigEndian.Uint16(es[1:3]) & 0x1fff
+		infoLength := int(binary.BigEndian.Uint16(es[3:5]) & 0x0fff)
+		if 5+infoLength > len(es) {
+			break
+		}
+		for desc := es[5 : 5+infoLength]; len(desc) >= 2 && 2+int(desc[1]) <= len(desc); desc = desc[2+int(desc[1]):] {
+			if streamType == 0x06 && desc[0] == 0x6a {
+				streamType = 0x81
+			}
+		}
+		es = es[5+infoLength:]
+		codec, ok := remuxCodecs[streamType]
+		if !ok {
+			log.Printf("Remux: stream type 0x%02x of PID 0x%x is not supported, skipped", streamType, pid)
+			continue
+		}
+		t := &remuxTrack{id: len(d.tracks) + 1, video: strings.HasSuffix(codec, "video") || codec == "h264", codec: codec}
+		d.tracks = append(d.tracks, t)
+		d.streams[pid] = &remuxStream{track: t}
+	}
+}
+
+func (d *remuxDemuxer) packet(pkt []byte) error {
+	pid := binary.BigEndian.Uint16(pkt[1:3]) & 0x1fff
+	if d.streams == nil {
+		sec, ok := vmdecrypt.Section(pkt)
+		if ok && pid == 0 && d.pmtPid == 0 && len(sec) >= 12 && sec[0] == 0 {
+			end := 3 + int(binary.BigEndian.Uint16(sec[1:3])&0x0fff) - 4
+			if end < 8 || end > len(sec) {
+				return nil
+			}
+			for prog := sec[8:end]; len(prog) >= 4; prog = prog[4:] {
+				if binary.BigEndian.Uint16(prog[0:2]) != 0 {
+					d.pmtPid = binary.BigEndian.Uint16(prog[2:4]) & 0x1fff
+					break
+				}
+			}
+		} else if ok && pid == d.pmtPid && pid != 0 {
+			d.parsePMT(sec)
+		}
+		return nil
+	}
+	s, ok := d.streams[pid]
+	if !ok || pkt[3]&0x10 == 0 {
+		return nil
+	}
+	payload := pkt[4:]
+	if pkt[3]&0x20 != 0 {
+		if int(pkt[4])+1 >= len(payload) {
+			return nil
+		}
+		payload = payload[1+pkt[4]:]
+	}
+	if pkt[1]&0x40 != 0 {
+		if err := d.flush(s); err != nil {
+			return err
+		}
+		s.pes = append(s.pes[:0], payload...)
+		s.rai = pkt[3]&0x20 != 0 && pkt[4] > 0 && pkt[5]&0x40 != 0
+	} else if s.pes != nil {
+		s.pes = append(s.pes, payload...)
+	}
+	return nil
+}
+
+// parsePES returns the payload of a PES packet and its timestamps
+func parsePES(pes []byte) (payload []byte, pts, dts uint64, ok bool) {
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		return nil, 0, 0, false
+	}
+	hdrLen := 9 + int(pes[8])
+	if hdrLen > len(pes) {
+		return nil, 0, 0, false
+	}
+	timestamp := func(p []byte) uint64 {
+		return uint64(p[0]>>1&7)<<30 | uint64(p[1])<<22 | uint64(p[2]>>1)<<15 | uint64(p[3])<<7 | uint64(p[4]>>1)
+	}
+	if pes[7]&0x80 == 0 || hdrLen < 14 {
+		return pes[hdrLen:], 0, 0, false
+	}
+	pts = timestamp(pes[9:14])
+	dts = pts
+	if pes[7]&0x40 != 0 && hdrLen >= 19 {
+		dts = timestamp(pes[14:19])
+	}
+	return pes[hdrLen:], pts, dts, true
+}
+
+// flush emits the samples of the assembled PES of the stream
+func (d *remuxDemuxer) flush(s *remuxStream) error {
+	if s.pes == nil {
+		return nil
+	}
+	payload, pts, dts, ok := parsePES(s.pes)
+	s.pes = s.pes[:0]
+	if payload == nil {
+		return nil
+	}
+	t := s.track
+	if t.video {
+		if !ok {
+			// video access units without timestamps can't be placed
+			return nil
+		}
+		sample := remuxSample{track: t, dts: s.clock.next(dts), key: s.rai}
+		sample.pts = sample.dts + signed33(pts, dts)
+		if t.codec == "h264" {
+			sample.data, sample.key = h264Sample(t, payload, sample.key)
+		} else {
+			sample.data, sample.key = mpegVideoSample(t, append([]byte(nil), payload...), sample.key)
+		}
+		if sample.data == nil {
+			return nil
+		}
+		return d.emit(sample)
+	}
+	if ok {
+		start := s.clock.next(pts)
+		if len(s.audio) == 0 {
+			s.audioStart, s.audioFrames = start, 0
+		}
+	} else if len(s.audio) == 0 && !s.clock.started {
+		return nil
+	}
+	s.audio = append(s.audio, payload...)
+	for {
+		frame, samples, skip := audioFrame(t, s.audio)
+		if frame == nil {
+			s.audio = s.audio[skip:]
+			return nil
+		}
+		s.audio = s.audio[skip+len(frame):]
+		ts := s.audioStart + s.audioFrames*int64(samples)*90000/int64(t.sampleRate)
+		s.audioFrames++
+		data := frame
+		if t.codec == "aac" {
+			// without the ADTS header
+			data = frame[adtsHeaderLength(frame):]
+		}
+		if err := d.emit(remuxSample{track: t, dts: ts, pts: ts, key: true, data: append([]byte(nil), data...)}); err != nil {
+			return err
+		}
+	}
+}
+
+// annexBUnits splits an H.264 access unit into its NAL units
+func annexBUnits(data []byte) [][]byte {
+	units := make([][]byte, 0)
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			units = append(units, trimZeros(data[start:i]))
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(data) {
+		units = append(units, data[start:])
+	}
+	return units
+}
+
+func trimZeros(b []byte) []byte {
+	for len(b) > 0 && b[len(b)-1] == 0 {
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+// h264Sample converts an access unit to length prefixed NAL units and
+// reports if it is a key frame, the SPS and PPS set the track config
+func h264Sample(t *remuxTrack, data []byte, key bool) ([]byte, bool) {
+	sample := make([]byte, 0, len(data)+16)
+	var sps, pps []byte
+	for _, nal := range annexBUnits(data) {
+		if len(nal) == 0 {
+			continue
+		}
+		switch nal[0] & 0x1f {
+		case 9, 12: // access unit delimiter, filler data
+			continue
+		case 5:
+			key = true
+		case 1:
+			br := bitReader{b: unescapeRBSP(nal[1:])}
+			br.ue() // first_mb_in_slice
+			if br.ue()%5 == 2 {
+				// I slice
+				key = true
+			}
+		case 7:
+			sps = nal
+		case 8:
+			pps = nal
+		}
+		sample = binary.BigEndian.AppendUint32(sample, uint32(len(nal)))
+		sample = append(sample, nal...)
+	}
+	if t.config == nil && sps != nil && pps != nil && len(sps) >= 4 {
+		t.width, t.height = h264Size(sps)
+		avcC := []byte{1, sps[1], sps[2], sps[3], 0xff, 0xe1}
+		avcC = binary.BigEndian.AppendUint16(avcC, uint16(len(sps)))
+		avcC = append(avcC, sps...)
+		avcC = append(avcC, 1)
+		avcC = binary.BigEndian.AppendUint16(avcC, uint16(len(pps)))
+		t.config = append(avcC, pps...)
+	}
+	if len(sample) == 0 {
+		return nil, false
+	}
+	return sample, key
+}
+
+// mpegVideoSample reports if an MPEG-1/2 picture is an I frame, the
+// sequence header sets the track config
+func mpegVideoSample(t *remuxTrack, data []byte, key bool) ([]byte, bool) {
+	for i := 0; i+6 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		switch data[i+3] {
+		case 0xb3:
+			if t.config == nil {
+				t.width = int(data[i+4])<<4 | int(data[i+5])>>4
+				t.height = int(data[i+5]&0x0f)<<8 | int(data[i+6])
+				// up to the GOP or picture header, with the extensions
+				end := len(data)
+				for j := i + 4; j+3 < len(data); j++ {
+					if data[j] == 0 && data[j+1] == 0 && data[j+2] == 1 && (data[j+3] == 0xb8 || data[j+3] == 0) {
+						end = j
+						break
+					}
+				}
+				t.config = append([]byte(nil), data[i:end]...)
+			}
+		case 0:
+			if (data[i+5]>>3)&7 == 1 {
+				key = true
+			}
+			return data, key
+		}
+	}
+	return data, key
+}
+
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+var mpegAudioBitrates = map[string][]int{
+	"v1l1": {0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+	"v1l2": {0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+	"v1l3": {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	"v2l1": {0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+	"v2l2": {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+}
+
+var ac3Bitrates = []int{32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 448, 512, 576, 640}
+
+func adtsHeaderLength(frame []byte) int {
+	if frame[1]&1 == 0 {
+		return 9
+	}
+	return 7
+}
+
+// audioFrame returns the first complete audio frame in buf, its samples
+// and the bytes to skip before it, nil if there is none. The first frame
+// sets the track config.
+func audioFrame(t *remuxTrack, buf []byte) ([]byte, int, int) {
+	for i := 0; i+7 <= len(buf); i++ {
+		h := buf[i:]
+		var size, samples int
+		switch t.codec {
+		case "aac":
+			if h[0] != 0xff || h[1]&0xf6 != 0xf0 || int(h[2]>>2&0x0f) >= len(aacSampleRates) {
+				continue
+			}
+			size = int(h[3]&3)<<11 | int(h[4])<<3 | int(h[5])>>5
+			if size <= adtsHeaderLength(h) {
+				continue
+			}
+			samples = 1024
+			if t.config == nil {
+				profile, rate, channels := h[2]>>6, h[2]>>2&0x0f, h[2]&1<<2|h[3]>>6
+				t.sampleRate, t.channels = aacSampleRates[rate], int(channels)
+				t.config = []byte{(profile+1)<<3 | rate>>1, rate&1<<7 | channels<<3}
+			}
+		case "mpeg-audio", "mp1", "mp2", "mp3":
+			version, layer, rate := h[1]>>3&3, h[1]>>1&3, int(h[2]>>2&3)
+			if h[0] != 0xff || h[1]&0xe0 != 0xe0 || version == 1 || layer == 0 || rate == 3 {
+				continue
+			}
+			table := "v1"
+			sampleRate := []int{44100, 48000, 32000}[rate]
+			if version != 3 {
+				table = "v2"
+				sampleRate /= 2
+				if version == 0 {
+					sampleRate /= 2
+				}
+			}
+			table += map[byte]string{3: "l1", 2: "l2", 1: "l2"}[layer]
+			if version == 3 && layer == 1 {
+				table = "v1l3"
+			}
+			index := int(h[2] >> 4)
+			if index == 0 || index == 15 {
+				continue
+			}
+			bitrate, padding := mpegAudioBitrates[table][index]*1000, int(h[2]>>1&1)
+			switch {
+			case layer == 3:
+				size, samples = (12*bitrate/sampleRate+padding)*4, 384
+			case layer == 1 && version != 3:
+				size, samples = 72*bitrate/sampleRate+padding, 576
+			default:
+				size, samples = 144*bitrate/sampleRate+padding, 1152
+			}
+			if t.config == nil {
+				t.codec = map[byte]string{3: "mp1", 2: "mp2", 1: "mp3"}[layer]
+				t.sampleRate, t.lsf = sampleRate, version != 3
+				t.channels = 2
+				if h[3]>>6 == 3 {
+					t.channels = 1
+				}
+				t.config = []byte{}
+			}
+		case "ac3":
+			fscod, frmsizecod := h[4]>>6, int(h[4]&0x3f)
+			if h[0] != 0x0b || h[1] != 0x77 || fscod == 3 || frmsizecod >= 2*len(ac3Bitrates) || h[5]>>3 > 10 {
+				continue
+			}
+			bitrate := ac3Bitrates[frmsizecod>>1]
+			size = []int{4 * bitrate, 2 * (bitrate*320/147 + frmsizecod&1), 6 * bitrate}[fscod]
+			samples = 1536
+			if t.config == nil {
+				br := bitReader{b: h[5:8]}
+				bsid, bsmod, acmod := br.bits(5), br.bits(3), br.bits(3)
+				if acmod&1 != 0 && acmod != 1 {
+					br.bits(2) // cmixlev
+				}
+				if acmod&4 != 0 {
+					br.bits(2) // surmixlev
+				}
+				if acmod == 2 {
+					br.bits(2) // dsurmod
+				}
+				lfeon := br.bits(1)
+				t.sampleRate = []int{48000, 44100, 32000}[fscod]
+				t.channels = []int{2, 1, 2, 3, 3, 4, 4, 5}[acmod] + int(lfeon)
+				dac3 := uint32(fscod)<<22 | bsid<<17 | bsmod<<14 | acmod<<11 | lfeon<<10 | uint32(frmsizecod>>1)<<5
+				t.config = []byte{byte(dac3 >> 16), byte(dac3 >> 8), byte(dac3)}
+			}
+		}
+		if i+size > len(buf) {
+			return nil, 0, i
+		}
+		return buf[i : i+size], samples, i
+	}
+	// keep a possible partial header
+	skip := len(buf) - 6
+	if skip < 0 {
+		skip = 0
+	}
+	return nil, 0, skip
+}
+
+// bitReader reads the bits of a byte slice MSB first, past the end it
+// returns zeros
+type bitReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	v := uint32(0)
+	for ; n > 0; n-- {
+		bit := uint32(0)
+		if r.pos/8 < len(r.b) {
+			bit = uint32(r.b[r.pos/8]>>(7-r.pos%8)) & 1
+		}
+		v = v<<1 | bit
+		r.pos++
+	}
+	return v
+}
+
+// ue reads an Exp-Golomb code
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for r.bits(1) == 0 && zeros < 32 {
+		zeros++
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+func (r *bitReader) se() int32 {
+	k := r.ue()
+	if k&1 != 0 {
+		return int32(k+1) / 2
+	}
+	return -int32(k / 2)
+}
+
+// unescapeRBSP removes the emulation prevention bytes of a NAL unit
+func unescapeRBSP(nal []byte) []byte {
+	rbsp := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
+
+// h264Size returns the picture size of an SPS
+func h264Size(sps []byte) (int, int) {
+	br := bitReader{b: unescapeRBSP(sps[1:])}
+	profile := br.bits(8)
+	br.bits(16) // constraint flags, level
+	br.ue()     // seq_parameter_set_id
+	chroma := uint32(1)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if chroma = br.ue(); chroma == 3 {
+			br.bits(1) // separate_colour_plane_flag
+		}
+		br.ue()    // bit_depth_luma_minus8
+		br.ue()    // bit_depth_chroma_minus8
+		br.bits(1) // qpprime_y_zero_transform_bypass_flag
+		if br.bits(1) != 0 {
+			lists := 8
+			if chroma == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if br.bits(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + br.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	br.ue() // log2_max_frame_num_minus4
+	switch br.ue() {
+	case 0:
+		br.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		br.bits(1)
+		br.se()
+		br.se()
+		for n := br.ue(); n > 0; n-- {
+			br.se()
+		}
+	}
+	br.ue()    // max_num_ref_frames
+	br.bits(1) // gaps_in_frame_num_value_allowed_flag
+	width := int(br.ue()+1) * 16
+	mapUnits := int(br.ue() + 1)
+	frameMbsOnly := int(br.bits(1))
+	height := (2 - frameMbsOnly) * mapUnits * 16
+	if frameMbsOnly == 0 {
+		br.bits(1) // mb_adaptive_frame_field_flag
+	}
+	br.bits(1) // direct_8x8_inference_flag
+	if br.bits(1) != 0 {
+		left, right, top, bottom := int(br.ue()), int(br.ue()), int(br.ue()), int(br.ue())
+		cropX, cropY := 1, 2-frameMbsOnly
+		if chroma == 1 || chroma == 2 {
+			cropX = 2
+		}
+		if chroma == 1 {
+			cropY *= 2
+		}
+		width -= (left + right) * cropX
+		height -= (top + bottom) * cropY
+	}
+	return width, height
+}
+
+// remuxFile remuxes a TS file into MP4 or MKV, the output is written to
+// dst.part and renamed when it is complete
+func remuxFile(src, dst, format string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst + ".part")
+	if err != nil {
+		return err
+	}
+	err = remux(bufio.NewReaderSize(in, 1<<16), out, format)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst + ".part")
+		return err
+	}
+	return os.Rename(dst+".part", dst)
+}
+
+func remux(r io.Reader, out *os.File, format string) error {
+	var mux remuxMuxer
+	var tracks []*remuxTrack
+	var base int64
+	pending := make([]remuxSample, 0)
+	d := &remuxDemuxer{}
+	// start writes the buffered samples once the codec parameters are
+	// known, from the first video key frame on. If forced the streams
+	// without parameters are left out.
+	start := func(force bool) error {
+		ready := len(d.tracks) > 0
+		for _, t := range d.tracks {
+			ready = ready && t.config != nil
+		}
+		if !ready && !force {
+			return nil
+		}
+		video := false
+		tracks = tracks[:0]
+		for _, t := range d.tracks {
+			if t.config != nil {
+				tracks = append(tracks, t)
+				video = video || t.video
+			}
+		}
+		if len(tracks) == 0 {
+			return errors.New("No supported streams found")
+		}
+		first := 0
+		for video && first < len(pending) && !(pending[first].track.video && pending[first].key && trackListed(tracks, pending[first].track)) {
+			first++
+		}
+		if first == len(pending) {
+			if !force {
+				return nil
+			}
+			return errors.New("No video key frame found")
+		}
+		base = pending[first].dts
+		for i, t := range tracks {
+			t.id = i + 1
+		}
+		var err error
+		if format == "mkv" {
+			mux, err = newMKVMuxer(out, tracks)
+		} else {
+			mux, err = newMP4Muxer(out, tracks)
+		}
+		if err != nil {
+			return err
+		}
+		for _, s := range pending {
+			if err := writeRemuxSample(mux, tracks, s, base); err != nil {
+				return err
+			}
+		}
+		pending = nil
+		return nil
+	}
+	d.emit = func(s remuxSample) error {
+		if mux != nil {
+			return writeRemuxSample(mux, tracks, s, base)
+		}
+		pending = append(pending, s)
+		return start(len(pending) >= remuxMaxPending)
+	}
+	pkt := make([]byte, 188)
+	for {
+		if _, err := io.ReadFull(r, pkt[:1]); err != nil {
+			break
+		}
+		if pkt[0] != 0x47 {
+			continue
+		}
+		if _, err := io.ReadFull(r, pkt[1:]); err != nil {
+			break
+		}
+		if shuttingDown.Load() {
+			return errors.New("Server is shutting down")
+		}
+		if err := d.packet(pkt); err != nil {
+			return err
+		}
+	}
+	for _, s := range d.streams {
+		if err := d.flush(s); err != nil {
+			return err
+		}
+	}
+	if mux == nil {
+		if err := start(true); err != nil {
+			return err
+		}
+	}
+	return mux.close()
+}
+
+func trackListed(tracks []*remuxTrack, t *remuxTrack) bool {
+	for _, listed := range tracks {
+		if listed == t {
+			return true
+		}
+	}
+	return false
+}
+
+// writeRemuxSample writes a sample of the muxed tracks, the ones before
+// the start are dropped
+func writeRemuxSample(mux remuxMuxer, tracks []*remuxTrack, s remuxSample, base int64) error {
+	if !trackListed(tracks, s.track) || s.dts < base {
+		return nil
+	}
+	s.dts -= base
+	s.pts -= base
+	if s.pts < s.dts {
+		s.pts = s.dts
+	}
+	return mux.writeSample(s)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Request IDs for correlating log lines of HTTP requests and channel
+// sessions. X-Request-ID is accepted only from trusted proxies.
+
+type ctxKey int
+
+const requestIDKey ctxKey = 0
+
+var trustedProxies []*net.IPNet
+
+func newID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// parseNetworks parses a comma separated list of addresses and networks
+func parseNetworks(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	if s == "" {
+		return nets, nil
+	}
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// inNetworks reports if the host of the remote address is in one of nets
+func inNetworks(remoteAddr string, nets []*net.IPNet) bool {
+	host, _, _ := net.SplitHostPort(remoteAddr)
+	ip := net.ParseIP(host)
+	for _, ipnet := range nets {
+		if ip != nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTrustedProxies(s string) error {
+	var err error
+	trustedProxies, err = parseNetworks(s)
+	return err
+}
+
+func trustedProxy(remoteAddr string) bool {
+	return inNetworks(remoteAddr, trustedProxies)
+}
+
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 64 || !trustedProxy(req.RemoteAddr) {
+			id = newID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		h.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), requestIDKey, id)))
+	})
+}
+
+func requestID(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDKey).(string)
+	return id
+}
+
+func reqLogf(req *http.Request, format string, v ...interface{}) {
+	log.Printf("[%s] %s", requestID(req), fmt.Sprintf(format, v...))
+}
+
+// httpError is http.Error with the request ID added to the message
+func httpError(w http.ResponseWriter, req *http.Request, msg string, code int) {
+	http.Error(w, fmt.Sprintf("%s (request ID: %s)", msg, requestID(req)), code)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Key rotation timeline: the key changes announced by the ECMs, the starts
+// of the crypto periods (the packets switching to the other key) and the
+// errors and RTP discontinuities of every channel, so that the crypto period length can be checked
+// and playback glitches can be correlated with the rotations.
+
+const maxRotationEvents = 1000
+
+type rotationEvent struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`          // "key", "period" or "error"
+	Key   string    `json:"key,omitempty"`  // "odd" or "even"
+	Kind  string    `json:"kind,omitempty"` // of the error
+}
+
+var rotationMu sync.Mutex
+
+// session key (key and period events) or multicast address (errors) =>
+// events, oldest first
+var rotations = make(map[string][]rotationEvent)
+
+func keyParity(odd bool) string {
+	if odd {
+		return "odd"
+	}
+	return "even"
+}
+
+func recordRotation(key string, e rotationEvent) {
+	e.Time = time.Now()
+	rotationMu.Lock()
+	defer rotationMu.Unlock()
+	events := append(rotations[key], e)
+	if len(events) > maxRotationEvents {
+		events = append(events[:0], events[len(events)-maxRotationEvents:]...)
+	}
+	rotations[key] = events
+}
+
+type rotationPeriod struct {
+	Start   time.Time `json:"start"`
+	Seconds float64   `json:"seconds"`
+	Key     string    `json:"key"`
+}
+
+type rotationTimeline struct {
+	Channel      string           `json:"channel"`
+	Addr         string           `json:"addr"`
+	Events       []rotationEvent  `json:"events"`
+	Periods      []rotationPeriod `json:"periods"`       // the completed ones
+	MedianPeriod float64          `json:"median_period"` // seconds, 0 if unknown
+}
+
+func channelRotation(chName string, chInfo ChannelInfo) rotationTimeline {
+	rotationMu.Lock()
+	events := append(make([]rotationEvent, 0), rotations[chInfo.sessionKey()]...)
+	if chInfo.sessionKey() != chInfo.addr {
+		events = append(events, rotations[chInfo.addr]...)
+	}
+	rotationMu.Unlock()
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	t := rotationTimeline{Channel: displayName(chName), Addr: chInfo.addr, Events: events, Periods: make([]rotationPeriod, 0)}
+	var start *rotationEvent
+	for i, e := range events {
+		if e.Event != "period" {
+			continue
+		}
+		if start != nil {
+			t.Periods = append(t.Periods, rotationPeriod{start.Time, e.Time.Sub(start.Time).Seconds(), start.Key})
+		}
+		start = &events[i]
+	}
+	if len(t.Periods) > 0 {
+		lengths := make([]float64, len(t.Periods))
+		for i, p := range t.Periods {
+			lengths[i] = p.Seconds
+		}
+		sort.Float64s(lengths)
+		t.MedianPeriod = lengths[len(lengths)/2]
+	}
+	return t
+}
+
+var rotationTemplate = template.Must(template.ParseFS(webFS, "web/rotation.html"))
+
+type rotationBar struct {
+	X, W  float64 // percent of the width
+	Class string
+	Title string
+}
+
+type rotationMark struct {
+	X     float64
+	Class string
+	Title string
+}
+
+// rotationGraph lays out the timeline in percent of the graph width
+func rotationGraph(t rotationTimeline) ([]rotationBar, []rotationMark) {
+	bars := make([]rotationBar, 0)
+	marks := make([]rotationMark, 0)
+	if len(t.Events) == 0 {
+		return bars, marks
+	}
+	from, to := t.Events[0].Time, time.Now()
+	span := to.Sub(from).Seconds()
+	if span <= 0 {
+		span = 1
+	}
+	x := func(tm time.Time) float64 { return tm.Sub(from).Seconds() / span * 100 }
+	for i, p := range t.Periods {
+		bars = append(bars, rotationBar{x(p.Start), p.Seconds / span * 100, p.Key,
+			fmt.Sprintf("period %d: %s key, %.1fs from %s", i+1, p.Key, p.Seconds, p.Start.Format("15:04:05"))})
+	}
+	for _, e := range t.Events {
+		switch e.Event {
+		case "key":
+			marks = append(marks, rotationMark{x(e.Time), "key", fmt.Sprintf("new %s key at %s", e.Key, e.Time.Format("15:04:05.000"))})
+		case "error":
+			marks = append(marks, rotationMark{x(e.Time), "error", fmt.Sprintf("%s error at %s", e.Kind, e.Time.Format("15:04:05.000"))})
+		}
+	}
+	return bars, marks
+}
+
+func rotationHandler(w http.ResponseWriter, req *http.Request) {
+	// requestURI should be /api/rotation/CNN?format=html
+	chName := strings.SplitN(req.RequestURI[len("/api/rotation/"):], "?", 2)[0]
+	chInfo, ok := getChannel(w, req, chName)
+	if !ok {
+		return
+	}
+	t := channelRotation(chName, chInfo)
+	if req.URL.Query().Get("format") != "html" {
+		writeJSON(w, t)
+		return
+	}
+	bars, marks := rotationGraph(t)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rotationTemplate.Execute(w, struct {
+		Timeline rotationTimeline
+		Bars     []rotationBar
+		Marks    []rotationMark
+	}{t, bars, marks})
+}
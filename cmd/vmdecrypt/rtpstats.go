@@ -0,0 +1,59 @@
+package main
+
+// RTP statistics with sequence numbers and timestamps extended to 64 bits,
+// so counters stay correct across 16-bit sequence and 32-bit timestamp
+// wraps in multi-day sessions.
+
+var rtpClock = 90000
+
+type RTPStats struct {
+	Packets         uint64  `json:"packets"`
+	Lost            uint64  `json:"lost"`
+	OutOfOrder      uint64  `json:"out_of_order"`
+	Discontinuities uint64  `json:"discontinuities"`
+	ExtSeq          uint64  `json:"ext_seq"`
+	SeqCycles       uint64  `json:"seq_cycles"`
+	ExtTimestamp    uint64  `json:"ext_timestamp"`
+	Duration        float64 `json:"duration_seconds"`
+	firstTimestamp  uint64
+}
+
+// update accounts a packet and reports if it is not the expected next one
+func (st *RTPStats) update(seq uint16, ts uint32) bool {
+	st.Packets++
+	if st.Packets == 1 {
+		st.ExtSeq = uint64(seq)
+		st.ExtTimestamp = uint64(ts)
+		st.firstTimestamp = st.ExtTimestamp
+		return false
+	}
+	discontinuity := false
+	delta := int16(seq - uint16(st.ExtSeq))
+	if delta > 0 {
+		if uint16(st.ExtSeq)+uint16(delta) < uint16(st.ExtSeq) {
+			st.SeqCycles++
+		}
+		st.ExtSeq += uint64(delta)
+		if delta > 1 {
+			st.Lost += uint64(delta - 1)
+			discontinuity = true
+		}
+	} else {
+		st.OutOfOrder++
+		discontinuity = true
+	}
+	if tsDelta := int32(ts - uint32(st.ExtTimestamp)); tsDelta > 0 {
+		st.ExtTimestamp += uint64(tsDelta)
+	}
+	st.Duration = float64(st.ExtTimestamp-st.firstTimestamp) / float64(rtpClock)
+	if discontinuity {
+		st.Discontinuities++
+	}
+	return discontinuity
+}
+
+func (ch *Channel) rtpStats() RTPStats {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.stats
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rgerganov/vmdecrypt"
+	"golang.org/x/net/ipv4"
+)
+
+// Scanning a multicast range for active MPEG-TS groups.
+
+const maxDiscoverAddrs = 1024
+const discoverWorkers = 32
+
+type discoveredChannel struct {
+	Addr      string `json:"addr"`
+	Format    string `json:"format"` // rtp or udp
+	Service   string `json:"service,omitempty"`
+	Scrambled bool   `json:"scrambled"`
+	Known     bool   `json:"known"`
+}
+
+func probeGroup(hostPort string, ifi *net.Interface, timeout time.Duration) *discoveredChannel {
+	host, _, _ := net.SplitHostPort(hostPort)
+	group := net.ParseIP(host)
+	c, err := net.ListenPacket("udp4", hostPort)
+	if err != nil {
+		return nil
+	}
+	defer c.Close()
+	p := ipv4.NewPacketConn(c)
+	if err := p.JoinGroup(ifi, &net.UDPAddr{IP: group}); err != nil {
+		return nil
+	}
+	defer p.LeaveGroup(ifi, &net.UDPAddr{IP: group})
+
+	var result *discoveredChannel
+	var program uint16
+	pmtFound := false
+	buf := make([]byte, maxDatagramSize)
+	deadline := time.Now().Add(timeout)
+	p.SetReadDeadline(deadline)
+	for time.Now().Before(deadline) {
+		n, _, _, err := p.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		payload := buf[:n]
+		format := "udp"
+		if n > 12 && payload[0]>>6 == 2 {
+			hdr, err := vmdecrypt.ParseRTP(payload)
+			if err != nil || hdr.Offset >= n {
+				continue
+			}
+			payload, format = payload[hdr.Offset:], "rtp"
+		}
+		payload = vmdecrypt.StripRS(payload, 0)
+		if len(payload)%188 != 0 || payload[0] != 0x47 {
+			continue
+		}
+		if result == nil {
+			result = &discoveredChannel{Addr: hostPort, Format: format}
+		}
+		for ; len(payload) >= 188; payload = payload[188:] {
+			pkt := payload[:188]
+			pid := binary.BigEndian.Uint16(pkt[1:3]) & 0x1fff
+			if (pkt[3]>>6)&3 >= 2 {
+				result.Scrambled = true
+			}
+			sec, ok := vmdecrypt.Section(pkt)
+			if !ok {
+				continue
+			}
+			if pid == 0 && !pmtFound && len(sec) >= 10 && sec[0] == 0 {
+				program = binary.BigEndian.Uint16(sec[8:10])
+				pmtFound = true
+			}
+			if pid == 0x11 && pmtFound {
+				result.Service = vmdecrypt.ParseSDT(sec, program)
+			}
+		}
+		if result.Service != "" {
+			break
+		}
+	}
+	return result
+}
+
+func expandRange(cidr string, ports []string) ([]string, error) {
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() == nil || !ip.IsMulticast() {
+		return nil, fmt.Errorf("%s is not an IPv4 multicast range", cidr)
+	}
+	addrs := make([]string, 0)
+	for ip := ip.Mask(ipnet.Mask).To4(); ipnet.Contains(ip); ip = nextIP(ip) {
+		for _, port := range ports {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+		}
+		if len(addrs) > maxDiscoverAddrs {
+			return nil, fmt.Errorf("Range too large, at most %d addresses can be scanned", maxDiscoverAddrs)
+		}
+	}
+	return addrs, nil
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+func knownAddrs() map[string]bool {
+	known := make(map[string]bool)
+	for _, k := range sortedChannels() {
+		chInfo, _ := lookupChannel(k)
+		known[chInfo.addr] = true
+	}
+	return known
+}
+
+// scanHandler scans the multicast range given with range and ports on
+// the interface given with iface (GET) or adds a found channel to the lineup (POST with addr, name, key)
+func scanHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost {
+		addChannelHandler(w, req)
+		return
+	}
+	q := req.URL.Query()
+	ports := strings.Split(q.Get("ports"), ",")
+	for _, port := range ports {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			httpError(w, req, "Invalid port "+port, http.StatusBadRequest)
+			return
+		}
+	}
+	addrs, err := expandRange(q.Get("range"), ports)
+	if err != nil {
+		httpError(w, req, err.Error(), http.StatusBadRequest)
+		return
+	}
+	timeout, err := time.ParseDuration(q.Get("timeout"))
+	if err != nil {
+		timeout = 2 * time.Second
+	}
+	scanIfi, err := receiveInterface(q.Get("iface"))
+	if err != nil {
+		httpError(w, req, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reqLogf(req, "Scanning %d multicast groups", len(addrs))
+	known := knownAddrs()
+	results := make([]*discoveredChannel, len(addrs))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < discoverWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				results[j] = probeGroup(addrs[j], scanIfi, timeout)
+			}
+		}()
+	}
+	for i := range addrs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	found := make([]*discoveredChannel, 0)
+	for _, r := range results {
+		if r != nil {
+			r.Known = known[r.Addr]
+			found = append(found, r)
+		}
+	}
+	writeJSON(w, found)
+}
+
+func addChannelHandler(w http.ResponseWriter, req *http.Request) {
+	addr := req.FormValue("addr")
+	name := req.FormValue("name")
+	key := req.FormValue("key")
+	iface := req.FormValue("iface")
+	format := req.FormValue("format")
+	if format != "" && format != "rtp" && format != "udp" {
+		httpError(w, req, "Invalid format "+format, http.StatusBadRequest)
+		return
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		httpError(w, req, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := receiveInterface(iface); err != nil {
+		httpError(w, req, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if name == "" {
+		name = addr
+	}
+	k := url.PathEscape(name)
+	addChannel(k, ChannelInfo{addr: addr, masterKey: key, format: format, iface: iface, unnamed: name == addr})
+	reqLogf(req, "Added channel %s @ %s", name, addr)
+	writeJSON(w, map[string]string{"name": name, "addr": addr})
+}
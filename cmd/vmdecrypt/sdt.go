@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/url"
+	"sync"
+)
+
+// Channel names from the SDT service_name, used for channels which are
+// listed only with their multicast address.
+
+var serviceNamesMu sync.Mutex
+
+// multicast address => SDT service name
+var serviceNames = make(map[string]string)
+
+func setServiceName(addr, name string) {
+	serviceNamesMu.Lock()
+	serviceNames[addr] = name
+	serviceNamesMu.Unlock()
+}
+
+// displayName returns the name of the channel shown in playlists
+func displayName(k string) string {
+	chInfo, _ := lookupChannel(k)
+	if chInfo.unnamed {
+		serviceNamesMu.Lock()
+		defer serviceNamesMu.Unlock()
+		if name, ok := serviceNames[chInfo.addr]; ok {
+			return name
+		}
+	}
+	name, _ := url.PathUnescape(k)
+	return name
+}
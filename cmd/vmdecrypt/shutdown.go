@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Planned shutdown on SIGTERM or SIGINT: the listener is closed and new
+// requests on open connections are refused with Retry-After. The decrypting
+// goroutines are stopped through decryptCtx and leave their multicast
+// groups, the streaming clients get what is left in the ring buffers and a
+// Retry-After trailer. The channels which had clients recently are saved,
+// so they can be joined early on the next start.
+
+const retryAfter = "5"
+const resumeWindow = time.Minute
+
+// how long the clients and recordings are waited for
+const shutdownTimeout = 5 * time.Second
+
+var stateFile string
+var shuttingDown atomic.Bool
+
+// canceled on shutdown
+var decryptCtx, stopDecrypting = context.WithCancel(context.Background())
+
+// canceled on shutdown and upgrade, stops the work done without clients:
+// re-outputs, prejoined channels and the periodic saving of the token usage
+var backgroundCtx, cancelBackground = context.WithCancel(context.Background())
+
+// the running decrypting goroutines
+var decryptWG sync.WaitGroup
+
+var recentChannelsMu sync.Mutex
+
+// multicast address => time when the last client was seen
+var recentChannels = make(map[string]time.Time)
+
+func touchRecent(addr string) {
+	recentChannelsMu.Lock()
+	recentChannels[addr] = time.Now()
+	recentChannelsMu.Unlock()
+}
+
+func withShutdown(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if shuttingDown.Load() {
+			w.Header().Set("Retry-After", retryAfter)
+			httpError(w, req, "Server is restarting", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// stopBackground stops the work of the process which is not serving a
+// client and saves its state for the next process
+func stopBackground() {
+	cancelBackground()
+	stopRecordings()
+	stopTranscoders()
+	writeUsageReport()
+	if stateFile != "" {
+		saveState()
+	}
+	if tokensEnabled() {
+		saveTokenUsage()
+	}
+}
+
+func saveState() {
+	runningChannelsMu.Lock()
+	for _, ch := range runningChannels {
+		touchRecent(ch.addr)
+	}
+	runningChannelsMu.Unlock()
+	recentChannelsMu.Lock()
+	data, _ := json.Marshal(recentChannels)
+	recentChannelsMu.Unlock()
+	if err := ioutil.WriteFile(stateFile, data, 0600); err != nil {
+		log.Println(err)
+	}
+}
+
+// resumeChannels joins the channels which had clients shortly before the
+// last shutdown and keeps them running for a minute
+func resumeChannels() {
+	data, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		return
+	}
+	var state map[string]time.Time
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Println(err)
+		return
+	}
+	for _, k := range sortedChannels() {
+		chInfo, _ := lookupChannel(k)
+		if t, ok := state[chInfo.addr]; ok && time.Since(t) < resumeWindow {
+			log.Println("Resuming channel @", chInfo.addr)
+			delete(state, chInfo.addr)
+			attachChannel(chInfo)
+			time.AfterFunc(resumeWindow, func() { detachChannel(chInfo) })
+		}
+	}
+}
+
+func handleShutdown(srv *http.Server) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
+	log.Println("Shutting down")
+	shuttingDown.Store(true)
+	// stop accepting connections, Shutdown returns when the clients are
+	// gone
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	served := make(chan struct{})
+	go func() {
+		srv.Shutdown(ctx)
+		close(served)
+	}()
+	stopBackground()
+	stopDecrypting()
+	select {
+	case <-served:
+	case <-ctx.Done():
+		log.Println("Clients did not disconnect in time")
+	}
+	waitRecordings(shutdownTimeout)
+	left := make(chan struct{})
+	go func() {
+		decryptWG.Wait()
+		close(left)
+	}()
+	select {
+	case <-left:
+	case <-time.After(shutdownTimeout):
+	}
+	log.Println("Shutdown complete")
+	os.Exit(0)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Slow streaming clients: a write which does not complete within
+// -write-timeout disconnects the client, so a stalled one does not keep
+// the channel running. Clients which fall behind the ring buffer skip to
+// the latest packets, or are disconnected with -slow-clients disconnect.
+
+var writeTimeout = 10 * time.Second
+var slowClients = "skip"
+
+// how often the write deadline is pushed forward
+const writeDeadlineInterval = time.Second
+
+func validateSlowClients() error {
+	if slowClients != "skip" && slowClients != "disconnect" {
+		return fmt.Errorf("Invalid slow client policy %s, expected skip or disconnect", slowClients)
+	}
+	return nil
+}
+
+// clientWriter writes to a streaming client with a write deadline
+type clientWriter struct {
+	w        http.ResponseWriter
+	rc       *http.ResponseController
+	deadline time.Time // when it was last set
+}
+
+func newClientWriter(w http.ResponseWriter) *clientWriter {
+	return &clientWriter{w: w, rc: http.NewResponseController(w)}
+}
+
+func (cw *clientWriter) Write(p []byte) (int, error) {
+	if writeTimeout > 0 {
+		if now := time.Now(); now.Sub(cw.deadline) >= writeDeadlineInterval {
+			// not all response writers support deadlines
+			cw.rc.SetWriteDeadline(now.Add(writeTimeout))
+			cw.deadline = now
+		}
+	}
+	return cw.w.Write(p)
+}
+
+// stalled reports if the write failed because of the deadline
+func stalled(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
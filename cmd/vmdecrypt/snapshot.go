@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Channel snapshots taken with ffmpeg and a mosaic page which shows them
+// in a grid.
+
+const snapshotMaxAge = 5 * time.Second
+const snapshotTimeout = 15 * time.Second
+
+type snapshot struct {
+	mu    sync.Mutex
+	jpeg  []byte
+	taken time.Time
+}
+
+var snapshotsMu sync.Mutex
+var snapshots = make(map[string]*snapshot)
+
+func takeSnapshot(k string) ([]byte, error) {
+	snapshotsMu.Lock()
+	s, ok := snapshots[k]
+	if !ok {
+		s = &snapshot{}
+		snapshots[k] = s
+	}
+	snapshotsMu.Unlock()
+
+	// concurrent requests for the same channel share one ffmpeg run
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.taken) < snapshotMaxAge {
+		return s.jpeg, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+	defer cancel()
+	input := fmt.Sprintf("%s/ch/%s%s", serverURL(), k, accessQuery(nil, k))
+	cmd := exec.CommandContext(ctx, ffmpegPath, "-hide_banner", "-loglevel", "error",
+		"-i", input, "-frames:v", "1", "-vf", "scale=320:-2", "-f", "image2", "-c:v", "mjpeg", "pipe:1")
+	jpeg, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	s.jpeg, s.taken = jpeg, time.Now()
+	return jpeg, nil
+}
+
+func snapshotHandler(w http.ResponseWriter, req *http.Request) {
+	// requestURI should be /api/snapshot/CNN.jpg
+	k := strings.TrimSuffix(req.URL.EscapedPath()[len("/api/snapshot/"):], ".jpg")
+	if _, ok := getChannel(w, req, k); !ok {
+		return
+	}
+	jpeg, err := takeSnapshot(k)
+	if err != nil {
+		reqLogf(req, "Snapshot of %s failed: %v", k, err)
+		httpError(w, req, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(jpeg)
+}
+
+var mosaicTemplate = template.Must(template.ParseFS(webFS, "web/mosaic.html"))
+
+type mosaicTile struct {
+	Name string
+	Src  string
+}
+
+// mosaicHandler shows snapshots of the running channels, or of the
+// channels given with ?channels=CNN,BBC
+func mosaicHandler(w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+	refresh, err := strconv.Atoi(req.URL.Query().Get("refresh"))
+	if err != nil || refresh < int(snapshotMaxAge.Seconds()) {
+		refresh = 10
+	}
+	var keys []string
+	if s := req.URL.Query().Get("channels"); s != "" {
+		keys = channelKeys(s)
+	} else {
+		running := make(map[string]bool)
+		runningChannelsMu.Lock()
+		for addr := range runningChannels {
+			running[addr] = true
+		}
+		runningChannelsMu.Unlock()
+		for _, k := range sortedChannels() {
+			if chInfo, _ := lookupChannel(k); running[chInfo.sessionKey()] {
+				keys = append(keys, k)
+			}
+		}
+	}
+	tiles := make([]mosaicTile, 0)
+	for _, k := range keys {
+		if _, ok := lookupChannel(k); !ok || !channelAllowed(req, k) {
+			continue
+		}
+		tiles = append(tiles, mosaicTile{displayName(k), "/api/snapshot/" + k + ".jpg" + accessQuery(req, k)})
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	mosaicTemplate.Execute(w, struct {
+		Tiles   []mosaicTile
+		Refresh int
+	}{tiles, refresh})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Source delivers the datagrams of a channel to the decrypt loop, so
+// channels are not tied to multicast reception.
+type Source interface {
+	// ReadPacket returns the next datagram, RTP or plain MPEG-TS
+	ReadPacket(ctx context.Context) ([]byte, error)
+	Close() error
+}
+
+// how long a source may stay silent before it is considered dead
+const sourceTimeout = 5 * time.Second
+
+type packetReader interface {
+	// ReadFrom returns the destination address of the datagram as well,
+	// nil if not known
+	ReadFrom(b []byte) (int, net.IP, error)
+}
+
+// openSource opens the input of a channel
+func openSource(chInfo ChannelInfo) (Source, error) {
+	if len(chInfo.sources) > 0 {
+		return openMerged(chInfo)
+	}
+	src, err := openInput(chInfo)
+	if err != nil || !chInfo.fec {
+		return src, err
+	}
+	fs, err := openFEC(src, chInfo)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	return fs, nil
+}
+
+func openInput(chInfo ChannelInfo) (Source, error) {
+	if chInfo.capture {
+		return openCapture(chInfo.addr, chInfo.iface)
+	}
+	return openMulticast(chInfo.addr, chInfo.iface)
+}
+
+// groupConn is the part of ipv4.PacketConn and ipv6.PacketConn needed for
+// receiving a multicast group
+type groupConn interface {
+	JoinGroup(ifi *net.Interface, group net.Addr) error
+	LeaveGroup(ifi *net.Interface, group net.Addr) error
+	SetReadDeadline(t time.Time) error
+}
+
+type multicastSource struct {
+	group *net.UDPAddr
+	ifi   *net.Interface
+	c     net.PacketConn
+	p     groupConn
+	r     packetReader
+	buf   []byte
+}
+
+// openMulticast joins the IPv4 or IPv6 multicast group hostPort on the
+// interface iface, -i if empty
+func openMulticast(hostPort, iface string) (Source, error) {
+	host, _, _ := net.SplitHostPort(hostPort)
+	group := &net.UDPAddr{IP: net.ParseIP(host)}
+	ifi, err := receiveInterface(iface)
+	if err != nil {
+		return nil, err
+	}
+	network := "udp4"
+	if group.IP.To4() == nil {
+		network = "udp6"
+	}
+	c, err := net.ListenPacket(network, hostPort)
+	if err != nil {
+		return nil, err
+	}
+	if rcvBuf > 0 {
+		if err := c.(*net.UDPConn).SetReadBuffer(rcvBuf); err != nil {
+			log.Printf("%v @ %v", err, hostPort)
+		}
+	}
+	s := &multicastSource{group: group, ifi: ifi, c: c, buf: make([]byte, maxDatagramSize)}
+	var r packetReader
+	// the destination is not reported everywhere, then nothing is filtered
+	if network == "udp4" {
+		p := ipv4.NewPacketConn(c)
+		p.SetControlMessage(ipv4.FlagDst, true)
+		s.p, r = p, ipv4Reader{p}
+	} else {
+		p := ipv6.NewPacketConn(c)
+		p.SetControlMessage(ipv6.FlagDst, true)
+		s.p, r = p, ipv6Reader{p}
+	}
+	if err := s.p.JoinGroup(ifi, group); err != nil {
+		c.Close()
+		return nil, err
+	}
+	s.r = impairReader(&groupReader{r, group.IP})
+	return s, nil
+}
+
+type ipv4Reader struct {
+	p *ipv4.PacketConn
+}
+
+func (r ipv4Reader) ReadFrom(b []byte) (int, net.IP, error) {
+	n, cm, _, err := r.p.ReadFrom(b)
+	if cm == nil {
+		return n, nil, err
+	}
+	return n, cm.Dst, err
+}
+
+type ipv6Reader struct {
+	p *ipv6.PacketConn
+}
+
+func (r ipv6Reader) ReadFrom(b []byte) (int, net.IP, error) {
+	n, cm, _, err := r.p.ReadFrom(b)
+	if cm == nil {
+		return n, nil, err
+	}
+	return n, cm.Dst, err
+}
+
+// groupReader drops the datagrams sent to other groups. The socket is bound
+// to the wildcard address, so it gets the groups with the same port joined
+// by other channels, or re-emitted by this host, as well.
+type groupReader struct {
+	r     packetReader
+	group net.IP
+}
+
+func (gr *groupReader) ReadFrom(b []byte) (int, net.IP, error) {
+	for {
+		n, dst, err := gr.r.ReadFrom(b)
+		if err != nil || dst == nil || dst.Equal(gr.group) {
+			return n, dst, err
+		}
+	}
+}
+
+func (s *multicastSource) ReadPacket(ctx context.Context) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(sourceTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	s.p.SetReadDeadline(deadline)
+	n, _, err := s.r.ReadFrom(s.buf)
+	if err != nil {
+		return nil, err
+	}
+	// the TS packets are kept in the ring buffer, so copy them out
+	return append([]byte(nil), s.buf[:n]...), nil
+}
+
+func (s *multicastSource) Close() error {
+	s.p.LeaveGroup(s.ifi, s.group)
+	return s.c.Close()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Standby for battery or solar powered boxes: after -standby without
+// clients (requests, RTP relays, outputs or recordings) the prejoined
+// channels leave their groups, the memory of the ring buffers is returned
+// to the OS, the tuning samples pause and the channels file is fetched
+// less often. The next request wakes the server up right away, except the
+// ones of monitoring.
+
+var standbyAfter time.Duration
+
+// how often the channels file is fetched in standby
+const standbyFetchInterval = 6 * time.Hour
+
+const standbyCheckInterval = 10 * time.Second
+
+var activeRequests atomic.Int64
+var lastRequest atomic.Int64   // end of the last request, in Unix nanoseconds
+var runningRelays atomic.Int64 // RTP relays and outputs
+
+var standbyMu sync.Mutex
+var standbyCond = sync.NewCond(&standbyMu)
+var inStandby bool
+
+// canceled when the server enters standby
+var standbyCtx, enterStandby = context.WithCancel(context.Background())
+
+// requests which neither wake the server up nor keep it awake
+var standbyPassive = map[string]bool{"/api/status": true}
+
+func withStandby(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if standbyPassive[req.URL.Path] {
+			h.ServeHTTP(w, req)
+			return
+		}
+		activeRequests.Add(1)
+		wakeUp()
+		defer func() {
+			lastRequest.Store(time.Now().UnixNano())
+			activeRequests.Add(-1)
+		}()
+		h.ServeHTTP(w, req)
+	})
+}
+
+func standby() bool {
+	standbyMu.Lock()
+	defer standbyMu.Unlock()
+	return inStandby
+}
+
+// awake waits until the server is not in standby and returns a context
+// which is canceled when it enters standby
+func awake() context.Context {
+	standbyMu.Lock()
+	defer standbyMu.Unlock()
+	for inStandby {
+		standbyCond.Wait()
+	}
+	return standbyCtx
+}
+
+func wakeUp() {
+	standbyMu.Lock()
+	defer standbyMu.Unlock()
+	if !inStandby {
+		return
+	}
+	inStandby = false
+	standbyCtx, enterStandby = context.WithCancel(context.Background())
+	standbyCond.Broadcast()
+	log.Println("Leaving standby")
+}
+
+// idle reports if there were no clients for -standby
+func idle() bool {
+	recordingsMu.Lock()
+	recording := len(recordings) > 0
+	recordingsMu.Unlock()
+	return activeRequests.Load() == 0 && runningRelays.Load() == 0 && !recording &&
+		time.Since(time.Unix(0, lastRequest.Load())) >= standbyAfter
+}
+
+func watchStandby() {
+	lastRequest.Store(time.Now().UnixNano())
+	for range time.Tick(standbyCheckInterval) {
+		// checked under the lock, so a request either keeps the server
+		// awake or wakes it up
+		standbyMu.Lock()
+		entered := !inStandby && idle()
+		if entered {
+			inStandby = true
+			enterStandby()
+		}
+		standbyMu.Unlock()
+		if entered {
+			log.Printf("No clients for %v, entering standby", standbyAfter)
+			// the stopped channels release their ring buffers
+			time.Sleep(time.Second)
+			debug.FreeOSMemory()
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+type sessionStatus struct {
+	Addr     string   `json:"addr"`
+	Session  string   `json:"session"`
+	Clients  int      `json:"clients"`
+	RTP      RTPStats `json:"rtp"`
+	Overruns uint64   `json:"overruns"`
+	Evicted  uint64   `json:"evicted"`
+	Restarts uint64   `json:"restarts"`
+}
+
+type serverStatus struct {
+	Sessions []sessionStatus `json:"sessions"`
+	Health   []healthStatus  `json:"health"`
+	Prejoin  []prejoinStatus `json:"prejoin"`
+	Outputs  []outputStatus  `json:"outputs"`
+	// buffer tuning suggestions from the recent error rates
+	Suggestions []tuningSuggestion `json:"suggestions"`
+	// end of the active maintenance window
+	Maintenance *time.Time `json:"maintenance,omitempty"`
+	Standby     bool       `json:"standby"`
+}
+
+func currentStatus() serverStatus {
+	runningChannelsMu.Lock()
+	sessions := make([]sessionStatus, 0)
+	for addr, ch := range runningChannels {
+		ch.mu.Lock()
+		overruns, evicted, restarts := ch.overruns, ch.evicted, ch.restarts
+		ch.mu.Unlock()
+		sessions = append(sessions, sessionStatus{addr, ch.id, ch.numClients, ch.rtpStats(), overruns, evicted, restarts})
+	}
+	runningChannelsMu.Unlock()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Addr < sessions[j].Addr })
+	st := serverStatus{Sessions: sessions, Health: healthStatuses(), Prejoin: prejoinStatuses(), Outputs: outputStatuses(),
+		Suggestions: tuningSuggestions(), Standby: standby()}
+	if until, ok := inMaintenance(); ok {
+		st.Maintenance = &until
+	}
+	return st
+}
+
+func statusHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, currentStatus())
+}
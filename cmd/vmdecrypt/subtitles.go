@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Teletext subtitles as live WebVTT. DVB bitmap subtitles are not
+// supported as they would require OCR.
+
+func unham84(b byte) byte {
+	return (b>>1)&1 | (b>>3)&1<<1 | (b>>5)&1<<2 | (b>>7)&1<<3
+}
+
+type teletextDecoder struct {
+	page      uint16
+	receiving bool
+	rows      [24]string
+	showPTS   uint64
+	basePTS   uint64
+	baseSet   bool
+}
+
+func vttTime(pts uint64) string {
+	ms := pts / 90
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+func (d *teletextDecoder) cue(pts uint64) string {
+	lines := make([]string, 0)
+	for _, row := range d.rows {
+		if row = strings.TrimSpace(row); row != "" {
+			lines = append(lines, row)
+		}
+	}
+	d.rows = [24]string{}
+	if len(lines) == 0 {
+		return ""
+	}
+	start := (d.showPTS - d.basePTS) & (1<<33 - 1)
+	end := (pts - d.basePTS) & (1<<33 - 1)
+	return fmt.Sprintf("%s --> %s\n%s\n\n", vttTime(start), vttTime(end), strings.Join(lines, "\n"))
+}
+
+// processPacket decodes a teletext packet (data unit payload) and returns
+// a WebVTT cue when the current page is complete
+func (d *teletextDecoder) processPacket(unit []byte, pts uint64) string {
+	data := make([]byte, len(unit))
+	for i, b := range unit {
+		data[i] = bits.Reverse8(b)
+	}
+	addr := unham84(data[3])<<4 | unham84(data[2])
+	mag := uint16(addr & 7)
+	if mag == 0 {
+		mag = 8
+	}
+	row := addr >> 3
+	data = data[4:]
+	cue := ""
+	if row == 0 {
+		page := mag<<8 | uint16(unham84(data[1]))<<4 | uint16(unham84(data[0]))
+		if d.receiving {
+			cue = d.cue(pts)
+		}
+		d.receiving = page == d.page
+		d.showPTS = pts
+	} else if row <= 23 && d.receiving && mag == d.page>>8 {
+		text := make([]byte, 40)
+		for i, c := range data[:40] {
+			c &= 0x7f
+			if c < 0x20 {
+				c = ' '
+			}
+			text[i] = c
+		}
+		d.rows[row] = string(text)
+	}
+	return cue
+}
+
+func (d *teletextDecoder) processPES(pes []byte, pts uint64) string {
+	if !d.baseSet {
+		d.basePTS, d.baseSet = pts, true
+	}
+	if len(pes) < 1 || pes[0] < 0x10 || pes[0] > 0x1f {
+		return ""
+	}
+	cues := ""
+	for units := pes[1:]; len(units) >= 2; {
+		id, length := units[0], int(units[1])
+		if 2+length > len(units) {
+			break
+		}
+		if (id == 0x02 || id == 0x03) && length == 0x2c {
+			cues += d.processPacket(units[2:2+length], pts)
+		}
+		units = units[2+length:]
+	}
+	return cues
+}
+
+func subtitlesHandler(w http.ResponseWriter, req *http.Request) {
+	// requestURI should be /subs/CNN.vtt or /subs/CNN.vtt?page=888
+	chName := strings.TrimSuffix(strings.SplitN(req.RequestURI[6:], "?", 2)[0], ".vtt")
+	chInfo, ok := getChannel(w, req, chName)
+	if !ok {
+		return
+	}
+	var page uint16
+	if p := req.URL.Query().Get("page"); p != "" {
+		n, err := strconv.ParseUint(p, 16, 16)
+		if err != nil {
+			httpError(w, req, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		page = uint16(n)
+	}
+	ch := attachChannel(chInfo)
+	defer detachChannel(chInfo)
+
+	cw := newClientWriter(w)
+	flusher, _ := w.(http.Flusher)
+	ptr := ch.currentPtr()
+	var val interface{}
+	var dec *teletextDecoder
+	var txtPid uint16
+	var pes []byte
+	var pts uint64
+	for {
+		ptr, val = ch.nextPtr(req.Context(), ptr)
+		if val == nil {
+			break
+		}
+		pkt := val.([]byte)
+		if dec == nil {
+			var txtPage uint16
+			txtPid, txtPage = ch.dec.Teletext()
+			if page == 0 {
+				page = txtPage
+			}
+			if txtPid == 0 {
+				if ch.dec.PMT() != nil {
+					httpError(w, req, "No teletext subtitles", http.StatusNotFound)
+					return
+				}
+				continue
+			}
+			dec = &teletextDecoder{page: page}
+			reqLogf(req, "Start serving subtitles client %v, session %v", req.RemoteAddr, ch.id)
+			defer reqLogf(req, "Stop serving subtitles client %v", req.RemoteAddr)
+		}
+		if binary.BigEndian.Uint16(pkt[1:3])&0x1fff != txtPid {
+			continue
+		}
+		if newPTS, ok := pesPTS(pkt); ok {
+			if pes == nil {
+				// the cue times are relative to the first PTS
+				w.Header().Set("Content-Type", "text/vtt")
+				fmt.Fprintf(cw, "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:%d,LOCAL:00:00:00.000\n\n", newPTS)
+				if flusher != nil {
+					flusher.Flush()
+				}
+			} else {
+				if cues := dec.processPES(pes, pts); cues != "" {
+					if _, err := io.WriteString(cw, cues); err != nil {
+						if stalled(err) {
+							reqLogf(req, "Client %v stalled for %v, disconnecting", req.RemoteAddr, writeTimeout)
+							ch.evict()
+						}
+						break
+					}
+					if flusher != nil {
+						flusher.Flush()
+					}
+				}
+			}
+			pes, pts = pesPayload(pkt), newPTS
+		} else if pes != nil {
+			pes = append(pes, pesPayload(pkt)...)
+		}
+	}
+}
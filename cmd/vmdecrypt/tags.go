@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Channel tags, e.g. "uhd", "radio" or "backup", with settings shared by
+// all channels with the tag, given in the tag_rules of the channels file:
+//
+//	"tag_rules": {"uhd": {"ring_size": 1024, "priority": 10},
+//	              "radio": {"hls_profile": "-vn"},
+//	              "backup": {"playlist": false}}
+//
+// and the tags attribute of the channels, e.g. {"tags": ["uhd", "news"]}.
+// When several tags of a channel set the same setting, the first one wins.
+// Tags without a rule only mark the channels, e.g. for the API.
+
+type tagRule struct {
+	RingSize   int      `json:"ring_size,omitempty"`   // TS packets in the ring buffer, -ring-size if 0
+	HLSProfile string   `json:"hls_profile,omitempty"` // replaces -hls-profile
+	Priority   *int     `json:"priority,omitempty"`    // higher first in playlists, 0 by default
+	Playlist   *bool    `json:"playlist,omitempty"`    // false omits the channels from playlists
+	Networks   []string `json:"networks,omitempty"`    // client networks allowed to use the channels
+}
+
+// the smallest ring buffer which can absorb a few datagrams
+const minTagRingSize = 16
+
+func (r tagRule) validate() error {
+	if r.RingSize != 0 && r.RingSize < minTagRingSize {
+		return fmt.Errorf("Ring size must be at least %d", minTagRingSize)
+	}
+	_, err := parseNetworks(strings.Join(r.Networks, ","))
+	return err
+}
+
+// parseTags returns the tags of the channel attributes
+func parseTags(attrs map[string]interface{}) ([]string, error) {
+	list, ok := attrs["tags"].([]interface{})
+	if !ok {
+		if _, present := attrs["tags"]; present {
+			return nil, errors.New("Tags must be a list")
+		}
+		return nil, nil
+	}
+	tags := make([]string, 0)
+	for _, v := range list {
+		tag, ok := v.(string)
+		if !ok || strings.TrimSpace(tag) == "" {
+			return nil, fmt.Errorf("Invalid tag %v", v)
+		}
+		tags = append(tags, strings.TrimSpace(tag))
+	}
+	return tags, nil
+}
+
+// mergeRules returns the settings of the tags and the rules which apply
+func mergeRules(tags []string, rules map[string]tagRule) (tagRule, map[string]tagRule) {
+	var merged tagRule
+	used := make(map[string]tagRule)
+	for _, tag := range tags {
+		r, ok := rules[tag]
+		if !ok {
+			continue
+		}
+		used[tag] = r
+		if merged.RingSize == 0 {
+			merged.RingSize = r.RingSize
+		}
+		if merged.HLSProfile == "" {
+			merged.HLSProfile = r.HLSProfile
+		}
+		if merged.Priority == nil {
+			merged.Priority = r.Priority
+		}
+		if merged.Playlist == nil {
+			merged.Playlist = r.Playlist
+		}
+		if merged.Networks == nil {
+			merged.Networks = r.Networks
+		}
+	}
+	return merged, used
+}
+
+func (chInfo ChannelInfo) hasTag(tag string) bool {
+	for _, t := range chInfo.tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func (chInfo ChannelInfo) ringSize() int {
+	if chInfo.rules.RingSize > 0 {
+		return chInfo.rules.RingSize
+	}
+	return RingSize
+}
+
+func (chInfo ChannelInfo) hlsProfile() string {
+	if chInfo.rules.HLSProfile != "" {
+		return chInfo.rules.HLSProfile
+	}
+	return hlsProfile
+}
+
+func (chInfo ChannelInfo) priority() int {
+	if chInfo.rules.Priority != nil {
+		return *chInfo.rules.Priority
+	}
+	return 0
+}
+
+func (chInfo ChannelInfo) inPlaylists() bool {
+	return chInfo.rules.Playlist == nil || *chInfo.rules.Playlist
+}
+
+// playlistChannels returns the visible channels which are listed in
+// playlists, the ones with a higher priority first
+func playlistChannels(req *http.Request) []string {
+	keys := make([]string, 0)
+	priorities := make(map[string]int)
+	for _, k := range visibleChannels(req) {
+		if chInfo, _ := lookupChannel(k); chInfo.inPlaylists() {
+			keys = append(keys, k)
+			priorities[k] = chInfo.priority()
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return priorities[keys[i]] > priorities[keys[j]] })
+	return keys
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// HTTPS: with -tls-cert and -tls-key the server speaks only TLS, the files
+// are reloaded when they change, e.g. after a renewal by certbot. With
+// -autocert the certificates of the given host names are obtained from
+// Let's Encrypt with the TLS-ALPN challenge, so -a must be reachable on
+// port 443. The URLs in playlists use https.
+
+var tlsCert, tlsKey string
+var autocertHosts, autocertDir string
+
+// how often the certificate file is checked for changes
+const certCheckInterval = time.Minute
+
+func tlsEnabled() bool {
+	return tlsCert != "" || autocertHosts != ""
+}
+
+// serverURL returns the base URL of the links to the server
+func serverURL() string {
+	if tlsEnabled() {
+		return "https://" + httpAddr
+	}
+	return "http://" + httpAddr
+}
+
+func validateTLS() error {
+	if (tlsCert == "") != (tlsKey == "") {
+		return errors.New("-tls-cert and -tls-key must be given together")
+	}
+	if tlsCert != "" && autocertHosts != "" {
+		return errors.New("-autocert can't be used with -tls-cert")
+	}
+	if tlsCert != "" {
+		_, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+		return err
+	}
+	return nil
+}
+
+// certReloader serves the certificate files and reloads them when they
+// change
+type certReloader struct {
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func (r *certReloader) load() error {
+	st, err := os.Stat(tlsCert)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+	if err != nil {
+		return err
+	}
+	r.cert, r.modTime = &cert, st.ModTime()
+	return nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) >= certCheckInterval {
+		r.checked = time.Now()
+		if st, err := os.Stat(tlsCert); err == nil && !st.ModTime().Equal(r.modTime) {
+			if err := r.load(); err != nil {
+				// keep the old one, the key may not be written yet
+				log.Printf("Reloading %s failed: %v", tlsCert, err)
+			} else {
+				log.Printf("Reloaded %s", tlsCert)
+			}
+		}
+	}
+	return r.cert, nil
+}
+
+// configureTLS sets the TLS config of the server
+func configureTLS(srv *http.Server) error {
+	if autocertHosts != "" {
+		hosts := strings.Split(autocertHosts, ",")
+		for i := range hosts {
+			hosts[i] = strings.TrimSpace(hosts[i])
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(hosts...),
+			Cache:      autocert.DirCache(autocertDir),
+		}
+		srv.TLSConfig = m.TLSConfig()
+		return nil
+	}
+	r := &certReloader{checked: time.Now()}
+	if err := r.load(); err != nil {
+		return err
+	}
+	srv.TLSConfig = &tls.Config{GetCertificate: r.getCertificate}
+	return nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Access tokens with optional byte and time quotas. When a tokens file is
+// given, all streaming endpoints require ?token=. The quota usage is saved
+// next to the tokens file.
+
+type tokenConfig struct {
+	Token      string `json:"token"`
+	Name       string `json:"name"`
+	Bytes      int64  `json:"bytes,omitempty"`    // 0 = unlimited
+	Duration   string `json:"duration,omitempty"` // e.g. "24h", counted from the first use
+	Restricted bool   `json:"restricted,omitempty"`
+}
+
+type tokenUsage struct {
+	BytesUsed int64     `json:"bytes_used"`
+	FirstUse  time.Time `json:"first_use"`
+}
+
+type tokenState struct {
+	tokenConfig
+	duration time.Duration
+	usage    tokenUsage
+	loaded   int64 // bytes used when the usage file was read
+}
+
+var tokensFile string
+var tokensMu sync.Mutex
+var tokensSaveMu sync.Mutex
+var tokens map[string]*tokenState
+var internalToken *tokenState
+
+func tokensEnabled() bool {
+	return tokens != nil
+}
+
+func loadTokens() error {
+	data, err := ioutil.ReadFile(tokensFile)
+	if err != nil {
+		return err
+	}
+	var list []tokenConfig
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	var usage map[string]tokenUsage
+	if data, err := ioutil.ReadFile(tokensFile + ".usage"); err == nil {
+		json.Unmarshal(data, &usage)
+	}
+	tokens = make(map[string]*tokenState)
+	for _, t := range list {
+		st := &tokenState{tokenConfig: t, usage: usage[t.Token], loaded: usage[t.Token].BytesUsed}
+		if t.Duration != "" {
+			if st.duration, err = time.ParseDuration(t.Duration); err != nil {
+				return err
+			}
+		}
+		tokens[t.Token] = st
+	}
+	// used for internal requests, e.g. from the HLS transcoders
+	internalToken = &tokenState{tokenConfig: tokenConfig{Token: newID() + newID(), Name: "internal", Restricted: true}}
+	tokens[internalToken.Token] = internalToken
+	log.Printf("%d tokens loaded", len(list))
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				saveTokenUsage()
+			case <-backgroundCtx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// reloadTokenUsage merges the usage saved by the old process after an
+// upgrade
+func reloadTokenUsage() {
+	if !tokensEnabled() {
+		return
+	}
+	data, err := ioutil.ReadFile(tokensFile + ".usage")
+	if err != nil {
+		return
+	}
+	var usage map[string]tokenUsage
+	if json.Unmarshal(data, &usage) != nil {
+		return
+	}
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	for k, u := range usage {
+		t := tokens[k]
+		if t == nil {
+			continue
+		}
+		// keep what was served while waiting for the handover
+		t.usage.BytesUsed += u.BytesUsed - t.loaded
+		t.loaded = u.BytesUsed
+		if t.usage.FirstUse.IsZero() || !u.FirstUse.IsZero() && u.FirstUse.Before(t.usage.FirstUse) {
+			t.usage.FirstUse = u.FirstUse
+		}
+	}
+}
+
+func saveTokenUsage() {
+	// the last save writes the latest usage
+	tokensSaveMu.Lock()
+	defer tokensSaveMu.Unlock()
+	tokensMu.Lock()
+	usage := make(map[string]tokenUsage)
+	for k, t := range tokens {
+		if t != internalToken && !t.usage.FirstUse.IsZero() {
+			usage[k] = t.usage
+		}
+	}
+	tokensMu.Unlock()
+	data, _ := json.Marshal(usage)
+	if err := ioutil.WriteFile(tokensFile+".usage", data, 0600); err != nil {
+		log.Println(err)
+	}
+}
+
+func requestToken(req *http.Request) *tokenState {
+	if !tokensEnabled() {
+		return nil
+	}
+	value := req.URL.Query().Get("token")
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	for k, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(value)) == 1 {
+			return t
+		}
+	}
+	return nil
+}
+
+func (t *tokenState) expiresAt() time.Time {
+	if t.duration == 0 || t.usage.FirstUse.IsZero() {
+		return time.Time{}
+	}
+	return t.usage.FirstUse.Add(t.duration)
+}
+
+// exhausted must be called with tokensMu held
+func (t *tokenState) exhausted() bool {
+	if t.Bytes > 0 && t.usage.BytesUsed >= t.Bytes {
+		return true
+	}
+	expires := t.expiresAt()
+	return !expires.IsZero() && time.Now().After(expires)
+}
+
+func (t *tokenState) Exhausted() bool {
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	return t.exhausted()
+}
+
+// consume accounts n bytes sent with the token and reports if the quota
+// still allows sending
+func (t *tokenState) consume(n int) bool {
+	if t == nil || t == internalToken {
+		return true
+	}
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	if t.usage.FirstUse.IsZero() {
+		t.usage.FirstUse = time.Now()
+	}
+	t.usage.BytesUsed += int64(n)
+	return !t.exhausted()
+}
+
+// tokenEntitled reports if the request has a token for restricted channels
+func tokenEntitled(req *http.Request) bool {
+	t := requestToken(req)
+	return t != nil && t.Restricted
+}
+
+// checkToken verifies the token of a streaming request
+func checkToken(w http.ResponseWriter, req *http.Request) bool {
+	if !tokensEnabled() {
+		return true
+	}
+	t := requestToken(req)
+	if t == nil {
+		httpError(w, req, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return false
+	}
+	if t.Exhausted() {
+		httpError(w, req, "Quota exceeded", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// accessQuery returns the query string for accessing the channel with the
+// credentials of the request, or with internal credentials if req is nil
+func accessQuery(req *http.Request, k string) string {
+	q := url.Values{}
+	if req == nil {
+		if tokensEnabled() {
+			q.Set("token", internalToken.Token)
+		}
+		if restrictedChannels[k] {
+			q.Set("pin", parentalPin)
+		}
+	} else {
+		if token := req.URL.Query().Get("token"); token != "" {
+			q.Set("token", token)
+		}
+		if restrictedChannels[k] && pinOK(req) {
+			q.Set("pin", parentalPin)
+		}
+	}
+	accessSignature(req, q, k)
+	if len(q) == 0 {
+		return ""
+	}
+	return "?" + q.Encode()
+}
+
+type quotaStatus struct {
+	Name           string     `json:"name"`
+	BytesUsed      int64      `json:"bytes_used"`
+	BytesLimit     int64      `json:"bytes_limit,omitempty"`
+	BytesRemaining *int64     `json:"bytes_remaining,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	Exhausted      bool       `json:"exhausted"`
+}
+
+func quotaHandler(w http.ResponseWriter, req *http.Request) {
+	t := requestToken(req)
+	if t == nil {
+		httpError(w, req, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	tokensMu.Lock()
+	st := quotaStatus{Name: t.Name, BytesUsed: t.usage.BytesUsed, BytesLimit: t.Bytes, Exhausted: t.exhausted()}
+	if t.Bytes > 0 {
+		remaining := t.Bytes - t.usage.BytesUsed
+		if remaining < 0 {
+			remaining = 0
+		}
+		st.BytesRemaining = &remaining
+	}
+	if expires := t.expiresAt(); !expires.IsZero() {
+		st.ExpiresAt = &expires
+	}
+	tokensMu.Unlock()
+	writeJSON(w, st)
+}
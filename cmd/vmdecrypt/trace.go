@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Packet level tracing which can be turned on at runtime for a single
+// channel or for all of them and is turned off automatically.
+
+const maxTraceDuration = 10 * time.Minute
+
+var tracesMu sync.Mutex
+
+// multicast address ("" for all channels) => end of tracing
+var traces = make(map[string]time.Time)
+
+// number of active traces, checked before taking the lock
+var activeTraces atomic.Int32
+
+func (ch *Channel) tracing() bool {
+	if activeTraces.Load() == 0 {
+		return false
+	}
+	tracesMu.Lock()
+	defer tracesMu.Unlock()
+	_, all := traces[""]
+	_, one := traces[ch.addr]
+	return all || one
+}
+
+func setTrace(addr string, d time.Duration) {
+	tracesMu.Lock()
+	defer tracesMu.Unlock()
+	until := time.Now().Add(d)
+	traces[addr] = until
+	activeTraces.Store(int32(len(traces)))
+	time.AfterFunc(d, func() {
+		tracesMu.Lock()
+		defer tracesMu.Unlock()
+		if traces[addr] == until {
+			stopTrace(addr)
+		}
+	})
+}
+
+// stopTrace must be called with tracesMu held
+func stopTrace(addr string) {
+	if _, ok := traces[addr]; !ok {
+		return
+	}
+	delete(traces, addr)
+	activeTraces.Store(int32(len(traces)))
+	if addr == "" {
+		log.Println("Tracing of all channels stopped")
+	} else {
+		log.Printf("Tracing of %v stopped", addr)
+	}
+}
+
+type traceStatus struct {
+	Addr  string    `json:"addr,omitempty"`
+	Until time.Time `json:"until"`
+}
+
+// traceHandler turns on tracing with POST /api/trace/CNN?duration=1m, off
+// with DELETE and lists the active traces with GET. Without a channel name
+// all channels are traced.
+func traceHandler(w http.ResponseWriter, req *http.Request) {
+	chName := strings.SplitN(req.RequestURI[len("/api/trace/"):], "?", 2)[0]
+	addr := ""
+	if chName != "" {
+		chInfo, ok := getChannel(w, req, chName)
+		if !ok {
+			return
+		}
+		addr = chInfo.addr
+	} else if !checkToken(w, req) {
+		return
+	}
+	switch req.Method {
+	case http.MethodPost:
+		d, err := time.ParseDuration(req.URL.Query().Get("duration"))
+		if err != nil || d <= 0 || d > maxTraceDuration {
+			d = time.Minute
+		}
+		if addr == "" {
+			reqLogf(req, "Tracing all channels for %v", d)
+		} else {
+			reqLogf(req, "Tracing %v for %v", addr, d)
+		}
+		setTrace(addr, d)
+	case http.MethodDelete:
+		tracesMu.Lock()
+		stopTrace(addr)
+		tracesMu.Unlock()
+	}
+	tracesMu.Lock()
+	statuses := make([]traceStatus, 0)
+	for a, until := range traces {
+		statuses = append(statuses, traceStatus{a, until})
+	}
+	tracesMu.Unlock()
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Addr < statuses[j].Addr })
+	writeJSON(w, statuses)
+}
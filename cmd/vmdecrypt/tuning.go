@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Buffer tuning suggestions: the loss, reordering and ring overrun counters
+// of the running channels and the UDP receive buffer errors of the kernel
+// are sampled every minute, /api/status suggests what to enlarge when they
+// grew within tuningWindow.
+
+const (
+	tuningWindow   = 15 * time.Minute
+	tuningInterval = time.Minute
+	// loss below this ratio is left alone
+	tuningLossRatio = 0.001
+)
+
+var rcvBuf int   // SO_RCVBUF of the multicast sockets, 0 = system default
+var ringSize int // -ring-size, 0 = automatic
+
+type tuningSample struct {
+	at         time.Time
+	packets    uint64
+	lost       uint64
+	outOfOrder uint64
+	overruns   uint64
+}
+
+type tuningSuggestion struct {
+	Addr       string `json:"addr,omitempty"`
+	Problem    string `json:"problem"`
+	Suggestion string `json:"suggestion"`
+}
+
+var tuningMu sync.Mutex
+
+// multicast address => samples, oldest first
+var tuningSamples = make(map[string][]tuningSample)
+
+// samples of the kernel UDP RcvbufErrors counter
+var rcvbufSamples []tuningSample
+
+// udpRcvbufErrors returns the RcvbufErrors counter of /proc/net/snmp, false
+// where it is not available
+func udpRcvbufErrors() (uint64, bool) {
+	data, err := ioutil.ReadFile("/proc/net/snmp")
+	if err != nil {
+		return 0, false
+	}
+	var names []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "Udp:" {
+			continue
+		}
+		if names == nil {
+			names = fields
+			continue
+		}
+		for i, name := range names {
+			if name == "RcvbufErrors" && i < len(fields) {
+				n, err := strconv.ParseUint(fields[i], 10, 64)
+				return n, err == nil
+			}
+		}
+	}
+	return 0, false
+}
+
+func pruneSamples(samples []tuningSample, now time.Time) []tuningSample {
+	for len(samples) > 0 && now.Sub(samples[0].at) > tuningWindow {
+		samples = samples[1:]
+	}
+	return samples
+}
+
+func sampleTuning() {
+	now := time.Now()
+	current := make(map[string]tuningSample)
+	runningChannelsMu.Lock()
+	for addr, ch := range runningChannels {
+		ch.mu.Lock()
+		current[addr] = tuningSample{now, ch.stats.Packets, ch.stats.Lost, ch.stats.OutOfOrder, ch.overruns}
+		ch.mu.Unlock()
+	}
+	runningChannelsMu.Unlock()
+
+	tuningMu.Lock()
+	defer tuningMu.Unlock()
+	for addr := range tuningSamples {
+		if _, ok := current[addr]; !ok {
+			delete(tuningSamples, addr)
+		}
+	}
+	for addr, s := range current {
+		samples := tuningSamples[addr]
+		// the counters start over when the channel is restarted
+		if n := len(samples); n > 0 && s.packets < samples[n-1].packets {
+			samples = nil
+		}
+		tuningSamples[addr] = append(pruneSamples(samples, now), s)
+	}
+	if n, ok := udpRcvbufErrors(); ok {
+		rcvbufSamples = append(pruneSamples(rcvbufSamples, now), tuningSample{at: now, lost: n})
+	}
+}
+
+func watchTuning() {
+	for range time.Tick(tuningInterval) {
+		if !standby() {
+			sampleTuning()
+		}
+	}
+}
+
+// channelFEC reports if FEC is enabled for the channel with address addr
+func channelFEC(addr string) bool {
+	// without the program of the session
+	addr, _, _ = strings.Cut(addr, "#")
+	channelsMu.RLock()
+	defer channelsMu.RUnlock()
+	for _, chInfo := range channels {
+		if chInfo.addr == addr {
+			return chInfo.fec
+		}
+	}
+	return false
+}
+
+func tuningSuggestions() []tuningSuggestion {
+	tuningMu.Lock()
+	defer tuningMu.Unlock()
+	suggestions := make([]tuningSuggestion, 0)
+	if n := len(rcvbufSamples); n > 1 {
+		if drops := rcvbufSamples[n-1].lost - rcvbufSamples[0].lost; drops > 0 {
+			size := "the system default"
+			if rcvBuf > 0 {
+				size = fmt.Sprintf("%d bytes", rcvBuf)
+			}
+			suggestions = append(suggestions, tuningSuggestion{
+				Problem:    fmt.Sprintf("The kernel dropped %d UDP datagrams because socket receive buffers were full", drops),
+				Suggestion: fmt.Sprintf("Increase -rcvbuf (now %s) and net.core.rmem_max", size),
+			})
+		}
+	}
+	addrs := make([]string, 0)
+	for addr := range tuningSamples {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		samples := tuningSamples[addr]
+		if len(samples) < 2 {
+			continue
+		}
+		first, last := samples[0], samples[len(samples)-1]
+		packets := last.packets - first.packets
+		if packets == 0 {
+			continue
+		}
+		if overruns := last.overruns - first.overruns; overruns > 0 {
+			suggestions = append(suggestions, tuningSuggestion{addr,
+				fmt.Sprintf("Clients fell behind the ring buffer %d times", overruns),
+				fmt.Sprintf("Increase -ring-size (now %d)", RingSize)})
+		}
+		if ooo := last.outOfOrder - first.outOfOrder; ooo > 0 {
+			s := tuningSuggestion{Addr: addr, Problem: fmt.Sprintf("%d RTP datagrams out of order", ooo)}
+			if jitterDepth > 1 {
+				s.Suggestion = fmt.Sprintf("Increase -jitter-depth (now %d) or -jitter-latency (now %v)", jitterDepth, jitterLatency)
+			} else {
+				s.Suggestion = "Enable the jitter buffer with -jitter-depth"
+			}
+			suggestions = append(suggestions, s)
+		}
+		lost := last.lost - first.lost
+		if float64(lost) > tuningLossRatio*float64(packets+lost) && !channelFEC(addr) {
+			suggestions = append(suggestions, tuningSuggestion{addr,
+				fmt.Sprintf("%d of %d RTP datagrams lost", lost, packets+lost),
+				`Enable FEC with {"fec": true} if the source sends SMPTE 2022-1 FEC streams`})
+		}
+	}
+	return suggestions
+}
@@ -0,0 +1,143 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Zero-downtime upgrades: on SIGUSR2 the binary is re-executed and the new
+// process inherits the HTTP listener. The old process stops accepting new
+// connections, stops its outputs, prejoined channels and recordings, saves
+// its state and exits when its clients disconnect. The new process waits
+// for this handover before it resumes the saved channels and starts its own
+// outputs, prejoined channels and recordings.
+
+const listenFdEnv = "VMDECRYPT_LISTEN_FD"
+const readyFdEnv = "VMDECRYPT_READY_FD"
+const handoverFdEnv = "VMDECRYPT_HANDOVER_FD"
+
+const handoverTimeout = time.Minute
+
+var drainTimeout time.Duration
+
+// listen returns the inherited listener or creates a new one
+func listen(addr string) (net.Listener, error) {
+	if os.Getenv(listenFdEnv) == "" {
+		return net.Listen("tcp", addr)
+	}
+	f := os.NewFile(3, "listener")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// notifyReady tells the parent process that the listener is taken over
+func notifyReady() {
+	if os.Getenv(readyFdEnv) == "" {
+		return
+	}
+	f := os.NewFile(4, "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// waitHandover waits until the parent process has stopped its outputs,
+// prejoined channels and recordings and saved its state
+func waitHandover() {
+	if os.Getenv(handoverFdEnv) == "" {
+		return
+	}
+	f := os.NewFile(5, "handover")
+	done := make(chan struct{})
+	go func() {
+		// closed by the parent, or when it exits
+		f.Read(make([]byte, 1))
+		f.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+		reloadTokenUsage()
+	case <-time.After(handoverTimeout):
+		log.Println("Timed out waiting for the old process to hand over")
+	}
+}
+
+// startUpgraded starts the new process and waits until it has taken over
+// the listener. The returned handover pipe is closed once the background
+// work is stopped.
+func startUpgraded(ln net.Listener) (*os.File, error) {
+	lnFile, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		return nil, err
+	}
+	defer lnFile.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	hr, hw, err := os.Pipe()
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	defer hr.Close()
+	exe, err := os.Executable()
+	if err != nil {
+		w.Close()
+		hw.Close()
+		return nil, err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{lnFile, w, hr}
+	cmd.Env = append(os.Environ(), listenFdEnv+"=3", readyFdEnv+"=4", handoverFdEnv+"=5")
+	if err := cmd.Start(); err != nil {
+		w.Close()
+		hw.Close()
+		return nil, err
+	}
+	w.Close()
+	log.Println("Started new process with pid", cmd.Process.Pid)
+	go cmd.Wait()
+	r.SetReadDeadline(time.Now().Add(30 * time.Second))
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		hw.Close()
+		return nil, err
+	}
+	return hw, nil
+}
+
+func handleUpgrade(srv *http.Server, ln net.Listener) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR2)
+	for range c {
+		log.Println("Upgrading binary")
+		handover, err := startUpgraded(ln)
+		if err != nil {
+			log.Println("Upgrade failed:", err)
+			continue
+		}
+		// the new process takes over the outputs, recordings and state
+		stopBackground()
+		waitRecordings(shutdownTimeout)
+		handover.Close()
+		log.Println("Upgrade complete, draining clients")
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		srv.Shutdown(ctx)
+		cancel()
+		log.Println("Done")
+		os.Exit(0)
+	}
+}
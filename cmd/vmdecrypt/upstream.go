@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Outgoing connections: the channels file, the webhook and the usage
+// report share one HTTP client whose idle keep-alive connections are closed
+// after -upstream-idle, and the host names of relay destinations and HTTP
+// endpoints are resolved through a small cache (-dns-cache).
+
+var upstreamIdle time.Duration
+var dnsCacheTTL time.Duration // 0 = no caching
+
+var upstreamTransport = &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	DialContext:           dialCached,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          16,
+	MaxIdleConnsPerHost:   2,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 30 * time.Second,
+	ExpectContinueTimeout: time.Second,
+}
+
+var httpClient = &http.Client{Transport: upstreamTransport, Timeout: 2 * time.Minute}
+
+var upstreamDialer = &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+var dnsMu sync.Mutex
+var dnsCache = make(map[string]dnsEntry)
+
+func setupUpstream() {
+	upstreamTransport.IdleConnTimeout = upstreamIdle
+}
+
+// lookupHost resolves the host name, IP addresses are returned as they are
+func lookupHost(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	if dnsCacheTTL == 0 {
+		return net.DefaultResolver.LookupHost(ctx, host)
+	}
+	now := time.Now()
+	dnsMu.Lock()
+	e, ok := dnsCache[host]
+	dnsMu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.addrs, nil
+	}
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	dnsMu.Lock()
+	for h, e := range dnsCache {
+		if now.After(e.expires) {
+			delete(dnsCache, h)
+		}
+	}
+	dnsCache[host] = dnsEntry{addrs, now.Add(dnsCacheTTL)}
+	dnsMu.Unlock()
+	return addrs, nil
+}
+
+// dialCached dials the addresses of the host one after the other
+func dialCached(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := lookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	err = errors.New("No addresses for " + host)
+	for _, a := range addrs {
+		var conn net.Conn
+		if conn, err = upstreamDialer.DialContext(ctx, network, net.JoinHostPort(a, port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// resolveUDPAddr is net.ResolveUDPAddr with the DNS cache
+func resolveUDPAddr(addr string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := lookupHost(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("No addresses for " + host)
+	}
+	p, err := net.LookupPort("udp", port)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(addrs[0])
+	// prefer IPv4 like net.ResolveUDPAddr
+	for _, a := range addrs {
+		if v4 := net.ParseIP(a).To4(); v4 != nil {
+			ip = v4
+			break
+		}
+	}
+	if ip == nil {
+		// e.g. with an IPv6 zone
+		return net.ResolveUDPAddr("udp", addr)
+	}
+	return &net.UDPAddr{IP: ip, Port: p}, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Usage report: the uptime, served bytes, errors and peak clients of every
+// channel since the start, written to the log on exit and optionally to
+// -report (a file or an http(s) URL which gets a POST).
+
+var reportTarget string
+
+var startTime = time.Now()
+
+type channelUsage struct {
+	uptime      time.Duration // of the finished sessions
+	started     time.Time     // start of the running session, zero if none
+	bytes       int64
+	peakClients int
+}
+
+var usageMu sync.Mutex
+
+// multicast address => usage
+var usage = make(map[string]*channelUsage)
+
+func getUsage(addr string) *channelUsage {
+	u, ok := usage[addr]
+	if !ok {
+		u = &channelUsage{}
+		usage[addr] = u
+	}
+	return u
+}
+
+// usageClients records the number of clients of a running channel
+func usageClients(addr string, clients int) {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	u := getUsage(addr)
+	if u.started.IsZero() {
+		u.started = time.Now()
+	}
+	if clients > u.peakClients {
+		u.peakClients = clients
+	}
+}
+
+// usageStopped records the end of a session of the channel
+func usageStopped(addr string) {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	u := getUsage(addr)
+	if !u.started.IsZero() {
+		u.uptime += time.Since(u.started)
+		u.started = time.Time{}
+	}
+}
+
+// usageServed accounts n bytes sent to a client of the channel
+func usageServed(addr string, n int) {
+	usageMu.Lock()
+	getUsage(addr).bytes += int64(n)
+	usageMu.Unlock()
+}
+
+type channelReport struct {
+	Names       []string       `json:"names"`
+	Addr        string         `json:"addr"`
+	Uptime      float64        `json:"uptime"` // seconds
+	Bytes       int64          `json:"bytes"`
+	Errors      map[string]int `json:"errors"`
+	PeakClients int            `json:"peak_clients"`
+}
+
+type usageReport struct {
+	Event    string          `json:"event"`
+	Started  time.Time       `json:"started"`
+	Stopped  time.Time       `json:"stopped"`
+	Channels []channelReport `json:"channels"`
+}
+
+func currentUsage() usageReport {
+	now := time.Now()
+	names := make(map[string][]string)
+	for _, k := range sortedChannels() {
+		chInfo, _ := lookupChannel(k)
+		names[chInfo.addr] = append(names[chInfo.addr], displayName(k))
+	}
+	r := usageReport{Event: "shutdown_report", Started: startTime, Stopped: now, Channels: make([]channelReport, 0)}
+	usageMu.Lock()
+	for addr, u := range usage {
+		uptime := u.uptime
+		if !u.started.IsZero() {
+			uptime += now.Sub(u.started)
+		}
+		r.Channels = append(r.Channels, channelReport{Names: names[addr], Addr: addr, Uptime: uptime.Seconds(),
+			Bytes: u.bytes, Errors: make(map[string]int), PeakClients: u.peakClients})
+	}
+	usageMu.Unlock()
+	healthMu.Lock()
+	for i, c := range r.Channels {
+		if h, ok := health[c.Addr]; ok {
+			for kind, n := range h.counts {
+				r.Channels[i].Errors[kind] = n
+			}
+		}
+	}
+	healthMu.Unlock()
+	sort.Slice(r.Channels, func(i, j int) bool { return r.Channels[i].Addr < r.Channels[j].Addr })
+	return r
+}
+
+func writeUsageReport() {
+	r := currentUsage()
+	log.Printf("Usage since %v:", r.Started.Format(time.RFC3339))
+	for _, c := range r.Channels {
+		errs := make([]string, 0)
+		for kind, n := range c.Errors {
+			errs = append(errs, fmt.Sprintf("%s=%d", kind, n))
+		}
+		sort.Strings(errs)
+		if len(errs) == 0 {
+			errs = append(errs, "none")
+		}
+		log.Printf("  %s @ %s: uptime %v, %d bytes served, peak %d clients, errors: %s",
+			strings.Join(c.Names, ", "), c.Addr, time.Duration(c.Uptime*float64(time.Second)).Round(time.Second),
+			c.Bytes, c.PeakClients, strings.Join(errs, " "))
+	}
+	if reportTarget == "" {
+		return
+	}
+	data, _ := json.MarshalIndent(r, "", "  ")
+	if !strings.HasPrefix(reportTarget, "http://") && !strings.HasPrefix(reportTarget, "https://") {
+		if err := ioutil.WriteFile(reportTarget, data, 0600); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	// the process is exiting, do not wait long
+	client := *httpClient
+	client.Timeout = 5 * time.Second
+	resp, err := client.Post(reportTarget, "application/json", bytes.NewReader(data))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// "vmdecrypt validate [flags]" checks the configuration without starting
+// any network activity. Errors are printed as JSON lines.
+
+type configError struct {
+	Flag    string `json:"flag"`
+	Channel string `json:"channel,omitempty"`
+	Line    int    `json:"line,omitempty"` // of the -config file
+	Error   string `json:"error"`
+}
+
+func flagValue(name string) string {
+	return flag.Lookup(name).Value.String()
+}
+
+func validateChannels(chURL string) []configError {
+	errs := make([]configError, 0)
+	if chURL == "" {
+		return append(errs, configError{Flag: "c", Error: "no channels file given"})
+	}
+	if strings.HasPrefix(chURL, "http://") || strings.HasPrefix(chURL, "https://") {
+		// remote channel lists are not fetched when validating
+		if _, err := url.Parse(chURL); err != nil {
+			errs = append(errs, configError{Flag: "c", Error: err.Error()})
+		}
+		return errs
+	}
+	body, err := readChannels(chURL)
+	if err != nil {
+		return append(errs, configError{Flag: "c", Error: err.Error()})
+	}
+	chans, _, parseErrs := parseChannels(body)
+	for _, err := range parseErrs {
+		errs = append(errs, configError{Flag: "c", Error: err.Error()})
+	}
+	keys := make([]string, 0)
+	for k := range chans {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		chInfo := chans[k]
+		name, _ := url.PathUnescape(k)
+		host, port, err := net.SplitHostPort(chInfo.addr)
+		if err != nil {
+			errs = append(errs, configError{Flag: "c", Channel: name, Error: err.Error()})
+		} else if ip := net.ParseIP(host); ip == nil || !ip.IsMulticast() {
+			errs = append(errs, configError{Flag: "c", Channel: name, Error: fmt.Sprintf("%s is not a multicast address", host)})
+		} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			errs = append(errs, configError{Flag: "c", Channel: name, Error: fmt.Sprintf("invalid port %s", port)})
+		}
+		if err := checkSources(chInfo.sources); err != nil {
+			errs = append(errs, configError{Flag: "c", Channel: name, Error: err.Error()})
+		}
+		if chInfo.capture && net.ParseIP(host).To4() == nil {
+			errs = append(errs, configError{Flag: "c", Channel: name, Error: "capture supports only IPv4 groups"})
+		}
+		if !validKey(chInfo.masterKey) {
+			errs = append(errs, configError{Flag: "c", Channel: name, Error: "channel key must be 16, 24 or 32 bytes in hex"})
+		}
+		if chInfo.output != "" {
+			if host, _, err := net.SplitHostPort(chInfo.output); err != nil {
+				errs = append(errs, configError{Flag: "c", Channel: name, Error: err.Error()})
+			} else if ip := net.ParseIP(host); ip == nil || !ip.IsMulticast() {
+				errs = append(errs, configError{Flag: "c", Channel: name, Error: fmt.Sprintf("output %s is not a multicast address", host)})
+			}
+		}
+		if chInfo.iface != "" {
+			if _, err := net.InterfaceByName(chInfo.iface); err != nil {
+				errs = append(errs, configError{Flag: "c", Channel: name, Error: err.Error()})
+			}
+		}
+		if chInfo.rules.HLSProfile != "" {
+			if _, err := parseHLSParams(flagValue("hls-params"), chInfo.rules.HLSProfile); err != nil {
+				errs = append(errs, configError{Flag: "c", Channel: name, Error: err.Error()})
+			}
+		}
+	}
+	numbered := make(map[int]string)
+	for _, k := range keys {
+		if n := chans[k].number; n != 0 {
+			name, _ := url.PathUnescape(k)
+			if other, ok := numbered[n]; ok {
+				errs = append(errs, configError{Flag: "c", Channel: name, Error: fmt.Sprintf("number %d is also used by %s", n, other)})
+			}
+			numbered[n] = name
+		}
+	}
+	for k := range restrictedChannels {
+		if _, ok := chans[k]; !ok && len(chans) > 0 {
+			name, _ := url.PathUnescape(k)
+			errs = append(errs, configError{Flag: "restricted", Channel: name, Error: "no such channel"})
+		}
+	}
+	for _, k := range channelKeys(flagValue("prejoin")) {
+		if _, ok := chans[k]; !ok && len(chans) > 0 {
+			name, _ := url.PathUnescape(k)
+			errs = append(errs, configError{Flag: "prejoin", Channel: name, Error: "no such channel"})
+		}
+	}
+	// errors of the schedule itself are reported by validateConfig
+	schedules, _ := parseRecordSchedule(flagValue("record-schedule"))
+	for _, s := range schedules {
+		if _, ok := chans[s.key]; !ok && len(chans) > 0 {
+			name, _ := url.PathUnescape(s.key)
+			errs = append(errs, configError{Flag: "record-schedule", Channel: name, Error: "no such channel"})
+		}
+	}
+	return errs
+}
+
+func validateConfig(configErrs []configError) int {
+	errs := append(make([]configError, 0), configErrs...)
+	if ifi, err := net.InterfaceByName(flagValue("i")); err != nil {
+		errs = append(errs, configError{Flag: "i", Error: err.Error()})
+	} else if ifi.Flags&net.FlagMulticast == 0 {
+		errs = append(errs, configError{Flag: "i", Error: "interface does not support multicast"})
+	}
+	if _, port, err := net.SplitHostPort(flagValue("a")); err != nil {
+		errs = append(errs, configError{Flag: "a", Error: err.Error()})
+	} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		errs = append(errs, configError{Flag: "a", Error: "invalid port " + port})
+	} else if _, err := listenAddr(flagValue("a")); err != nil {
+		errs = append(errs, configError{Flag: "a", Error: err.Error()})
+	}
+	if tunerCount < 1 {
+		errs = append(errs, configError{Flag: "tuners", Error: "must be positive"})
+	}
+	parseRestricted(flagValue("restricted"))
+	if len(restrictedChannels) > 0 && parentalPin == "" {
+		errs = append(errs, configError{Flag: "pin", Error: "restricted channels require a PIN"})
+	}
+	if err := parseTrustedProxies(flagValue("trusted-proxies")); err != nil {
+		errs = append(errs, configError{Flag: "trusted-proxies", Error: err.Error()})
+	}
+	if err := setupChannelsClient(); err != nil {
+		errs = append(errs, configError{Flag: "c-cert", Error: err.Error()})
+	}
+	if ffmpegPath != "" {
+		if _, err := exec.LookPath(ffmpegPath); err != nil {
+			errs = append(errs, configError{Flag: "ffmpeg", Error: err.Error()})
+		}
+	}
+	if apiKeysFile != "" {
+		if err := loadAPIKeys(); err != nil {
+			errs = append(errs, configError{Flag: "api-keys", Error: err.Error()})
+		}
+	}
+	if _, err := parseNetworks(flagValue("auth-exempt")); err != nil {
+		errs = append(errs, configError{Flag: "auth-exempt", Error: err.Error()})
+	}
+	if basicAuthFile != "" {
+		if err := loadBasicAuth(); err != nil {
+			errs = append(errs, configError{Flag: "basic-auth", Error: err.Error()})
+		}
+	}
+	if signKeyFile != "" {
+		if err := loadSignKey(); err != nil {
+			errs = append(errs, configError{Flag: "sign-key", Error: err.Error()})
+		}
+	}
+	if hlsWatermark && tokensFile == "" {
+		errs = append(errs, configError{Flag: "hls-watermark", Error: "watermarks require -tokens"})
+	}
+	if _, err := parseLadder(flagValue("hls-ladder")); err != nil {
+		errs = append(errs, configError{Flag: "hls-ladder", Error: err.Error()})
+	}
+	if _, err := parseHLSParams(flagValue("hls-params"), hlsProfile); err != nil {
+		errs = append(errs, configError{Flag: "hls-params", Error: err.Error()})
+	}
+	if _, err := parseMaintenance(flagValue("maintenance")); err != nil {
+		errs = append(errs, configError{Flag: "maintenance", Error: err.Error()})
+	}
+	if webhookURL != "" {
+		if u, err := url.Parse(webhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, configError{Flag: "webhook", Error: "must be an http(s) URL"})
+		}
+	}
+	if standbyAfter < 0 {
+		errs = append(errs, configError{Flag: "standby", Error: "must not be negative"})
+	}
+	if upstreamIdle < 0 {
+		errs = append(errs, configError{Flag: "upstream-idle", Error: "must not be negative"})
+	}
+	if dnsCacheTTL < 0 {
+		errs = append(errs, configError{Flag: "dns-cache", Error: "must not be negative"})
+	}
+	if err := validateTLS(); err != nil {
+		errs = append(errs, configError{Flag: "tls-cert", Error: err.Error()})
+	}
+	if http2Streams < 0 {
+		errs = append(errs, configError{Flag: "http2-streams", Error: "must not be negative"})
+	}
+	if strings.Contains(reportTarget, "://") {
+		if u, err := url.Parse(reportTarget); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, configError{Flag: "report", Error: "must be a file or an http(s) URL"})
+		}
+	}
+	if pacingSmoothing < 0 || pacingSmoothing >= 1 {
+		errs = append(errs, configError{Flag: "pace-smoothing", Error: "must be in [0, 1)"})
+	}
+	if _, err := parseOutputRange(flagValue("output-range")); err != nil {
+		errs = append(errs, configError{Flag: "output-range", Error: err.Error()})
+	}
+	if outputTTL < 0 || outputTTL > 255 {
+		errs = append(errs, configError{Flag: "output-ttl", Error: "must be in [0, 255]"})
+	}
+	if outputIface != "" {
+		if _, err := net.InterfaceByName(outputIface); err != nil {
+			errs = append(errs, configError{Flag: "output-iface", Error: err.Error()})
+		}
+	}
+	if err := validateDiskRing(); err != nil {
+		errs = append(errs, configError{Flag: "disk-ring-dir", Error: err.Error()})
+	}
+	if err := validateRecording(); err != nil {
+		errs = append(errs, configError{Flag: "record-dir", Error: err.Error()})
+	}
+	if schedules, err := parseRecordSchedule(flagValue("record-schedule")); err != nil {
+		errs = append(errs, configError{Flag: "record-schedule", Error: err.Error()})
+	} else if len(schedules) > 0 && recordDir == "" {
+		errs = append(errs, configError{Flag: "record-schedule", Error: "requires -record-dir"})
+	}
+	if err := validateRemux(); err != nil {
+		errs = append(errs, configError{Flag: "record-remux", Error: err.Error()})
+	} else if recordRemux != "" && recordDir == "" {
+		errs = append(errs, configError{Flag: "record-remux", Error: "requires -record-dir"})
+	}
+	if jitterDepth < 0 || jitterDepth > 1<<15 {
+		errs = append(errs, configError{Flag: "jitter-depth", Error: "must be in [0, 32768]"})
+	}
+	if _, err := parseCAIDs(flagValue("caid")); err != nil {
+		errs = append(errs, configError{Flag: "caid", Error: err.Error()})
+	}
+	if logSampleWindow < 0 {
+		errs = append(errs, configError{Flag: "log-sample", Error: "must not be negative"})
+	}
+	if rcvBuf < 0 {
+		errs = append(errs, configError{Flag: "rcvbuf", Error: "must not be negative"})
+	}
+	if watchdogStall < 0 {
+		errs = append(errs, configError{Flag: "watchdog", Error: "must not be negative"})
+	}
+	if watchdogRestarts < 0 {
+		errs = append(errs, configError{Flag: "watchdog-restarts", Error: "must not be negative"})
+	}
+	if outageLimit < 0 {
+		errs = append(errs, configError{Flag: "outage", Error: "must not be negative"})
+	}
+	if writeTimeout < 0 {
+		errs = append(errs, configError{Flag: "write-timeout", Error: "must not be negative"})
+	}
+	if err := validateSlowClients(); err != nil {
+		errs = append(errs, configError{Flag: "slow-clients", Error: err.Error()})
+	}
+	if err := validateLatencyBudget(); err != nil {
+		errs = append(errs, configError{Flag: "latency-budget", Error: err.Error()})
+	}
+	if ringSize < 0 {
+		errs = append(errs, configError{Flag: "ring-size", Error: "must not be negative"})
+	}
+	if relayHeartbeat < 0 {
+		errs = append(errs, configError{Flag: "relay-heartbeat", Error: "must not be negative"})
+	}
+	errs = append(errs, validateChannels(flagValue("c"))...)
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, e := range errs {
+		enc.Encode(e)
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "%d configuration errors\n", len(errs))
+		return 1
+	}
+	fmt.Fprintln(os.Stderr, "Configuration OK")
+	return 0
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rgerganov/vmdecrypt"
+)
+
+// vmdecrypt verify-key: checks channel keys against the ECMs of a capture
+// file and reports the crypto periods each key decrypts.
+
+// cryptoPeriod is a run of ECMs with the same table ID (0x80 or 0x81)
+type cryptoPeriod struct {
+	start float64 // seconds from the first PCR, -1 without PCR
+	table byte
+	ok    bool // an ECM of the period was decrypted
+}
+
+type keyCheck struct {
+	key     string
+	dec     *vmdecrypt.Decryptor
+	gotKeys bool
+	err     error // the first error other than ECM failures
+	periods []cryptoPeriod
+}
+
+func (kc *keyCheck) process(pkt []byte, t float64) {
+	kc.gotKeys = false
+	err := kc.dec.ProcessPacket(pkt)
+	if err != nil && !errors.Is(err, vmdecrypt.ErrECM) {
+		if kc.err == nil {
+			kc.err = err
+		}
+		return
+	}
+	if err == nil && !kc.gotKeys {
+		return
+	}
+	sec, _ := vmdecrypt.Section(pkt)
+	n := len(kc.periods)
+	if n == 0 || kc.periods[n-1].table != sec[0] {
+		kc.periods = append(kc.periods, cryptoPeriod{start: t, table: sec[0]})
+		n++
+	}
+	if kc.gotKeys {
+		kc.periods[n-1].ok = true
+	}
+}
+
+// validRanges returns the decrypted crypto periods, e.g. "1-3, 5"
+func (kc *keyCheck) validRanges() string {
+	ranges := make([]string, 0)
+	for i := 0; i < len(kc.periods); i++ {
+		if !kc.periods[i].ok {
+			continue
+		}
+		j := i
+		for j+1 < len(kc.periods) && kc.periods[j+1].ok {
+			j++
+		}
+		r := fmt.Sprintf("%d-%d", i+1, j+1)
+		if i == j {
+			r = strconv.Itoa(i + 1)
+		}
+		if start, end := kc.periods[i].start, kc.periods[j].start; start >= 0 {
+			r += fmt.Sprintf(" (%.1fs to %.1fs)", start, end)
+		}
+		ranges = append(ranges, r)
+		i = j
+	}
+	return strings.Join(ranges, ", ")
+}
+
+// readPacket reads the next TS packet, skipping the bytes before a sync byte
+func readPacket(r *bufio.Reader, pkt []byte) error {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b == 0x47 {
+			break
+		}
+	}
+	pkt[0] = 0x47
+	_, err := io.ReadFull(r, pkt[1:])
+	return err
+}
+
+// pcrBase returns the 90 kHz PCR base of the packet, if it has one
+func pcrBase(pkt []byte) (uint64, bool) {
+	if pkt[3]&0x20 == 0 || pkt[4] < 7 || pkt[5]&0x10 == 0 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(pkt[6:14]) >> 31, true
+}
+
+func readKeys(list, file string) ([]string, error) {
+	keys := make([]string, 0)
+	if list != "" {
+		keys = append(keys, strings.Split(list, ",")...)
+	}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		// one key per line, anything after it is a comment
+		for _, line := range strings.Split(string(data), "\n") {
+			if fields := strings.Fields(line); len(fields) > 0 && !strings.HasPrefix(fields[0], "#") {
+				keys = append(keys, fields[0])
+			}
+		}
+	}
+	for _, k := range keys {
+		if !validKey(k) {
+			return nil, fmt.Errorf("Invalid key %q, expected 16, 24 or 32 bytes in hex", k)
+		}
+	}
+	return keys, nil
+}
+
+func verifyKey(args []string) int {
+	fs := flag.NewFlagSet("verify-key", flag.ExitOnError)
+	file := fs.String("file", "", "Capture of the channel (MPEG-TS)")
+	keyList := fs.String("key", "", "Comma separated channel keys in hex")
+	keyFile := fs.String("keys", "", "File with one channel key in hex per line")
+	caidList := fs.String("caid", "0x5601", "Comma separated CAIDs of the ECMs")
+	program := fs.Uint("program", 0, "Service ID of the channel in multi-program streams (0 = first)")
+	keyLength := fs.Int("key-length", 16, "Length of the keys in the ECMs in bytes")
+	keyOffsets := fs.String("key-offsets", "9,25", "Comma separated offsets of the two keys in the decrypted ECMs")
+	fs.Parse(args)
+	keys, err := readKeys(*keyList, *keyFile)
+	var caids []uint16
+	if err == nil {
+		caids, err = parseCAIDs(*caidList)
+	}
+	var layout vmdecrypt.KeyLayout
+	if err == nil {
+		offsets := make([]int, 0)
+		for _, o := range strings.Split(*keyOffsets, ",") {
+			off, err := strconv.Atoi(strings.TrimSpace(o))
+			if err != nil {
+				off = -1
+			}
+			offsets = append(offsets, off)
+		}
+		layout, err = newKeyLayout(offsets, *keyLength)
+	}
+	if *file == "" || len(keys) == 0 || err != nil {
+		if err != nil {
+			fmt.Println(err)
+		}
+		fmt.Println("Usage: vmdecrypt verify-key -file capture.ts -key <hex>[,<hex>...] [-keys keys.txt] [-caid 0x5601] [-program <id>] [-key-length 16 -key-offsets 9,25]")
+		return 2
+	}
+	f, err := os.Open(*file)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	defer f.Close()
+
+	checks := make([]*keyCheck, len(keys))
+	for i, k := range keys {
+		key, _ := hex.DecodeString(k)
+		kc := &keyCheck{key: k, dec: vmdecrypt.NewDecryptor(key)}
+		kc.dec.CAIDs = caids
+		kc.dec.ServiceID = uint16(*program)
+		kc.dec.KeyLayout = layout
+		kc.dec.OnKeys = func() { kc.gotKeys = true }
+		checks[i] = kc
+	}
+	r := bufio.NewReaderSize(f, 1<<20)
+	pkt := make([]byte, 188)
+	packets := 0
+	var firstPCR uint64
+	t, pcrFound := -1.0, false
+	for readPacket(r, pkt) == nil {
+		packets++
+		if pcr, ok := pcrBase(pkt); ok {
+			if !pcrFound {
+				firstPCR, pcrFound = pcr, true
+			}
+			t = float64(pcr-firstPCR) / 90000
+		}
+		// only the clear packets (PAT, PMT, ECM) matter for the keys
+		if pkt[3]>>6 >= 2 {
+			continue
+		}
+		for _, kc := range checks {
+			kc.process(pkt, t)
+		}
+	}
+
+	fmt.Printf("%s: %d packets, %d crypto periods\n", *file, packets, len(checks[0].periods))
+	valid := 0
+	for _, kc := range checks {
+		switch ranges := kc.validRanges(); {
+		case len(kc.periods) == 0 && kc.err != nil:
+			fmt.Printf("%s: no ECMs found: %v\n", kc.key, kc.err)
+		case len(kc.periods) == 0:
+			fmt.Printf("%s: no ECMs found\n", kc.key)
+		case ranges == "":
+			fmt.Printf("%s: invalid\n", kc.key)
+		default:
+			fmt.Printf("%s: valid for crypto periods %s\n", kc.key, ranges)
+			valid++
+		}
+	}
+	if valid == 0 {
+		return 1
+	}
+	return 0
+}
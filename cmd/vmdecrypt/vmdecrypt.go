@@ -0,0 +1,1245 @@
+package main
+
+import (
+	"container/ring"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/rgerganov/vmdecrypt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Channel struct {
+	addr       string
+	stats      RTPStats
+	dec        *vmdecrypt.Decryptor
+	fp         fingerprinter
+	mu         sync.Mutex
+	buf        *ring.Ring
+	disk       *diskRing
+	c          *sync.Cond
+	ctx        context.Context // canceled when the last client detaches
+	cancel     context.CancelFunc
+	ioerr      bool
+	numClients int
+	http       bool
+	id         string
+	written    uint64 // packets added to buf
+	overruns   uint64 // clients which fell behind buf
+	evicted    uint64 // slow clients which were disconnected
+	restarts   uint64 // of the receiver by the watchdog
+	logs       *logSampler
+	ringSize   int // packets in buf
+
+	batch   packetBatch // of the decrypting goroutine
+	started bool        // the output started, with -start-pat
+
+	relaysMu     sync.Mutex
+	relays       []*channelRelay
+	relaysClosed bool // the channel stopped
+}
+
+var RingSize = 64
+
+// large enough for jumbo frames and datagrams reassembled from fragments
+const maxDatagramSize = 65535
+
+var runningChannelsMu sync.Mutex
+var runningChannels map[string]*Channel
+
+var ifi *net.Interface
+var httpAddr string
+
+type ChannelInfo struct {
+	addr      string
+	masterKey string
+	format    string // "rtp", "udp" (plain MPEG-TS) or empty to detect
+	group     string
+	logo      string              // logo URL for the playlists
+	epgID     string              // tvg-id of the channel in an external guide
+	number    int                 // channel number, 0 = after the numbered ones
+	iface     string              // multicast interface, -i if empty
+	capture   bool                // sniff the traffic instead of joining the group
+	output    string              // multicast group:port where it is re-emitted
+	fec       bool                // SMPTE 2022-1 FEC on port+2 and port+4
+	sources   []sourceAddr        // extra groups merged into the stream
+	headers   map[string]string   // extra HTTP response headers
+	caids     []uint16            // CAIDs of the ECMs, -caid if empty
+	program   uint16              // service ID in multi-program streams, 0 = first
+	pmtPid    uint16              // PID of the PMT, 0 = from the PAT
+	ecmPid    uint16              // PID of the ECMs, 0 = from the PMT
+	caProfile string              // name of the CA profile
+	keyLayout vmdecrypt.KeyLayout // from the CA profile, zero = default
+	unnamed   bool                // named after the SDT service name
+	tags      []string
+	rules     tagRule            // settings of the tags
+	tagRules  map[string]tagRule // rules of the tags, for the export
+	networks  []string           // networks attribute, for the export
+	// client networks allowed to use the channel, from the networks
+	// attribute or the tag rules, all if empty
+	allowedNets []*net.IPNet
+}
+
+// channel name => ChannelInfo
+var channels map[string]ChannelInfo
+var channelsMu sync.RWMutex
+
+// last successfully fetched channels file
+var channelsCache string
+
+func lookupChannel(k string) (ChannelInfo, bool) {
+	channelsMu.RLock()
+	defer channelsMu.RUnlock()
+	chInfo, ok := channels[k]
+	return chInfo, ok
+}
+
+// channels added, changed or removed (nil) at runtime, they take precedence
+// over the channels file
+var channelOverrides = make(map[string]*ChannelInfo)
+
+func addChannel(k string, chInfo ChannelInfo) {
+	channelsMu.Lock()
+	channels[k] = chInfo
+	channelOverrides[k] = &chInfo
+	unifyAliases()
+	channelsMu.Unlock()
+}
+
+// removeChannel removes a channel from the lineup, false if there is no
+// such channel
+func removeChannel(k string) bool {
+	channelsMu.Lock()
+	defer channelsMu.Unlock()
+	if _, ok := channels[k]; !ok {
+		return false
+	}
+	delete(channels, k)
+	channelOverrides[k] = nil
+	unifyAliases()
+	return true
+}
+
+// sessionKey identifies the running channel, the channels with the same
+// address and program share it
+func (chInfo ChannelInfo) sessionKey() string {
+	if chInfo.program == 0 {
+		return chInfo.addr
+	}
+	return fmt.Sprintf("%s#%d", chInfo.addr, chInfo.program)
+}
+
+// CAIDs of the ECMs of the channels without the caid attribute
+var defaultCAIDs []uint16
+
+var stripCA bool
+
+var clearScrambling bool
+
+// hold the packets of a channel until its first keys
+var waitKeys bool
+
+// start the output of a channel at the first PAT after its keys
+var startAtPAT bool
+
+// parseCAIDs parses comma separated CAIDs, e.g. "0x5601,0x5602"
+func parseCAIDs(s string) ([]uint16, error) {
+	caids := make([]uint16, 0)
+	for _, c := range strings.Split(s, ",") {
+		caid, err := strconv.ParseUint(strings.TrimSpace(c), 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CAID %q", c)
+		}
+		caids = append(caids, uint16(caid))
+	}
+	return caids, nil
+}
+
+// parsePid parses a PID attribute, a number or a string like "0x1ff"
+func parsePid(v interface{}) (uint16, error) {
+	var pid uint64
+	switch p := v.(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		if p != float64(int(p)) {
+			return 0, fmt.Errorf("Invalid PID %v", p)
+		}
+		pid = uint64(p)
+	case string:
+		var err error
+		if pid, err = strconv.ParseUint(strings.TrimSpace(p), 0, 16); err != nil {
+			return 0, fmt.Errorf("Invalid PID %q", p)
+		}
+	default:
+		return 0, fmt.Errorf("Invalid PID %v", p)
+	}
+	// 0 is the PAT and 0x1fff the null packets
+	if pid < 1 || pid > 0x1ffe {
+		return 0, fmt.Errorf("Invalid PID %v", v)
+	}
+	return uint16(pid), nil
+}
+
+// validKey reports if k is a channel key, 16, 24 or 32 bytes in hex
+func validKey(k string) bool {
+	key, err := hex.DecodeString(k)
+	return err == nil && (len(key) == 16 || len(key) == 24 || len(key) == 32)
+}
+
+// CA profile of the channels file, for deployments whose ECMs carry other
+// keys than AES-128 at the usual offsets, e.g.
+// "ca_profiles": {"vcas256": {"key_length": 32, "key_offsets": [9, 41]}}
+type caProfile struct {
+	KeyLength  int   `json:"key_length"`
+	KeyOffsets []int `json:"key_offsets"`
+}
+
+func newKeyLayout(offsets []int, length int) (vmdecrypt.KeyLayout, error) {
+	if length != 16 && length != 24 && length != 32 {
+		return vmdecrypt.KeyLayout{}, fmt.Errorf("Invalid key length %d, expected 16, 24 or 32", length)
+	}
+	if len(offsets) != 2 || offsets[0] < 0 || offsets[1] < 0 {
+		return vmdecrypt.KeyLayout{}, fmt.Errorf("Invalid key offsets %v, expected two offsets in the ECM", offsets)
+	}
+	return vmdecrypt.KeyLayout{Offsets: [2]int{offsets[0], offsets[1]}, Length: length}, nil
+}
+
+// newDecryptor returns a decryptor for the channel with the given key
+func newDecryptor(chInfo ChannelInfo, masterKey string) *vmdecrypt.Decryptor {
+	key, _ := hex.DecodeString(masterKey)
+	dec := vmdecrypt.NewDecryptor(key)
+	dec.CAIDs = defaultCAIDs
+	dec.ServiceID = chInfo.program
+	dec.StripCA = stripCA
+	dec.KeepScrambling = !clearScrambling
+	dec.KeyLayout = chInfo.keyLayout
+	dec.FixedPMTPid = chInfo.pmtPid
+	dec.FixedECMPid = chInfo.ecmPid
+	if len(chInfo.caids) > 0 {
+		dec.CAIDs = chInfo.caids
+	}
+	return dec
+}
+
+// setHeaders adds the extra response headers of the channel
+func (chInfo ChannelInfo) setHeaders(w http.ResponseWriter) {
+	for k, v := range chInfo.headers {
+		w.Header().Set(k, v)
+	}
+}
+
+func newChannel(chInfo ChannelInfo, http bool) *Channel {
+	addr := chInfo.addr
+	ch := Channel{addr: addr, dec: newDecryptor(chInfo, chInfo.masterKey), numClients: 1, http: http, id: newID(),
+		ringSize: chInfo.ringSize()}
+	if http {
+		ch.buf = ring.New(ch.ringSize)
+		ch.c = sync.NewCond(&ch.mu)
+		ch.ctx, ch.cancel = context.WithCancel(decryptCtx)
+		ch.http = true
+		ch.disk = diskRingFor(addr)
+	}
+	ch.logs = newLogSampler(ch.logf)
+	ch.dec.Logf = ch.logs.printf
+	ch.dec.Trace = ch.tracing
+	ch.dec.OnServiceName = func(name string) { setServiceName(addr, name) }
+	ch.dec.OnKeys = func() { recordWorking(addr) }
+	ch.dec.OnEvents = func(events []vmdecrypt.Event) { storeEvents(addr, events) }
+	ch.dec.OnKeyChange = func(odd bool) {
+		recordRotation(chInfo.sessionKey(), rotationEvent{Event: "key", Key: keyParity(odd)})
+	}
+	ch.dec.OnCryptoPeriod = func(odd bool) {
+		recordRotation(chInfo.sessionKey(), rotationEvent{Event: "period", Key: keyParity(odd)})
+	}
+	ch.dec.OnFormatChange = func(reason string) { formatChanged(&ch, chInfo, reason) }
+	ch.dec.OnPacket = ch.onPacket
+	if waitKeys {
+		ch.dec.HoldPackets = ch.ringSize
+	}
+	return &ch
+}
+
+func (ch *Channel) logf(format string, v ...interface{}) {
+	log.Printf("[%s] %s", ch.id, fmt.Sprintf(format, v...))
+}
+
+// parseRTP returns the offset of the RTP payload
+func (ch *Channel) parseRTP(pkt []byte) (int, error) {
+	hdr, err := vmdecrypt.ParseRTP(pkt)
+	if err != nil {
+		return 0, err
+	}
+	ch.mu.Lock()
+	discontinuity := ch.stats.update(hdr.Seq, hdr.Timestamp)
+	ch.mu.Unlock()
+	if discontinuity {
+		ch.logs.printf("RTP discontinuity detected")
+		recordRotation(ch.addr, rotationEvent{Event: "error", Kind: "discontinuity"})
+	}
+	if ch.tracing() {
+		ch.logf("trace: RTP seq=%d ts=%d len=%d", hdr.Seq, hdr.Timestamp, len(pkt))
+	}
+	return hdr.Offset, nil
+}
+
+// payloadOffset returns the offset of the MPEG-TS payload of a datagram,
+// plain MPEG-TS is detected from the sync byte if the format is not known
+// (the first byte of RTP packets is never 0x47 as their version is 2)
+func (ch *Channel) payloadOffset(payload []byte, format string) (int, error) {
+	if format == "udp" || (format == "" && len(payload) > 0 && payload[0] == 0x47) {
+		return 0, nil
+	}
+	return ch.parseRTP(payload)
+}
+
+func savePacket(pkt []byte) {
+	f, err := os.OpenFile("dump.ts", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(pkt); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (ch *Channel) processRTP(payload []byte, offset int) error {
+	return ch.dec.Process(payload[offset:])
+}
+
+// onPacket is called with every decrypted packet
+func (ch *Channel) onPacket(pkt []byte) {
+	ch.fingerprint(pkt)
+	if startAtPAT && !ch.started {
+		// the first PAT section after the keys
+		pid := binary.BigEndian.Uint16(pkt[1:3]) & 0x1fff
+		if !ch.dec.HasKeys() || pid != 0 || pkt[1]&0x40 == 0 {
+			return
+		}
+		ch.started = true
+	}
+	if ch.http {
+		ch.batch.pkts = append(ch.batch.pkts, pkt)
+	}
+	if ch.disk != nil {
+		ch.disk.write(pkt)
+	}
+	//savePacket(pkt)
+	//log.Printf("% x\n", pkt)
+}
+
+func (ch *Channel) currentPtr() *ring.Ring {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.buf
+}
+
+// currentPos returns the current position in buf and its packet number
+func (ch *Channel) currentPos() (*ring.Ring, uint64) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.buf, ch.written
+}
+
+// overrun reports if the packet number pos has already been overwritten
+func (ch *Channel) overrun(pos uint64) bool {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.written-pos <= uint64(ch.ringSize) {
+		return false
+	}
+	ch.overruns++
+	return true
+}
+
+func (ch *Channel) evict() {
+	ch.mu.Lock()
+	ch.evicted++
+	ch.mu.Unlock()
+}
+
+// nextPtr waits for the next packet, after closeBuf the packets which are
+// left are returned before nil. It returns nil right away when ctx is done.
+func (ch *Channel) nextPtr(ctx context.Context, ptr *ring.Ring) (*ring.Ring, interface{}) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ptr == ch.buf && !ch.ioerr {
+		stop := context.AfterFunc(ctx, func() {
+			ch.mu.Lock()
+			ch.c.Broadcast()
+			ch.mu.Unlock()
+		})
+		defer stop()
+		for ptr == ch.buf && !ch.ioerr && ctx.Err() == nil {
+			ch.c.Wait()
+		}
+	}
+	if ptr != ch.buf && ctx.Err() == nil {
+		return ptr.Next(), ptr.Value
+	} else {
+		return ptr, nil
+	}
+}
+
+func (ch *Channel) closeBuf() {
+	ch.mu.Lock()
+	ch.ioerr = true
+	ch.c.Broadcast()
+	ch.mu.Unlock()
+}
+
+// decrypt reads datagrams from src and decrypts them until an error,
+// out is called with every decrypted datagram if given, when its batch is
+// flushed
+func (ch *Channel) decrypt(ctx context.Context, src Source, format string, out func([]byte) error) error {
+	var jb *jitterBuffer
+	if jitterDepth > 1 {
+		jb = newJitterBuffer(jitterDepth, jitterLatency)
+	}
+	// the clients get what was decrypted
+	defer ch.flushBatch(func([]byte) error { return nil })
+	for {
+		payload, err := src.ReadPacket(ch.readContext(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if ch.batchTimeout(err) {
+				if err := ch.flushBatch(out); err != nil {
+					return err
+				}
+				continue
+			}
+			recordError(ch.addr, "io")
+			return sourceError{err}
+		}
+		offset, err := ch.payloadOffset(payload, format)
+		if err != nil {
+			recordError(ch.addr, "rtp")
+			return err
+		}
+		if jb == nil || offset == 0 {
+			if err := ch.decryptPayload(payload, offset, out); err != nil {
+				return err
+			}
+		} else {
+			for _, p := range jb.push(&jitterPacket{payload, offset, time.Now()}) {
+				if err := ch.decryptPayload(p.payload, p.offset, out); err != nil {
+					return err
+				}
+			}
+		}
+		if err := ch.endDatagram(out); err != nil {
+			return err
+		}
+	}
+}
+
+func (ch *Channel) decryptPayload(payload []byte, offset int, out func([]byte) error) error {
+	payload = vmdecrypt.StripRS(payload, offset)
+	if err := ch.processRTP(payload, offset); err != nil {
+		recordError(ch.addr, errorKind(err))
+		return err
+	}
+	if out != nil {
+		ch.batch.datagrams = append(ch.batch.datagrams, payload)
+	}
+	return nil
+}
+
+// decryptHTTP decrypts into the ring buffer and to the relays until ch.ctx
+// is canceled, the receiver fails -watchdog-restarts times in a row or an
+// outage lasts longer than -outage. The clients get the rest of the buffer.
+func decryptHTTP(ch *Channel, chInfo ChannelInfo) {
+	defer decryptWG.Done()
+	defer ch.closeBuf()
+	defer ch.closeRelays()
+	hostPort := chInfo.addr
+	var outage time.Time // start of the current outage
+	delay := minRejoinDelay
+	restarts := 0 // in a row
+	for {
+		written, started := ch.packetsWritten(), time.Now()
+		err := ch.runReceiver(chInfo)
+		if ch.ctx.Err() != nil {
+			break
+		}
+		ch.logf("%v @ %v", err, hostPort)
+		if err != errStalled && time.Since(started) >= watchdogReset {
+			restarts = 0
+		}
+		if !isSourceError(err) {
+			if restarts >= watchdogRestarts {
+				ch.logf("I/O error, stop decrypting channel @ %v", hostPort)
+				break
+			}
+			restarts++
+			ch.restarted()
+			ch.logf("Restarting the receiver @ %v", hostPort)
+			continue
+		}
+		if outageLimit == 0 {
+			ch.logf("I/O error, stop decrypting channel @ %v", hostPort)
+			break
+		}
+		if outage.IsZero() || ch.packetsWritten() != written {
+			outage, delay = time.Now(), minRejoinDelay
+		}
+		if time.Since(outage) >= outageLimit {
+			ch.logf("Outage longer than %v, stop decrypting channel @ %v", outageLimit, hostPort)
+			break
+		}
+		ch.logf("Joining again in %v @ %v", delay, hostPort)
+		select {
+		case <-ch.ctx.Done():
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxRejoinDelay)
+	}
+	switch {
+	case decryptCtx.Err() != nil:
+		ch.logf("Shutting down, stop decrypting channel @ %v", hostPort)
+	case ch.ctx.Err() != nil:
+		ch.logf("No more clients, stop decrypting channel @ %v", hostPort)
+	}
+	ch.logf("Done @ %v", hostPort)
+}
+
+func decryptRTP(ctx context.Context, ch *Channel, chInfo ChannelInfo, dest relayWriter) {
+	defer decryptWG.Done()
+	runningRelays.Add(1)
+	defer runningRelays.Add(-1)
+	hostPort := chInfo.addr
+	src, err := openSource(chInfo)
+	if err != nil {
+		ch.logf("%v", err)
+		recordError(hostPort, "join")
+	} else {
+		ch.logf("Start decrypting channel @ %v", hostPort)
+		err = ch.decrypt(ctx, src, chInfo.inputFormat(), func(payload []byte) error {
+			_, err := dest.Write(payload)
+			return err
+		})
+		src.Close()
+		ch.logf("%v @ %v", err, hostPort)
+	}
+	ch.logf("I/O error, stop decrypting channel @ %v", hostPort)
+	dest.Close()
+	ch.logf("Done @ %v", hostPort)
+}
+
+func rtpHandler(w http.ResponseWriter, req *http.Request) {
+	// requestURI should be /rtp/CNN/192.168.1.1:51820
+	// or /rtp/session/<id>/keepalive
+	parts := strings.Split(req.RequestURI[5:], "/")
+	if len(parts) == 3 && parts[0] == "session" && strings.SplitN(parts[2], "?", 2)[0] == "keepalive" {
+		relayKeepaliveHandler(w, req, parts[1])
+		return
+	}
+	if len(parts) != 2 {
+		httpError(w, req, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	chName := parts[0]
+	chInfo, ok := getChannel(w, req, chName)
+	if !ok {
+		return
+	}
+	addr := strings.SplitN(parts[1], "?", 2)[0]
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		httpError(w, req, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	dest, err := dialRelay(addr, req.URL.Query())
+	if err != nil {
+		httpError(w, req, err.Error(), http.StatusBadRequest)
+		return
+	}
+	out, err := relayOutput(dest, req.URL.Query())
+	if err != nil {
+		dest.Close()
+		httpError(w, req, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the relay shares the channel with the HTTP clients and the other
+	// relays, so the group is joined once
+	ch := attachChannel(chInfo)
+	id := newID()
+	if relayHeartbeat > 0 {
+		out = newHeartbeatWriter(out, id)
+	}
+	if !ch.addRelay(&channelRelay{id, chInfo, out}) {
+		httpError(w, req, "Channel stopped", http.StatusServiceUnavailable)
+		return
+	}
+	reqLogf(req, "Start relaying to %v, session %v of %v", addr, id, ch.id)
+	writeJSON(w, map[string]string{"session": id})
+}
+
+func attachChannel(chInfo ChannelInfo) *Channel {
+	runningChannelsMu.Lock()
+	defer runningChannelsMu.Unlock()
+	ch, ok := runningChannels[chInfo.sessionKey()]
+	if !ok {
+		ch = newChannel(chInfo, true)
+		runningChannels[chInfo.sessionKey()] = ch
+		decryptWG.Add(1)
+		go withChannelLabels(ch, func() { decryptHTTP(ch, chInfo) })
+	} else {
+		ch.numClients += 1
+	}
+	usageClients(chInfo.addr, ch.numClients)
+	return ch
+}
+
+func detachChannel(chInfo ChannelInfo) {
+	runningChannelsMu.Lock()
+	defer runningChannelsMu.Unlock()
+	touchRecent(chInfo.addr)
+	if ch, ok := runningChannels[chInfo.sessionKey()]; ok {
+		ch.numClients -= 1
+		if ch.numClients == 0 {
+			ch.cancel()
+			delete(runningChannels, chInfo.sessionKey())
+			usageStopped(chInfo.addr)
+		}
+	}
+}
+
+func chHandler(w http.ResponseWriter, req *http.Request) {
+	chName := strings.SplitN(req.RequestURI[4:], "?", 2)[0]
+	chInfo, ok := getChannel(w, req, chName)
+	if !ok {
+		return
+	}
+	chInfo.setHeaders(w)
+	ch := attachChannel(chInfo)
+
+	reqLogf(req, "Start serving client %v, session %v", req.RemoteAddr, ch.id)
+	w.Header().Set("Trailer", "Retry-After")
+	token := requestToken(req)
+	client := req.URL.Query().Get("client")
+	sess := registerClient(client, chName)
+	cw := newClientWriter(w)
+	withChannelLabels(ch, func() {
+		ptr, pos := ch.currentPos()
+		var val interface{}
+		for {
+			ptr, val = ch.nextPtr(req.Context(), ptr)
+			if t := sess.takeZap(); t != nil {
+				detachChannel(chInfo)
+				ch, chInfo = t.ch, t.chInfo
+				ptr, pos = ch.currentPos()
+				reqLogf(req, "Client %v zapped to session %v", client, ch.id)
+				continue
+			}
+			if val == nil {
+				break
+			}
+			if ch.overrun(pos) {
+				if slowClients == "disconnect" {
+					reqLogf(req, "Client %v fell behind the stream, disconnecting", req.RemoteAddr)
+					ch.evict()
+					break
+				}
+				// continue with the latest packets
+				ptr, pos = ch.currentPos()
+				continue
+			}
+			pos++
+			n, err := cw.Write(val.([]byte))
+			usageServed(ch.addr, n)
+			if err != nil {
+				if stalled(err) {
+					reqLogf(req, "Client %v stalled for %v, disconnecting", req.RemoteAddr, writeTimeout)
+					ch.evict()
+				}
+				break
+			}
+			if !token.consume(n) {
+				reqLogf(req, "Quota of token %s exceeded", token.Name)
+				break
+			}
+		}
+	})
+
+	unregisterClient(client, sess)
+	reqLogf(req, "Stop serving client %v", req.RemoteAddr)
+	if shuttingDown.Load() {
+		w.Header().Set("Retry-After", retryAfter)
+	}
+	detachChannel(chInfo)
+}
+
+func sortedChannels() []string {
+	channelsMu.RLock()
+	keys := make([]string, 0)
+	for k, _ := range channels {
+		keys = append(keys, k)
+	}
+	channelsMu.RUnlock()
+	sort.Strings(keys)
+	return keys
+}
+
+func m3uHandler(w http.ResponseWriter, req *http.Request) {
+	writeM3U(w, req, playlistChannels(req))
+}
+
+// tvgID returns the guide ID of the channel, its name in /xmltv.xml unless
+// the channels file gives one
+func (chInfo ChannelInfo) tvgID(k string) string {
+	if chInfo.epgID != "" {
+		return chInfo.epgID
+	}
+	return k
+}
+
+// extinfAttrs returns the #EXTINF attributes of the channel
+func extinfAttrs(k string, chInfo ChannelInfo) string {
+	attrs := fmt.Sprintf(" tvg-id=%q", chInfo.tvgID(k))
+	if chInfo.number != 0 {
+		attrs += fmt.Sprintf(" tvg-chno=\"%d\"", chInfo.number)
+	}
+	if chInfo.logo != "" {
+		attrs += fmt.Sprintf(" tvg-logo=%q", chInfo.logo)
+	}
+	if chInfo.group != "" {
+		attrs += fmt.Sprintf(" group-title=%q", chInfo.group)
+	}
+	return attrs
+}
+
+func writeM3U(w http.ResponseWriter, req *http.Request, keys []string) {
+	fmt.Fprintf(w, "#EXTM3U url-tvg=\"%s/xmltv.xml%s\"\n", serverURL(), accessQuery(req, ""))
+	annotate := req.URL.Query().Get("annotate") != ""
+	for _, k := range keys {
+		chInfo, _ := lookupChannel(k)
+		if annotate {
+			io.WriteString(w, healthComment(chInfo.addr))
+		}
+		if _, disabled := channelDisabled(chInfo.addr); disabled {
+			fmt.Fprintf(w, "#EXTINF:-1%s, %s (disabled)\n", extinfAttrs(k, chInfo), displayName(k))
+		} else {
+			fmt.Fprintf(w, "#EXTINF:-1%s, %s\n", extinfAttrs(k, chInfo), displayName(k))
+		}
+		fmt.Fprintf(w, "%s/ch/%s%s\n", serverURL(), k, accessQuery(req, k))
+	}
+}
+
+// address scheme => input format
+var inputFormats = map[string]string{"igmp": "", "rtp": "rtp", "udp": "udp"}
+
+// parseChannels parses the channels file, malformed entries are skipped
+// and reported as errors
+func parseChannels(body []byte) (map[string]ChannelInfo, string, []error) {
+	var f struct {
+		Date       string               `json:"date"`
+		Channels   [][]interface{}      `json:"channels"`
+		CAProfiles map[string]caProfile `json:"ca_profiles"`
+		TagRules   map[string]tagRule   `json:"tag_rules"`
+	}
+	if err := json.Unmarshal(body, &f); err != nil {
+		return nil, "", []error{err}
+	}
+	chans := make(map[string]ChannelInfo)
+	errs := make([]error, 0)
+	layouts := make(map[string]vmdecrypt.KeyLayout)
+	for name, p := range f.CAProfiles {
+		layout, err := newKeyLayout(p.KeyOffsets, p.KeyLength)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("CA profile %s: %v", name, err))
+			continue
+		}
+		layouts[name] = layout
+	}
+	rules := make(map[string]tagRule)
+	for tag, r := range f.TagRules {
+		if err := r.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("Tag rule %s: %v", tag, err))
+			continue
+		}
+		rules[tag] = r
+	}
+	for i, v := range f.Channels {
+		if len(v) < 3 {
+			errs = append(errs, fmt.Errorf("Entry %d: expected [name, address, key]", i))
+			continue
+		}
+		name, _ := v[0].(string)
+		addr, _ := v[1].(string)
+		scheme, hostPort, _ := strings.Cut(addr, "://")
+		format, ok := inputFormats[scheme]
+		if !ok {
+			errs = append(errs, fmt.Errorf("Entry %d (%s): unsupported address %q", i, name, addr))
+			continue
+		}
+		unnamed := name == ""
+		if unnamed {
+			name = hostPort
+		}
+		// optional channel attributes, e.g. {"group": "News", "iface": "eth0.100"}
+		var attrs map[string]interface{}
+		if len(v) > 3 {
+			attrs, _ = v[3].(map[string]interface{})
+		}
+		group, _ := attrs["group"].(string)
+		logo, _ := attrs["logo"].(string)
+		epgID, _ := attrs["epg_id"].(string)
+		var number int
+		if n, ok := attrs["number"].(float64); ok {
+			if n < 1 || n != float64(int(n)) {
+				errs = append(errs, fmt.Errorf("Entry %d (%s): invalid number %v", i, name, n))
+				continue
+			}
+			number = int(n)
+		}
+		iface, _ := attrs["iface"].(string)
+		capture, _ := attrs["capture"].(bool)
+		output, _ := attrs["output"].(string)
+		fec, _ := attrs["fec"].(bool)
+		sources, err := parseSources(attrs["sources"])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Entry %d (%s): %v", i, name, err))
+			continue
+		}
+		var caids []uint16
+		switch c := attrs["caid"].(type) {
+		case string:
+			var err error
+			if caids, err = parseCAIDs(c); err != nil {
+				errs = append(errs, fmt.Errorf("Entry %d (%s): %v", i, name, err))
+				continue
+			}
+		case float64:
+			caids = []uint16{uint16(c)}
+		}
+		var program uint16
+		if p, ok := attrs["program"].(float64); ok {
+			if p < 1 || p > 0xffff || p != float64(int(p)) {
+				errs = append(errs, fmt.Errorf("Entry %d (%s): invalid program %v", i, name, p))
+				continue
+			}
+			program = uint16(p)
+		}
+		pmtPid, err := parsePid(attrs["pmt_pid"])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Entry %d (%s): pmt_pid: %v", i, name, err))
+			continue
+		}
+		ecmPid, err := parsePid(attrs["ecm_pid"])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Entry %d (%s): ecm_pid: %v", i, name, err))
+			continue
+		}
+		var keyLayout vmdecrypt.KeyLayout
+		caProfile, _ := attrs["ca_profile"].(string)
+		if caProfile != "" {
+			var ok bool
+			if keyLayout, ok = layouts[caProfile]; !ok {
+				errs = append(errs, fmt.Errorf("Entry %d (%s): unknown CA profile %q", i, name, caProfile))
+				continue
+			}
+		}
+		tags, err := parseTags(attrs)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Entry %d (%s): %v", i, name, err))
+			continue
+		}
+		merged, tagRules := mergeRules(tags, rules)
+		networks, err := parseNetworkList(attrs["networks"])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Entry %d (%s): %v", i, name, err))
+			continue
+		}
+		allowed := networks
+		if allowed == nil {
+			allowed = merged.Networks
+		}
+		allowedNets, _ := parseNetworks(strings.Join(allowed, ","))
+		var headers map[string]string
+		if h, ok := attrs["headers"].(map[string]interface{}); ok {
+			headers = make(map[string]string)
+			for k, v := range h {
+				if s, ok := v.(string); ok {
+					headers[k] = s
+				}
+			}
+		}
+		switch key := v[2].(type) {
+		case string:
+			name = url.PathEscape(name)
+			chans[name] = ChannelInfo{addr: hostPort, masterKey: key, format: format, group: group, logo: logo, epgID: epgID, number: number, iface: iface, capture: capture, output: output, fec: fec, sources: sources, headers: headers, caids: caids, program: program, pmtPid: pmtPid, ecmPid: ecmPid, caProfile: caProfile, keyLayout: keyLayout, unnamed: unnamed, tags: tags, rules: merged, tagRules: tagRules, networks: networks, allowedNets: allowedNets}
+		case float64:
+			// ignore
+		}
+	}
+	return chans, f.Date, errs
+}
+
+func readChannels(chURL string) ([]byte, error) {
+	if !strings.HasPrefix(chURL, "http://") && !strings.HasPrefix(chURL, "https://") {
+		return ioutil.ReadFile(chURL)
+	}
+	resp, err := channelsClient.Get(chURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// the next fetch is in an hour, no need to keep the connection
+	defer channelsClient.CloseIdleConnections()
+	return ioutil.ReadAll(resp.Body)
+}
+
+func fetchChannels(chURL string) {
+	cached := false
+	body, err := readChannels(chURL)
+	if err != nil {
+		if channelsCache == "" {
+			log.Fatal(err)
+		}
+		// start with the last fetched channels when the provider is unreachable
+		log.Printf("%v, using the cached channels from %s", err, channelsCache)
+		if body, err = ioutil.ReadFile(channelsCache); err != nil {
+			log.Fatal(err)
+		}
+		cached = true
+	}
+	chans, chdate, errs := parseChannels(body)
+	if chans == nil {
+		log.Fatal(errs[0])
+	}
+	if channelsCache != "" && !cached {
+		if err := ioutil.WriteFile(channelsCache+".tmp", body, 0600); err != nil {
+			log.Println(err)
+		} else if err := os.Rename(channelsCache+".tmp", channelsCache); err != nil {
+			log.Println(err)
+		}
+	}
+	for _, err := range errs {
+		log.Println(err)
+	}
+	channelsMu.Lock()
+	for name, chInfo := range chans {
+		channels[name] = chInfo
+	}
+	for name, chInfo := range channelOverrides {
+		if chInfo == nil {
+			delete(channels, name)
+		} else {
+			channels[name] = *chInfo
+		}
+	}
+	unifyAliases()
+	total := len(channels)
+	channelsMu.Unlock()
+	log.Printf("%d channels loaded, last updated on %s\n", total, chdate)
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "loadtest" {
+		os.Exit(loadtest(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "canary" {
+		os.Exit(canary(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify-key" {
+		os.Exit(verifyKey(os.Args[2:]))
+	}
+	validateOnly := len(os.Args) > 1 && os.Args[1] == "validate"
+	if validateOnly {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	configFile := flag.String("config", "", "YAML file with flag values, e.g. \"hls-ll: true\", the command line takes precedence")
+	ifname := flag.String("i", "eth0", "Multicast interface")
+	chURL := flag.String("c", "", "Channels file URL or path")
+	flag.StringVar(&channelsCache, "c-cache", "", "File with the last fetched channels, used when the channels URL is unreachable")
+	flag.StringVar(&fetchCert, "c-cert", "", "Client certificate (PEM) for fetching the channels file")
+	flag.StringVar(&fetchKey, "c-key", "", "Private key (PEM) of the client certificate")
+	flag.StringVar(&fetchCA, "c-ca", "", "CA bundle (PEM) for verifying the channels file server")
+	flag.StringVar(&httpAddr, "a", "localhost:8080", "Network address (host:port or interface:port) for the HTTP server")
+	flag.IntVar(&tunerCount, "tuners", 4, "Number of tuners reported to HDHomeRun clients")
+	flag.StringVar(&parentalPin, "pin", "", "PIN for accessing restricted channels")
+	restricted := flag.String("restricted", "", "Comma separated list of restricted channels")
+	outRange := flag.String("output-range", "", "Re-emit all channels to this multicast range keeping the host part of their group, e.g. 239.2.0.0/16")
+	flag.IntVar(&outputTTL, "output-ttl", 0, "Multicast TTL of the re-emitted channels (0 = system default)")
+	flag.StringVar(&outputIface, "output-iface", "", "Interface for the re-emitted channels")
+	prejoinList := flag.String("prejoin", "", "Comma separated list of channels which are decrypted from the start regardless of clients")
+	proxies := flag.String("trusted-proxies", "", "Comma separated list of proxy addresses/networks allowed to set X-Request-ID")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 30*time.Minute, "Maximum time to wait for clients to disconnect when upgrading")
+	flag.StringVar(&stateFile, "state", "", "File for saving the recently used channels on shutdown")
+	flag.IntVar(&errorBudget, "error-budget", 0, "Disable channels with this many errors in 10 minutes (0 = never)")
+	flag.DurationVar(&errorCooldown, "error-cooldown", 10*time.Minute, "How long channels stay disabled after exceeding the error budget")
+	flag.IntVar(&jitterDepth, "jitter-depth", 0, "Reorder RTP datagrams in a jitter buffer of this many datagrams (0 = off)")
+	flag.DurationVar(&jitterLatency, "jitter-latency", 50*time.Millisecond, "How long the jitter buffer waits for missing RTP datagrams")
+	flag.IntVar(&rcvBuf, "rcvbuf", 0, "Receive buffer size (SO_RCVBUF) of the multicast sockets in bytes (0 = system default)")
+	flag.DurationVar(&writeTimeout, "write-timeout", writeTimeout, "Disconnect streaming clients whose writes block for this long (0 = never)")
+	flag.StringVar(&slowClients, "slow-clients", slowClients, "What to do with clients which fall behind the ring buffer: skip to the latest packets or disconnect")
+	flag.DurationVar(&watchdogStall, "watchdog", watchdogStall, "Restart the receiver of a channel which decrypts no packets for this long (0 = never)")
+	flag.IntVar(&watchdogRestarts, "watchdog-restarts", watchdogRestarts, "Restarts of a failing receiver in a row before the channel stops")
+	flag.DurationVar(&outageLimit, "outage", outageLimit, "Join the group again after I/O errors until the outage lasts this long (0 = stop at the first error)")
+	flag.DurationVar(&latencyBudget, "latency-budget", 0, "Batch the decrypted datagrams received within this time, e.g. 5ms, for lower CPU usage (0 = per datagram)")
+	flag.IntVar(&ringSize, "ring-size", 0, "Size of the ring buffers of the channels in TS packets (0 = automatic)")
+	caidList := flag.String("caid", "0x5601", "Comma separated CAIDs of the ECMs, the first CA descriptor is used if none matches")
+	flag.BoolVar(&stripCA, "strip-ca", false, "Remove the CA descriptors and ECMs from the output")
+	flag.BoolVar(&clearScrambling, "clear-scrambling", true, "Clear the scrambling bits of the decrypted packets")
+	flag.BoolVar(&waitKeys, "wait-keys", true, "Hold the packets of a channel until its first ECM is decrypted, instead of passing them scrambled")
+	flag.BoolVar(&startAtPAT, "start-pat", false, "Start the output of a channel at the first PAT after its first ECM is decrypted")
+	flag.DurationVar(&logSampleWindow, "log-sample", 10*time.Second, "Log repeated stream errors of a channel once in this time with a summary (0 = log all)")
+	flag.IntVar(&rtpClock, "rtp-clock", 90000, "RTP clock rate in Hz")
+	maintenance := flag.String("maintenance", "", "Comma separated maintenance windows, e.g. 2026-10-20T02:00:00Z/2h or 03:00/30m for daily windows")
+	flag.StringVar(&maintenanceMessage, "maintenance-message", "", "Message for the clients refused during maintenance")
+	flag.IntVar(&http2Streams, "http2-streams", 100, "Maximum concurrent streams of an HTTP/2 (h2c) connection, 0 disables HTTP/2")
+	flag.StringVar(&tlsCert, "tls-cert", "", "Certificate file (PEM) for serving HTTPS")
+	flag.StringVar(&tlsKey, "tls-key", "", "Private key file (PEM) of -tls-cert")
+	flag.StringVar(&autocertHosts, "autocert", "", "Comma separated host names to get certificates for from Let's Encrypt")
+	flag.StringVar(&autocertDir, "autocert-dir", "autocert", "Directory where the Let's Encrypt certificates are cached")
+	flag.StringVar(&reportTarget, "report", "", "File or http(s) URL (POST) for the usage report written on exit")
+	flag.DurationVar(&standbyAfter, "standby", 0, "Enter standby after this time without clients, e.g. 30m (0 = never)")
+	flag.DurationVar(&upstreamIdle, "upstream-idle", 90*time.Second, "Close idle keep-alive connections to the channels file server, webhook and report URL after this time")
+	flag.DurationVar(&dnsCacheTTL, "dns-cache", time.Minute, "Cache the resolved host names of relay destinations and HTTP endpoints for this long (0 = off)")
+	flag.StringVar(&webhookURL, "webhook", "", "URL which is notified with a POST when a maintenance window starts and ends and when the format of a channel changes")
+	flag.StringVar(&apiKeysFile, "api-keys", "", "JSON file with the API keys, the API requires one of them when given")
+	flag.StringVar(&auditLogFile, "audit-log", "", "File where every API request is appended as a JSON line")
+	flag.StringVar(&basicAuthFile, "basic-auth", "", "File with user:password lines, the streaming endpoints and playlists require one of them")
+	flag.StringVar(&signKeyFile, "sign-key", "", "File with the secret for signed URLs, enables authentication of the streaming endpoints")
+	exemptList := flag.String("auth-exempt", "", "Comma separated networks whose clients need no authentication, e.g. 192.168.1.0/24")
+	flag.StringVar(&tokensFile, "tokens", "", "JSON file with access tokens and their quotas")
+	flag.BoolVar(&gsoEnabled, "gso", true, "Use UDP segmentation offload for relay outputs when supported")
+	flag.BoolVar(&pacingEnabled, "pace", false, "Pace relay outputs according to the PCR bitrate")
+	flag.DurationVar(&relayHeartbeat, "relay-heartbeat", 0, "Stop relays whose clients send no keepalive for this long (0 = never)")
+	flag.Float64Var(&pacingSmoothing, "pace-smoothing", 0.9, "Smoothing factor (0-1) of the PCR bitrate used for pacing")
+	dlna := flag.Bool("dlna", false, "Announce the channels as UPnP/DLNA MediaServer")
+	flag.StringVar(&diskRingDir, "disk-ring-dir", "", "Directory for the disk rings of the channels, enables timeshift")
+	flag.Int64Var(&diskRingSize, "disk-ring-size", 1024, "Size of the disk ring of each channel in MiB")
+	flag.StringVar(&recordDir, "record-dir", "", "Directory for recordings, enables the recording API")
+	flag.StringVar(&recordTemplate, "record-template", "{channel}-{start}.ts", "File name of the recordings with {channel}, {start}, {date} and {time}")
+	flag.DurationVar(&recordSegment, "record-segment", 0, "Start a new file of a recording after this time (0 = never)")
+	flag.Int64Var(&recordQuota, "record-quota", 0, "Size of the recordings in MiB, the oldest files are removed beyond it (0 = unlimited)")
+	flag.StringVar(&recordRemux, "record-remux", "", "Remux the finished recording files into mp4 or mkv")
+	flag.BoolVar(&recordKeepTS, "record-keep-ts", false, "Keep the TS of the remuxed recordings")
+	recordScheduleList := flag.String("record-schedule", "", "Comma separated recordings, e.g. CNN@20:00/1h (daily) or BBC@2026-10-20T20:00:00Z/30m")
+	flag.StringVar(&ffmpegPath, "ffmpeg", "", "Path to ffmpeg, enables HLS output")
+	flag.StringVar(&whepICEServers, "whep-ice", "", "Comma separated STUN/TURN URLs for the WHEP sessions, e.g. stun:stun.l.google.com:19302")
+	flag.StringVar(&hlsDir, "hls-dir", "", "Directory for HLS segments")
+	flag.BoolVar(&hlsLowLatency, "hls-ll", false, "Low-latency HLS with partial segments")
+	flag.BoolVar(&hlsRestartOnChange, "hls-restart-on-change", false, "Restart the HLS transcoders of a channel when its format changes")
+	flag.BoolVar(&hlsWatermark, "hls-watermark", false, "Burn an identifier of the token into the HLS renditions")
+	ladder := flag.String("hls-ladder", "", "Transcoded HLS renditions, e.g. 1280x720@2800k,854x480@1200k")
+	flag.StringVar(&hlsProfile, "hls-profile", "", "Extra ffmpeg options of the HLS transcoders, {name} is replaced with a parameter of -hls-params, e.g. \"-preset {preset}\"")
+	hlsParamList := flag.String("hls-params", "", "Query parameters of HLS requests passed through to -hls-profile with their defaults, e.g. preset=veryfast")
+	flag.Parse()
+	configErrs := loadConfigFile(*configFile)
+	if validateOnly {
+		os.Exit(validateConfig(configErrs))
+	}
+	for _, e := range configErrs {
+		if e.Line > 0 {
+			log.Printf("%s:%d: %s: %s", *configFile, e.Line, e.Flag, e.Error)
+		} else {
+			log.Printf("%s: %s: %s", *configFile, e.Flag, e.Error)
+		}
+	}
+	if len(configErrs) > 0 {
+		os.Exit(1)
+	}
+	log.SetOutput(io.MultiWriter(os.Stderr, recentLog))
+	var err error
+	ifi, err = net.InterfaceByName(*ifname)
+	if err != nil {
+		fmt.Printf("No such network interface: %s\n", *ifname)
+		os.Exit(1)
+	}
+	if httpAddr, err = listenAddr(httpAddr); err != nil {
+		log.Fatal(err)
+	}
+	applyLimits()
+	if ringSize > 0 {
+		RingSize = ringSize
+	}
+	growRingForJitter()
+	parseRestricted(*restricted)
+	if err := parseTrustedProxies(*proxies); err != nil {
+		log.Fatal(err)
+	}
+	setupUpstream()
+	if err := setupChannelsClient(); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateDiskRing(); err != nil {
+		log.Fatal(err)
+	}
+	if defaultCAIDs, err = parseCAIDs(*caidList); err != nil {
+		log.Fatal(err)
+	}
+	if outputRange, err = parseOutputRange(*outRange); err != nil {
+		log.Fatal(err)
+	}
+	if maintenanceWindows, err = parseMaintenance(*maintenance); err != nil {
+		log.Fatal(err)
+	}
+	if len(maintenanceWindows) > 0 {
+		go watchMaintenance()
+	}
+	if err := validateRecording(); err != nil {
+		log.Fatal(err)
+	}
+	if recordSchedules, err = parseRecordSchedule(*recordScheduleList); err != nil {
+		log.Fatal(err)
+	}
+	if recordDir == "" && len(recordSchedules) > 0 {
+		log.Fatal("-record-schedule requires -record-dir")
+	}
+	if err := validateRemux(); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateTLS(); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateSlowClients(); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateLatencyBudget(); err != nil {
+		log.Fatal(err)
+	}
+	if recordDir == "" && recordRemux != "" {
+		log.Fatal("-record-remux requires -record-dir")
+	}
+	go watchTuning()
+	if standbyAfter > 0 {
+		go watchStandby()
+	}
+	if apiKeysFile != "" {
+		if err := loadAPIKeys(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if authExempt, err = parseNetworks(*exemptList); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadStreamAuth(); err != nil {
+		log.Fatal(err)
+	}
+	if tokensFile != "" {
+		if err := loadTokens(); err != nil {
+			log.Fatal(err)
+		}
+		loadPrefs()
+	}
+	channels = make(map[string]ChannelInfo)
+	if *chURL != "" {
+		ticker := time.NewTicker(1 * time.Hour)
+		go func() {
+			fetchChannels(*chURL)
+			waitHandover()
+			if stateFile != "" {
+				resumeChannels()
+			}
+			startPrejoin(channelKeys(*prejoinList))
+			startOutputs()
+			if len(recordSchedules) > 0 {
+				go watchRecordSchedules()
+			}
+			fetched := time.Now()
+			for {
+				<-ticker.C
+				if standby() && time.Since(fetched) < standbyFetchInterval {
+					continue
+				}
+				fetchChannels(*chURL)
+				fetched = time.Now()
+				startOutputs()
+			}
+		}()
+	}
+
+	log.Printf("Starting HTTP server on %s, multicast interface: %s\n", httpAddr, *ifname)
+	runningChannels = make(map[string]*Channel)
+	http.HandleFunc("/rtp/", rtpHandler)
+	http.HandleFunc("/ch/", chHandler)
+	http.HandleFunc("/whep/", whepHandler)
+	http.HandleFunc("/audio/", audioHandler)
+	http.HandleFunc("/ws/", wsHandler)
+	http.HandleFunc("/subs/", subtitlesHandler)
+	http.HandleFunc("/timeshift/", timeshiftHandler)
+	if recordDir != "" {
+		http.HandleFunc("/record/", recordHandler)
+		go remuxWorker()
+	}
+	http.HandleFunc("/api/remux", remuxHandler)
+	http.HandleFunc("/channels.m3u", m3uHandler)
+	http.HandleFunc("/xmltv.xml", xmltvHandler)
+	http.HandleFunc("/discover.json", discoverHandler)
+	http.HandleFunc("/lineup.json", lineupHandler)
+	http.HandleFunc("/lineup_status.json", lineupStatusHandler)
+	http.HandleFunc("/lineup.post", lineupPostHandler)
+	http.HandleFunc("/player_api.php", xtreamHandler)
+	http.HandleFunc("/live/", liveHandler)
+	http.HandleFunc("/api/cast", castHandler)
+	http.HandleFunc("/channels", channelsPageHandler)
+	http.HandleFunc("/api/channels", channelsAPIHandler)
+	http.HandleFunc("/api/channels/export", exportHandler)
+	http.HandleFunc("/api/status", statusHandler)
+	http.HandleFunc("/api/quota", quotaHandler)
+	http.HandleFunc("/api/version", versionHandler)
+	http.HandleFunc("/api/fingerprint/", fingerprintHandler)
+	http.HandleFunc("/api/profile/", profileHandler)
+	http.HandleFunc("/api/trace/", traceHandler)
+	http.HandleFunc("/api/rotation/", rotationHandler)
+	http.HandleFunc("/api/zap", zapHandler)
+	http.HandleFunc("/api/sign", signHandler)
+	http.HandleFunc("/api/debug/bundle", debugBundleHandler)
+	if tokensEnabled() {
+		http.HandleFunc("/api/prefs", prefsHandler)
+		http.HandleFunc("/u/", personalM3UHandler)
+	}
+	http.HandleFunc("/api/discover", scanHandler)
+	http.HandleFunc("/api/keys/probe", keyProbeHandler)
+	if hlsEnabled() {
+		startHLS(*ladder, *hlsParamList)
+		http.HandleFunc("/api/snapshot/", snapshotHandler)
+		http.HandleFunc("/mosaic", mosaicHandler)
+	}
+	if *dlna {
+		startDLNA()
+	}
+	ln, err := listen(httpAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := &http.Server{Handler: withRequestID(withShutdown(withStandby(withAPIKeys(withStreamAuth(http.DefaultServeMux)))))}
+	configureHTTP(srv)
+	if tlsEnabled() {
+		if err := configureTLS(srv); err != nil {
+			log.Fatal(err)
+		}
+	}
+	go handleUpgrade(srv, ln)
+	go handleShutdown(srv)
+	notifyReady()
+	if tlsEnabled() {
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	// wait for the upgrade to complete
+	select {}
+}
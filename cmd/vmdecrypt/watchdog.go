@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// Channel watchdog: the receiver of a channel (the goroutine reading and
+// decrypting the group) is restarted while the clients stay attached when
+// it decrypts no packets for -watchdog, fails to decrypt (e.g. ECM errors)
+// or panics. After -watchdog-restarts restarts in a row, without a receiver
+// running for watchdogReset in between, the channel stops.
+
+var watchdogStall = 20 * time.Second
+var watchdogRestarts = 3
+
+const watchdogReset = time.Minute
+
+var errStalled = errors.New("Receiver stalled")
+
+// runReceiver runs the receiver until an error, a stall or until ch.ctx is
+// canceled
+func (ch *Channel) runReceiver(chInfo ChannelInfo) (err error) {
+	ctx, cancel := context.WithCancelCause(ch.ctx)
+	defer cancel(nil)
+	if watchdogStall > 0 {
+		go ch.watchStall(ctx, cancel)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("%v\n%s", r, debug.Stack())
+			err = fmt.Errorf("Receiver panic: %v", r)
+		}
+	}()
+	err = ch.decryptSource(ctx, chInfo)
+	if errors.Is(context.Cause(ctx), errStalled) {
+		return errStalled
+	}
+	return err
+}
+
+// watchStall cancels the receiver when ch.written stops growing for
+// -watchdog
+func (ch *Channel) watchStall(ctx context.Context, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(watchdogStall / 4)
+	defer ticker.Stop()
+	written, since := ch.packetsWritten(), time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if w := ch.packetsWritten(); w != written {
+			written, since = w, time.Now()
+		} else if time.Since(since) >= watchdogStall {
+			ch.logf("No packets decrypted for %v @ %v", watchdogStall, ch.addr)
+			cancel(errStalled)
+			return
+		}
+	}
+}
+
+func (ch *Channel) restarted() {
+	ch.mu.Lock()
+	ch.restarts++
+	ch.mu.Unlock()
+}
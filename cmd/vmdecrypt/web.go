@@ -0,0 +1,9 @@
+package main
+
+import "embed"
+
+// The web UI is embedded into the binary, so the release builds are self
+// contained.
+
+//go:embed web
+var webFS embed.FS
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/oggreader"
+)
+
+// WebRTC output with WHEP (WebRTC-HTTP Egress Protocol) for sub-second
+// latency in browsers: POST /whep/CNN with an SDP offer returns the answer
+// and the session URL in Location, DELETE on it ends the session. The H.264
+// video is sent as received, the audio is transcoded to Opus by ffmpeg when
+// -ffmpeg is given, as browsers do not decode the AAC or MPEG audio of the
+// channels over WebRTC. The ICE candidates are gathered before answering,
+// trickle ICE (PATCH) is not supported.
+
+const whepMaxOffer = 64 << 10
+const whepGatherTimeout = 5 * time.Second
+
+// sessions which are not connected by then are closed
+const whepConnectTimeout = 30 * time.Second
+
+// comma separated STUN/TURN URLs, e.g. stun:stun.l.google.com:19302
+var whepICEServers string
+
+type whepSession struct {
+	id        string
+	k         string
+	pc        *webrtc.PeerConnection
+	cancel    context.CancelFunc
+	connected chan struct{}
+}
+
+var whepSessionsMu sync.Mutex
+var whepSessions = make(map[string]*whepSession)
+
+func whepHandler(w http.ResponseWriter, req *http.Request) {
+	// requestURI should be /whep/CNN or /whep/CNN/<session id>
+	parts := strings.Split(req.URL.EscapedPath()[6:], "/")
+	// players of other origins are allowed, like for /ch/
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+	switch {
+	case req.Method == http.MethodOptions:
+		w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 1 && req.Method == http.MethodPost:
+		startWHEP(w, req, parts[0])
+	case len(parts) == 2 && req.Method == http.MethodDelete:
+		whepSessionsMu.Lock()
+		s, ok := whepSessions[parts[1]]
+		whepSessionsMu.Unlock()
+		if !ok || s.k != parts[0] {
+			httpError(w, req, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		s.cancel()
+	default:
+		httpError(w, req, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func whepConfiguration() webrtc.Configuration {
+	var config webrtc.Configuration
+	if whepICEServers != "" {
+		config.ICEServers = []webrtc.ICEServer{{URLs: strings.Split(whepICEServers, ",")}}
+	}
+	return config
+}
+
+// addWHEPTrack adds a track of the codec to pc and reads the RTCP of the
+// player for the NACK and report interceptors
+func addWHEPTrack(pc *webrtc.PeerConnection, codec webrtc.RTPCodecCapability, id string) (*webrtc.TrackLocalStaticSample, error) {
+	track, err := webrtc.NewTrackLocalStaticSample(codec, id, "vmdecrypt")
+	if err != nil {
+		return nil, err
+	}
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := sender.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return track, nil
+}
+
+func startWHEP(w http.ResponseWriter, req *http.Request, k string) {
+	chInfo, ok := getChannel(w, req, k)
+	if !ok {
+		return
+	}
+	if ct, _, _ := strings.Cut(req.Header.Get("Content-Type"), ";"); ct != "application/sdp" {
+		httpError(w, req, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+	offer, err := io.ReadAll(http.MaxBytesReader(w, req.Body, whepMaxOffer))
+	if err != nil {
+		httpError(w, req, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	pc, err := webrtc.NewPeerConnection(whepConfiguration())
+	if err != nil {
+		reqLogf(req, "%v", err)
+		httpError(w, req, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	video, err := addWHEPTrack(pc, webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}, "video")
+	var audio *webrtc.TrackLocalStaticSample
+	if err == nil && ffmpegPath != "" {
+		audio, err = addWHEPTrack(pc, webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio")
+	}
+	if err == nil {
+		err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(offer)})
+	}
+	var answer webrtc.SessionDescription
+	if err == nil {
+		answer, err = pc.CreateAnswer(nil)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err == nil {
+		err = pc.SetLocalDescription(answer)
+	}
+	if err != nil {
+		pc.Close()
+		reqLogf(req, "WHEP offer rejected: %v", err)
+		httpError(w, req, "Invalid offer", http.StatusBadRequest)
+		return
+	}
+	select {
+	case <-gathered:
+	case <-time.After(whepGatherTimeout):
+		reqLogf(req, "WHEP: ICE gathering did not complete in %v", whepGatherTimeout)
+	case <-req.Context().Done():
+		pc.Close()
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &whepSession{id: newID() + newID(), k: k, pc: pc, cancel: cancel, connected: make(chan struct{})}
+	var connectedOnce sync.Once
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			connectedOnce.Do(func() { close(s.connected) })
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			cancel()
+		}
+	})
+	whepSessionsMu.Lock()
+	whepSessions[s.id] = s
+	whepSessionsMu.Unlock()
+	go s.serve(ctx, req, chInfo, requestToken(req), video, audio)
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/whep/"+k+"/"+s.id+accessQuery(req, k))
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, pc.LocalDescription().SDP)
+}
+
+// serve waits for the player to connect and sends the channel until the
+// session ends
+func (s *whepSession) serve(ctx context.Context, req *http.Request, chInfo ChannelInfo, token *tokenState, video, audio *webrtc.TrackLocalStaticSample) {
+	defer func() {
+		s.cancel()
+		s.pc.Close()
+		whepSessionsMu.Lock()
+		delete(whepSessions, s.id)
+		whepSessionsMu.Unlock()
+	}()
+	select {
+	case <-s.connected:
+	case <-ctx.Done():
+		return
+	case <-time.After(whepConnectTimeout):
+		reqLogf(req, "WHEP client %v did not connect in %v", req.RemoteAddr, whepConnectTimeout)
+		return
+	}
+	reqLogf(req, "Start serving WHEP client %v", req.RemoteAddr)
+	if audio != nil {
+		go s.sendAudio(ctx, req, chInfo, token, audio)
+	}
+	s.sendVideo(ctx, req, chInfo, token, video, audio != nil)
+	reqLogf(req, "Stop serving WHEP client %v", req.RemoteAddr)
+}
+
+// h264Pid returns the H.264 stream of the channel with the lowest PID,
+// known is false until the PMT is received
+func (ch *Channel) h264Pid() (pid uint16, found, known bool) {
+	streams := ch.dec.StreamList()
+	for _, s := range streams {
+		if s.Type == 0x1b && (!found || s.PID < pid) {
+			pid, found = s.PID, true
+		}
+	}
+	return pid, found, len(streams) > 0
+}
+
+// sendVideo sends the access units of the H.264 stream of the channel,
+// starting with an IDR picture. Without video the audio is sent alone.
+func (s *whepSession) sendVideo(ctx context.Context, req *http.Request, chInfo ChannelInfo, token *tokenState, track *webrtc.TrackLocalStaticSample, withAudio bool) {
+	ch := attachChannel(chInfo)
+	defer detachChannel(chInfo)
+	var pid uint16
+	found := false
+	var au, sps, pps []byte
+	var pts uint64
+	started := false
+	ptr, pos := ch.currentPos()
+	var val interface{}
+	for {
+		ptr, val = ch.nextPtr(ctx, ptr)
+		if val == nil {
+			return
+		}
+		if ch.overrun(pos) {
+			// continue with the next IDR picture
+			ptr, pos = ch.currentPos()
+			au, started = nil, false
+			continue
+		}
+		pos++
+		pkt := val.([]byte)
+		if !found {
+			var known bool
+			if pid, found, known = ch.h264Pid(); !found {
+				if known {
+					reqLogf(req, "WHEP: %s has no H.264 video", chInfo.addr)
+					if withAudio {
+						<-ctx.Done()
+					}
+					return
+				}
+				continue
+			}
+		}
+		if binary.BigEndian.Uint16(pkt[1:3])&0x1fff != pid {
+			continue
+		}
+		newPTS, ok := pesPTS(pkt)
+		if !ok {
+			if au != nil {
+				au = append(au, pesPayload(pkt)...)
+			}
+			continue
+		}
+		if au != nil {
+			// the access unit lasts until the next one, jumps and the
+			// reordering of B-frames give no duration
+			duration := (newPTS - pts) & (1<<33 - 1)
+			if duration > 90000 {
+				duration = 0
+			}
+			var data []byte
+			data, sps, pps = annexBSample(au, sps, pps, !started)
+			if data != nil {
+				started = true
+				if err := track.WriteSample(media.Sample{Data: data, Duration: time.Duration(duration) * time.Second / 90000}); err != nil {
+					return
+				}
+				usageServed(chInfo.addr, len(data))
+				if !token.consume(len(data)) {
+					reqLogf(req, "Quota of token %s exceeded", token.Name)
+					return
+				}
+			}
+		}
+		au, pts = append(make([]byte, 0, 64<<10), pesPayload(pkt)...), newPTS
+	}
+}
+
+// annexBSample returns the access unit to send and the SPS and PPS seen so
+// far. IDR pictures without parameter sets get the last ones, before the
+// first IDR picture nothing is sent.
+func annexBSample(au, sps, pps []byte, waitIDR bool) ([]byte, []byte, []byte) {
+	idr, hasParams := false, false
+	for _, nal := range nalUnits(au) {
+		switch nal[0] & 0x1f {
+		case 5:
+			idr = true
+		case 7:
+			sps, hasParams = nal, true
+		case 8:
+			pps = nal
+		}
+	}
+	if !idr {
+		if waitIDR {
+			return nil, sps, pps
+		}
+		return au, sps, pps
+	}
+	if sps == nil || pps == nil {
+		return nil, sps, pps
+	}
+	if hasParams {
+		return au, sps, pps
+	}
+	data := make([]byte, 0, 8+len(sps)+len(pps)+len(au))
+	data = append(append(data, 0, 0, 0, 1), sps...)
+	data = append(append(data, 0, 0, 0, 1), pps...)
+	return append(data, au...), sps, pps
+}
+
+// nalUnits returns the NAL units of an Annex B access unit
+func nalUnits(au []byte) [][]byte {
+	var nals [][]byte
+	start := -1
+	for i := 0; i+2 < len(au); i++ {
+		if au[i] != 0 || au[i+1] != 0 || au[i+2] != 1 {
+			continue
+		}
+		if start >= 0 && i > start {
+			nals = append(nals, bytes.TrimRight(au[start:i], "\x00"))
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(au) {
+		nals = append(nals, au[start:])
+	}
+	return nals
+}
+
+// sendAudio sends the audio of the channel transcoded to Opus by ffmpeg,
+// one 20ms frame per Ogg page
+func (s *whepSession) sendAudio(ctx context.Context, req *http.Request, chInfo ChannelInfo, token *tokenState, track *webrtc.TrackLocalStaticSample) {
+	input := fmt.Sprintf("%s/ch/%s%s", serverURL(), s.k, accessQuery(nil, s.k))
+	cmd := exec.CommandContext(ctx, ffmpegPath, "-hide_banner", "-loglevel", "error",
+		"-i", input, "-vn", "-c:a", "libopus", "-ac", "2", "-ar", "48000", "-page_duration", "20000", "-f", "ogg", "pipe:1")
+	out, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		reqLogf(req, "WHEP: cannot start ffmpeg: %v", err)
+		return
+	}
+	defer cmd.Wait()
+	ogg, _, err := oggreader.NewWith(out)
+	if err != nil {
+		if ctx.Err() == nil {
+			reqLogf(req, "WHEP: no audio from ffmpeg: %v", err)
+		}
+		return
+	}
+	var granule uint64
+	for {
+		page, hdr, err := ogg.ParseNextPage()
+		if err != nil {
+			return
+		}
+		if _, ok := hdr.HeaderType(page); ok {
+			// OpusTags
+			continue
+		}
+		// the granule position counts the samples at 48 kHz
+		duration := 20 * time.Millisecond
+		if granule != 0 {
+			duration = time.Duration(hdr.GranulePosition-granule) * time.Second / 48000
+		}
+		granule = hdr.GranulePosition
+		if err := track.WriteSample(media.Sample{Data: page, Duration: duration}); err != nil {
+			return
+		}
+		usageServed(chInfo.addr, len(page))
+		if !token.consume(len(page)) {
+			reqLogf(req, "Quota of token %s exceeded", token.Name)
+			s.cancel()
+			return
+		}
+	}
+}
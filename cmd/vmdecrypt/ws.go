@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// MPEG-TS over WebSocket for browser players (mpegts.js) and clients behind
+// proxies which do not pass endless chunked responses. Every binary frame
+// carries whole TS packets, the ones available when it is sent, at most
+// wsFrameSize bytes.
+
+const wsFrameSize = 188 * 348
+
+func wsHandler(w http.ResponseWriter, req *http.Request) {
+	// requestURI should be /ws/CNN
+	chName := strings.SplitN(req.RequestURI[4:], "?", 2)[0]
+	chInfo, ok := getChannel(w, req, chName)
+	if !ok {
+		return
+	}
+	srv := websocket.Server{
+		// browsers of other origins are allowed, like for /ch/
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(conn *websocket.Conn) {
+			serveWS(conn, req, chInfo)
+		},
+	}
+	srv.ServeHTTP(w, req)
+}
+
+func serveWS(conn *websocket.Conn, req *http.Request, chInfo ChannelInfo) {
+	conn.PayloadType = websocket.BinaryFrame
+	// the request context is not canceled when the client of the hijacked
+	// connection goes away, so the frames from the client are read until
+	// its close frame or an error
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	go func() {
+		io.Copy(io.Discard, conn)
+		cancel()
+	}()
+	ch := attachChannel(chInfo)
+	defer detachChannel(chInfo)
+
+	reqLogf(req, "Start serving WebSocket client %v, session %v", req.RemoteAddr, ch.id)
+	token := requestToken(req)
+	frame := make([]byte, 0, wsFrameSize)
+	ptr, pos := ch.currentPos()
+	var val interface{}
+	for {
+		ptr, val = ch.nextPtr(ctx, ptr)
+		if val == nil {
+			break
+		}
+		if ch.overrun(pos) {
+			if slowClients == "disconnect" {
+				reqLogf(req, "Client %v fell behind the stream, disconnecting", req.RemoteAddr)
+				ch.evict()
+				break
+			}
+			ptr, pos = ch.currentPos()
+			frame = frame[:0]
+			continue
+		}
+		pos++
+		frame = append(frame, val.([]byte)...)
+		if len(frame)+188 <= wsFrameSize && ptr != ch.currentPtr() {
+			// more packets are waiting
+			continue
+		}
+		if writeTimeout > 0 {
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		}
+		_, err := conn.Write(frame)
+		usageServed(ch.addr, len(frame))
+		if err != nil {
+			if stalled(err) {
+				reqLogf(req, "Client %v stalled for %v, disconnecting", req.RemoteAddr, writeTimeout)
+				ch.evict()
+			}
+			break
+		}
+		if !token.consume(len(frame)) {
+			reqLogf(req, "Quota of token %s exceeded", token.Name)
+			break
+		}
+		frame = frame[:0]
+	}
+	reqLogf(req, "Stop serving WebSocket client %v", req.RemoteAddr)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Minimal Xtream Codes API for IPTV apps which only speak it (TiviMate,
+// IPTV Smarters): player_api.php with the live actions and the
+// /live/<username>/<password>/<stream id>.ts stream URLs. The password is
+// the access token if tokens are used, otherwise any credentials work.
+// Channels without a group are listed in the "Other" category.
+
+type xtreamUserInfo struct {
+	Username       string   `json:"username"`
+	Password       string   `json:"password"`
+	Auth           int      `json:"auth"`
+	Status         string   `json:"status,omitempty"`
+	ExpDate        *string  `json:"exp_date"`
+	IsTrial        string   `json:"is_trial"`
+	MaxConnections string   `json:"max_connections"`
+	OutputFormats  []string `json:"allowed_output_formats"`
+}
+
+type xtreamServerInfo struct {
+	URL          string `json:"url"`
+	Port         string `json:"port"`
+	HTTPSPort    string `json:"https_port,omitempty"`
+	Protocol     string `json:"server_protocol"`
+	TimestampNow int64  `json:"timestamp_now"`
+	Timezone     string `json:"timezone"`
+}
+
+type xtreamCategory struct {
+	ID       string `json:"category_id"`
+	Name     string `json:"category_name"`
+	ParentID int    `json:"parent_id"`
+}
+
+type xtreamStream struct {
+	Num          int    `json:"num"`
+	Name         string `json:"name"`
+	StreamType   string `json:"stream_type"`
+	StreamID     int    `json:"stream_id"`
+	StreamIcon   string `json:"stream_icon"`
+	EPGChannelID string `json:"epg_channel_id"`
+	Added        string `json:"added"`
+	CategoryID   string `json:"category_id"`
+	TVArchive    int    `json:"tv_archive"`
+	DirectSource string `json:"direct_source"`
+}
+
+const xtreamOtherCategory = "Other"
+
+// xtreamRequest passes the password of an Xtream request as the token, so
+// the playlist and parental control checks see the usual credentials
+func xtreamRequest(req *http.Request, password string) {
+	if !tokensEnabled() {
+		return
+	}
+	q := req.URL.Query()
+	q.Set("token", password)
+	req.URL.RawQuery = q.Encode()
+}
+
+// xtreamAuthorized reports if the credentials of the request are valid
+func xtreamAuthorized(req *http.Request) bool {
+	if !tokensEnabled() {
+		return true
+	}
+	t := requestToken(req)
+	return t != nil && t != internalToken && !t.Exhausted()
+}
+
+func xtreamGroup(chInfo ChannelInfo) string {
+	if chInfo.group == "" {
+		return xtreamOtherCategory
+	}
+	return chInfo.group
+}
+
+// xtreamCategories returns the groups of the visible channels => category ID
+func xtreamCategories(req *http.Request) ([]xtreamCategory, map[string]string) {
+	groups := make([]string, 0)
+	ids := make(map[string]string)
+	for _, k := range playlistChannels(req) {
+		chInfo, _ := lookupChannel(k)
+		if group := xtreamGroup(chInfo); ids[group] == "" {
+			ids[group] = "-"
+			groups = append(groups, group)
+		}
+	}
+	sort.Strings(groups)
+	categories := make([]xtreamCategory, 0)
+	for i, group := range groups {
+		ids[group] = strconv.Itoa(i + 1)
+		categories = append(categories, xtreamCategory{ID: ids[group], Name: group})
+	}
+	return categories, ids
+}
+
+func xtreamLogin(req *http.Request, username, password string) interface{} {
+	user := xtreamUserInfo{Username: username, Password: password, IsTrial: "0", MaxConnections: "1",
+		OutputFormats: []string{"ts"}}
+	if !xtreamAuthorized(req) {
+		return struct {
+			User xtreamUserInfo `json:"user_info"`
+		}{user}
+	}
+	user.Auth = 1
+	user.Status = "Active"
+	if t := requestToken(req); t != nil {
+		tokensMu.Lock()
+		if exp := t.expiresAt(); !exp.IsZero() {
+			s := strconv.FormatInt(exp.Unix(), 10)
+			user.ExpDate = &s
+		}
+		tokensMu.Unlock()
+	}
+	host, port, _ := strings.Cut(req.Host, ":")
+	server := xtreamServerInfo{URL: host, Port: port, Protocol: "http", TimestampNow: time.Now().Unix()}
+	if tlsEnabled() {
+		if port == "" {
+			server.Port = "443"
+		}
+		server.HTTPSPort, server.Protocol = server.Port, "https"
+	} else if port == "" {
+		server.Port = "80"
+	}
+	server.Timezone, _ = time.Now().Zone()
+	return struct {
+		User   xtreamUserInfo   `json:"user_info"`
+		Server xtreamServerInfo `json:"server_info"`
+	}{user, server}
+}
+
+func xtreamHandler(w http.ResponseWriter, req *http.Request) {
+	if refuseMaintenance(w, req) {
+		return
+	}
+	q := req.URL.Query()
+	username, password := q.Get("username"), q.Get("password")
+	xtreamRequest(req, password)
+	action := q.Get("action")
+	if action == "" {
+		writeJSON(w, xtreamLogin(req, username, password))
+		return
+	}
+	if !xtreamAuthorized(req) {
+		httpError(w, req, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	switch action {
+	case "get_live_categories":
+		categories, _ := xtreamCategories(req)
+		writeJSON(w, categories)
+	case "get_live_streams":
+		_, ids := xtreamCategories(req)
+		category := q.Get("category_id")
+		// the stream ID is the position in the list of all channels, so it
+		// does not depend on the credentials
+		all := sortedChannels()
+		numbers := guideNumbers()
+		streams := make([]xtreamStream, 0)
+		for _, k := range playlistChannels(req) {
+			chInfo, _ := lookupChannel(k)
+			id := ids[xtreamGroup(chInfo)]
+			if category != "" && category != id {
+				continue
+			}
+			streams = append(streams, xtreamStream{Num: numbers[k], Name: displayName(k), StreamType: "live",
+				StreamID: sort.SearchStrings(all, k) + 1, StreamIcon: chInfo.logo, EPGChannelID: chInfo.tvgID(k), Added: "0", CategoryID: id})
+		}
+		writeJSON(w, streams)
+	case "get_vod_categories", "get_vod_streams", "get_series_categories", "get_series":
+		// no VOD or series, but the apps insist on asking
+		writeJSON(w, []struct{}{})
+	default:
+		httpError(w, req, "Unsupported action", http.StatusBadRequest)
+	}
+}
+
+// liveHandler redirects /live/<username>/<password>/<stream id>.ts to the
+// channel
+func liveHandler(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/live/"), "/")
+	if len(parts) != 3 {
+		httpError(w, req, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	xtreamRequest(req, parts[1])
+	if !xtreamAuthorized(req) {
+		httpError(w, req, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	ext := strings.LastIndex(parts[2], ".")
+	if ext < 0 {
+		ext = len(parts[2])
+	}
+	id, err := strconv.Atoi(parts[2][:ext])
+	keys := sortedChannels()
+	if err != nil || id < 1 || id > len(keys) {
+		httpError(w, req, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	k := keys[id-1]
+	http.Redirect(w, req, fmt.Sprintf("/ch/%s%s", k, accessQuery(req, k)), http.StatusFound)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// Zapping: a /ch/ client started with ?client=<id> can be switched to
+// another channel on the same HTTP connection with
+// POST /api/zap?from=CNN&to=BBC&client=<id>
+
+type zapTarget struct {
+	k      string
+	chInfo ChannelInfo
+	ch     *Channel
+}
+
+type clientSession struct {
+	mu      sync.Mutex
+	k       string
+	pending *zapTarget // attached channel waiting to be picked up
+	closed  bool
+}
+
+var clientSessionsMu sync.Mutex
+
+// client id => session
+var clientSessions = make(map[string]*clientSession)
+
+func registerClient(id, k string) *clientSession {
+	sess := &clientSession{k: k}
+	if id == "" {
+		return sess
+	}
+	clientSessionsMu.Lock()
+	clientSessions[id] = sess
+	clientSessionsMu.Unlock()
+	return sess
+}
+
+// unregisterClient closes the session and detaches the channel of a zap
+// which came too late
+func unregisterClient(id string, sess *clientSession) {
+	if id != "" {
+		clientSessionsMu.Lock()
+		if clientSessions[id] == sess {
+			delete(clientSessions, id)
+		}
+		clientSessionsMu.Unlock()
+	}
+	sess.mu.Lock()
+	sess.closed = true
+	t := sess.pending
+	sess.pending = nil
+	sess.mu.Unlock()
+	if t != nil {
+		detachChannel(t.chInfo)
+	}
+}
+
+// takeZap returns the channel the client should switch to, if any
+func (sess *clientSession) takeZap() *zapTarget {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	t := sess.pending
+	if t != nil {
+		sess.k = t.k
+		sess.pending = nil
+	}
+	return t
+}
+
+// zap attaches the channel k and hands it over to the client
+func (sess *clientSession) zap(from, k string, chInfo ChannelInfo) (*Channel, error) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.closed {
+		return nil, errors.New("Client is gone")
+	}
+	if sess.pending != nil {
+		return nil, errors.New("Client is already zapping")
+	}
+	if from != "" && url.PathEscape(from) != sess.k {
+		return nil, fmt.Errorf("Client is not watching %s", from)
+	}
+	// attach before the client leaves the old channel, so a running
+	// channel is not torn down and joined again
+	ch := attachChannel(chInfo)
+	sess.pending = &zapTarget{k, chInfo, ch}
+	return ch, nil
+}
+
+func zapHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		httpError(w, req, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	q := req.URL.Query()
+	clientSessionsMu.Lock()
+	sess, ok := clientSessions[q.Get("client")]
+	clientSessionsMu.Unlock()
+	if !ok {
+		httpError(w, req, "No such client", http.StatusNotFound)
+		return
+	}
+	k := url.PathEscape(q.Get("to"))
+	chInfo, ok := getChannel(w, req, k)
+	if !ok {
+		return
+	}
+	ch, err := sess.zap(q.Get("from"), k, chInfo)
+	if err != nil {
+		httpError(w, req, err.Error(), http.StatusConflict)
+		return
+	}
+	reqLogf(req, "Zapping client %v to %v, session %v", q.Get("client"), q.Get("to"), ch.id)
+	writeJSON(w, map[string]string{"client": q.Get("client"), "channel": q.Get("to"), "session": ch.id})
+}
@@ -0,0 +1,75 @@
+package vmdecrypt
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Heuristic detection of format changes mid-stream: the elementary streams
+// of new PMT versions and the video parameter sets are compared with the
+// previous ones.
+
+// stream type => reports if a NAL unit or start code (the byte after
+// 00 00 01) begins the video parameters, e.g. the SPS
+var isVideoParams = map[byte]func(b byte) bool{
+	0x01: func(b byte) bool { return b == 0xb3 },         // MPEG-1 sequence header
+	0x02: func(b byte) bool { return b == 0xb3 },         // MPEG-2 sequence header
+	0x1b: func(b byte) bool { return b&0x1f == 7 },       // H.264 SPS
+	0x24: func(b byte) bool { return (b>>1)&0x3f == 33 }, // HEVC SPS
+}
+
+// streamsChange describes the difference of two stream maps, empty if they
+// are the same
+func streamsChange(old, streams map[uint16]byte) string {
+	changes := make([]string, 0)
+	for pid, streamType := range streams {
+		if oldType, ok := old[pid]; !ok {
+			changes = append(changes, fmt.Sprintf("PID 0x%x added with stream type 0x%02x", pid, streamType))
+		} else if oldType != streamType {
+			changes = append(changes, fmt.Sprintf("PID 0x%x stream type 0x%02x -> 0x%02x", pid, oldType, streamType))
+		}
+	}
+	for pid, streamType := range old {
+		if _, ok := streams[pid]; !ok {
+			changes = append(changes, fmt.Sprintf("PID 0x%x with stream type 0x%02x removed", pid, streamType))
+		}
+	}
+	sort.Strings(changes)
+	return strings.Join(changes, ", ")
+}
+
+// videoParams returns the video parameters which start in the payload of
+// a decrypted packet, only if they end in it as well
+func videoParams(pkt []byte, isParams func(byte) bool) []byte {
+	payload, ok := TSPayload(pkt)
+	if !ok {
+		return nil
+	}
+	for i := 0; i+3 < len(payload); i++ {
+		if payload[i] != 0 || payload[i+1] != 0 || payload[i+2] != 1 || !isParams(payload[i+3]) {
+			continue
+		}
+		params := payload[i+3:]
+		end := bytes.Index(params, []byte{0, 0, 1})
+		if end < 0 {
+			return nil
+		}
+		// without the zero bytes of the next start code
+		return bytes.TrimRight(params[:end], "\x00")
+	}
+	return nil
+}
+
+func (d *Decryptor) checkVideoParams(pkt []byte) {
+	params := videoParams(pkt, isVideoParams[d.videoType])
+	if params == nil || bytes.Equal(params, d.videoParams) {
+		return
+	}
+	changed := d.videoParams != nil
+	d.videoParams = append(d.videoParams[:0], params...)
+	if changed {
+		d.OnFormatChange(fmt.Sprintf("video parameters of PID 0x%x changed", d.videoPid))
+	}
+}
@@ -0,0 +1,68 @@
+package vmdecrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+)
+
+// keyState holds the keys of the last ECM. It is never modified, the
+// decrypting goroutine swaps it atomically for a new one, so it can be read
+// from any goroutine.
+type keyState struct {
+	odd, even []byte // for scrambling control 3 and 2
+	oddBlock  cipher.Block
+	evenBlock cipher.Block
+}
+
+func newKeyState(odd, even []byte) (*keyState, error) {
+	oddBlock, err := aes.NewCipher(odd)
+	if err != nil {
+		return nil, err
+	}
+	evenBlock, err := aes.NewCipher(even)
+	if err != nil {
+		return nil, err
+	}
+	return &keyState{odd: odd, even: even, oddBlock: oddBlock, evenBlock: evenBlock}, nil
+}
+
+// block returns the cipher for the scrambling control, nil if the packet
+// is not scrambled
+func (k *keyState) block(scramble byte) cipher.Block {
+	switch scramble {
+	case 2:
+		return k.evenBlock
+	case 3:
+		return k.oddBlock
+	}
+	return nil
+}
+
+// setKeys makes the keys current and reports which of them changed
+func (d *Decryptor) setKeys(odd, even []byte) (bool, bool, error) {
+	k, err := newKeyState(odd, even)
+	if err != nil {
+		return false, false, err
+	}
+	old := d.keys.Swap(k)
+	if old == nil {
+		return true, true, nil
+	}
+	return !bytes.Equal(old.odd, odd), !bytes.Equal(old.even, even), nil
+}
+
+// HasKeys reports if keys were decrypted from an ECM
+func (d *Decryptor) HasKeys() bool {
+	return d.keys.Load() != nil
+}
+
+// Keys returns copies of the current odd and even keys, nil if no ECM was
+// decrypted yet
+func (d *Decryptor) Keys() (odd, even []byte) {
+	k := d.keys.Load()
+	if k == nil {
+		return nil, nil
+	}
+	return bytes.Clone(k.odd), bytes.Clone(k.even)
+}
@@ -0,0 +1,412 @@
+package vmdecrypt
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+// Parsing of the PSI/SI descriptors and tables used besides the PAT and PMT.
+
+// longest section_length of private sections, PSI sections are shorter
+const maxSectionLength = 4093
+
+// TSPayload returns the payload of a TS packet after the adaptation field,
+// false if it has none
+func TSPayload(pkt []byte) ([]byte, bool) {
+	if len(pkt) < 5 || pkt[3]&0x10 == 0 {
+		return nil, false
+	}
+	start := 4
+	if pkt[3]&0x20 != 0 {
+		start += 1 + int(pkt[4])
+	}
+	if start >= len(pkt) {
+		return nil, false
+	}
+	return pkt[start:], true
+}
+
+// Section returns the PSI section which starts in the TS packet after the
+// pointer field, false if no section starts in it. The section may continue
+// in the next packets of the PID.
+func Section(pkt []byte) ([]byte, bool) {
+	payload, ok := TSPayload(pkt)
+	// payload_unit_start_indicator
+	if !ok || pkt[1]&0x40 == 0 {
+		return nil, false
+	}
+	start := 1 + int(payload[0])
+	if start >= len(payload) {
+		return nil, false
+	}
+	return payload[start:], true
+}
+
+// sectionAssembler reassembles the sections of one PID which span several
+// TS packets
+type sectionAssembler struct {
+	buf []byte // the started section, nil if none
+	cc  byte   // continuity counter of the last packet
+}
+
+// take returns the section in buf once it is complete, an invalid
+// section_length drops it
+func (a *sectionAssembler) take() ([]byte, bool) {
+	if len(a.buf) < 3 {
+		return nil, false
+	}
+	length := int(binary.BigEndian.Uint16(a.buf[1:3]) & 0x0fff)
+	if length > maxSectionLength {
+		a.buf = nil
+		return nil, false
+	}
+	if len(a.buf) < 3+length {
+		return nil, false
+	}
+	sec := a.buf[:3+length]
+	a.buf = nil
+	return sec, true
+}
+
+// push adds the payload of a TS packet and returns the sections completed
+// by it. Sections are dropped when a packet of them is lost.
+func (a *sectionAssembler) push(pkt []byte) [][]byte {
+	payload, ok := TSPayload(pkt)
+	if !ok {
+		return nil
+	}
+	continuous := a.buf != nil && pkt[3]&0xf == (a.cc+1)&0xf
+	a.cc = pkt[3] & 0xf
+	var sections [][]byte
+	if pkt[1]&0x40 == 0 {
+		if !continuous {
+			a.buf = nil
+			return nil
+		}
+		a.buf = append(a.buf, payload...)
+		if sec, ok := a.take(); ok {
+			sections = append(sections, sec)
+		}
+		return sections
+	}
+	pointer := int(payload[0])
+	if 1+pointer > len(payload) {
+		a.buf = nil
+		return nil
+	}
+	// the pointer field covers the end of the previous section
+	if continuous {
+		a.buf = append(a.buf, payload[1:1+pointer]...)
+		if sec, ok := a.take(); ok {
+			sections = append(sections, sec)
+		}
+	}
+	a.buf = nil
+	for data := payload[1+pointer:]; len(data) > 0 && data[0] != 0xff; {
+		a.buf = append([]byte(nil), data...)
+		sec, ok := a.take()
+		if !ok {
+			break
+		}
+		sections = append(sections, sec)
+		data = data[len(sec):]
+	}
+	return sections
+}
+
+// TeletextSubtitlePage parses the teletext descriptor (0x56) of an
+// elementary stream and returns the first subtitle page
+func TeletextSubtitlePage(desc []byte) (uint16, bool) {
+	for len(desc) >= 2 {
+		tag, length := desc[0], int(desc[1])
+		if 2+length > len(desc) {
+			break
+		}
+		if tag == 0x56 {
+			for d := desc[2 : 2+length]; len(d) >= 5; d = d[5:] {
+				txtType := d[3] >> 3
+				if txtType == 0x02 || txtType == 0x05 {
+					mag := uint16(d[3] & 7)
+					if mag == 0 {
+						mag = 8
+					}
+					return mag<<8 | uint16(d[4]), true
+				}
+			}
+		}
+		desc = desc[2+length:]
+	}
+	return 0, false
+}
+
+// Language returns the ISO 639-2 code of the language descriptor (0x0a)
+// of an elementary stream, "" if it has none
+func Language(desc []byte) string {
+	for len(desc) >= 2 {
+		tag, length := desc[0], int(desc[1])
+		if 2+length > len(desc) {
+			break
+		}
+		if tag == 0x0a && length >= 3 {
+			return strings.ToLower(string(desc[2:5]))
+		}
+		desc = desc[2+length:]
+	}
+	return ""
+}
+
+// dvbString strips the character table selector of DVB text fields
+func dvbString(b []byte) string {
+	if len(b) > 0 && b[0] < 0x20 {
+		if b[0] == 0x10 && len(b) >= 3 {
+			b = b[3:]
+		} else {
+			b = b[1:]
+		}
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// ParseSDT returns the service name of the given program from an SDT
+// section, or of the first service if the program is not found
+func ParseSDT(section []byte, program uint16) string {
+	if len(section) < 11 || section[0] != 0x42 {
+		return ""
+	}
+	end := 3 + int(binary.BigEndian.Uint16(section[1:3])&0x0fff) - 4
+	if end > len(section) {
+		end = len(section)
+	}
+	first := ""
+	for svc := section[11:end]; len(svc) >= 5; {
+		serviceID := binary.BigEndian.Uint16(svc[0:2])
+		descLength := int(binary.BigEndian.Uint16(svc[3:5]) & 0x0fff)
+		if 5+descLength > len(svc) {
+			break
+		}
+		for desc := svc[5 : 5+descLength]; len(desc) >= 2; {
+			tag, length := desc[0], int(desc[1])
+			if 2+length > len(desc) {
+				break
+			}
+			if tag == 0x48 && length >= 3 {
+				d := desc[2 : 2+length]
+				providerLength := int(d[1])
+				if 3+providerLength <= len(d) {
+					nameLength := int(d[2+providerLength])
+					if 3+providerLength+nameLength <= len(d) {
+						name := dvbString(d[3+providerLength : 3+providerLength+nameLength])
+						if serviceID == program {
+							return name
+						}
+						if first == "" {
+							first = name
+						}
+					}
+				}
+			}
+			desc = desc[2+length:]
+		}
+		svc = svc[5+descLength:]
+	}
+	return first
+}
+
+// Event is a programme from the EIT
+type Event struct {
+	ID          uint16
+	Start       time.Time
+	Duration    time.Duration
+	Language    string // ISO 639-2 code of the title and description
+	Title       string
+	Description string
+}
+
+// bcd decodes a binary-coded decimal byte
+func bcd(b byte) int {
+	return int(b>>4)*10 + int(b&0xf)
+}
+
+// ParseEIT returns the events of the given program from an EIT
+// present/following or schedule section of the actual transport stream
+func ParseEIT(section []byte, program uint16) []Event {
+	if len(section) < 14 || section[0] < 0x4e || section[0] > 0x5f || section[0] == 0x4f {
+		return nil
+	}
+	if binary.BigEndian.Uint16(section[3:5]) != program {
+		return nil
+	}
+	end := 3 + int(binary.BigEndian.Uint16(section[1:3])&0x0fff) - 4
+	if end > len(section) {
+		end = len(section)
+	}
+	events := make([]Event, 0)
+	for ev := section[14:end]; len(ev) >= 12; {
+		descLength := int(binary.BigEndian.Uint16(ev[10:12]) & 0x0fff)
+		if 12+descLength > len(ev) {
+			break
+		}
+		e := Event{ID: binary.BigEndian.Uint16(ev[0:2])}
+		// modified Julian date and BCD time in UTC, all ones if undefined
+		if mjd := int(binary.BigEndian.Uint16(ev[2:4])); mjd != 0xffff {
+			e.Start = time.Unix(int64(mjd-40587)*86400, 0).UTC().Add(time.Duration(bcd(ev[4]))*time.Hour +
+				time.Duration(bcd(ev[5]))*time.Minute + time.Duration(bcd(ev[6]))*time.Second)
+		}
+		e.Duration = time.Duration(bcd(ev[7]))*time.Hour + time.Duration(bcd(ev[8]))*time.Minute +
+			time.Duration(bcd(ev[9]))*time.Second
+		for desc := ev[12 : 12+descLength]; len(desc) >= 2; {
+			tag, length := desc[0], int(desc[1])
+			if 2+length > len(desc) {
+				break
+			}
+			// short_event_descriptor
+			if d := desc[2 : 2+length]; tag == 0x4d && length >= 5 && e.Title == "" {
+				nameLength := int(d[3])
+				if 5+nameLength <= len(d) {
+					textLength := int(d[4+nameLength])
+					if 5+nameLength+textLength <= len(d) {
+						e.Language = string(d[0:3])
+						e.Title = dvbString(d[4 : 4+nameLength])
+						e.Description = dvbString(d[5+nameLength : 5+nameLength+textLength])
+					}
+				}
+			}
+			desc = desc[2+length:]
+		}
+		if !e.Start.IsZero() && e.Title != "" {
+			events = append(events, e)
+		}
+		ev = ev[12+descLength:]
+	}
+	return events
+}
+
+var crcTable = func() [256]uint32 {
+	var t [256]uint32
+	for i := range t {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		t[i] = crc
+	}
+	return t
+}()
+
+// crc32 is the CRC of PSI sections (CRC-32/MPEG-2)
+func crc32(b []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, c := range b {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^c]
+	}
+	return crc
+}
+
+// withoutCA returns the descriptors without the CA descriptors (0x09)
+func withoutCA(desc []byte) []byte {
+	out := make([]byte, 0, len(desc))
+	for len(desc) >= 2 {
+		length := int(desc[1])
+		if 2+length > len(desc) {
+			break
+		}
+		if desc[0] != 0x09 {
+			out = append(out, desc[:2+length]...)
+		}
+		desc = desc[2+length:]
+	}
+	return out
+}
+
+// stripCA returns the PMT section without its CA descriptors and with a
+// new CRC
+func stripCA(sec []byte) []byte {
+	if len(sec) < 16 || sec[0] != 2 {
+		return sec
+	}
+	end := len(sec) - 4
+	piLength := int(binary.BigEndian.Uint16(sec[10:12]) & 0x0fff)
+	if 12+piLength > end {
+		return sec
+	}
+	out := append([]byte(nil), sec[:12]...)
+	pi := withoutCA(sec[12 : 12+piLength])
+	binary.BigEndian.PutUint16(out[10:12], uint16(sec[10]&0xf0)<<8|uint16(len(pi)))
+	out = append(out, pi...)
+	for es := sec[12+piLength : end]; len(es) >= 5; {
+		infoLength := int(binary.BigEndian.Uint16(es[3:5]) & 0x0fff)
+		if 5+infoLength > len(es) {
+			break
+		}
+		info := withoutCA(es[5 : 5+infoLength])
+		out = append(out, es[:5]...)
+		binary.BigEndian.PutUint16(out[len(out)-2:], uint16(es[3]&0xf0)<<8|uint16(len(info)))
+		out = append(out, info...)
+		es = es[5+infoLength:]
+	}
+	binary.BigEndian.PutUint16(out[1:3], uint16(sec[1]&0xf0)<<8|uint16(len(out)+4-3))
+	return binary.BigEndian.AppendUint32(out, crc32(out))
+}
+
+// FilterPMT returns the PMT section with only the elementary streams for
+// which keep returns true and with a new CRC
+func FilterPMT(sec []byte, keep func(pid uint16) bool) []byte {
+	if len(sec) < 16 || sec[0] != 2 {
+		return sec
+	}
+	end := len(sec) - 4
+	piLength := int(binary.BigEndian.Uint16(sec[10:12]) & 0x0fff)
+	if 12+piLength > end {
+		return sec
+	}
+	out := append([]byte(nil), sec[:12+piLength]...)
+	for es := sec[12+piLength : end]; len(es) >= 5; {
+		infoLength := int(binary.BigEndian.Uint16(es[3:5]) & 0x0fff)
+		if 5+infoLength > len(es) {
+			break
+		}
+		if keep(binary.BigEndian.Uint16(es[1:3]) & 0x1fff) {
+			out = append(out, es[:5+infoLength]...)
+		}
+		es = es[5+infoLength:]
+	}
+	binary.BigEndian.PutUint16(out[1:3], uint16(sec[1]&0xf0)<<8|uint16(len(out)+4-3))
+	return binary.BigEndian.AppendUint32(out, crc32(out))
+}
+
+// Packetize splits a section into TS packets of the PID, without the
+// continuity counter
+func Packetize(sec []byte, pid uint16) [][]byte {
+	data := append([]byte{0}, sec...)
+	pkts := make([][]byte, 0)
+	for first := true; len(data) > 0; first = false {
+		pkt := make([]byte, 188)
+		pkt[0] = 0x47
+		pkt[1] = byte(pid >> 8)
+		if first {
+			pkt[1] |= 0x40
+		}
+		pkt[2] = byte(pid)
+		pkt[3] = 0x10
+		n := copy(pkt[4:], data)
+		for i := 4 + n; i < 188; i++ {
+			pkt[i] = 0xff
+		}
+		data = data[n:]
+		pkts = append(pkts, pkt)
+	}
+	return pkts
+}
+
+// nullPacket turns the packet into a null packet in place
+func nullPacket(pkt []byte) {
+	pkt[1], pkt[2], pkt[3] = 0x1f, 0xff, 0x10
+	for i := 4; i < len(pkt); i++ {
+		pkt[i] = 0xff
+	}
+}
@@ -0,0 +1,193 @@
+package vmdecrypt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// psiPacket returns a packet of PID 0x100 with the payload, padded with
+// stuffing bytes
+func psiPacket(pusi bool, cc byte, payload []byte) []byte {
+	pkt := bytes.Repeat([]byte{0xff}, 188)
+	pkt[0], pkt[1], pkt[2], pkt[3] = 0x47, 0x01, 0x00, 0x10|cc&0xf
+	if pusi {
+		pkt[1] |= 0x40
+	}
+	copy(pkt[4:], payload)
+	return pkt
+}
+
+// testSection returns a section of the table with n body bytes and a CRC
+func testSection(tableID byte, n int) []byte {
+	sec := []byte{tableID, 0xb0 | byte((n+4)>>8), byte(n + 4)}
+	for i := 0; i < n; i++ {
+		sec = append(sec, byte(i))
+	}
+	return binary.BigEndian.AppendUint32(sec, crc32(sec))
+}
+
+func cat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestSectionAssembler(t *testing.T) {
+	a, a2 := testSection(2, 20), testSection(2, 30)
+	b := testSection(2, 300) // spans two packets
+	c := testSection(0x42, 40)
+	spanning := cat([]byte{0}, b)
+	// the second packet starts with the end of b, then c starts after the
+	// pointer field
+	pointed := cat([]byte{byte(len(b) - 183)}, b[183:], c)
+	tests := []struct {
+		name string
+		pkts [][]byte
+		want [][]byte
+	}{
+		{"one packet", [][]byte{psiPacket(true, 0, cat([]byte{0}, a))}, [][]byte{a}},
+		{"two sections in a packet", [][]byte{psiPacket(true, 0, cat([]byte{0}, a, a2))}, [][]byte{a, a2}},
+		{"spanning packets", [][]byte{psiPacket(true, 0, spanning[:184]), psiPacket(false, 1, spanning[184:])}, [][]byte{b}},
+		{"pointer field", [][]byte{psiPacket(true, 14, spanning[:184]), psiPacket(true, 15, pointed)}, [][]byte{b, c}},
+		{"counter wraps", [][]byte{psiPacket(true, 15, spanning[:184]), psiPacket(false, 0, spanning[184:])}, [][]byte{b}},
+		{"lost packet", [][]byte{psiPacket(true, 0, spanning[:184]), psiPacket(false, 2, spanning[184:])}, nil},
+		{"recovered after a lost packet", [][]byte{psiPacket(true, 0, spanning[:184]), psiPacket(false, 2, spanning[184:]),
+			psiPacket(true, 3, cat([]byte{0}, a))}, [][]byte{a}},
+		{"lost packet before the pointer field", [][]byte{psiPacket(true, 0, spanning[:184]), psiPacket(true, 2, pointed)}, [][]byte{c}},
+		{"duplicate packet", [][]byte{psiPacket(true, 0, spanning[:184]), psiPacket(true, 0, spanning[:184]),
+			psiPacket(false, 1, spanning[184:])}, [][]byte{b}},
+		{"continuation without a start", [][]byte{psiPacket(false, 1, spanning[184:])}, nil},
+		{"section_length too long", [][]byte{psiPacket(true, 0, []byte{0, 0x02, 0xbf, 0xff, 0})}, nil},
+		{"pointer beyond the payload", [][]byte{psiPacket(true, 0, spanning[:184]), psiPacket(true, 1, []byte{200})}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var a sectionAssembler
+			var got [][]byte
+			for _, pkt := range tt.pkts {
+				got = append(got, a.push(pkt)...)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sections %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+// testPMT returns a PMT section with the program info and the elementary
+// streams (type, PID, ES info)
+func testPMT(pi []byte, es ...[]byte) []byte {
+	body := []byte{0, 1, 0xc1, 0, 0, 0xe1, 0x00, 0xf0 | byte(len(pi)>>8), byte(len(pi))}
+	body = append(body, pi...)
+	for _, e := range es {
+		body = append(body, e...)
+	}
+	sec := []byte{2, 0xb0 | byte((len(body)+4)>>8), byte(len(body) + 4)}
+	sec = append(sec, body...)
+	return binary.BigEndian.AppendUint32(sec, crc32(sec))
+}
+
+func testES(streamType byte, pid uint16, info []byte) []byte {
+	return append([]byte{streamType, 0xe0 | byte(pid>>8), byte(pid), 0xf0 | byte(len(info)>>8), byte(len(info))}, info...)
+}
+
+func TestStripCA(t *testing.T) {
+	ca := []byte{0x09, 4, 0x56, 0x01, 0xe1, 0xff}
+	lang := []byte{0x0a, 4, 'e', 'n', 'g', 0}
+	tests := []struct {
+		name string
+		pmt  []byte
+		want []byte
+	}{
+		{"no CA", testPMT(nil, testES(0x1b, 0x100, nil), testES(0x0f, 0x101, lang)),
+			testPMT(nil, testES(0x1b, 0x100, nil), testES(0x0f, 0x101, lang))},
+		{"program info", testPMT(ca, testES(0x1b, 0x100, nil)), testPMT(nil, testES(0x1b, 0x100, nil))},
+		{"ES info", testPMT(nil, testES(0x1b, 0x100, ca), testES(0x0f, 0x101, cat(lang, ca))),
+			testPMT(nil, testES(0x1b, 0x100, nil), testES(0x0f, 0x101, lang))},
+		{"everywhere", testPMT(cat(ca, lang, ca), testES(0x1b, 0x100, cat(ca, ca))),
+			testPMT(lang, testES(0x1b, 0x100, nil))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := stripCA(tt.pmt)
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("stripCA %x, want %x", got, tt.want)
+			}
+			// the CRC over the whole section is zero
+			if crc := crc32(got); crc != 0 {
+				t.Errorf("CRC residue %08x", crc)
+			}
+		})
+	}
+}
+
+func TestFilterPMT(t *testing.T) {
+	lang := []byte{0x0a, 4, 'd', 'e', 'u', 0}
+	pmt := testPMT(lang, testES(0x1b, 0x100, nil), testES(0x0f, 0x101, lang), testES(0x06, 0x102, nil))
+	got := FilterPMT(pmt, func(pid uint16) bool { return pid == 0x101 })
+	if want := testPMT(lang, testES(0x0f, 0x101, lang)); !bytes.Equal(got, want) {
+		t.Errorf("FilterPMT %x, want %x", got, want)
+	}
+	if crc := crc32(got); crc != 0 {
+		t.Errorf("CRC residue %08x", crc)
+	}
+}
+
+// testEIT returns an EIT present/following section of program 1 with the
+// events
+func testEIT(tableID byte, events ...[]byte) []byte {
+	body := []byte{0, 1, 0xc1, 0, 0, 0, 1, 0, 1, 0, 0x4e}
+	for _, e := range events {
+		body = append(body, e...)
+	}
+	sec := []byte{tableID, 0xf0 | byte((len(body)+4)>>8), byte(len(body) + 4)}
+	sec = append(sec, body...)
+	return binary.BigEndian.AppendUint32(sec, crc32(sec))
+}
+
+// testEvent returns an event with the MJD/BCD start, BCD duration and a
+// short event descriptor
+func testEvent(id uint16, start [5]byte, duration [3]byte, title, text string) []byte {
+	d := cat([]byte{0x4d, byte(5 + len(title) + len(text))}, []byte("eng"), []byte{byte(len(title))}, []byte(title),
+		[]byte{byte(len(text))}, []byte(text))
+	ev := []byte{byte(id >> 8), byte(id)}
+	ev = append(ev, start[:]...)
+	ev = append(ev, duration[:]...)
+	ev = append(ev, 0x80|byte(len(d)>>8), byte(len(d)))
+	return append(ev, d...)
+}
+
+func TestParseEIT(t *testing.T) {
+	tests := []struct {
+		name    string
+		section []byte
+		program uint16
+		want    []Event
+	}{
+		// the example of EN 300 468 annex C
+		{"MJD and BCD", testEIT(0x4e, testEvent(1, [5]byte{0xc0, 0x79, 0x12, 0x45, 0x00}, [3]byte{0x01, 0x45, 0x30}, "News", "Headlines")), 1,
+			[]Event{{ID: 1, Start: time.Date(1993, 10, 13, 12, 45, 0, 0, time.UTC), Duration: time.Hour + 45*time.Minute + 30*time.Second,
+				Language: "eng", Title: "News", Description: "Headlines"}}},
+		{"present and following", testEIT(0x4e,
+			testEvent(2, [5]byte{0xef, 0x92, 0x23, 0x59, 0x59}, [3]byte{0x00, 0x00, 0x01}, "Late", ""),
+			testEvent(3, [5]byte{0xef, 0x93, 0x00, 0x00, 0x00}, [3]byte{0x23, 0x59, 0x59}, "\x05Night", "Until the morning")), 1,
+			[]Event{
+				{ID: 2, Start: time.Date(2026, 10, 17, 23, 59, 59, 0, time.UTC), Duration: time.Second, Language: "eng", Title: "Late"},
+				{ID: 3, Start: time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC), Duration: 23*time.Hour + 59*time.Minute + 59*time.Second,
+					Language: "eng", Title: "Night", Description: "Until the morning"}}},
+		{"schedule table", testEIT(0x50, testEvent(4, [5]byte{0xef, 0x92, 0x20, 0x00, 0x00}, [3]byte{0x00, 0x30, 0x00}, "Film", "")), 1,
+			[]Event{{ID: 4, Start: time.Date(2026, 10, 17, 20, 0, 0, 0, time.UTC), Duration: 30 * time.Minute, Language: "eng", Title: "Film"}}},
+		{"undefined start", testEIT(0x4e, testEvent(5, [5]byte{0xff, 0xff, 0xff, 0xff, 0xff}, [3]byte{0x01, 0x00, 0x00}, "Soon", "")), 1,
+			[]Event{}},
+		{"other program", testEIT(0x4e, testEvent(1, [5]byte{0xc0, 0x79, 0x12, 0x45, 0x00}, [3]byte{0x01, 0x45, 0x30}, "News", "")), 2, nil},
+		{"other transport stream", testEIT(0x4f, testEvent(1, [5]byte{0xc0, 0x79, 0x12, 0x45, 0x00}, [3]byte{0x01, 0x45, 0x30}, "News", "")), 1, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseEIT(tt.section, tt.program); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("events %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,505 +1,644 @@
-package main
+// Package vmdecrypt decrypts MPEG-TS streams encrypted with Verimatrix VCAS
+// (CAID 0x5601 by default) given the channel key.
+//
+// A Decryptor is fed with the TS packets of one channel, it finds the ECM
+// PID from the PAT and PMT, decrypts the ECMs with the channel key and
+// decrypts the packets in place with the keys from the ECMs:
+//
+//	dec := vmdecrypt.NewDecryptor(key)
+//	dec.OnPacket = func(pkt []byte) { out.Write(pkt) }
+//	for {
+//		n, _ := conn.Read(buf)
+//		hdr, err := vmdecrypt.ParseRTP(buf[:n])
+//		...
+//		if err := dec.Process(buf[hdr.Offset:n]); err != nil {
+//			...
+//		}
+//	}
+package vmdecrypt
 
 import (
-	"container/ring"
 	"crypto/aes"
 	"encoding/binary"
-	"encoding/hex"
-	"encoding/json"
 	"errors"
-	"flag"
 	"fmt"
-	"golang.org/x/net/ipv4"
-	"io"
-	"io/ioutil"
-	"log"
-	"net"
-	"net/http"
-	"net/url"
-	"os"
-	"sort"
-	"strings"
 	"sync"
-	"time"
+	"sync/atomic"
 )
 
-type Channel struct {
-	lastRTPSeq  uint16
-	firstPkt    bool
-	pmtPid      uint16
+// ErrECM is returned when an ECM cannot be decrypted with the channel key
+var ErrECM = errors.New("Error decrypting ECM")
+
+// KeyLayout describes where the two keys are in a decrypted ECM
+type KeyLayout struct {
+	// Offsets of the first and the second key, the first one is the odd
+	// key in ECMs with table ID 0x81 and the even one otherwise
+	Offsets [2]int
+	// Length of the keys, 16, 24 or 32 bytes
+	Length int
+}
+
+// DefaultKeyLayout is the layout of the VCAS ECMs with AES-128 keys
+var DefaultKeyLayout = KeyLayout{Offsets: [2]int{9, 25}, Length: 16}
+
+// Decryptor keeps the state of decrypting one TS stream. Process and
+// ProcessPacket must be called from a single goroutine, the accessor
+// methods can be called from any goroutine.
+type Decryptor struct {
+	// OnPacket is called with every processed (decrypted) packet
+	OnPacket func(pkt []byte)
+	// OnServiceName is called with the service name from the SDT
+	OnServiceName func(name string)
+	// OnEvents is called with the events of the program from the EIT
+	// present/following and schedule sections, which are repeated over and
+	// over. The EIT is only parsed when it is set.
+	OnEvents func(events []Event)
+	// OnKeys is called when new keys are decrypted from an ECM
+	OnKeys func()
+	// OnKeyChange is called when an ECM brings a new odd (scrambling
+	// control 3) or even (2) key
+	OnKeyChange func(odd bool)
+	// OnCryptoPeriod is called when the packets switch to the other key,
+	// i.e. at the start of a crypto period
+	OnCryptoPeriod func(odd bool)
+	// OnFormatChange is called when the elementary streams of the PMT or
+	// the video parameters (SPS or sequence header) change mid-stream
+	OnFormatChange func(reason string)
+	// Logf logs stream events, e.g. lost TS sync
+	Logf func(format string, v ...interface{})
+	// Trace enables logging of every packet when it returns true
+	Trace func() bool
+	// CAIDs are the CA system IDs of the ECMs, 0x5601 if empty. When the
+	// PMT has no CA descriptor with one of them, the first one is used.
+	CAIDs []uint16
+	// StripCA removes the CA descriptors from the PMT and replaces the ECM
+	// packets with null packets, for players which are confused by them.
+	// It implies clearing the scrambling bits.
+	StripCA bool
+	// KeepScrambling keeps the transport_scrambling_control bits of the
+	// decrypted packets, by default they are cleared so that demuxers do
+	// not treat the packets as scrambled
+	KeepScrambling bool
+	// ServiceID selects the program of multi-program streams, the first
+	// one in the PAT if 0
+	ServiceID uint16
+	// KeyLayout locates the keys in the ECMs, DefaultKeyLayout if zero
+	KeyLayout KeyLayout
+	// FixedPMTPid and FixedECMPid are used instead of the PIDs from the PAT
+	// and the CA descriptors of the PMT, for streams with broken signalling.
+	// 0 = detect.
+	FixedPMTPid uint16
+	FixedECMPid uint16
+	// HoldPackets holds up to this many packets until the first keys are
+	// decrypted from an ECM, they are decrypted with these keys and passed
+	// to OnPacket then instead of scrambled. The oldest ones are dropped
+	// when the limit is reached. 0 = don't hold.
+	HoldPackets int
+
+	masterKey   []byte
 	pmtPidFound bool
+	sdtFound    bool
 	ecmPid      uint16
 	ecmPidFound bool
-	masterKey   string
-	aesKey1     []byte
-	aesKey2     []byte
-	mu          sync.Mutex
-	buf         *ring.Ring
-	c           *sync.Cond
-	done        chan bool
-	ioerr       bool
-	numClients  int
-	http        bool
+	pmtFound    bool
+	lostSync    bool
+	keys        atomic.Pointer[keyState]
+	scramble    byte                         // scrambling control of the last decrypted packet
+	sections    map[uint16]*sectionAssembler // PID => its PSI sections
+	pmtVersion  byte
+	videoPid    uint16
+	videoType   byte
+	videoParams []byte   // last SPS or sequence header of the video
+	pmtOut      [][]byte // stripped PMT packets waiting for a PMT packet to replace
+	pmtCC       byte
+	held        [][]byte // packets waiting for the first keys
+
+	mu      sync.Mutex // guards the fields below
+	pmtPid  uint16
+	program uint16
+	streams map[uint16]byte // elementary stream PID => stream type
+	list    []Stream        // the elementary streams in PMT order
+	pmt     []byte          // the last PMT section
+	txtPid  uint16
+	txtPage uint16 // teletext subtitle page, e.g. 0x888
 }
 
-const RingSize = 64
-
-var runningChannelsMu sync.Mutex
-var runningChannels map[string]*Channel
-
-var ifi *net.Interface
-var httpAddr string
+// NewDecryptor returns a decryptor for the channel with the given AES key
+// (16, 24 or 32 bytes)
+func NewDecryptor(masterKey []byte) *Decryptor {
+	return &Decryptor{masterKey: masterKey}
+}
 
-type ChannelInfo struct {
-	addr      string
-	masterKey string
+func (d *Decryptor) logf(format string, v ...interface{}) {
+	if d.Logf != nil {
+		d.Logf(format, v...)
+	}
 }
 
-// channel name => ChannelInfo
-var channels map[string]ChannelInfo
+func (d *Decryptor) tracing() bool {
+	return d.Trace != nil && d.Trace()
+}
 
-func newChannel(masterKey string, http bool) *Channel {
-	ch := Channel{firstPkt: true, masterKey: masterKey, numClients: 1, http: http}
-	if http {
-		ch.buf = ring.New(RingSize)
-		ch.c = sync.NewCond(&ch.mu)
-		ch.done = make(chan bool)
-		ch.http = true
-	}
-	return &ch
+// RTPHeader is the part of the RTP header used for decrypting
+type RTPHeader struct {
+	Seq       uint16
+	Timestamp uint32
+	Offset    int // start of the payload
 }
 
-func (ch *Channel) parseRTP(pkt []byte) (int, error) {
+// ParseRTP parses the RTP header of a datagram
+func ParseRTP(pkt []byte) (RTPHeader, error) {
+	if len(pkt) < 12 {
+		return RTPHeader{}, fmt.Errorf("Unexpected RTP packet length %v", len(pkt))
+	}
 	version := pkt[0] >> 6
 	if version != 2 {
-		return 0, fmt.Errorf("Unexpected RTP version %v", version)
+		return RTPHeader{}, fmt.Errorf("Unexpected RTP version %v", version)
 	}
 	hasExtension := (pkt[0] >> 4) & 1
-	seq := binary.BigEndian.Uint16(pkt[2:4])
-	if ch.firstPkt {
-		ch.lastRTPSeq = seq - 1
-		ch.firstPkt = false
+	hdr := RTPHeader{
+		Seq:       binary.BigEndian.Uint16(pkt[2:4]),
+		Timestamp: binary.BigEndian.Uint32(pkt[4:8]),
+		Offset:    12,
 	}
-	if ch.lastRTPSeq+1 != seq {
-		log.Println("RTP discontinuity detected")
-	}
-	ch.lastRTPSeq = seq
-	extSize := 0
 	if hasExtension > 0 {
-		extSize = 4 + int(binary.BigEndian.Uint16(pkt[14:16])*4)
+		if len(pkt) < 16 {
+			return RTPHeader{}, fmt.Errorf("Unexpected RTP packet length %v", len(pkt))
+		}
+		hdr.Offset += 4 + int(binary.BigEndian.Uint16(pkt[14:16])*4)
 	}
-	return 12 + extSize, nil
+	if hdr.Offset > len(pkt) {
+		return RTPHeader{}, fmt.Errorf("Unexpected RTP packet length %v", len(pkt))
+	}
+	return hdr, nil
 }
 
-func (ch *Channel) processECM(pkt []byte) error {
-	key, _ := hex.DecodeString(ch.masterKey)
-	cipher, _ := aes.NewCipher([]byte(key))
-	ecm := make([]byte, 64)
-	for i := 0; i < 4; i++ {
-		cipher.Decrypt(ecm[i*16:], pkt[29+i*16:])
+func (d *Decryptor) processECM(sec []byte) error {
+	layout := d.KeyLayout
+	if layout.Length == 0 {
+		layout = DefaultKeyLayout
+	}
+	// the decrypted blocks must cover both keys
+	n := 64
+	for _, off := range layout.Offsets {
+		for off+layout.Length > n {
+			n += 16
+		}
+	}
+	if len(sec) < 24+n {
+		return fmt.Errorf("%w: section too short", ErrECM)
+	}
+	cipher, err := aes.NewCipher(d.masterKey)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrECM, err)
+	}
+	ecm := make([]byte, n)
+	for i := 0; i < n/16; i++ {
+		cipher.Decrypt(ecm[i*16:], sec[24+i*16:])
 	}
 	if ecm[0] != 0x43 || ecm[1] != 0x45 || ecm[2] != 0x42 {
-		return errors.New("Error decrypting ECM")
+		return ErrECM
+	}
+	if d.tracing() {
+		d.logf("trace: ECM table=0x%x", sec[0])
 	}
-	if pkt[5] == 0x81 {
-		ch.aesKey1 = ecm[9 : 9+16]
-		ch.aesKey2 = ecm[25 : 25+16]
-	} else {
-		ch.aesKey2 = ecm[9 : 9+16]
-		ch.aesKey1 = ecm[25 : 25+16]
+	first := ecm[layout.Offsets[0] : layout.Offsets[0]+layout.Length]
+	second := ecm[layout.Offsets[1] : layout.Offsets[1]+layout.Length]
+	odd, even := second, first
+	if sec[0] == 0x81 {
+		odd, even = first, second
+	}
+	oddChanged, evenChanged, err := d.setKeys(odd, even)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrECM, err)
+	}
+	if d.OnKeyChange != nil {
+		if oddChanged {
+			d.OnKeyChange(true)
+		}
+		if evenChanged {
+			d.OnKeyChange(false)
+		}
 	}
 	return nil
 }
 
-func (ch *Channel) decryptPacket(pkt []byte) {
-	if ch.aesKey1 == nil || ch.aesKey2 == nil {
+func (d *Decryptor) decryptPacket(pkt []byte) {
+	keys := d.keys.Load()
+	if keys == nil {
 		return
 	}
 	scramble := (pkt[3] >> 6) & 3
-	if scramble < 2 {
+	block := keys.block(scramble)
+	if block == nil {
 		return
 	}
-	var aesKey []byte
-	if scramble == 2 {
-		aesKey = ch.aesKey2
-	} else if scramble == 3 {
-		aesKey = ch.aesKey1
+	if scramble != d.scramble && d.scramble != 0 && d.OnCryptoPeriod != nil {
+		d.OnCryptoPeriod(scramble == 3)
 	}
-	cipher, _ := aes.NewCipher([]byte(aesKey))
-	pkt = pkt[4:]
-	for len(pkt) > 16 {
-		cipher.Decrypt(pkt, pkt)
-		pkt = pkt[16:]
+	d.scramble = scramble
+	// only the payload is scrambled, not the adaptation field
+	payload, ok := TSPayload(pkt)
+	if !d.KeepScrambling || d.StripCA {
+		pkt[3] &= 0x3f
 	}
-}
-
-func savePacket(pkt []byte) {
-	f, err := os.OpenFile("dump.ts", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
-	if err != nil {
-		panic(err)
+	if !ok {
+		return
 	}
-	defer f.Close()
-	if _, err := f.Write(pkt); err != nil {
-		log.Fatal(err)
+	// the residue shorter than a block is in the clear
+	for len(payload) >= 16 {
+		block.Decrypt(payload, payload)
+		payload = payload[16:]
 	}
 }
 
-func (ch *Channel) parseEcmPid(desc []byte) error {
+func (d *Decryptor) parseEcmPid(desc []byte) error {
 	//log.Printf("% x\n", desc)
-	for len(desc) > 0 {
+	caids := d.CAIDs
+	if len(caids) == 0 {
+		caids = []uint16{0x5601}
+	}
+	var first []byte
+	for len(desc) >= 2 {
 		tag := desc[0]
-		length := desc[1]
-		if tag == 0x09 {
+		length := int(desc[1])
+		if 2+length > len(desc) {
+			break
+		}
+		if tag == 0x09 && length >= 4 {
 			caid := binary.BigEndian.Uint16(desc[2:4])
-			if caid == 0x5601 {
-				ch.ecmPid = binary.BigEndian.Uint16(desc[4:6])
-				ch.ecmPidFound = true
-				//log.Printf("ECM pid=0x%x", ch.ecmPid)
-				return nil
+			for _, c := range caids {
+				if caid == c {
+					d.ecmPid = binary.BigEndian.Uint16(desc[4:6])
+					d.ecmPidFound = true
+					//log.Printf("ECM pid=0x%x", d.ecmPid)
+					return nil
+				}
+			}
+			if first == nil {
+				first = desc
 			}
 		}
 		desc = desc[2+length:]
 	}
+	if first != nil {
+		d.logf("No CA descriptor with CAID %s, using CAID 0x%04x", formatCAIDs(caids), binary.BigEndian.Uint16(first[2:4]))
+		d.ecmPid = binary.BigEndian.Uint16(first[4:6])
+		d.ecmPidFound = true
+		return nil
+	}
 	return errors.New("Cannot find ECM PID")
 }
 
-func (ch *Channel) processPacket(pkt []byte) error {
-	if pkt[0] != 0x47 {
-		return fmt.Errorf("Expected sync byte but got: %v", pkt[0])
-	}
-	pid := binary.BigEndian.Uint16(pkt[1:3]) & 0x1fff
-	if !ch.pmtPidFound && pid == 0 {
-		// process PAT
-		if pkt[4] != 0 {
-			return errors.New("[PAT] Pointer fields are not supported yet")
+func formatCAIDs(caids []uint16) string {
+	s := ""
+	for i, caid := range caids {
+		if i > 0 {
+			s += ","
 		}
-		if pkt[5] != 0 {
-			return fmt.Errorf("Unexpected PAT table ID: %v", pkt[5])
-		}
-		ch.pmtPid = binary.BigEndian.Uint16(pkt[15:17]) & 0x1fff
-		ch.pmtPidFound = true
-		//log.Printf("PMT pid=0x%x", ch.pmtPid)
+		s += fmt.Sprintf("0x%04x", caid)
 	}
-	if !ch.ecmPidFound && ch.pmtPidFound && pid == ch.pmtPid {
-		// process PMT
-		if pkt[4] != 0 {
-			return errors.New("[PMT] Pointer fields are not supported yet")
-		}
-		if pkt[5] != 2 {
-			return fmt.Errorf("Unexpected PMT table ID: %v", pkt[5])
+	return s
+}
+
+func (d *Decryptor) parseStreams(es []byte) {
+	streams := make(map[uint16]byte)
+	list := make([]Stream, 0)
+	var txtPid, txtPage uint16
+	for len(es) >= 5 {
+		pid := binary.BigEndian.Uint16(es[1:3]) & 0x1fff
+		streams[pid] = es[0]
+		infoLength := int(binary.BigEndian.Uint16(es[3:5]) & 0x0fff)
+		if 5+infoLength > len(es) {
+			break
 		}
-		piLength := binary.BigEndian.Uint16(pkt[15:17]) & 0x03ff
-		if err := ch.parseEcmPid(pkt[17 : 17+piLength]); err != nil {
-			return err
+		list = append(list, Stream{PID: pid, Type: es[0], Language: Language(es[5 : 5+infoLength])})
+		if page, ok := TeletextSubtitlePage(es[5 : 5+infoLength]); ok && txtPage == 0 {
+			txtPid, txtPage = pid, page
 		}
-	}
-	if ch.ecmPidFound && pid == ch.ecmPid {
-		if err := ch.processECM(pkt); err != nil {
-			return err
+		es = es[5+infoLength:]
+	}
+	d.mu.Lock()
+	d.streams = streams
+	d.list = list
+	d.txtPid, d.txtPage = txtPid, txtPage
+	d.mu.Unlock()
+	videoPid := d.videoPid
+	d.videoPid, d.videoType = 0, 0
+	for pid, streamType := range streams {
+		if isVideoParams[streamType] != nil && (d.videoPid == 0 || pid < d.videoPid) {
+			d.videoPid, d.videoType = pid, streamType
 		}
 	}
-	ch.decryptPacket(pkt)
-	if ch.http {
-		ch.addToBuf(pkt)
+	if d.videoPid != videoPid {
+		d.videoParams = nil
 	}
-	return nil
-	//savePacket(pkt)
-	//log.Printf("% x\n", pkt)
 }
 
-func (ch *Channel) processRTP(payload []byte, offset int) error {
-	if (len(payload)-offset)%188 != 0 {
-		return fmt.Errorf("Unexpected RTP payload length: %v", len(payload))
-	}
-	pkt := payload[offset:]
-	for len(pkt) > 0 {
-		if err := ch.processPacket(pkt[:188]); err != nil {
+// processSection processes a PAT, PMT, SDT or EIT section
+func (d *Decryptor) processSection(pid uint16, sec []byte) error {
+	switch {
+	case pid == 0 && !d.pmtPidFound:
+		if sec[0] != 0 {
+			return fmt.Errorf("Unexpected PAT table ID: %v", sec[0])
+		}
+		if len(sec) < 12 {
+			return errors.New("[PAT] Section too short")
+		}
+		found := false
+		for programs := sec[8 : len(sec)-4]; len(programs) >= 4; programs = programs[4:] {
+			program := binary.BigEndian.Uint16(programs[0:2])
+			// program 0 is the NIT
+			if program == 0 || (d.ServiceID != 0 && program != d.ServiceID) {
+				continue
+			}
+			d.mu.Lock()
+			d.program = program
+			d.pmtPid = binary.BigEndian.Uint16(programs[2:4]) & 0x1fff
+			d.mu.Unlock()
+			found = true
+			break
+		}
+		if !found {
+			// the program may be in another section of the PAT
+			if sec[7] > 0 {
+				return nil
+			}
+			if d.ServiceID != 0 {
+				return fmt.Errorf("[PAT] Program %d not found", d.ServiceID)
+			}
+			return errors.New("[PAT] No programs")
+		}
+		d.pmtPidFound = true
+		//log.Printf("PMT pid=0x%x", d.pmtPid)
+	case d.pmtPidFound && pid == d.pmtPid:
+		if sec[0] != 2 {
+			return fmt.Errorf("Unexpected PMT table ID: %v", sec[0])
+		}
+		// without the CRC
+		sectionEnd := len(sec) - 4
+		if sectionEnd < 12 {
+			return errors.New("[PMT] Section too short")
+		}
+		// PMTs of other programs may share the PID
+		version := (sec[5] >> 1) & 0x1f
+		if d.program == 0 {
+			// fixed PMT PID, the first program unless ServiceID is set
+			d.mu.Lock()
+			d.program = binary.BigEndian.Uint16(sec[3:5])
+			d.mu.Unlock()
+		}
+		if binary.BigEndian.Uint16(sec[3:5]) != d.program || (d.pmtFound && d.ecmPidFound && version == d.pmtVersion) {
+			return nil
+		}
+		piLength := int(binary.BigEndian.Uint16(sec[10:12]) & 0x03ff)
+		if 12+piLength > sectionEnd {
+			return errors.New("[PMT] Invalid program info length")
+		}
+		old := d.Streams()
+		d.mu.Lock()
+		d.pmt = append([]byte(nil), sec...)
+		d.mu.Unlock()
+		d.parseStreams(sec[12+piLength : sectionEnd])
+		if d.pmtFound {
+			if change := streamsChange(old, d.Streams()); change != "" && d.OnFormatChange != nil {
+				d.OnFormatChange(change)
+			}
+		}
+		d.pmtVersion = version
+		d.pmtFound = true
+		if d.FixedECMPid != 0 {
+			return nil
+		}
+		if err := d.parseEcmPid(sec[12 : 12+piLength]); err != nil && !d.ecmPidFound {
 			return err
 		}
-		pkt = pkt[188:]
+	case d.pmtPidFound && pid == 0x11 && !d.sdtFound:
+		if name := ParseSDT(sec, d.program); name != "" {
+			if d.OnServiceName != nil {
+				d.OnServiceName(name)
+			}
+			d.sdtFound = true
+		}
+	case d.pmtPidFound && pid == 0x12 && d.OnEvents != nil:
+		if events := ParseEIT(sec, d.program); len(events) > 0 {
+			d.OnEvents(events)
+		}
 	}
 	return nil
 }
 
-func (ch *Channel) addToBuf(val interface{}) {
-	ch.mu.Lock()
-	ch.buf.Value = val
-	ch.buf = ch.buf.Next()
-	ch.c.Broadcast()
-	ch.mu.Unlock()
-}
-
-func (ch *Channel) currentPtr() *ring.Ring {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
-	return ch.buf
-}
-
-func (ch *Channel) nextPtr(ptr *ring.Ring) (*ring.Ring, interface{}) {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
-	for ptr == ch.buf && !ch.ioerr {
-		ch.c.Wait()
-	}
-	if !ch.ioerr {
-		return ptr.Next(), ptr.Value
-	} else {
-		return ptr, nil
-	}
-}
-
-func (ch *Channel) closeBuf() {
-	ch.mu.Lock()
-	ch.ioerr = true
-	ch.c.Broadcast()
-	ch.mu.Unlock()
+// stripPacket replaces the PMT packet with the next stripped one and the
+// ECM packet with a null packet, it reports if the packet is to be output
+func (d *Decryptor) stripPacket(pkt []byte, pid uint16) bool {
+	switch {
+	case d.pmtPidFound && pid == d.pmtPid:
+		// the stripped sections are not longer than the original ones, so
+		// they are output in the packets of the next sections at the latest
+		if len(d.pmtOut) == 0 {
+			nullPacket(pkt)
+			return false
+		}
+		copy(pkt, d.pmtOut[0])
+		pkt[3] |= d.pmtCC
+		d.pmtCC = (d.pmtCC + 1) & 0xf
+		d.pmtOut = d.pmtOut[1:]
+	case d.ecmPidFound && pid == d.ecmPid:
+		nullPacket(pkt)
+		return false
+	}
+	return true
 }
 
-func decryptHTTP(ch *Channel, hostPort string) {
-	host, _, _ := net.SplitHostPort(hostPort)
-	group := net.ParseIP(host)
-	c, err := net.ListenPacket("udp4", hostPort)
-	if err != nil {
-		log.Fatal(err)
+// ProcessPacket processes and decrypts a single 188-byte TS packet in place
+func (d *Decryptor) ProcessPacket(pkt []byte) error {
+	if pkt[0] != 0x47 {
+		return fmt.Errorf("Expected sync byte but got: %v", pkt[0])
 	}
-	defer c.Close()
-
-	p := ipv4.NewPacketConn(c)
-	if err := p.JoinGroup(ifi, &net.UDPAddr{IP: group}); err != nil {
-		log.Println(err)
-		goto ioerr
+	pid := binary.BigEndian.Uint16(pkt[1:3]) & 0x1fff
+	if !d.pmtPidFound && d.FixedPMTPid != 0 {
+		d.mu.Lock()
+		d.pmtPid, d.program = d.FixedPMTPid, d.ServiceID
+		d.mu.Unlock()
+		d.pmtPidFound = true
+	}
+	if !d.ecmPidFound && d.FixedECMPid != 0 {
+		d.ecmPid, d.ecmPidFound = d.FixedECMPid, true
+	}
+	if d.tracing() {
+		d.logf("trace: TS pid=0x%x pusi=%d scrambling=%d adaptation=%d cc=%d",
+			pid, (pkt[1]>>6)&1, (pkt[3]>>6)&3, (pkt[3]>>4)&3, pkt[3]&0xf)
+	}
+	if (pid == 0 && !d.pmtPidFound) || (d.pmtPidFound && (pid == d.pmtPid || (pid == 0x11 && !d.sdtFound) ||
+		(pid == 0x12 && d.OnEvents != nil))) {
+		if d.sections == nil {
+			d.sections = make(map[uint16]*sectionAssembler)
+		}
+		a, ok := d.sections[pid]
+		if !ok {
+			a = &sectionAssembler{}
+			d.sections[pid] = a
+		}
+		for _, sec := range a.push(pkt) {
+			if err := d.processSection(pid, sec); err != nil {
+				return err
+			}
+			if d.StripCA && d.pmtPidFound && pid == d.pmtPid {
+				d.pmtOut = append(d.pmtOut, Packetize(stripCA(sec), pid)...)
+			}
+		}
 	}
-	defer p.LeaveGroup(ifi, &net.UDPAddr{IP: group})
-
-	log.Println("Start decrypting channel @", hostPort)
-	for {
-		select {
-		case <-ch.done:
-			goto noclients
-		default:
-			// do nothing
-		}
-		pkt := make([]byte, 1500)
-		p.SetReadDeadline(time.Now().Add(5 * time.Second))
-		n, _, _, err := p.ReadFrom(pkt)
-		if err != nil {
-			log.Printf("%v @ %v", err, hostPort)
-			goto ioerr
-		}
-		payload := pkt[:n]
-		offset, err := ch.parseRTP(payload)
-		if err != nil {
-			log.Printf("%v @ %v", err, hostPort)
-			goto ioerr
-		}
-		if err := ch.processRTP(payload, offset); err != nil {
-			log.Printf("%v @ %v", err, hostPort)
-			goto ioerr
-		}
-	}
-noclients:
-	log.Println("No more clients, stop decrypting channel @", hostPort)
-	ch.done <- true
-	log.Println("Done @", hostPort)
-	return
-
-ioerr:
-	log.Println("I/O error, stop decrypting channel @", hostPort)
-	ch.closeBuf()
-	<-ch.done
-	ch.done <- true
-	log.Println("Done @", hostPort)
-}
-
-func decryptRTP(ch *Channel, hostPort string, dest net.Conn) {
-	host, _, _ := net.SplitHostPort(hostPort)
-	group := net.ParseIP(host)
-	c, err := net.ListenPacket("udp4", hostPort)
-	if err != nil {
-		log.Fatal(err)
+	// ECMs fit in the packet they start in
+	if sec, ok := Section(pkt); ok && d.ecmPidFound && pid == d.ecmPid {
+		if err := d.processECM(sec); err != nil {
+			return err
+		}
+		if d.OnKeys != nil {
+			d.OnKeys()
+		}
 	}
-	defer c.Close()
-
-	p := ipv4.NewPacketConn(c)
-	if err := p.JoinGroup(ifi, &net.UDPAddr{IP: group}); err != nil {
-		log.Println(err)
-		goto ioerr
+	if d.HoldPackets > 0 && !d.HasKeys() {
+		if len(d.held) == d.HoldPackets {
+			d.held = d.held[1:]
+		}
+		// the caller may reuse pkt
+		d.held = append(d.held, append([]byte(nil), pkt...))
+		return nil
 	}
-	defer p.LeaveGroup(ifi, &net.UDPAddr{IP: group})
-
-	log.Println("Start decrypting channel @", hostPort)
-	for {
-		pkt := make([]byte, 1500)
-		p.SetReadDeadline(time.Now().Add(5 * time.Second))
-		n, _, _, err := p.ReadFrom(pkt)
-		if err != nil {
-			log.Printf("%v @ %v", err, hostPort)
-			goto ioerr
-		}
-		payload := pkt[:n]
-		offset, err := ch.parseRTP(payload)
-		if err != nil {
-			log.Printf("%v @ %v", err, hostPort)
-			goto ioerr
-		}
-		if err := ch.processRTP(payload, offset); err != nil {
-			log.Printf("%v @ %v", err, hostPort)
-			goto ioerr
-		}
-		if _, err := dest.Write(payload); err != nil {
-			log.Printf("%v @ %v", err, hostPort)
-			goto ioerr
+	if len(d.held) > 0 {
+		for _, p := range d.held {
+			d.outputPacket(p)
 		}
+		d.held = nil
 	}
-
-ioerr:
-	log.Println("I/O error, stop decrypting channel @", hostPort)
-	log.Println("Done @", hostPort)
+	d.outputPacket(pkt)
+	return nil
 }
 
-func rtpHandler(w http.ResponseWriter, req *http.Request) {
-	// requestURI should be /rtp/CNN/192.168.1.1:51820
-	parts := strings.Split(req.RequestURI[5:], "/")
-	if len(parts) != 2 {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return
-	}
-	chName := parts[0]
-	chInfo, ok := channels[chName];
-	if !ok {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+// outputPacket decrypts the packet and passes it to OnPacket
+func (d *Decryptor) outputPacket(pkt []byte) {
+	pid := binary.BigEndian.Uint16(pkt[1:3]) & 0x1fff
+	d.decryptPacket(pkt)
+	decrypted := pkt[3]>>6 < 2 || d.HasKeys()
+	if d.StripCA && !d.stripPacket(pkt, pid) {
 		return
 	}
-	addr := parts[1]
-	if _, _, err := net.SplitHostPort(addr); err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return
+	if pid == d.videoPid && d.videoPid != 0 && decrypted && d.OnFormatChange != nil {
+		d.checkVideoParams(pkt)
 	}
-	dest, err := net.Dial("udp", addr)
-	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return
+	if d.OnPacket != nil {
+		d.OnPacket(pkt)
 	}
-	ch := newChannel(chInfo.masterKey, false)
-	go decryptRTP(ch, chInfo.addr, dest)
 }
 
-func chHandler(w http.ResponseWriter, req *http.Request) {
-	chName := req.RequestURI[4:]
-	chInfo, ok := channels[chName]
-	if !ok {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return
+// StripRS removes the Reed-Solomon bytes from 204-byte TS packets after the
+// given offset, the packet size is detected from the sync byte spacing
+func StripRS(payload []byte, offset int) []byte {
+	ts := payload[offset:]
+	if len(ts) == 0 || len(ts)%204 != 0 {
+		return payload
 	}
-	runningChannelsMu.Lock()
-	ch, ok := runningChannels[chInfo.addr]
-	if !ok {
-		ch = newChannel(chInfo.masterKey, true)
-		runningChannels[chInfo.addr] = ch
-		go decryptHTTP(ch, chInfo.addr)
-	} else {
-		ch.numClients += 1
+	for i := 0; i < len(ts); i += 204 {
+		if ts[i] != 0x47 {
+			return payload
+		}
+	}
+	n := len(ts) / 204
+	for i := 1; i < n; i++ {
+		copy(ts[i*188:], ts[i*204:i*204+188])
 	}
-	runningChannelsMu.Unlock()
+	return payload[:offset+n*188]
+}
 
-	log.Println("Start serving client", req.RemoteAddr)
-	ptr := ch.currentPtr()
-	var val interface{}
-	for {
-		ptr, val = ch.nextPtr(ptr)
-		if val == nil {
-			break
-		}
-		_, err := w.Write(val.([]byte))
-		if err != nil {
-			break
+// resync returns the TS from the next sync byte which starts a whole packet
+// followed by another sync byte or the end of the datagram
+func resync(ts []byte) []byte {
+	for i := 1; i+188 <= len(ts); i++ {
+		if ts[i] == 0x47 && (i+188 == len(ts) || ts[i+188] == 0x47) {
+			return ts[i:]
 		}
 	}
+	return nil
+}
 
-	log.Println("Stop serving client", req.RemoteAddr)
-	runningChannelsMu.Lock()
-	if ch, ok = runningChannels[chInfo.addr]; ok {
-		ch.numClients -= 1
-		if ch.numClients == 0 {
-			ch.done <- true
-			<-ch.done
-			delete(runningChannels, chInfo.addr)
+// Process processes the TS packets of a datagram payload. A packet which is
+// not followed by a sync byte 188 bytes later is dropped with the bytes up to
+// the next aligned packet, so the stream resynchronizes within the datagram.
+func (d *Decryptor) Process(ts []byte) error {
+	dropped := 0
+	for len(ts) >= 188 {
+		if ts[0] != 0x47 || len(ts) > 188 && ts[188] != 0x47 {
+			next := resync(ts)
+			dropped += len(ts) - len(next)
+			ts = next
+			continue
 		}
+		if err := d.ProcessPacket(ts[:188]); err != nil {
+			return err
+		}
+		ts = ts[188:]
+	}
+	dropped += len(ts)
+	if dropped > 0 && !d.lostSync {
+		d.logf("Lost TS sync, dropped %v bytes", dropped)
+		d.lostSync = true
+	} else if dropped == 0 && d.lostSync {
+		d.logf("TS sync recovered")
+		d.lostSync = false
 	}
-	runningChannelsMu.Unlock()
+	return nil
 }
 
-func m3uHandler(w http.ResponseWriter, req *http.Request) {
-	io.WriteString(w, "#EXTM3U\n")
-	keys := make([]string, 0)
-	for k, _ := range channels {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
-	for _, k := range keys {
-		chName, _ := url.PathUnescape(k)
-		fmt.Fprintf(w, "#EXTINF:-1, %s\n", chName)
-		fmt.Fprintf(w, "http://%s/ch/%s\n", httpAddr, k)
-	}
+// PMTPid returns the PID of the PMT, or 0 if the PAT was not seen yet
+func (d *Decryptor) PMTPid() uint16 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pmtPid
 }
 
-func fetchChannels(chURL string) {
-	resp, err := http.Get(chURL)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
-	var f interface{}
-	err = json.Unmarshal(body, &f)
-	if err != nil {
-		log.Fatal(err)
-	}
-	m := f.(map[string]interface{})
-	chdate := m["date"]
-	all := m["channels"].([]interface{})
-	for _, c := range all {
-		v := c.([]interface{})
-		name := v[0].(string)
-		addr := v[1].(string)
-		switch key := v[2].(type) {
-		case string:
-			name = url.PathEscape(name)
-			// strip "igmp://" from address
-			channels[name] = ChannelInfo{addr[7:], key}
-		case float64:
-			// ignore
-		}
-	}
-	log.Printf("%d channels loaded, last updated on %s\n", len(channels), chdate)
+// Program returns the program number from the PAT
+func (d *Decryptor) Program() uint16 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.program
 }
 
-func main() {
-	ifname := flag.String("i", "eth0", "Multicast interface")
-	chURL := flag.String("c", "", "Channels file URL")
-	flag.StringVar(&httpAddr, "a", "localhost:8080", "Network address (host:port) for the HTTP server")
-	flag.Parse()
-	var err error
-	ifi, err = net.InterfaceByName(*ifname)
-	if err != nil {
-		fmt.Printf("No such network interface: %s\n", *ifname)
-		os.Exit(1)
-	}
-	channels = make(map[string]ChannelInfo)
-	if *chURL != "" {
-		ticker := time.NewTicker(1 * time.Hour)
-		go func() {
-			for {
-				fetchChannels(*chURL)
-				<-ticker.C
-			}
-		}()
+// Streams returns the elementary streams from the PMT (PID => stream type)
+func (d *Decryptor) Streams() map[uint16]byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	streams := make(map[uint16]byte, len(d.streams))
+	for pid, streamType := range d.streams {
+		streams[pid] = streamType
 	}
+	return streams
+}
+
+// Stream is an elementary stream of the PMT
+type Stream struct {
+	PID      uint16
+	Type     byte
+	Language string // ISO 639-2 code, "" if unknown
+}
+
+// StreamList returns the elementary streams in the order of the PMT
+func (d *Decryptor) StreamList() []Stream {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Stream(nil), d.list...)
+}
+
+// PMT returns the last PMT section of the program, nil if none was seen.
+// It must not be modified.
+func (d *Decryptor) PMT() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pmt
+}
 
-	log.Printf("Starting HTTP server on %s, multicast interface: %s\n", httpAddr, *ifname)
-	runningChannels = make(map[string]*Channel)
-	http.HandleFunc("/rtp/", rtpHandler)
-	http.HandleFunc("/ch/", chHandler)
-	http.HandleFunc("/channels.m3u", m3uHandler)
-	log.Fatal(http.ListenAndServe(httpAddr, nil))
+// Teletext returns the PID and the page of the teletext subtitles
+func (d *Decryptor) Teletext() (uint16, uint16) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.txtPid, d.txtPage
 }
@@ -0,0 +1,69 @@
+package vmdecrypt
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// tsPacket returns a clear packet of PID 0x100 whose payload is filled
+// with n
+func tsPacket(n byte) []byte {
+	pkt := bytes.Repeat([]byte{n}, 188)
+	pkt[0], pkt[1], pkt[2], pkt[3] = 0x47, 0x01, 0x00, 0x10|n&0xf
+	return pkt
+}
+
+func datagram(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestProcessResync(t *testing.T) {
+	tests := []struct {
+		name    string
+		ts      []byte
+		want    []byte // payload bytes of the packets passed to OnPacket
+		lostLog bool
+	}{
+		{"aligned", datagram(tsPacket(1), tsPacket(2), tsPacket(3), tsPacket(4), tsPacket(5), tsPacket(6), tsPacket(7)),
+			[]byte{1, 2, 3, 4, 5, 6, 7}, false},
+		{"leading garbage", datagram([]byte{1, 2, 3}, tsPacket(1), tsPacket(2)), []byte{1, 2}, true},
+		{"trailing partial packet", datagram(tsPacket(1), tsPacket(2), tsPacket(3)[:100]), []byte{1, 2}, true},
+		// the third packet of 7 lost its last 50 bytes, the datagram still
+		// starts with a sync byte
+		{"misaligned in the middle", datagram(tsPacket(1), tsPacket(2), tsPacket(3)[:138], tsPacket(4), tsPacket(5), tsPacket(6), tsPacket(7)),
+			[]byte{1, 2, 4, 5, 6, 7}, true},
+		{"misaligned twice", datagram(tsPacket(1), tsPacket(2)[:100], tsPacket(3), tsPacket(4)[:10], tsPacket(5)), []byte{1, 3, 5}, true},
+		{"no sync byte", make([]byte, 7*188), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDecryptor(make([]byte, 16))
+			var got []byte
+			d.OnPacket = func(pkt []byte) { got = append(got, pkt[4]) }
+			lost := false
+			d.Logf = func(format string, v ...interface{}) { lost = true }
+			if err := d.Process(tt.ts); err != nil {
+				t.Fatalf("Process: %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("packets %v, want %v", got, tt.want)
+			}
+			if lost != tt.lostLog {
+				t.Errorf("lost sync logged %v, want %v", lost, tt.lostLog)
+			}
+		})
+	}
+}
+
+func TestProcessSyncRecovered(t *testing.T) {
+	d := NewDecryptor(make([]byte, 16))
+	var logs []string
+	d.Logf = func(format string, v ...interface{}) { logs = append(logs, format) }
+	d.Process(datagram(tsPacket(1), tsPacket(2)[:100], tsPacket(3)))
+	d.Process(datagram(tsPacket(4)[:20], tsPacket(5)))
+	d.Process(datagram(tsPacket(6), tsPacket(7)))
+	if len(logs) != 2 || !strings.HasPrefix(logs[0], "Lost TS sync") || logs[1] != "TS sync recovered" {
+		t.Errorf("logs %q, want one lost sync and one recovered", logs)
+	}
+}